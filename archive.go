@@ -0,0 +1,119 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// An archive node keeps everything that ever existed in the cluster. A path deleted or renamed away on another node
+// stays where it is, and the deletion is only recorded. The path is then left out of syncing, until another node
+// creates it again. When a change from another node replaces a file, the contents it had are kept as a version of
+// the file, and an archive node never lets go of versions. The rest of the cluster carries on as usual.
+
+// copyArchiveFile - copy a file, keeping its times
+func copyArchiveFile(sourcePath, destinationPath string, info os.FileInfo) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	destination, err := os.OpenFile(destinationPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(destination, source)
+	closeErr := destination.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(destinationPath)
+		return err
+	}
+	return os.Chtimes(destinationPath, time.Now(), info.ModTime())
+}
+
+// keepDeletedPath - on an archive node, leave a path deleted on another node where it is and stop tracking it. Its
+// tombstone has to be recorded already, and is kept as the record of the deletion. Call when inside of a lock!
+func (handler *FilesystemTracker) keepDeletedPath(relativePath string) {
+	tombstone, deleted := handler.tombstones[relativePath]
+	if !deleted {
+		return
+	}
+
+	log.Printf("Archive: %s was deleted on %s. Keeping it", relativePath, tombstone.Origin)
+	tombstone.Acknowledged = nil
+	handler.archived[relativePath] = tombstone
+	delete(handler.contents, relativePath)
+	handler.markIndexDirty(relativePath)
+	handler.scheduleStateSave()
+}
+
+// isArchived - check if a path was deleted elsewhere and is only kept here. Call when inside of a lock!
+func (handler *FilesystemTracker) isArchived(relativePath string) bool {
+	_, archived := handler.archived[relativePath]
+	return archived
+}
+
+// copyRenamedPath - on an archive node, a rename on another node copies the path to its new name so that the old one
+// stays. Whatever is tracked below a directory is tracked under the new name as well, at the same versions, so the
+// copies are not taken for changes made here. Call when inside of a lock!
+func (handler *FilesystemTracker) copyRenamedPath(sourcePath, destinationPath string) error {
+	sourceRoot := filepath.Join(handler.directory, sourcePath)
+	destinationRoot := filepath.Join(handler.directory, destinationPath)
+
+	return filepath.Walk(sourceRoot, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relative := strings.TrimPrefix(fullPath, sourceRoot)
+		target := destinationRoot + relative
+
+		if info.IsDir() {
+			err = os.MkdirAll(target, os.ModeDir+os.ModePerm)
+		} else if info.Mode().IsRegular() {
+			err = copyArchiveFile(fullPath, target, info)
+		} else {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("copying %s to %s: %s", fullPath, target, err)
+		}
+
+		// The top of the rename is tracked by the caller
+		if relative == "" {
+			return nil
+		}
+		entry, tracked := handler.contents[sourcePath+filepath.ToSlash(relative)]
+		copied, statErr := os.Stat(target)
+		if tracked && statErr == nil {
+			entry.FileInfo = copied
+			entry.setup = true
+			handler.contents[destinationPath+filepath.ToSlash(relative)] = entry
+			handler.recordChange(destinationPath + filepath.ToSlash(relative))
+		}
+		return nil
+	})
+}
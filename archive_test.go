@@ -0,0 +1,98 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArchiveNodeKeepsDeletedPaths(t *testing.T) {
+	useTestSettings(t)
+	globalSettings.Archive = true
+
+	tracker := createTracker("archiveDeletes")
+	globalSettings.Directory = tracker.directory
+	receiveTestFile(t, tracker, "kept.txt", "kept.txt", "archivePeer", VersionVector{"archivePeer": 1})
+
+	deletedVersion := VersionVector{"archivePeer": 2}
+	tracker.ProcessCatalog(catalogEvent(t, "archivePeer",
+		EntryJSON{RelativePath: "kept.txt", ModTime: time.Now(), Deleted: true, Origin: "archivePeer", Version: deletedVersion}))
+
+	_, err := os.Stat(filepath.Join(tracker.directory, "kept.txt"))
+	if err != nil {
+		t.Fatalf("an archive node should keep a file deleted elsewhere. err: %v", err)
+	}
+
+	// The tombstone goes once every peer has it. The record of the deletion stays.
+	tracker.fsLock.RLock()
+	_, tracked := tracker.contents["kept.txt"]
+	archived := tracker.archived["kept.txt"]
+	tracker.fsLock.RUnlock()
+	if tracked || archived.Origin != "archivePeer" || archived.Version.Compare(deletedVersion) != VERSION_EQUAL {
+		t.Fatalf("the deletion should be recorded and the file no longer tracked. tracked: %v archived: %#v", tracked, archived)
+	}
+
+	// After a restart the kept file is still not taken for something new
+	tracker = restartTracker(tracker)
+	defer cleanupTracker(tracker)
+	waitForScan(t, tracker)
+
+	tracker.fsLock.RLock()
+	_, tracked = tracker.contents["kept.txt"]
+	_, stillArchived := tracker.archived["kept.txt"]
+	tracker.fsLock.RUnlock()
+	if tracked || !stillArchived {
+		t.Fatalf("a kept file should not come back to life after a restart. tracked: %v archived: %v", tracked, stillArchived)
+	}
+}
+
+func TestArchiveNodeKeepsReplacedContents(t *testing.T) {
+	useTestSettings(t)
+	globalSettings.Archive = true
+
+	tracker := createTracker("archiveOverwrites")
+	defer cleanupTracker(tracker)
+	globalSettings.Directory = tracker.directory
+	receiveTestFile(t, tracker, "doc.txt", "doc.txt", "archivePeer", VersionVector{"archivePeer": 1})
+	info, _ := os.Stat(filepath.Join(tracker.directory, "doc.txt"))
+
+	err := tracker.applyRemoteChange(EntryJSON{RelativePath: "doc.txt", Version: VersionVector{"archivePeer": 2}},
+		func(relativePath string) error {
+			// Received files are renamed into place
+			stagingPath := filepath.Join(t.TempDir(), "staged")
+			err := ioutil.WriteFile(stagingPath, []byte("replaced"), 0666)
+			if err != nil {
+				return err
+			}
+			return os.Rename(stagingPath, filepath.Join(tracker.directory, relativePath))
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions := tracker.versionList("doc.txt")
+	if len(versions) != 1 || !versions[0].ModTime.Equal(info.ModTime()) {
+		t.Fatalf("the replaced contents should be kept as a version. versions: %#v", versions)
+	}
+	kept, err := ioutil.ReadFile(fileVersionPath(versions[0]))
+	if err != nil || string(kept) != "doc.txt" {
+		t.Fatalf("the replaced contents should be kept. kept: %q err: %v", kept, err)
+	}
+}
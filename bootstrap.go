@@ -23,10 +23,11 @@ import (
 	"github.com/goji/httpauth"
 	log "github.com/sirupsen/logrus"
 	"io"
+	"io/ioutil"
 	"math/rand"
+	"mime/multipart"
 	"net"
 	"net/http"
-	"os"
 	"sync"
 	"time"
 )
@@ -46,6 +47,8 @@ type ReplicatServer struct {
 
 // GetStatus - get the current status of the server
 func (server *ReplicatServer) GetStatus() string {
+	server.Lock.Lock()
+	defer server.Lock.Unlock()
 	return server.Status
 }
 
@@ -55,7 +58,9 @@ func (server *ReplicatServer) SetStatus(status string) {
 	// if the server is being shut down or at the end of a unit test)
 	// the assignment can crash without this check
 	if server != nil {
+		server.Lock.Lock()
 		server.Status = status
+		server.Lock.Unlock()
 		sendConfigToServer()
 	}
 }
@@ -94,6 +99,16 @@ func BootstrapAndServe(address string) {
 	http.Handle("/tree/", httpauth.SimpleBasicAuth("replicat", "isthecat")(http.HandlerFunc(folderTreeHandler)))
 	http.Handle("/config/", httpauth.SimpleBasicAuth("replicat", "isthecat")(http.HandlerFunc(configHandler)))
 	http.Handle("/upload/", httpauth.SimpleBasicAuth("replicat", "isthecat")(http.HandlerFunc(uploadHandler)))
+	http.Handle("/queue/", httpauth.SimpleBasicAuth("replicat", "isthecat")(http.HandlerFunc(outboundQueueHandler)))
+	http.Handle("/conflicts/", httpauth.SimpleBasicAuth("replicat", "isthecat")(http.HandlerFunc(conflictsHandler)))
+	http.Handle("/transfers/", httpauth.SimpleBasicAuth("replicat", "isthecat")(http.HandlerFunc(transfersHandler)))
+	http.Handle("/divergent/", httpauth.SimpleBasicAuth("replicat", "isthecat")(http.HandlerFunc(divergentHandler)))
+	http.Handle("/trash/", httpauth.SimpleBasicAuth("replicat", "isthecat")(http.HandlerFunc(trashHandler)))
+	http.Handle("/versions/", httpauth.SimpleBasicAuth("replicat", "isthecat")(http.HandlerFunc(versionsHandler)))
+	http.Handle("/snapshots/", httpauth.SimpleBasicAuth("replicat", "isthecat")(http.HandlerFunc(snapshotsHandler)))
+	http.Handle("/breaker/", httpauth.SimpleBasicAuth("replicat", "isthecat")(http.HandlerFunc(breakerHandler)))
+	http.Handle("/merkle/", httpauth.SimpleBasicAuth("replicat", "isthecat")(http.HandlerFunc(merkleHandler)))
+	http.Handle("/changes/", httpauth.SimpleBasicAuth("replicat", "isthecat")(http.HandlerFunc(changesHandler)))
 
 	//exerciseMinio()
 
@@ -115,6 +130,9 @@ func BootstrapAndServe(address string) {
 	serverMap[globalSettings.Name] = server
 	tracker.Initialize(directory, server)
 
+	// Deliver anything that was still queued for other nodes when we last stopped
+	loadOutboundQueues()
+
 	go func(tracker StorageTracker) {
 		for true {
 			tracker.GetStatistics()
@@ -212,66 +230,75 @@ func sendConfigToServer() {
 }
 
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "POST" {
-		r.ParseMultipartForm(32 << 20)
-		file, handler, err := r.FormFile("uploadfile")
+	switch r.Method {
+	case "GET":
+		if r.URL.Query().Get("signature") != "" {
+			signatureHandler(w, r)
+		} else {
+			uploadStatusHandler(w, r)
+		}
+	case "POST":
+		// Walk the parts as they arrive instead of spooling the whole form. The sender writes the small fields
+		// first so they are known before the file contents start streaming in.
+		reader, err := r.MultipartReader()
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
-		defer file.Close()
-		fmt.Fprint(w, handler.Header)
-
-		hash := []byte(r.Form.Get("HASH"))
 
-		storage := serverMap[globalSettings.Name].storage
-		local, _ := storage.getEntryJSON(handler.Filename)
+		fields := make(map[string]string)
 
-		if !bytes.Equal(hash, local.Hash) {
-			fullPath := globalSettings.Directory + "/" + handler.Filename
-			f, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE, 0666)
-
-			if err != nil {
-				fmt.Println(err)
-				return
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
 			}
-
-			bytesWritten, err := io.Copy(f, file)
 			if err != nil {
-				log.Printf("Error copying file: %s, error(%#v)", handler.Filename, err)
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte("500 - Error copying file"))
-				f.Close()
+				log.Printf("Error reading upload: %s", err)
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("400 - Error reading upload"))
 				return
 			}
-			fmt.Printf("Wrote out (%s) bytes (%d)", handler.Filename, bytesWritten)
-			f.Close()
-
-			// Get the old entry
-			entryString := r.Form.Get("entryJSON")
-			if entryString != "" {
-				var entry EntryJSON
-				err := json.Unmarshal([]byte(entryString), &entry)
-				if err != nil {
-					log.Fatalf("Error copying file (Entry handling): %s, error(%#v)", handler.Filename, err)
-					w.WriteHeader(http.StatusInternalServerError)
-					w.Write([]byte("500 - Error copying file"))
-					return
-				}
 
-				err = os.Chtimes(fullPath, time.Now(), entry.ModTime)
+			switch part.FormName() {
+			case "uploadfile":
+				err = receiveUploadChunk(w, part, fields)
+			case "deltafile":
+				err = receiveDelta(w, part, fields)
+			default:
+				var value []byte
+				value, err = readUploadField(part)
+				fields[part.FormName()] = string(value)
 				if err != nil {
-					log.Fatalf("Error copying file (Changing times): %s, error(%#v)", handler.Filename, err)
-					w.WriteHeader(http.StatusInternalServerError)
-					w.Write([]byte("500 - Error copying file"))
-					return
+					// The file parts answer for themselves. A bad field has to be answered here, or the sender
+					// takes the missing status for success.
+					http.Error(w, err.Error(), http.StatusBadRequest)
 				}
 			}
+			part.Close()
 
+			if err != nil {
+				log.Printf("Error handling upload part (%s): %s", part.FormName(), err)
+				return
+			}
 		}
 	}
 }
 
+// UPLOAD_MAX_FIELD_SIZE - Largest non file form field accepted by the upload handler
+const UPLOAD_MAX_FIELD_SIZE = 1 << 20
+
+func readUploadField(part *multipart.Part) ([]byte, error) {
+	value, err := ioutil.ReadAll(io.LimitReader(part, UPLOAD_MAX_FIELD_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(value) > UPLOAD_MAX_FIELD_SIZE {
+		return nil, fmt.Errorf("form field %s is larger than %d bytes", part.FormName(), UPLOAD_MAX_FIELD_SIZE)
+	}
+	return value, nil
+}
+
 var configUpdateChannel = make(chan *map[string]*ReplicatServer, 100)
 
 func configHandler(_ http.ResponseWriter, r *http.Request) {
@@ -303,6 +330,7 @@ func configUpdateProcessor(c chan *map[string]*ReplicatServer) {
 			if !exists {
 				fmt.Printf("No longer found config for: %s deleting", name)
 				delete(serverMap, name)
+				peerDeparted(name)
 				continue
 			}
 
@@ -341,9 +369,14 @@ func configUpdateProcessor(c chan *map[string]*ReplicatServer) {
 
 				fmt.Printf("New server configuration provided. Copying: %s", name)
 				serverMap[name] = newServerData
+				peerReturned(name)
 			}
 		}
 
+		// A configuration change is usually a node coming or going. Try anything that is waiting on a peer right away.
+		wakeOutboundQueues()
+		go expireDepartedPeers(time.Now())
+
 		if sendData {
 			server := serverMap[globalSettings.Name]
 			fmt.Println("about to send existing files")
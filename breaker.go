@@ -0,0 +1,310 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// Two circuit breakers watch how many files are deleted and modified within a window of time, one for changes made
+// here and one for changes from other nodes. A node started on an empty or wrongly mounted directory, or a mass
+// rewrite of files, trips them. From then on deletes and modifications going that way are held back, and stay held
+// until an operator confirms or rejects them. Confirming lets them through. Rejecting outgoing changes brings back
+// what the other nodes have, and rejecting incoming ones sends our copies back out over theirs.
+
+const (
+	// BREAKER_OUTGOING - The breaker for changes made here
+	BREAKER_OUTGOING = "outgoing"
+	// BREAKER_INCOMING - The breaker for changes from other nodes
+	BREAKER_INCOMING = "incoming"
+	// BREAKER_CHANGE_CREATE - A new path. New paths never trip a breaker and are not held.
+	BREAKER_CHANGE_CREATE = "create"
+	// BREAKER_CHANGE_MODIFY - New contents for a path that was there
+	BREAKER_CHANGE_MODIFY = "modify"
+	// BREAKER_CHANGE_DELETE - A path that was there is gone
+	BREAKER_CHANGE_DELETE = "delete"
+	// BREAKER_DEFAULT_WINDOW_SECONDS - How long changes are counted for when the settings do not say
+	BREAKER_DEFAULT_WINDOW_SECONDS = 60
+	// BREAKER_DEFAULT_DELETE_PERCENT - The share of files deleted within a window that trips a breaker
+	BREAKER_DEFAULT_DELETE_PERCENT = 10
+	// BREAKER_DEFAULT_MODIFY_PERCENT - The share of files modified within a window that trips a breaker
+	BREAKER_DEFAULT_MODIFY_PERCENT = 25
+	// BREAKER_DEFAULT_MINIMUM - Fewer changes than this never trip a breaker, however small the tree is
+	BREAKER_DEFAULT_MINIMUM = 50
+)
+
+var (
+	// BREAKER_ERROR_BAD_DIRECTION - Breakers are outgoing or incoming
+	BREAKER_ERROR_BAD_DIRECTION = errors.New("Replicat: No such breaker. Use outgoing or incoming")
+	// BREAKER_ERROR_NOT_TRIPPED - There is nothing to confirm or reject
+	BREAKER_ERROR_NOT_TRIPPED = errors.New("Replicat: The breaker is not tripped")
+)
+
+// HeldChange - a delete or modification a tripped breaker keeps from going through
+type HeldChange struct {
+	RelativePath string
+	Change       string
+	Node         string        // the node the change came from
+	Version      VersionVector `json:",omitempty"`
+	Held         time.Time
+}
+
+// CircuitBreaker - counts the deletes and modifications going one way. Once tripped it holds them back.
+type CircuitBreaker struct {
+	Direction string
+	Tripped   time.Time
+	Reason    string
+	Held      map[string]HeldChange
+	recent    []HeldChange // the deletes and modifications within the window
+}
+
+// newCircuitBreaker - a breaker that is not tripped
+func newCircuitBreaker(direction string) *CircuitBreaker {
+	return &CircuitBreaker{Direction: direction, Held: make(map[string]HeldChange)}
+}
+
+// isTripped - check if the breaker is holding changes back
+func (breaker *CircuitBreaker) isTripped() bool {
+	return !breaker.Tripped.IsZero()
+}
+
+// breakerSetting - a breaker setting, or its default when it is not set
+func breakerSetting(configured, fallback int) int {
+	if configured == 0 {
+		return fallback
+	}
+	return configured
+}
+
+// exceedsBreakerLimit - check if a number of changes is more than a share of the files allows. A negative share turns
+// the limit off.
+func exceedsBreakerLimit(count, percent, total int) bool {
+	minimum := breakerSetting(globalSettings.MassChangeMinimum, BREAKER_DEFAULT_MINIMUM)
+	return percent >= 0 && count >= minimum && count*100 > percent*total
+}
+
+// observeChange - count a change going through a breaker, and report whether it is held back. A breaker that trips
+// holds the change that tripped it. An outgoing breaker holds the rest of the window too, as those changes may not
+// have reached the other nodes yet. Call when inside of a lock!
+func (handler *FilesystemTracker) observeChange(breaker *CircuitBreaker, change HeldChange) bool {
+	if change.RelativePath == "" || isMetadataPath(change.RelativePath) || change.Change == BREAKER_CHANGE_CREATE {
+		return false
+	}
+	if breaker.isTripped() {
+		// A change held again, as another node offers it again, stays held under everything that was offered
+		earlier, known := breaker.Held[change.RelativePath]
+		if known {
+			change.Version = earlier.Version.Merge(change.Version)
+		}
+		breaker.Held[change.RelativePath] = change
+		handler.scheduleStateSave()
+		return true
+	}
+
+	window := time.Duration(breakerSetting(globalSettings.MassChangeWindowSeconds, BREAKER_DEFAULT_WINDOW_SECONDS)) * time.Second
+	recent := breaker.recent[:0]
+	deletes, modifies := 0, 0
+	for _, earlier := range append(breaker.recent, change) {
+		if change.Held.Sub(earlier.Held) >= window {
+			continue
+		}
+		recent = append(recent, earlier)
+		if earlier.Change == BREAKER_CHANGE_DELETE {
+			deletes++
+		} else {
+			modifies++
+		}
+	}
+	breaker.recent = recent
+
+	// What was deleted in the window is no longer tracked, but was part of the tree
+	total := len(handler.contents) + deletes
+	switch {
+	case exceedsBreakerLimit(deletes, breakerSetting(globalSettings.MassDeletePercent, BREAKER_DEFAULT_DELETE_PERCENT), total):
+		breaker.Reason = fmt.Sprintf("%d of %d paths deleted within %s", deletes, total, window)
+	case exceedsBreakerLimit(modifies, breakerSetting(globalSettings.MassModifyPercent, BREAKER_DEFAULT_MODIFY_PERCENT), total):
+		breaker.Reason = fmt.Sprintf("%d of %d paths modified within %s", modifies, total, window)
+	default:
+		return false
+	}
+
+	log.Printf("The %s circuit breaker tripped: %s. Deletes and modifications are held until they are confirmed or rejected",
+		breaker.Direction, breaker.Reason)
+	breaker.Tripped = change.Held
+	held := []HeldChange{change}
+	if breaker.Direction == BREAKER_OUTGOING {
+		held = breaker.recent
+	}
+	for _, earlier := range held {
+		breaker.Held[earlier.RelativePath] = earlier
+	}
+	breaker.recent = nil
+	handler.scheduleStateSave()
+	return true
+}
+
+// holdLocalChange - check if a change made here is kept from the other nodes, as it is in a receive-only folder or the
+// outgoing breaker holds it. Call when inside of a lock!
+func (handler *FilesystemTracker) holdLocalChange(relativePath, change string) bool {
+	if handler.flagDivergence(relativePath, change == BREAKER_CHANGE_DELETE) {
+		return true
+	}
+	return handler.observeChange(handler.breakers[BREAKER_OUTGOING], HeldChange{RelativePath: relativePath, Change: change,
+		Node: globalSettings.Name, Held: time.Now()})
+}
+
+// holdRemoteChange - check if the incoming breaker holds back a delete or modification from another node. Only paths
+// we have count. Call when inside of a lock!
+func (handler *FilesystemTracker) holdRemoteChange(relativePath, change, node string, version VersionVector) bool {
+	entry, exists := handler.contents[relativePath]
+	if !exists || entry.FileInfo == nil {
+		return false
+	}
+
+	held := handler.observeChange(handler.breakers[BREAKER_INCOMING], HeldChange{RelativePath: relativePath, Change: change,
+		Node: node, Version: version, Held: time.Now()})
+	if held {
+		log.Printf("Holding the %s of %s from %s. The incoming circuit breaker is tripped", change, relativePath, node)
+	}
+	return held
+}
+
+// isHeldBack - check if a path has a change of ours that is not sent to the other nodes. Call when inside of a lock!
+func (handler *FilesystemTracker) isHeldBack(relativePath string) bool {
+	_, held := handler.breakers[BREAKER_OUTGOING].Held[relativePath]
+	return held || handler.isDivergent(relativePath)
+}
+
+// breakerList - the state of both breakers
+func (handler *FilesystemTracker) breakerList() []CircuitBreaker {
+	handler.fsLock.RLock()
+	defer handler.fsLock.RUnlock()
+
+	breakers := make([]CircuitBreaker, 0, len(handler.breakers))
+	for _, direction := range []string{BREAKER_OUTGOING, BREAKER_INCOMING} {
+		breaker := *handler.breakers[direction]
+		breaker.Held = make(map[string]HeldChange, len(breaker.Held))
+		for relativePath, change := range handler.breakers[direction].Held {
+			breaker.Held[relativePath] = change
+		}
+		breaker.recent = nil
+		breakers = append(breakers, breaker)
+	}
+	return breakers
+}
+
+// settleBreaker - let the changes a tripped breaker holds through, or throw them away, and close the breaker again
+func (handler *FilesystemTracker) settleBreaker(direction string, confirm bool) error {
+	handler.fsLock.Lock()
+	breaker, known := handler.breakers[direction]
+	if !known {
+		handler.fsLock.Unlock()
+		return BREAKER_ERROR_BAD_DIRECTION
+	}
+	if !breaker.isTripped() {
+		handler.fsLock.Unlock()
+		return BREAKER_ERROR_NOT_TRIPPED
+	}
+
+	held := breaker.Held
+	handler.breakers[direction] = newCircuitBreaker(direction)
+	handler.scheduleStateSave()
+	log.Printf("The %s circuit breaker was reset. %d held changes confirmed: %v", direction, len(held), confirm)
+
+	pull := false
+	switch {
+	case direction == BREAKER_OUTGOING && confirm:
+		// The other nodes skipped these while they were held, so they go in the change log again
+		for relativePath := range held {
+			handler.recordChange(relativePath)
+		}
+	case direction == BREAKER_OUTGOING:
+		for relativePath := range held {
+			handler.revertLocalChange(relativePath)
+		}
+		pull = true
+	case confirm:
+		pull = true
+	default:
+		// Our copies get a newer version than what was held, so the other nodes take them back
+		for relativePath, change := range held {
+			entry, exists := handler.contents[relativePath]
+			if !exists || entry.FileInfo == nil {
+				continue
+			}
+			entry.version = entry.version.Merge(change.Version).Increment(globalSettings.Name)
+			handler.contents[relativePath] = entry
+			handler.recordChange(relativePath)
+		}
+	}
+
+	if !pull {
+		handler.SendCatalog()
+	}
+	handler.fsLock.Unlock()
+
+	// What is held back is left out of the hash tree, so it has to be built again
+	handler.merkleLock.Lock()
+	handler.merkle = nil
+	handler.merkleLock.Unlock()
+
+	if pull {
+		handler.resyncWithPeers()
+	}
+	return nil
+}
+
+// breakerHandler - the state of the circuit breakers, or settle a tripped one with
+// POST /breaker/?direction=<outgoing|incoming>&decision=<confirm|reject>
+func breakerHandler(w http.ResponseWriter, r *http.Request) {
+	server, exists := serverMap[globalSettings.Name]
+	if !exists || server.storage == nil {
+		http.Error(w, "Storage is not set up", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(server.storage.breakerList())
+	case "POST":
+		query := r.URL.Query()
+		decision := query.Get("decision")
+		if decision != "confirm" && decision != "reject" {
+			http.Error(w, "decision must be confirm or reject", http.StatusBadRequest)
+			return
+		}
+
+		err := server.storage.settleBreaker(query.Get("direction"), decision == "confirm")
+		switch err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case BREAKER_ERROR_BAD_DIRECTION:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case BREAKER_ERROR_NOT_TRIPPED:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,142 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOutgoingBreakerHoldsDeletesOfAnEmptyDirectory(t *testing.T) {
+	useTestSettings(t)
+	globalSettings.MassChangeMinimum = 5
+
+	folder := createExtraFolder("breakerOutgoing")
+	globalSettings.Directory = folder
+	for i := 0; i < 10; i++ {
+		ioutil.WriteFile(filepath.Join(folder, fmt.Sprintf("file%d.txt", i)), []byte("contents"), 0644)
+	}
+	first := new(FilesystemTracker)
+	first.Initialize(folder, &ReplicatServer{})
+
+	// As if the node came back up on a directory that is not mounted
+	for i := 0; i < 10; i++ {
+		os.Remove(filepath.Join(folder, fmt.Sprintf("file%d.txt", i)))
+	}
+	second := restartTracker(first)
+	waitForScan(t, second)
+
+	// Still held after another restart, until someone decides
+	tracker := restartTracker(second)
+	defer cleanupTracker(tracker)
+	waitForScan(t, tracker)
+
+	breakers := tracker.breakerList()
+	if !breakers[0].isTripped() || len(breakers[0].Held) != 10 || breakers[1].isTripped() {
+		t.Fatalf("deleting everything should trip the outgoing breaker and hold every delete: %#v", breakers)
+	}
+	_, found := tracker.changedEntry("file3.txt")
+	tracker.fsLock.RLock()
+	_, inTree := tracker.buildMerkleTree()["file3.txt"]
+	tracker.fsLock.RUnlock()
+	if found || inTree {
+		t.Fatalf("a held delete should not be offered to the other nodes. changes: %v tree: %v", found, inTree)
+	}
+
+	err := tracker.settleBreaker(BREAKER_OUTGOING, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.waitForResync()
+	tracker.fsLock.RLock()
+	_, deleted := tracker.tombstones["file3.txt"]
+	tracker.fsLock.RUnlock()
+	if deleted || tracker.breakerList()[0].isTripped() {
+		t.Fatalf("rejected deletes should be dropped so the files come back from the other nodes. tombstone: %v", deleted)
+	}
+	if tracker.settleBreaker(BREAKER_OUTGOING, true) != BREAKER_ERROR_NOT_TRIPPED {
+		t.Fatal("a breaker that is not tripped has nothing to settle")
+	}
+}
+
+func TestIncomingBreakerHoldsMassDeleteFromPeer(t *testing.T) {
+	useTestSettings(t)
+	globalSettings.MassChangeMinimum = 3
+
+	tracker := createTracker("breakerIncoming")
+	defer cleanupTracker(tracker)
+	globalSettings.Directory = tracker.directory
+	watchTestTracker(tracker)
+
+	var tombstones []EntryJSON
+	for i := 0; i < 10; i++ {
+		relativePath := fmt.Sprintf("file%d.txt", i)
+		receiveTestFile(t, tracker, relativePath, relativePath, "breakerPeer", VersionVector{"breakerPeer": 1})
+		tombstones = append(tombstones, EntryJSON{RelativePath: relativePath, ModTime: time.Now(), Deleted: true,
+			Origin: "breakerPeer", Version: VersionVector{"breakerPeer": 2}})
+	}
+	tracker.ProcessCatalog(catalogEvent(t, "breakerPeer", tombstones...))
+
+	breaker := tracker.breakerList()[1]
+	if !breaker.isTripped() || len(breaker.Held) != 8 {
+		t.Fatalf("the third delete should trip the incoming breaker and be held with the rest: %#v", breaker)
+	}
+	remaining, _ := filepath.Glob(filepath.Join(tracker.directory, "file*.txt"))
+	if len(remaining) != 8 {
+		t.Fatalf("held deletes should not be applied. %d files left", len(remaining))
+	}
+
+	// A delete sent as an event is held too, and leaves no tombstone behind
+	eventPath := breakerHeldPath(breaker)
+	eventVersion := VersionVector{"breakerPeer": 3}
+	err := tracker.applyRemoteDelete(eventPath, false, "breakerPeer", time.Now(), eventVersion)
+	remaining, _ = filepath.Glob(filepath.Join(tracker.directory, "file*.txt"))
+	if err != nil || len(remaining) != 8 {
+		t.Fatalf("a delete event should be held while the breaker is tripped. err: %v files left: %d", err, len(remaining))
+	}
+	tracker.fsLock.RLock()
+	_, recorded := tracker.tombstones[eventPath]
+	tracker.fsLock.RUnlock()
+	if recorded {
+		t.Fatalf("a held delete event should not leave a tombstone for %s", eventPath)
+	}
+
+	err = tracker.settleBreaker(BREAKER_INCOMING, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.waitForResync()
+	for relativePath := range breaker.Held {
+		if tracker.currentVersion(relativePath).Compare(VersionVector{"breakerPeer": 2}) != VERSION_DOMINATES {
+			t.Fatalf("a rejected delete should be answered with a newer version of %s: %s", relativePath, tracker.currentVersion(relativePath))
+		}
+	}
+	if tracker.currentVersion(eventPath).Compare(eventVersion) != VERSION_DOMINATES {
+		t.Fatalf("a rejected delete event should be answered with a version newer than its own: %s", tracker.currentVersion(eventPath))
+	}
+}
+
+// breakerHeldPath - any one of the paths a breaker holds
+func breakerHeldPath(breaker CircuitBreaker) string {
+	for relativePath := range breaker.Held {
+		return relativePath
+	}
+	return ""
+}
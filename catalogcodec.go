@@ -0,0 +1,415 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Catalogs travel as a stream of length prefixed records instead of one JSON document, so both sides handle one entry
+// at a time no matter how many there are. The stream starts with CATALOG_STREAM_MAGIC and the format version. Each
+// record after that is the length of its body followed by the body. A record of length 0 ends the stream.
+//
+// The body of a record is
+//
+//	uvarint  bytes shared with the path of the record before
+//	string   the rest of the path
+//	byte     flags: directory, deleted, has a mod time, has metadata, tree node
+//	bytes    hash
+//	varint   mod time, nanoseconds since the epoch (only with the flag)
+//	varint   size
+//	string   server name
+//	string   origin
+//	uvarint  number of nodes in the version, then for each: string node, uvarint counter
+//	bytes    metadata of the file as JSON (only with the flag)
+//
+// where strings and bytes are a uvarint length followed by that many bytes. Version 1 streams have no metadata.
+//
+// A directory of the hash tree sent through /merkle/ is a stream too. It starts with a tree node record for the
+// directory, then one for each child, each followed by the record of the child's own entry when it has one. A tree node
+// record carries the path, the hash of everything below it and the directory flag when it has children. Tree nodes only
+// ever appear in answers to /merkle/, never in a catalog.
+
+const (
+	// CATALOG_STREAM_MAGIC - The first bytes of every catalog stream
+	CATALOG_STREAM_MAGIC = "RPCT"
+	// CATALOG_STREAM_VERSION - The version of the format written. Streams with a newer version are rejected.
+	CATALOG_STREAM_VERSION = 2
+	// CATALOG_STREAM_OLDEST_VERSION - The oldest version of the format read. Streams with an older one are rejected.
+	CATALOG_STREAM_OLDEST_VERSION = 1
+	// CATALOG_STREAM_CONTENT_TYPE - The content type of a catalog stream sent over HTTP
+	CATALOG_STREAM_CONTENT_TYPE = "application/x-replicat-catalog"
+	// CATALOG_MAX_RECORD_SIZE - The largest record a decoder accepts. Anything larger is treated as a broken stream.
+	CATALOG_MAX_RECORD_SIZE = 1 << 20
+)
+
+const (
+	catalogFlagDirectory = 1 << iota
+	catalogFlagDeleted
+	catalogFlagModTime
+	catalogFlagMetadata
+	catalogFlagTreeNode
+)
+
+// ErrCatalogStreamFormat - a catalog stream that can not be read
+var ErrCatalogStreamFormat = errors.New("malformed catalog stream")
+
+// ErrCatalogBadPath - a catalog entry for a path outside of the synced directory
+var ErrCatalogBadPath = errors.New("catalog entry path is outside of the synced directory")
+
+// catalogSource - where the entries of a catalog come from, one at a time. Next returns io.EOF after the last one.
+type catalogSource interface {
+	Next() (EntryJSON, error)
+}
+
+// catalogEncoder - writes entries to a catalog stream as they come
+type catalogEncoder struct {
+	writer   *bufio.Writer
+	record   bytes.Buffer
+	previous string
+	count    int
+}
+
+// newCatalogEncoder - start a catalog stream
+func newCatalogEncoder(w io.Writer) (*catalogEncoder, error) {
+	encoder := &catalogEncoder{writer: bufio.NewWriter(w)}
+	encoder.writer.WriteString(CATALOG_STREAM_MAGIC)
+	err := encoder.writer.WriteByte(CATALOG_STREAM_VERSION)
+	return encoder, err
+}
+
+// Encode - add an entry to the stream
+func (encoder *catalogEncoder) Encode(entry EntryJSON) error {
+	return encoder.encode(entry, false)
+}
+
+// EncodeTreeNode - add a node of the hash tree to the stream
+func (encoder *catalogEncoder) EncodeTreeNode(relativePath string, hash []byte, hasChildren bool) error {
+	return encoder.encode(EntryJSON{RelativePath: relativePath, Hash: hash, IsDirectory: hasChildren}, true)
+}
+
+func (encoder *catalogEncoder) encode(entry EntryJSON, treeNode bool) error {
+	record := &encoder.record
+	record.Reset()
+
+	shared := sharedPrefixLength(encoder.previous, entry.RelativePath)
+	putUvarint(record, uint64(shared))
+	putString(record, entry.RelativePath[shared:])
+
+	var flags byte
+	if entry.IsDirectory {
+		flags |= catalogFlagDirectory
+	}
+	if entry.Deleted {
+		flags |= catalogFlagDeleted
+	}
+	if !entry.ModTime.IsZero() {
+		flags |= catalogFlagModTime
+	}
+	if treeNode {
+		flags |= catalogFlagTreeNode
+	}
+	var metadata []byte
+	if !entry.FileMetadata.isEmpty() {
+		flags |= catalogFlagMetadata
+		var err error
+		metadata, err = json.Marshal(entry.FileMetadata)
+		if err != nil {
+			return err
+		}
+	}
+	record.WriteByte(flags)
+
+	putUvarint(record, uint64(len(entry.Hash)))
+	record.Write(entry.Hash)
+	if !entry.ModTime.IsZero() {
+		putVarint(record, entry.ModTime.UnixNano())
+	}
+	putVarint(record, entry.Size)
+	putString(record, entry.ServerName)
+	putString(record, entry.Origin)
+
+	putUvarint(record, uint64(len(entry.Version)))
+	for node, counter := range entry.Version {
+		putString(record, node)
+		putUvarint(record, counter)
+	}
+	if metadata != nil {
+		putUvarint(record, uint64(len(metadata)))
+		record.Write(metadata)
+	}
+
+	lengthPrefix := make([]byte, binary.MaxVarintLen64)
+	encoder.writer.Write(lengthPrefix[:binary.PutUvarint(lengthPrefix, uint64(record.Len()))])
+	_, err := encoder.writer.Write(record.Bytes())
+	encoder.previous = entry.RelativePath
+	encoder.count++
+	return err
+}
+
+// Close - end the stream and flush whatever is still buffered. The underlying writer is left open.
+func (encoder *catalogEncoder) Close() error {
+	err := encoder.writer.WriteByte(0)
+	if err != nil {
+		return err
+	}
+	return encoder.writer.Flush()
+}
+
+// catalogDecoder - reads the entries of a catalog stream one at a time
+type catalogDecoder struct {
+	reader   *bufio.Reader
+	record   []byte
+	previous string
+	done     bool
+}
+
+// newCatalogDecoder - start reading a catalog stream, checking it is one we understand
+func newCatalogDecoder(r io.Reader) (*catalogDecoder, error) {
+	decoder := &catalogDecoder{reader: bufio.NewReader(r)}
+	header := make([]byte, len(CATALOG_STREAM_MAGIC)+1)
+	_, err := io.ReadFull(decoder.reader, header)
+	if err != nil {
+		return nil, fmt.Errorf("reading catalog stream header: %s", err)
+	}
+	if string(header[:len(CATALOG_STREAM_MAGIC)]) != CATALOG_STREAM_MAGIC {
+		return nil, ErrCatalogStreamFormat
+	}
+	version := header[len(CATALOG_STREAM_MAGIC)]
+	if version < CATALOG_STREAM_OLDEST_VERSION || version > CATALOG_STREAM_VERSION {
+		return nil, fmt.Errorf("catalog stream version %d is not supported", version)
+	}
+	return decoder, nil
+}
+
+// Next - the next entry in the stream. io.EOF means the stream ended where it should. A stream that stops before its
+// end marker is an error.
+func (decoder *catalogDecoder) Next() (EntryJSON, error) {
+	entry, treeNode, err := decoder.nextRecord()
+	if err == nil && treeNode {
+		return EntryJSON{}, ErrCatalogStreamFormat
+	}
+	return entry, err
+}
+
+// nextRecord - the next record in the stream, which is either an entry or a node of the hash tree
+func (decoder *catalogDecoder) nextRecord() (entry EntryJSON, treeNode bool, err error) {
+	if decoder.done {
+		return entry, false, io.EOF
+	}
+
+	length, err := binary.ReadUvarint(decoder.reader)
+	if err == io.EOF {
+		return entry, false, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return entry, false, err
+	}
+	if length == 0 {
+		decoder.done = true
+		return entry, false, io.EOF
+	}
+	if length > CATALOG_MAX_RECORD_SIZE {
+		return entry, false, ErrCatalogStreamFormat
+	}
+
+	if uint64(cap(decoder.record)) < length {
+		decoder.record = make([]byte, length)
+	}
+	record := decoder.record[:length]
+	_, err = io.ReadFull(decoder.reader, record)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return entry, false, err
+	}
+
+	fields := recordReader{data: record}
+	shared := fields.uvarint()
+	suffix := fields.bytes()
+	if shared > uint64(len(decoder.previous)) {
+		return entry, false, ErrCatalogStreamFormat
+	}
+	entry.RelativePath = decoder.previous[:shared] + string(suffix)
+
+	flags := fields.byte()
+	entry.IsDirectory = flags&catalogFlagDirectory != 0
+	entry.Deleted = flags&catalogFlagDeleted != 0
+	hash := fields.bytes()
+	if len(hash) > 0 {
+		entry.Hash = append([]byte(nil), hash...)
+	}
+	if flags&catalogFlagModTime != 0 {
+		entry.ModTime = time.Unix(0, fields.varint())
+	}
+	entry.Size = fields.varint()
+	entry.ServerName = string(fields.bytes())
+	entry.Origin = string(fields.bytes())
+
+	nodes := fields.uvarint()
+	if nodes > uint64(len(record)) {
+		return entry, false, ErrCatalogStreamFormat
+	}
+	if nodes > 0 {
+		entry.Version = make(VersionVector, nodes)
+		for i := uint64(0); i < nodes; i++ {
+			node := string(fields.bytes())
+			entry.Version[node] = fields.uvarint()
+		}
+	}
+	if flags&catalogFlagMetadata != 0 {
+		metadata := fields.bytes()
+		if fields.err == nil && json.Unmarshal(metadata, &entry.FileMetadata) != nil {
+			return EntryJSON{}, false, ErrCatalogStreamFormat
+		}
+	}
+
+	if fields.err != nil || len(fields.data) != 0 {
+		return EntryJSON{}, false, ErrCatalogStreamFormat
+	}
+	// The tree node of the root is the only record without a path
+	treeRoot := flags&catalogFlagTreeNode != 0 && entry.RelativePath == ""
+	if !treeRoot && !validRelativePath(entry.RelativePath) {
+		return EntryJSON{}, false, ErrCatalogBadPath
+	}
+	decoder.previous = entry.RelativePath
+	return entry, flags&catalogFlagTreeNode != 0, nil
+}
+
+// jsonCatalogSource - the entries of a catalog sent as a JSON list, read one at a time
+type jsonCatalogSource struct {
+	decoder *json.Decoder
+	started bool
+}
+
+func (source *jsonCatalogSource) Next() (entry EntryJSON, err error) {
+	if !source.started {
+		source.started = true
+		token, err := source.decoder.Token()
+		if err != nil {
+			return entry, err
+		}
+		if token != json.Delim('[') {
+			return entry, fmt.Errorf("expected a list of entries, found %v", token)
+		}
+	}
+	if !source.decoder.More() {
+		return entry, io.EOF
+	}
+	err = source.decoder.Decode(&entry)
+	if err == nil && !validRelativePath(entry.RelativePath) {
+		return EntryJSON{}, ErrCatalogBadPath
+	}
+	return entry, err
+}
+
+// catalogSourceFor - read a catalog carried in an event. Catalogs are streams unless they come from a node that still
+// sends them as JSON.
+func catalogSourceFor(data []byte) (catalogSource, error) {
+	if bytes.HasPrefix(data, []byte(CATALOG_STREAM_MAGIC)) {
+		return newCatalogDecoder(bytes.NewReader(data))
+	}
+	return &jsonCatalogSource{decoder: json.NewDecoder(bytes.NewReader(data))}, nil
+}
+
+// sharedPrefixLength - how many leading bytes two paths have in common
+func sharedPrefixLength(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+func putUvarint(buffer *bytes.Buffer, value uint64) {
+	var scratch [binary.MaxVarintLen64]byte
+	buffer.Write(scratch[:binary.PutUvarint(scratch[:], value)])
+}
+
+func putVarint(buffer *bytes.Buffer, value int64) {
+	var scratch [binary.MaxVarintLen64]byte
+	buffer.Write(scratch[:binary.PutVarint(scratch[:], value)])
+}
+
+func putString(buffer *bytes.Buffer, value string) {
+	putUvarint(buffer, uint64(len(value)))
+	buffer.WriteString(value)
+}
+
+// recordReader - takes the fields of one record apart. The first problem is kept in err and everything after it reads
+// as zero.
+type recordReader struct {
+	data []byte
+	err  error
+}
+
+func (fields *recordReader) uvarint() uint64 {
+	if fields.err != nil {
+		return 0
+	}
+	value, n := binary.Uvarint(fields.data)
+	if n <= 0 {
+		fields.err = ErrCatalogStreamFormat
+		return 0
+	}
+	fields.data = fields.data[n:]
+	return value
+}
+
+func (fields *recordReader) varint() int64 {
+	if fields.err != nil {
+		return 0
+	}
+	value, n := binary.Varint(fields.data)
+	if n <= 0 {
+		fields.err = ErrCatalogStreamFormat
+		return 0
+	}
+	fields.data = fields.data[n:]
+	return value
+}
+
+func (fields *recordReader) byte() byte {
+	if fields.err != nil || len(fields.data) == 0 {
+		fields.err = ErrCatalogStreamFormat
+		return 0
+	}
+	value := fields.data[0]
+	fields.data = fields.data[1:]
+	return value
+}
+
+func (fields *recordReader) bytes() []byte {
+	length := fields.uvarint()
+	if fields.err != nil {
+		return nil
+	}
+	if length > uint64(len(fields.data)) {
+		fields.err = ErrCatalogStreamFormat
+		return nil
+	}
+	value := fields.data[:length]
+	fields.data = fields.data[length:]
+	return value
+}
@@ -0,0 +1,163 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// encodeCatalog - write entries as a catalog stream
+func encodeCatalog(t *testing.T, entries ...EntryJSON) []byte {
+	var buffer bytes.Buffer
+	encoder, err := newCatalogEncoder(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		err = encoder.Encode(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = encoder.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestCatalogStreamRoundTrip(t *testing.T) {
+	modTime := time.Date(2016, 10, 16, 12, 30, 0, 5, time.UTC)
+	entries := []EntryJSON{
+		{RelativePath: "photos", IsDirectory: true, ModTime: modTime, Size: 4096, ServerName: "NodeA", Version: VersionVector{"NodeA": 1}},
+		{RelativePath: "photos/2016/beach.jpg", Hash: []byte{1, 2, 3}, ModTime: modTime, Size: 1 << 40, ServerName: "NodeA", Version: VersionVector{"NodeA": 3, "NodeB": 2}},
+		{RelativePath: "photos/2016/beach copy.jpg", ModTime: modTime, Deleted: true, Origin: "NodeB", Version: VersionVector{"NodeB": 4}},
+		{RelativePath: "empty.txt", ServerName: "NodeA"},
+		{RelativePath: "photos/run.sh", Hash: []byte{4, 5}, ModTime: modTime, Size: 20, ServerName: "NodeA", Version: VersionVector{"NodeA": 2},
+			FileMetadata: FileMetadata{Mode: 0755 | os.ModeSetgid, Owner: &FileOwner{UID: 1000, GID: 0},
+				Xattrs: map[string][]byte{"user.origin": []byte("camera")}, LinkGroup: "801:1f"}},
+	}
+
+	data := encodeCatalog(t, entries...)
+	jsonData, _ := json.Marshal(entries)
+	if len(data) >= len(jsonData) {
+		t.Fatalf("expected the stream to be smaller than JSON. stream: %d JSON: %d", len(data), len(jsonData))
+	}
+
+	decoder, err := newCatalogDecoder(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range entries {
+		entry, err := decoder.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.RelativePath != expected.RelativePath || entry.IsDirectory != expected.IsDirectory || entry.Deleted != expected.Deleted ||
+			!bytes.Equal(entry.Hash, expected.Hash) || !entry.ModTime.Equal(expected.ModTime) || entry.Size != expected.Size ||
+			entry.ServerName != expected.ServerName || entry.Origin != expected.Origin || entry.Version.Compare(expected.Version) != VERSION_EQUAL ||
+			!sameMetadata(entry.FileMetadata, expected.FileMetadata) {
+			t.Fatalf("entry changed on the way through.\nexpected: %#v\nfound:    %#v", expected, entry)
+		}
+	}
+	_, err = decoder.Next()
+	if err != io.EOF {
+		t.Fatalf("expected the end of the stream. err: %v", err)
+	}
+}
+
+func TestCatalogStreamRejectsBrokenStreams(t *testing.T) {
+	data := encodeCatalog(t, EntryJSON{RelativePath: "a.txt", Size: 1}, EntryJSON{RelativePath: "b.txt", Size: 2})
+
+	// Cut off before the end marker
+	decoder, err := newCatalogDecoder(bytes.NewReader(data[:len(data)-1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for err == nil {
+		_, err = decoder.Next()
+	}
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("a stream without its end marker should not end cleanly. err: %v", err)
+	}
+
+	newer := append([]byte(nil), data...)
+	newer[len(CATALOG_STREAM_MAGIC)] = CATALOG_STREAM_VERSION + 1
+	_, err = newCatalogDecoder(bytes.NewReader(newer))
+	if err == nil {
+		t.Fatal("a stream in a format we do not know should be rejected")
+	}
+
+	_, err = newCatalogDecoder(bytes.NewReader([]byte(`[{"RelativePath": "a.txt"}]`)))
+	if err != ErrCatalogStreamFormat {
+		t.Fatalf("expected a format error for something that is not a stream. err: %v", err)
+	}
+
+	// Nodes of the hash tree are not entries and have no place in a catalog
+	var tree bytes.Buffer
+	encoder, _ := newCatalogEncoder(&tree)
+	encoder.EncodeTreeNode("docs", []byte("hash"), true)
+	encoder.Close()
+	decoder, err = newCatalogDecoder(&tree)
+	if err == nil {
+		_, err = decoder.Next()
+	}
+	if err != ErrCatalogStreamFormat {
+		t.Fatalf("expected a format error for a tree node in a catalog. err: %v", err)
+	}
+
+	// Paths outside of the synced directory are refused whichever way the catalog comes
+	for _, path := range []string{"../outside.txt", "/etc/passwd", "docs/../../outside.txt"} {
+		decoder, err = newCatalogDecoder(bytes.NewReader(encodeCatalog(t, EntryJSON{RelativePath: path})))
+		if err == nil {
+			_, err = decoder.Next()
+		}
+		if err != ErrCatalogBadPath {
+			t.Fatalf("expected a path error for (%s) in a stream. err: %v", path, err)
+		}
+
+		listed, _ := json.Marshal([]EntryJSON{{RelativePath: path}})
+		source, _ := catalogSourceFor(listed)
+		_, err = source.Next()
+		if err != ErrCatalogBadPath {
+			t.Fatalf("expected a path error for (%s) in a JSON catalog. err: %v", path, err)
+		}
+	}
+}
+
+func TestProcessCatalogReadsStreamAndJSON(t *testing.T) {
+	useTestSettings(t)
+	tracker := createTracker("catalogStream")
+	defer cleanupTracker(tracker)
+	globalSettings.Directory = tracker.directory
+
+	tracker.ProcessCatalog(Event{Name: "replicat.Catalog", Source: "streamPeer",
+		RawData: encodeCatalog(t, EntryJSON{RelativePath: "fromStream", IsDirectory: true, Version: VersionVector{"streamPeer": 1}})})
+	tracker.ProcessCatalog(catalogEvent(t, "streamPeer", EntryJSON{RelativePath: "fromJSON", IsDirectory: true, Version: VersionVector{"streamPeer": 1}}))
+
+	for _, name := range []string{"fromStream", "fromJSON"} {
+		info, err := os.Stat(filepath.Join(tracker.directory, name))
+		if err != nil || !info.IsDir() {
+			t.Fatalf("expected %s to be created from the catalog. err: %v", name, err)
+		}
+	}
+}
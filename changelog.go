@@ -0,0 +1,378 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Every change to a tracked path gets the next number in the tracker's change log. A peer remembers how far into our
+// log it has processed, its cursor, and when we announce our catalog it asks for the changes after that instead of
+// comparing everything. Only a peer whose cursor is older than what the log still holds has to compare everything.
+//
+// The log is kept in a file under the metadata directory. The first line names the log and the last sequence dropped
+// from it, and each line after that is a change. New changes are appended as the state is saved, and the file is only
+// written again as a whole when the log starts over or drops its oldest changes.
+
+const (
+	// CHANGELOG_MAX_RECORDS - The change log keeps at most this many records. Older ones are dropped.
+	CHANGELOG_MAX_RECORDS = 100000
+	// CHANGELOG_FILE - File under the metadata directory holding the change log
+	CHANGELOG_FILE = "changes.log"
+)
+
+// ChangeRecord - one change to a path. The state of the path is looked up when the change is asked for.
+type ChangeRecord struct {
+	Sequence     uint64
+	RelativePath string
+}
+
+// changeLog - the recent changes to tracked paths. A new log ID is picked whenever the log starts over, so cursors
+// into an older log are not mistaken for cursors into this one.
+type changeLog struct {
+	LogID   string
+	Next    uint64 // the sequence the next change gets
+	Dropped uint64 // the last sequence that is no longer in the log
+	Records []ChangeRecord
+
+	saved   int  // how many of the records are in the file
+	rewrite bool // the file no longer matches the log and has to be written again as a whole
+}
+
+// changeLogHeader - the first line of the change log file
+type changeLogHeader struct {
+	LogID   string
+	Dropped uint64
+}
+
+// ChangeCursor - how far into a peer's change log we have processed
+type ChangeCursor struct {
+	LogID    string
+	Sequence uint64
+}
+
+// ChangesResponse - the paths changed after a cursor, newest first. Truncated means the log no longer holds all of
+// them. A peer gets the current state of each path as a catalog stream, with the rest in the headers below.
+type ChangesResponse struct {
+	LogID     string
+	Sequence  uint64
+	Truncated bool
+	Paths     []string
+}
+
+const (
+	// CHANGES_HEADER_LOG_ID - The header carrying the ID of the change log the changes come from
+	CHANGES_HEADER_LOG_ID = "X-Replicat-Log-Id"
+	// CHANGES_HEADER_SEQUENCE - The header carrying the sequence the changes run up to
+	CHANGES_HEADER_SEQUENCE = "X-Replicat-Sequence"
+	// CHANGES_HEADER_TRUNCATED - The header present when the log no longer holds every change asked for
+	CHANGES_HEADER_TRUNCATED = "X-Replicat-Truncated"
+)
+
+// newChangeLog - an empty log with a new ID
+func newChangeLog() changeLog {
+	return changeLog{LogID: fmt.Sprintf("%s-%d", globalSettings.Name, time.Now().UnixNano()), Next: 1, rewrite: true}
+}
+
+func (handler *FilesystemTracker) changeLogPath() string {
+	return filepath.Join(handler.directory, REPLICAT_METADATA_DIRECTORY, CHANGELOG_FILE)
+}
+
+// loadChangeLog - read the change log a previous run left behind. found is false when there is none that can be used.
+func loadChangeLog(logPath string) (changes changeLog, found bool) {
+	file, err := os.Open(logPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Unable to read the change log. Starting a new one: %s", err)
+		}
+		return
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	var header changeLogHeader
+	err = decoder.Decode(&header)
+	if err != nil || header.LogID == "" {
+		log.Printf("The change log has no header. Starting a new one: %v", err)
+		return
+	}
+
+	changes = changeLog{LogID: header.LogID, Dropped: header.Dropped, Next: header.Dropped + 1}
+	for {
+		var record ChangeRecord
+		err = decoder.Decode(&record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil || record.Sequence < changes.Next {
+			// A save cut short leaves a damaged last line. Everything before it is good, and the file is written again.
+			log.Printf("The change log ends with a damaged record. Ignoring the rest: %v", err)
+			changes.rewrite = true
+			break
+		}
+		changes.Records = append(changes.Records, record)
+		changes.Next = record.Sequence + 1
+	}
+	changes.saved = len(changes.Records)
+
+	return changes, true
+}
+
+// unsaved - what has to be written to bring the file up to date with the log, which is then taken as written. Call
+// when inside of a lock!
+func (changes *changeLog) unsaved() (header changeLogHeader, records []ChangeRecord, rewrite bool) {
+	header = changeLogHeader{LogID: changes.LogID, Dropped: changes.Dropped}
+	rewrite = changes.rewrite
+	if rewrite {
+		records = changes.Records
+	} else {
+		records = changes.Records[changes.saved:]
+	}
+
+	changes.rewrite = false
+	changes.saved = len(changes.Records)
+	return
+}
+
+// writeChangeLog - append records to the change log file, or write it again as a whole. Records are never changed once
+// they are in the log, so this does not need the lock.
+func writeChangeLog(logPath string, header changeLogHeader, records []ChangeRecord, rewrite bool) error {
+	if !rewrite && len(records) == 0 {
+		return nil
+	}
+
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	if rewrite {
+		encoder.Encode(header)
+	}
+	for _, record := range records {
+		encoder.Encode(record)
+	}
+
+	if rewrite {
+		return writeFileAtomic(logPath, buffer.Bytes())
+	}
+
+	file, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(buffer.Bytes())
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// lastSequence - the sequence of the most recent change
+func (changes *changeLog) lastSequence() uint64 {
+	return changes.Next - 1
+}
+
+// recordChange - add a change to a path to the log and get the state saved. Call when inside of a lock!
+func (handler *FilesystemTracker) recordChange(relativePath string) {
+	handler.markIndexDirty(relativePath)
+
+	changes := &handler.changes
+	changes.Records = append(changes.Records, ChangeRecord{Sequence: changes.Next, RelativePath: relativePath})
+	changes.Next++
+
+	// Drop a quarter at a time so this is not done on every change once the log is full
+	if len(changes.Records) > CHANGELOG_MAX_RECORDS {
+		drop := len(changes.Records) - CHANGELOG_MAX_RECORDS*3/4
+		changes.Dropped = changes.Records[drop-1].Sequence
+		changes.Records = append([]ChangeRecord(nil), changes.Records[drop:]...)
+		changes.rewrite = true
+	}
+
+	handler.scheduleStateSave()
+}
+
+// changesSince - every path changed after a cursor into our log
+func (handler *FilesystemTracker) changesSince(logID string, since uint64) ChangesResponse {
+	handler.fsLock.RLock()
+	defer handler.fsLock.RUnlock()
+
+	changes := &handler.changes
+	response := ChangesResponse{LogID: changes.LogID, Sequence: changes.lastSequence()}
+	if logID != changes.LogID || since < changes.Dropped || since > changes.lastSequence() {
+		response.Truncated = true
+		return response
+	}
+
+	seen := make(map[string]bool)
+	response.Paths = make([]string, 0)
+	for i := len(changes.Records) - 1; i >= 0 && changes.Records[i].Sequence > since; i-- {
+		relativePath := changes.Records[i].RelativePath
+		if seen[relativePath] || isMetadataPath(relativePath) {
+			continue
+		}
+		seen[relativePath] = true
+		response.Paths = append(response.Paths, relativePath)
+	}
+
+	return response
+}
+
+// changedEntry - the current state of a changed path as it goes into a catalog, which is its tombstone if it is gone.
+// Paths our ignore files and settings leave out are not found, and neither are changes we keep to ourselves.
+func (handler *FilesystemTracker) changedEntry(relativePath string) (entry EntryJSON, found bool) {
+	handler.fsLock.RLock()
+	defer handler.fsLock.RUnlock()
+
+	if handler.isHeldBack(relativePath) {
+		return
+	}
+
+	value, exists := handler.contents[relativePath]
+	tombstone, deleted := handler.tombstones[relativePath]
+	if exists && value.FileInfo != nil {
+		entry, found = catalogEntry(relativePath, value), true
+	} else if deleted {
+		entry, found = tombstone.entryJSON(), true
+	}
+	if found && handler.ignoresEntry(entry) {
+		return EntryJSON{}, false
+	}
+	return
+}
+
+// changeCursor - how far into a peer's log we have processed
+func (handler *FilesystemTracker) changeCursor(peer string) (cursor ChangeCursor, known bool) {
+	handler.fsLock.RLock()
+	defer handler.fsLock.RUnlock()
+
+	cursor, known = handler.cursors[peer]
+	return
+}
+
+// setChangeCursor - remember how far into a peer's log we have processed
+func (handler *FilesystemTracker) setChangeCursor(peer string, cursor ChangeCursor) {
+	handler.fsLock.Lock()
+	defer handler.fsLock.Unlock()
+
+	handler.cursors[peer] = cursor
+	handler.scheduleStateSave()
+}
+
+// fetchChanges - ask a peer for the changes after our cursor into its log. Unless the response is truncated, the
+// changes are read from the returned catalog as they arrive, and body has to be closed once they are.
+func fetchChanges(address string, cursor ChangeCursor) (response ChangesResponse, changes catalogSource, body io.Closer, err error) {
+	values := url.Values{}
+	values.Set("log", cursor.LogID)
+	values.Set("since", strconv.FormatUint(cursor.Sequence, 10))
+
+	req, err := http.NewRequest("GET", "http://"+address+"/changes/?"+values.Encode(), nil)
+	if err != nil {
+		return
+	}
+
+	data := []byte(globalSettings.ManagerCredentials)
+	authHash := base64.StdEncoding.EncodeToString(data)
+	req.Header.Add("Authorization", "Basic "+authHash)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		err = fmt.Errorf("changes since %d returned %s", cursor.Sequence, resp.Status)
+		return
+	}
+
+	response.LogID = resp.Header.Get(CHANGES_HEADER_LOG_ID)
+	response.Sequence, err = strconv.ParseUint(resp.Header.Get(CHANGES_HEADER_SEQUENCE), 10, 64)
+	response.Truncated = resp.Header.Get(CHANGES_HEADER_TRUNCATED) != ""
+	if err == nil && !response.Truncated {
+		changes, err = newCatalogDecoder(resp.Body)
+	}
+	if err != nil || response.Truncated {
+		resp.Body.Close()
+		return
+	}
+
+	return response, changes, resp.Body, nil
+}
+
+// changesHandler - answer a peer asking for the changes after its cursor. GET /changes/?log=<log id>&since=<sequence>
+func changesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	server, exists := serverMap[globalSettings.Name]
+	if !exists || server.storage == nil {
+		http.Error(w, "Storage is not set up", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	since, err := strconv.ParseUint(query.Get("since"), 10, 64)
+	if err != nil {
+		http.Error(w, "since is required", http.StatusBadRequest)
+		return
+	}
+
+	response := server.storage.changesSince(query.Get("log"), since)
+	log.Printf("Sending %d changes since %d to a peer. Truncated: %v", len(response.Paths), since, response.Truncated)
+
+	w.Header().Set("Content-Type", CATALOG_STREAM_CONTENT_TYPE)
+	w.Header().Set(CHANGES_HEADER_LOG_ID, response.LogID)
+	w.Header().Set(CHANGES_HEADER_SEQUENCE, strconv.FormatUint(response.Sequence, 10))
+	if response.Truncated {
+		w.Header().Set(CHANGES_HEADER_TRUNCATED, "true")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Each path is looked up as it is written, so only the list of paths is held while the peer reads
+	encoder, err := newCatalogEncoder(w)
+	for _, relativePath := range response.Paths {
+		if err != nil {
+			break
+		}
+		entry, found := server.storage.changedEntry(relativePath)
+		if found {
+			err = encoder.Encode(entry)
+		}
+	}
+	if err == nil {
+		err = encoder.Close()
+	}
+	if err != nil {
+		log.Printf("Unable to send the changes since %d: %s", since, err)
+	}
+}
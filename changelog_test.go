@@ -0,0 +1,160 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestChangesSinceCursor(t *testing.T) {
+	tracker := createTracker("changesSince")
+	defer cleanupTracker(tracker)
+
+	receiveTestFile(t, tracker, "before.txt", "before", "nodeA", VersionVector{"nodeA": 1})
+	cursor := ChangeCursor{LogID: tracker.changes.LogID, Sequence: tracker.changes.lastSequence()}
+	receiveTestFile(t, tracker, "after.txt", "after", "nodeA", VersionVector{"nodeA": 1})
+	receiveTestFile(t, tracker, "after.txt", "after again", "nodeA", VersionVector{"nodeA": 2})
+
+	changes := tracker.changesSince(cursor.LogID, cursor.Sequence)
+	if changes.Truncated || len(changes.Paths) != 1 || changes.Paths[0] != "after.txt" || changes.Sequence != cursor.Sequence+2 {
+		t.Fatalf("expected after.txt once and the position of the log. changes: %#v", changes)
+	}
+	entry, found := tracker.changedEntry("after.txt")
+	if !found || entry.Version["nodeA"] != 2 {
+		t.Fatalf("expected the current state of after.txt. entry: %#v", entry)
+	}
+
+	if !tracker.changesSince("some other log", cursor.Sequence).Truncated {
+		t.Fatal("a cursor into a different log can not be used")
+	}
+
+	tracker.fsLock.Lock()
+	tracker.changes.Dropped = cursor.Sequence + 1
+	tracker.fsLock.Unlock()
+	if !tracker.changesSince(cursor.LogID, cursor.Sequence).Truncated {
+		t.Fatal("a cursor older than what the log holds can not be used")
+	}
+}
+
+func TestReconnectUsesChangesSinceCursor(t *testing.T) {
+	useTestSettings(t)
+	local := createTracker("changesLocal")
+	defer cleanupTracker(local)
+	remote := createTracker("changesRemote")
+	defer cleanupTracker(remote)
+
+	requested := make([]string, 0)
+	var requestedLock sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// File requests for what turns out to be needed arrive here too. Only the catalog requests are of interest.
+		switch r.URL.Path {
+		case "/changes/":
+			changesHandler(w, r)
+		case "/merkle/":
+			merkleHandler(w, r)
+		default:
+			return
+		}
+		requestedLock.Lock()
+		requested = append(requested, r.URL.Path)
+		requestedLock.Unlock()
+	}))
+	defer server.Close()
+
+	serverMapLock.Lock()
+	serverMap[globalSettings.Name] = &ReplicatServer{Name: globalSettings.Name, storage: remote}
+	serverMap["changesPeer"] = &ReplicatServer{Name: "changesPeer", Address: strings.TrimPrefix(server.URL, "http://")}
+	serverMapLock.Unlock()
+
+	announce := func() {
+		remote.fsLock.RLock()
+		announcement := CatalogAnnouncement{Root: remote.buildMerkleTree()[""].hash, LogID: remote.changes.LogID, Sequence: remote.changes.lastSequence()}
+		remote.fsLock.RUnlock()
+		data, _ := json.Marshal(announcement)
+		requestedLock.Lock()
+		requested = requested[:0]
+		requestedLock.Unlock()
+		local.ProcessMerkleRoot(Event{Name: "replicat.MerkleRoot", Source: "changesPeer", RawData: data})
+	}
+
+	// The first time there is no cursor, so the trees are compared
+	receiveTestFile(t, remote, "first.txt", "first", "changesPeer", VersionVector{"changesPeer": 1})
+	announce()
+	cursor, known := local.changeCursor("changesPeer")
+	if !known || cursor.LogID != remote.changes.LogID || cursor.Sequence != remote.changes.lastSequence() {
+		t.Fatalf("expected a cursor at the end of the peer's log. cursor: %#v known: %v", cursor, known)
+	}
+
+	// After that only the changes since the cursor are asked for
+	receiveTestFile(t, remote, "second.txt", "second", "changesPeer", VersionVector{"changesPeer": 1})
+	announce()
+	if len(requested) != 1 || requested[0] != "/changes/" {
+		t.Fatalf("expected a single request for the changes. requested: %v", requested)
+	}
+	local.fsLock.RLock()
+	_, needed := local.neededFiles["second.txt"]
+	local.fsLock.RUnlock()
+	if !needed {
+		t.Fatal("the file changed since the cursor should be requested")
+	}
+
+	// Once the log no longer reaches back to the cursor, everything is compared again
+	receiveTestFile(t, remote, "third.txt", "third", "changesPeer", VersionVector{"changesPeer": 1})
+	remote.fsLock.Lock()
+	remote.changes.Dropped = remote.changes.lastSequence()
+	remote.fsLock.Unlock()
+	announce()
+	if len(requested) < 2 || requested[0] != "/changes/" || requested[1] != "/merkle/" {
+		t.Fatalf("expected to fall back to comparing the trees. requested: %v", requested)
+	}
+}
+
+func TestChangeLogIsAppendedAndSurvivesRestart(t *testing.T) {
+	tracker := createTracker("changesSaved")
+	defer cleanupTracker(tracker)
+
+	receiveTestFile(t, tracker, "first.txt", "first", "nodeA", VersionVector{"nodeA": 1})
+	tracker.saveState()
+	saved, _ := os.Stat(tracker.changeLogPath())
+	receiveTestFile(t, tracker, "second.txt", "second", "nodeA", VersionVector{"nodeA": 1})
+	tracker.saveState()
+	appended, err := os.Stat(tracker.changeLogPath())
+	if err != nil || saved == nil || appended.Size() <= saved.Size() {
+		t.Fatalf("new changes should be appended to the change log. err: %v", err)
+	}
+
+	// A save cut short leaves half a record behind
+	file, _ := os.OpenFile(tracker.changeLogPath(), os.O_WRONLY|os.O_APPEND, 0644)
+	file.WriteString(`{"Sequence":99,"Rela`)
+	file.Close()
+
+	tracker.fsLock.RLock()
+	expected := tracker.changes
+	tracker.fsLock.RUnlock()
+	loaded, found := loadChangeLog(tracker.changeLogPath())
+	if !found || loaded.LogID != expected.LogID || loaded.Next != expected.Next || len(loaded.Records) != len(expected.Records) {
+		t.Fatalf("the change log should come back as it was saved. loaded: %#v expected: %#v", loaded, expected)
+	}
+	if !loaded.rewrite {
+		t.Fatal("a change log with a damaged end should be written again")
+	}
+}
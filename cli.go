@@ -17,10 +17,18 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/urfave/cli"
+	"io"
+	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 )
 
 // SetupCli sets up the command line environment. Provide help and read the settings in.
@@ -79,6 +87,26 @@ func SetupCli() {
 			globalSettings.ClusterKey = c.GlobalString("cluster_key")
 		}
 
+		if c.GlobalString("hash_algorithm") != "" {
+			globalSettings.HashAlgorithm = c.GlobalString("hash_algorithm")
+		}
+
+		if err = validateHashAlgorithm(globalSettings.HashAlgorithm); err != nil {
+			panic(fmt.Sprintf("cannot use config file. %s", err))
+		}
+		if err = validateConflictPolicies(globalSettings.ConflictPolicies); err != nil {
+			panic(fmt.Sprintf("cannot use config file. %s", err))
+		}
+		if err = validateIgnoreSettings(globalSettings); err != nil {
+			panic(fmt.Sprintf("cannot use config file. %s", err))
+		}
+		if err = validateFolderDirections(globalSettings.FolderDirections); err != nil {
+			panic(fmt.Sprintf("cannot use config file. %s", err))
+		}
+		if err = validateFolderMetadata(globalSettings.FolderMetadata); err != nil {
+			panic(fmt.Sprintf("cannot use config file. %s", err))
+		}
+
 		SetGlobalSettings(globalSettings)
 		return nil
 	}
@@ -113,6 +141,11 @@ func SetupCli() {
 			Usage:  "Specify cluster's key.",
 			EnvVar: "cluster_key, ck",
 		},
+		cli.StringFlag{
+			Name:   "hash_algorithm, ha",
+			Usage:  "Specify the content hash used by the cluster: blake2b (default), sha256 or md5. All nodes must match.",
+			EnvVar: "hash_algorithm, ha",
+		},
 		cli.StringFlag{
 			Name:   "address, a",
 			Usage:  "Specify a listen address for this node. e.g. '127.0.0.1:8000' or ':8000' for where updates are accepted from",
@@ -126,5 +159,446 @@ func SetupCli() {
 		},
 	}
 
+	app.Commands = []cli.Command{
+		{
+			Name:  "trash",
+			Usage: "Work with the trash of a running node",
+			Subcommands: []cli.Command{
+				{
+					Name:   "list",
+					Usage:  "List what is in the trash",
+					Action: commandAction(trashListCommand),
+				},
+				{
+					Name:      "restore",
+					Usage:     "Put an item back where it was, or at the path given",
+					ArgsUsage: "<id> [path]",
+					Action:    commandAction(trashRestoreCommand),
+				},
+				{
+					Name:      "purge",
+					Usage:     "Delete an item from the trash for good",
+					ArgsUsage: "<id>",
+					Action:    commandAction(trashPurgeCommand),
+				},
+			},
+		},
+		{
+			Name:  "versions",
+			Usage: "Work with the versions a running node keeps of replaced files",
+			Subcommands: []cli.Command{
+				{
+					Name:      "list",
+					Usage:     "List the versions kept of a file",
+					ArgsUsage: "<path>",
+					Action:    commandAction(versionsListCommand),
+				},
+				{
+					Name:      "restore",
+					Usage:     "Put a version of a file back in place. The change is sent to the other nodes",
+					ArgsUsage: "<path> <id>",
+					Action:    commandAction(versionsRestoreCommand),
+				},
+			},
+		},
+		{
+			Name:  "snapshot",
+			Usage: "Work with the snapshots of a running node",
+			Subcommands: []cli.Command{
+				{
+					Name:      "create",
+					Usage:     "Record every tracked path under a name",
+					ArgsUsage: "<name>",
+					Action:    commandAction(snapshotCreateCommand),
+				},
+				{
+					Name:   "list",
+					Usage:  "List the snapshots",
+					Action: commandAction(snapshotListCommand),
+				},
+				{
+					Name:      "diff",
+					Usage:     "Show what changed since a snapshot, or between two",
+					ArgsUsage: "<name> [other name]",
+					Action:    commandAction(snapshotDiffCommand),
+				},
+				{
+					Name:      "export",
+					Usage:     "Write a snapshot, or a directory in it, to a tar archive",
+					ArgsUsage: "<name> <tar file> [path]",
+					Action:    commandAction(snapshotExportCommand),
+				},
+				{
+					Name:      "restore",
+					Usage:     "Put a directory, or everything, back the way a snapshot has it. The changes are sent to the other nodes",
+					ArgsUsage: "<name> [path]",
+					Action:    commandAction(snapshotRestoreCommand),
+				},
+				{
+					Name:      "delete",
+					Usage:     "Drop a snapshot",
+					ArgsUsage: "<name>",
+					Action:    commandAction(snapshotDeleteCommand),
+				},
+			},
+		},
+		{
+			Name:  "breaker",
+			Usage: "Work with the mass change circuit breakers of a running node",
+			Subcommands: []cli.Command{
+				{
+					Name:   "status",
+					Usage:  "Show whether the breakers are tripped and the changes they hold",
+					Action: commandAction(breakerStatusCommand),
+				},
+				{
+					Name:      "confirm",
+					Usage:     "Let the changes a tripped breaker holds through",
+					ArgsUsage: "<outgoing|incoming>",
+					Action:    commandAction(breakerSettleCommand("confirm")),
+				},
+				{
+					Name:      "reject",
+					Usage:     "Throw away the changes a tripped breaker holds",
+					ArgsUsage: "<outgoing|incoming>",
+					Action:    commandAction(breakerSettleCommand("reject")),
+				},
+			},
+		},
+	}
+
 	app.Run(os.Args)
 }
+
+// commandAction - run a command against a running node and exit, instead of going on to start a node
+func commandAction(command func(c *cli.Context) error) func(c *cli.Context) error {
+	return func(c *cli.Context) error {
+		err := command(c)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+		return nil
+	}
+}
+
+// nodeRequest - make a request to the API of a running node. The node is the one at the address given on the command
+// line, or in the config file.
+func nodeRequest(c *cli.Context, method, path string, query url.Values) (*http.Response, error) {
+	address := c.GlobalString("address")
+	if address == "" {
+		jsonFile := "nodes.json"
+		if c.GlobalString("config") != "" {
+			jsonFile = c.GlobalString("config")
+		}
+
+		var settings Settings
+		configFile, err := os.Open(jsonFile)
+		if err != nil {
+			return nil, fmt.Errorf("no address given and unable to read the config file: %s", err)
+		}
+		defer configFile.Close()
+		err = json.NewDecoder(configFile).Decode(&settings)
+		if err != nil {
+			return nil, fmt.Errorf("no address given and unable to read the config file: %s", err)
+		}
+		address = settings.Address
+	}
+	if strings.HasPrefix(address, ":") {
+		address = "127.0.0.1" + address
+	}
+
+	req, err := http.NewRequest(method, "http://"+address+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth("replicat", "isthecat")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s %s", method, path, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return resp, nil
+}
+
+func trashListCommand(c *cli.Context) error {
+	resp, err := nodeRequest(c, "GET", "/trash/", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var items []TrashItem
+	err = json.NewDecoder(resp.Body).Decode(&items)
+	if err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tTRASHED\tREASON\tFROM\tSIZE\tPATH")
+	for _, item := range items {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%d\t%s\n", item.ID, item.Trashed.Format(time.RFC3339), item.Reason, item.Origin,
+			item.Size, item.RelativePath)
+	}
+	return writer.Flush()
+}
+
+func trashRestoreCommand(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("usage: trash restore <id> [path]")
+	}
+
+	query := url.Values{}
+	query.Set("id", c.Args().Get(0))
+	query.Set("path", c.Args().Get(1))
+	resp, err := nodeRequest(c, "POST", "/trash/", query)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func trashPurgeCommand(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("usage: trash purge <id>")
+	}
+
+	query := url.Values{}
+	query.Set("id", c.Args().Get(0))
+	resp, err := nodeRequest(c, "DELETE", "/trash/", query)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func versionsListCommand(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("usage: versions list <path>")
+	}
+
+	query := url.Values{}
+	query.Set("path", c.Args().Get(0))
+	resp, err := nodeRequest(c, "GET", "/versions/", query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var versions []FileVersion
+	err = json.NewDecoder(resp.Body).Decode(&versions)
+	if err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tMODIFIED\tREPLACED\tFROM\tSIZE\tHASH")
+	for _, version := range versions {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%d\t%x\n", version.ID, version.ModTime.Format(time.RFC3339),
+			version.Replaced.Format(time.RFC3339), version.Origin, version.Size, version.Hash)
+	}
+	return writer.Flush()
+}
+
+func versionsRestoreCommand(c *cli.Context) error {
+	if c.NArg() < 2 {
+		return fmt.Errorf("usage: versions restore <path> <id>")
+	}
+
+	query := url.Values{}
+	query.Set("path", c.Args().Get(0))
+	query.Set("id", c.Args().Get(1))
+	resp, err := nodeRequest(c, "POST", "/versions/", query)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func snapshotCreateCommand(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("usage: snapshot create <name>")
+	}
+
+	query := url.Values{}
+	query.Set("name", c.Args().Get(0))
+	resp, err := nodeRequest(c, "POST", "/snapshots/", query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var snapshot Snapshot
+	err = json.NewDecoder(resp.Body).Decode(&snapshot)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d files, %d directories, %d bytes\n", snapshot.Name, snapshot.Files, snapshot.Directories, snapshot.Size)
+	return nil
+}
+
+func snapshotListCommand(c *cli.Context) error {
+	resp, err := nodeRequest(c, "GET", "/snapshots/", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var snapshots []Snapshot
+	err = json.NewDecoder(resp.Body).Decode(&snapshots)
+	if err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tCREATED\tFILES\tDIRECTORIES\tSIZE")
+	for _, snapshot := range snapshots {
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%d\t%d\n", snapshot.Name, snapshot.Created.Format(time.RFC3339), snapshot.Files,
+			snapshot.Directories, snapshot.Size)
+	}
+	return writer.Flush()
+}
+
+func snapshotDiffCommand(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("usage: snapshot diff <name> [other name]")
+	}
+
+	query := url.Values{}
+	query.Set("from", c.Args().Get(0))
+	query.Set("to", c.Args().Get(1))
+	resp, err := nodeRequest(c, "GET", "/snapshots/diff/", query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var changes []SnapshotChange
+	err = json.NewDecoder(resp.Body).Decode(&changes)
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		fmt.Printf("%-8s %s\n", change.Change, change.RelativePath)
+	}
+	return nil
+}
+
+func snapshotExportCommand(c *cli.Context) error {
+	if c.NArg() < 2 {
+		return fmt.Errorf("usage: snapshot export <name> <tar file> [path]")
+	}
+
+	query := url.Values{}
+	query.Set("name", c.Args().Get(0))
+	query.Set("path", c.Args().Get(2))
+	resp, err := nodeRequest(c, "GET", "/snapshots/export/", query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	archive, err := os.Create(c.Args().Get(1))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(archive, resp.Body)
+	closeErr := archive.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func snapshotRestoreCommand(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("usage: snapshot restore <name> [path]")
+	}
+
+	query := url.Values{}
+	query.Set("name", c.Args().Get(0))
+	query.Set("path", c.Args().Get(1))
+	resp, err := nodeRequest(c, "POST", "/snapshots/restore/", query)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func snapshotDeleteCommand(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("usage: snapshot delete <name>")
+	}
+
+	query := url.Values{}
+	query.Set("name", c.Args().Get(0))
+	resp, err := nodeRequest(c, "DELETE", "/snapshots/", query)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func breakerStatusCommand(c *cli.Context) error {
+	resp, err := nodeRequest(c, "GET", "/breaker/", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var breakers []CircuitBreaker
+	err = json.NewDecoder(resp.Body).Decode(&breakers)
+	if err != nil {
+		return err
+	}
+
+	for _, breaker := range breakers {
+		if !breaker.isTripped() {
+			fmt.Printf("%s: closed\n", breaker.Direction)
+			continue
+		}
+		fmt.Printf("%s: tripped at %s. %s. %d changes held\n", breaker.Direction, breaker.Tripped.Format(time.RFC3339),
+			breaker.Reason, len(breaker.Held))
+
+		writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(writer, "  CHANGE\tFROM\tHELD\tPATH")
+		for _, change := range breaker.Held {
+			fmt.Fprintf(writer, "  %s\t%s\t%s\t%s\n", change.Change, change.Node, change.Held.Format(time.RFC3339), change.RelativePath)
+		}
+		err = writer.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// breakerSettleCommand - confirm or reject what a tripped breaker holds
+func breakerSettleCommand(decision string) func(c *cli.Context) error {
+	return func(c *cli.Context) error {
+		if c.NArg() < 1 {
+			return fmt.Errorf("usage: breaker %s <outgoing|incoming>", decision)
+		}
+
+		query := url.Values{}
+		query.Set("direction", c.Args().Get(0))
+		query.Set("decision", decision)
+		resp, err := nodeRequest(c, "POST", "/breaker/", query)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+}
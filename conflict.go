@@ -0,0 +1,246 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// When a file is changed on two nodes that could not see each other, neither version includes the other. The conflict
+// policy for the path decides which edit keeps the path and whether the other one is kept next to it as a conflict
+// copy. Every node that has the losing edit makes the copy, and it reaches the others like any other new file.
+
+// CONFLICT_DATE_FORMAT - How the date of the losing edit appears in the name of a conflict copy
+const CONFLICT_DATE_FORMAT = "2006-01-02"
+
+// Conflict - a path that was changed independently on more than one node. ConflictPath is empty when the policy
+// dropped the losing edit.
+type Conflict struct {
+	RelativePath   string
+	ConflictPath   string `json:",omitempty"`
+	LosingNode     string
+	Policy         string
+	WinningVersion VersionVector
+	LosingVersion  VersionVector
+	Detected       time.Time
+}
+
+// conflictCopyPath - where the losing edit of a path is kept. report.docx becomes
+// report (conflict from NodeB 2016-10-16).docx in the same folder.
+func conflictCopyPath(relativePath, losingNode string, modTime time.Time) string {
+	extension := filepath.Ext(relativePath)
+	base := strings.TrimSuffix(relativePath, extension)
+	return fmt.Sprintf("%s (conflict from %s %s)%s", base, losingNode, modTime.Format(CONFLICT_DATE_FORMAT), extension)
+}
+
+// newConflict - describe a conflict by the versions that won and lost
+func newConflict(relativePath, policy string, winner, loser VersionVector, loserModTime time.Time, keepLoser bool) Conflict {
+	losingNode := strings.Join(loser.NodesAhead(winner), "+")
+	if losingNode == "" {
+		losingNode = "unknown"
+	}
+
+	conflict := Conflict{RelativePath: relativePath, LosingNode: losingNode, Policy: policy, WinningVersion: winner,
+		LosingVersion: loser, Detected: time.Now()}
+	if keepLoser {
+		conflict.ConflictPath = conflictCopyPath(relativePath, losingNode, loserModTime)
+	}
+	return conflict
+}
+
+// recordConflict - add a conflict to the list waiting to be resolved. Call when inside of a lock!
+func (handler *FilesystemTracker) recordConflict(conflict Conflict) {
+	for _, existing := range handler.conflicts {
+		if existing.RelativePath == conflict.RelativePath && existing.LosingVersion.Compare(conflict.LosingVersion) == VERSION_EQUAL {
+			return
+		}
+	}
+
+	if conflict.ConflictPath != "" {
+		log.Printf("Conflict on %s (%s). The edit from %s is kept as %s", conflict.RelativePath, conflict.Policy, conflict.LosingNode, conflict.ConflictPath)
+	} else {
+		log.Printf("Conflict on %s (%s). The edit from %s is dropped", conflict.RelativePath, conflict.Policy, conflict.LosingNode)
+	}
+	handler.conflicts = append(handler.conflicts, conflict)
+	handler.scheduleStateSave()
+}
+
+// decideConflict - check if a change from another node conflicts with our edit of the path and, if it does, what the
+// policy for the path makes of it. Call when inside of a lock!
+func (handler *FilesystemTracker) decideConflict(remote EntryJSON) (resolution ConflictResolution, conflict Conflict, isConflict bool) {
+	path := remote.RelativePath
+	local, exists := handler.contents[path]
+	if !exists || local.FileInfo == nil || local.IsDir() || remote.IsDirectory || local.version.Compare(remote.Version) != VERSION_CONCURRENT {
+		return
+	}
+
+	if local.hash == nil {
+		local.hash, _, _ = cachedFileHash(filepath.Join(handler.directory, path))
+	}
+	if bytes.Equal(local.hash, remote.Hash) {
+		return
+	}
+
+	localSide := ConflictSide{Nodes: local.version.NodesAhead(remote.Version), Hash: local.hash, ModTime: local.ModTime(),
+		Size: local.Size(), Version: local.version}
+	remoteSide := ConflictSide{Nodes: remote.Version.NodesAhead(local.version), Hash: remote.Hash, ModTime: remote.ModTime,
+		Size: remote.Size, Version: remote.Version}
+
+	policy := conflictPolicyFor(path)
+	resolution = policy.Resolve(localSide, remoteSide)
+	if resolution.RemoteWins {
+		conflict = newConflict(path, policy.Name(), remote.Version, local.version, local.ModTime(), resolution.KeepLoser)
+	} else {
+		conflict = newConflict(path, policy.Name(), local.version, remote.Version, remote.ModTime, resolution.KeepLoser)
+	}
+	return resolution, conflict, true
+}
+
+// conflictCopyExists - check if the conflict copy for a conflict is already here. Call when inside of a lock!
+func (handler *FilesystemTracker) conflictCopyExists(conflict Conflict) bool {
+	_, err := os.Stat(filepath.Join(handler.directory, conflict.ConflictPath))
+	return err == nil
+}
+
+// resolveConflict - settle a change from another node that conflicts with our edit of the path. handled is true when
+// the change has been dealt with here, by putting it in place as a conflict copy or by dropping it as stale. Otherwise
+// the change replaces our edit, which has been copied aside if the policy keeps it. Call when inside of a lock!
+func (handler *FilesystemTracker) resolveConflict(remote EntryJSON, apply func(relativePath string) error) (handled bool, err error) {
+	resolution, conflict, isConflict := handler.decideConflict(remote)
+	if !isConflict {
+		return false, nil
+	}
+	handler.recordConflict(conflict)
+
+	if resolution.RemoteWins {
+		if resolution.KeepLoser {
+			err = handler.copyConflict(remote.RelativePath, conflict.ConflictPath)
+			if err != nil {
+				log.Printf("Unable to keep the conflicting copy of %s: %s", remote.RelativePath, err)
+				return true, err
+			}
+		}
+		return false, nil
+	}
+
+	if resolution.KeepLoser && !handler.conflictCopyExists(conflict) {
+		return true, apply(conflict.ConflictPath)
+	}
+	return true, TRACKER_ERROR_STALE_VERSION
+}
+
+// copyConflict - keep our edit of a path under its conflict name. The copy shows up as a new local file and is sent
+// to the other nodes from there. Call when inside of a lock!
+func (handler *FilesystemTracker) copyConflict(relativePath, conflictPath string) error {
+	source, err := os.Open(filepath.Join(handler.directory, relativePath))
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+
+	destinationPath := filepath.Join(handler.directory, conflictPath)
+	destination, err := os.OpenFile(destinationPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.ModePerm)
+	if os.IsExist(err) {
+		// Made by an earlier attempt, or already received from another node
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(destination, source)
+	closeErr := destination.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(destinationPath)
+		return err
+	}
+
+	return os.Chtimes(destinationPath, time.Now(), info.ModTime())
+}
+
+// conflictList - the conflicts waiting to be resolved, oldest first
+func (handler *FilesystemTracker) conflictList() []Conflict {
+	handler.fsLock.RLock()
+	defer handler.fsLock.RUnlock()
+
+	conflicts := make([]Conflict, len(handler.conflicts))
+	copy(conflicts, handler.conflicts)
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Detected.Before(conflicts[j].Detected) })
+	return conflicts
+}
+
+// dismissConflict - drop the conflicts for a conflict copy, or for a path, once someone has dealt with them. The files
+// themselves are left alone.
+func (handler *FilesystemTracker) dismissConflict(path string) bool {
+	handler.fsLock.Lock()
+	defer handler.fsLock.Unlock()
+
+	remaining := handler.conflicts[:0]
+	for _, conflict := range handler.conflicts {
+		if conflict.ConflictPath != path && conflict.RelativePath != path {
+			remaining = append(remaining, conflict)
+		}
+	}
+	if len(remaining) == len(handler.conflicts) {
+		return false
+	}
+
+	handler.conflicts = remaining
+	handler.scheduleStateSave()
+	return true
+}
+
+// conflictsHandler - list the conflicts on this node, or dismiss some with DELETE /conflicts/?path=<conflict copy or path>
+func conflictsHandler(w http.ResponseWriter, r *http.Request) {
+	server, exists := serverMap[globalSettings.Name]
+	if !exists || server.storage == nil {
+		http.Error(w, "Storage is not set up", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(server.storage.conflictList())
+	case "DELETE":
+		conflictPath := r.URL.Query().Get("path")
+		if !server.storage.dismissConflict(conflictPath) {
+			http.Error(w, "No such conflict", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
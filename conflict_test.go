@@ -0,0 +1,152 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// applyConflictingUpload - apply contents from another node as an upload would
+func applyConflictingUpload(tracker *FilesystemTracker, relativePath, contents string, modTime time.Time) error {
+	remote := EntryJSON{RelativePath: relativePath, Hash: []byte(contents), ModTime: modTime,
+		Version: VersionVector{"conflictBase": 1, "conflictRemote": 1}}
+	return tracker.applyRemoteChange(remote, func(targetPath string) error {
+		return ioutil.WriteFile(filepath.Join(tracker.directory, targetPath), []byte(contents), 0666)
+	})
+}
+
+// editConflictingFile - receive a file from conflictBase and edit it here, so the next change from conflictRemote
+// conflicts with our edit. Returns when our edit was made.
+func editConflictingFile(t *testing.T, tracker *FilesystemTracker, relativePath string) time.Time {
+	watchTestTracker(tracker)
+	receiveTestFile(t, tracker, relativePath, "the base", "conflictBase", VersionVector{"conflictBase": 1})
+	editTestFile(t, tracker, relativePath, "our edit")
+
+	info, err := os.Stat(filepath.Join(tracker.directory, relativePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.ModTime()
+}
+
+func TestConflictCopyPath(t *testing.T) {
+	date := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	copyPath := conflictCopyPath(filepath.Join("docs", "report.docx"), "NodeB", date)
+	if copyPath != filepath.Join("docs", "report (conflict from NodeB 2026-10-16).docx") {
+		t.Fatalf("unexpected conflict copy path: %s", copyPath)
+	}
+}
+
+func TestNewerRemoteEditKeepsLocalEditAsConflictCopy(t *testing.T) {
+	useTestSettings(t)
+	tracker := createTracker("conflictRemoteWins")
+	defer cleanupTracker(tracker)
+
+	edited := editConflictingFile(t, tracker, "report.txt")
+	err := applyConflictingUpload(tracker, "report.txt", "their edit", edited.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadFile(filepath.Join(tracker.directory, "report.txt"))
+	if string(data) != "their edit" {
+		t.Fatalf("the newer edit should keep the path. found: %s", data)
+	}
+
+	conflicts := tracker.conflictList()
+	if len(conflicts) != 1 || conflicts[0].LosingNode != globalSettings.Name {
+		t.Fatalf("expected one conflict lost by %s. conflicts: %#v", globalSettings.Name, conflicts)
+	}
+	data, err = ioutil.ReadFile(filepath.Join(tracker.directory, conflicts[0].ConflictPath))
+	if err != nil || string(data) != "our edit" {
+		t.Fatalf("our edit should be kept as %s. contents: %s err: %v", conflicts[0].ConflictPath, data, err)
+	}
+}
+
+func TestOlderRemoteEditIsKeptAsConflictCopy(t *testing.T) {
+	useTestSettings(t)
+	tracker := createTracker("conflictLocalWins")
+	defer cleanupTracker(tracker)
+
+	edited := editConflictingFile(t, tracker, "report.txt")
+	err := applyConflictingUpload(tracker, "report.txt", "their edit", edited.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadFile(filepath.Join(tracker.directory, "report.txt"))
+	if string(data) != "our edit" {
+		t.Fatalf("our newer edit should keep the path. found: %s", data)
+	}
+
+	conflicts := tracker.conflictList()
+	if len(conflicts) != 1 || conflicts[0].LosingNode != "conflictRemote" {
+		t.Fatalf("expected one conflict lost by conflictRemote. conflicts: %#v", conflicts)
+	}
+	data, err = ioutil.ReadFile(filepath.Join(tracker.directory, conflicts[0].ConflictPath))
+	if err != nil || string(data) != "their edit" {
+		t.Fatalf("their edit should be kept as %s. contents: %s err: %v", conflicts[0].ConflictPath, data, err)
+	}
+
+	// Once the copy is here, the same edit arriving again is dropped
+	err = applyConflictingUpload(tracker, "report.txt", "their edit", edited.Add(-time.Hour))
+	if err != TRACKER_ERROR_STALE_VERSION {
+		t.Fatalf("the losing edit should not be applied twice. err: %v", err)
+	}
+}
+
+func TestConflictsHandlerListsAndDismisses(t *testing.T) {
+	useTestSettings(t)
+	tracker := createTracker("conflictHandler")
+	defer cleanupTracker(tracker)
+	serverMap[globalSettings.Name] = &ReplicatServer{Name: globalSettings.Name, storage: tracker}
+
+	tracker.fsLock.Lock()
+	tracker.recordConflict(newConflict("a.txt", CONFLICT_POLICY_KEEP_BOTH, VersionVector{"nodeA": 1}, VersionVector{"nodeB": 1}, time.Now(), true))
+	tracker.fsLock.Unlock()
+
+	server := httptest.NewServer(http.HandlerFunc(conflictsHandler))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conflicts []Conflict
+	json.NewDecoder(resp.Body).Decode(&conflicts)
+	resp.Body.Close()
+	if len(conflicts) != 1 || conflicts[0].RelativePath != "a.txt" {
+		t.Fatalf("unexpected conflict list: %#v", conflicts)
+	}
+
+	request, _ := http.NewRequest("DELETE", server.URL+"?path="+url.QueryEscape(conflicts[0].ConflictPath), nil)
+	resp, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || len(tracker.conflictList()) != 0 {
+		t.Fatalf("the conflict should have been dismissed. status: %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,195 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Conflict policies are set per directory prefix in the settings, for example
+//
+//	"ConflictPolicies": {"config": "prefer-node:NodeA", "media": "keep-both"}
+//
+// The longest matching prefix applies. Paths that match nothing use keep-both.
+
+const (
+	// CONFLICT_POLICY_LAST_WRITER_WINS - The newer edit keeps the path and the other one is dropped
+	CONFLICT_POLICY_LAST_WRITER_WINS = "last-writer-wins"
+	// CONFLICT_POLICY_KEEP_BOTH - The newer edit keeps the path and the other one is kept as a conflict copy
+	CONFLICT_POLICY_KEEP_BOTH = "keep-both"
+	// CONFLICT_POLICY_PREFER_NODE - An edit made on the named node keeps the path. Written as prefer-node:NodeA
+	CONFLICT_POLICY_PREFER_NODE = "prefer-node"
+	// CONFLICT_POLICY_PREFER_LARGER - The larger file keeps the path
+	CONFLICT_POLICY_PREFER_LARGER = "prefer-larger"
+	// CONFLICT_POLICY_NEVER_OVERWRITE - A node never replaces its own edit. The other edit is kept as a conflict copy.
+	CONFLICT_POLICY_NEVER_OVERWRITE = "never-overwrite"
+	// CONFLICT_POLICY_DEFAULT - The policy for paths that no configured prefix matches
+	CONFLICT_POLICY_DEFAULT = CONFLICT_POLICY_KEEP_BOTH
+)
+
+// ConflictSide - one of two independent edits of a path
+type ConflictSide struct {
+	Nodes   []string // the nodes that made changes this side has and the other does not
+	Hash    []byte
+	ModTime time.Time
+	Size    int64
+	Version VersionVector
+}
+
+// ConflictResolution - how a conflict is settled on this node
+type ConflictResolution struct {
+	RemoteWins bool // their edit takes the path
+	KeepLoser  bool // the edit that did not get the path is kept as a conflict copy
+}
+
+// ConflictPolicy - decides between two independent edits of the same path. Every node has to reach the same decision
+// with the sides swapped, or the nodes will not agree on what the path holds. never-overwrite is the one exception.
+type ConflictPolicy interface {
+	Name() string
+	Resolve(local, remote ConflictSide) ConflictResolution
+}
+
+// newerSideWins - the newer edit wins. Equal times fall back to the contents so that every node makes the same choice.
+func newerSideWins(local, remote ConflictSide) bool {
+	if !remote.ModTime.Equal(local.ModTime) {
+		return remote.ModTime.After(local.ModTime)
+	}
+	return bytes.Compare(remote.Hash, local.Hash) > 0
+}
+
+type lastWriterWinsPolicy struct{}
+
+func (lastWriterWinsPolicy) Name() string { return CONFLICT_POLICY_LAST_WRITER_WINS }
+
+func (lastWriterWinsPolicy) Resolve(local, remote ConflictSide) ConflictResolution {
+	return ConflictResolution{RemoteWins: newerSideWins(local, remote)}
+}
+
+type keepBothPolicy struct{}
+
+func (keepBothPolicy) Name() string { return CONFLICT_POLICY_KEEP_BOTH }
+
+func (keepBothPolicy) Resolve(local, remote ConflictSide) ConflictResolution {
+	return ConflictResolution{RemoteWins: newerSideWins(local, remote), KeepLoser: true}
+}
+
+type preferNodePolicy struct {
+	node string
+}
+
+func (policy preferNodePolicy) Name() string { return CONFLICT_POLICY_PREFER_NODE + ":" + policy.node }
+
+func (policy preferNodePolicy) Resolve(local, remote ConflictSide) ConflictResolution {
+	localPreferred, remotePreferred := policy.madeBy(local), policy.madeBy(remote)
+	if localPreferred == remotePreferred {
+		// Neither edit, or both, came from the preferred node
+		return ConflictResolution{RemoteWins: newerSideWins(local, remote)}
+	}
+	return ConflictResolution{RemoteWins: remotePreferred}
+}
+
+func (policy preferNodePolicy) madeBy(side ConflictSide) bool {
+	for _, node := range side.Nodes {
+		if node == policy.node {
+			return true
+		}
+	}
+	return false
+}
+
+type preferLargerPolicy struct{}
+
+func (preferLargerPolicy) Name() string { return CONFLICT_POLICY_PREFER_LARGER }
+
+func (preferLargerPolicy) Resolve(local, remote ConflictSide) ConflictResolution {
+	if local.Size == remote.Size {
+		return ConflictResolution{RemoteWins: newerSideWins(local, remote)}
+	}
+	return ConflictResolution{RemoteWins: remote.Size > local.Size}
+}
+
+type neverOverwritePolicy struct{}
+
+func (neverOverwritePolicy) Name() string { return CONFLICT_POLICY_NEVER_OVERWRITE }
+
+func (neverOverwritePolicy) Resolve(local, remote ConflictSide) ConflictResolution {
+	return ConflictResolution{RemoteWins: false, KeepLoser: true}
+}
+
+// parseConflictPolicy - turn the name of a policy from the settings into the policy
+func parseConflictPolicy(spec string) (ConflictPolicy, error) {
+	name, argument := spec, ""
+	separator := strings.Index(spec, ":")
+	if separator >= 0 {
+		name, argument = spec[:separator], spec[separator+1:]
+	}
+
+	switch {
+	case name == CONFLICT_POLICY_PREFER_NODE && argument != "":
+		return preferNodePolicy{node: argument}, nil
+	case argument != "":
+		return nil, fmt.Errorf("conflict policy %s does not take an argument", name)
+	case name == CONFLICT_POLICY_LAST_WRITER_WINS:
+		return lastWriterWinsPolicy{}, nil
+	case name == CONFLICT_POLICY_KEEP_BOTH:
+		return keepBothPolicy{}, nil
+	case name == CONFLICT_POLICY_PREFER_LARGER:
+		return preferLargerPolicy{}, nil
+	case name == CONFLICT_POLICY_NEVER_OVERWRITE:
+		return neverOverwritePolicy{}, nil
+	}
+	return nil, fmt.Errorf("unknown conflict policy: %s", spec)
+}
+
+// validateConflictPolicies - check every configured policy can be used
+func validateConflictPolicies(policies map[string]string) error {
+	for prefix, spec := range policies {
+		_, err := parseConflictPolicy(spec)
+		if err != nil {
+			return fmt.Errorf("conflict policy for %q: %s", prefix, err)
+		}
+	}
+	return nil
+}
+
+// prefixMatches - check if a path is at or below a directory prefix. The empty prefix matches everything.
+func prefixMatches(prefix, relativePath string) bool {
+	prefix = strings.Trim(filepath.ToSlash(prefix), "/")
+	relativePath = strings.Trim(filepath.ToSlash(relativePath), "/")
+	return prefix == "" || relativePath == prefix || strings.HasPrefix(relativePath, prefix+"/")
+}
+
+// conflictPolicyFor - the policy configured for the longest prefix of a path
+func conflictPolicyFor(relativePath string) ConflictPolicy {
+	spec, longest := CONFLICT_POLICY_DEFAULT, -1
+	for prefix, configured := range globalSettings.ConflictPolicies {
+		if len(prefix) > longest && prefixMatches(prefix, relativePath) {
+			spec, longest = configured, len(prefix)
+		}
+	}
+
+	policy, err := parseConflictPolicy(spec)
+	if err != nil {
+		log.Printf("Using %s for %s: %s", CONFLICT_POLICY_DEFAULT, relativePath, err)
+		return keepBothPolicy{}
+	}
+	return policy
+}
@@ -0,0 +1,117 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConflictPoliciesAgreeOnEveryNode(t *testing.T) {
+	older := ConflictSide{Nodes: []string{"NodeA"}, Hash: []byte{1}, ModTime: time.Unix(1000, 0), Size: 500}
+	newer := ConflictSide{Nodes: []string{"NodeB"}, Hash: []byte{2}, ModTime: time.Unix(2000, 0), Size: 10}
+
+	cases := []struct {
+		spec      string
+		newerWins bool
+		keepLoser bool
+	}{
+		{CONFLICT_POLICY_LAST_WRITER_WINS, true, false},
+		{CONFLICT_POLICY_KEEP_BOTH, true, true},
+		{"prefer-node:NodeA", false, false},
+		{"prefer-node:NodeB", true, false},
+		{"prefer-node:NodeC", true, false},
+		{CONFLICT_POLICY_PREFER_LARGER, false, false},
+	}
+
+	for _, c := range cases {
+		policy, err := parseConflictPolicy(c.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The node with the older edit and the node with the newer one have to pick the same winner
+		onOlder := policy.Resolve(older, newer)
+		onNewer := policy.Resolve(newer, older)
+		if onOlder.RemoteWins != c.newerWins || onNewer.RemoteWins == c.newerWins {
+			t.Errorf("%s: nodes disagree or picked the wrong edit. on older: %#v on newer: %#v", c.spec, onOlder, onNewer)
+		}
+		if onOlder.KeepLoser != c.keepLoser || onNewer.KeepLoser != c.keepLoser {
+			t.Errorf("%s: expected keep loser %v. on older: %#v on newer: %#v", c.spec, c.keepLoser, onOlder, onNewer)
+		}
+	}
+}
+
+func TestConflictPolicyForLongestPrefix(t *testing.T) {
+	useTestSettings(t)
+	globalSettings.ConflictPolicies = map[string]string{
+		"shared":        CONFLICT_POLICY_LAST_WRITER_WINS,
+		"shared/config": "prefer-node:NodeA",
+		"media/":        CONFLICT_POLICY_NEVER_OVERWRITE,
+	}
+
+	cases := map[string]string{
+		"shared/notes.txt":       CONFLICT_POLICY_LAST_WRITER_WINS,
+		"shared/config/app.conf": "prefer-node:NodeA",
+		"shared/configs/app":     CONFLICT_POLICY_LAST_WRITER_WINS,
+		"media/song.mp3":         CONFLICT_POLICY_NEVER_OVERWRITE,
+		"mediaplayer.txt":        CONFLICT_POLICY_DEFAULT,
+		"top.txt":                CONFLICT_POLICY_DEFAULT,
+	}
+	for path, expected := range cases {
+		if name := conflictPolicyFor(path).Name(); name != expected {
+			t.Errorf("%s: expected %s got %s", path, expected, name)
+		}
+	}
+
+	if validateConflictPolicies(map[string]string{"x": "prefer-node"}) == nil {
+		t.Error("prefer-node without a node should be rejected")
+	}
+	if validateConflictPolicies(map[string]string{"x": "newest"}) == nil {
+		t.Error("an unknown policy should be rejected")
+	}
+}
+
+func TestNeverOverwriteKeepsBothEditsOnEachNode(t *testing.T) {
+	useTestSettings(t)
+	globalSettings.ConflictPolicies = map[string]string{"": CONFLICT_POLICY_NEVER_OVERWRITE}
+	tracker := createTracker("conflictNeverOverwrite")
+	defer cleanupTracker(tracker)
+
+	edited := editConflictingFile(t, tracker, "settings.ini")
+
+	// Even a newer edit does not replace ours. It is kept next to it.
+	err := applyConflictingUpload(tracker, "settings.ini", "their edit", edited.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadFile(filepath.Join(tracker.directory, "settings.ini"))
+	if string(data) != "our edit" {
+		t.Fatalf("our edit should never be overwritten. found: %s", data)
+	}
+
+	conflicts := tracker.conflictList()
+	if len(conflicts) != 1 || conflicts[0].Policy != CONFLICT_POLICY_NEVER_OVERWRITE {
+		t.Fatalf("expected one never-overwrite conflict. conflicts: %#v", conflicts)
+	}
+	data, err = ioutil.ReadFile(filepath.Join(tracker.directory, conflicts[0].ConflictPath))
+	if err != nil || string(data) != "their edit" {
+		t.Fatalf("their edit should be kept as %s. contents: %s err: %v", conflicts[0].ConflictPath, data, err)
+	}
+}
@@ -0,0 +1,595 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Delta transfers work like rsync. The receiver describes the copy it already has as a list of block signatures. The sender
+// rolls a weak checksum across its version of the file looking for those blocks and sends back a stream of instructions:
+// copy block n from the old file, or insert these literal bytes. The receiver rebuilds the file next to the old one and
+// moves it into place.
+
+const (
+	// DELTA_MIN_FILE_SIZE - Files smaller than this are always sent whole
+	DELTA_MIN_FILE_SIZE = 1 << 20
+	// DELTA_BLOCK_SIZE - Smallest block size used when signing a file
+	DELTA_BLOCK_SIZE = 64 << 10
+	// DELTA_MAX_BLOCKS - Block size grows with the file to keep the signature near this many blocks
+	DELTA_MAX_BLOCKS = 16384
+	// DELTA_STAGING_DIRECTORY - Directory under the metadata directory where files are rebuilt from a delta
+	DELTA_STAGING_DIRECTORY = "staging"
+
+	deltaMagic         = "RDLT"
+	deltaVersion       = 1
+	deltaOpCopy        = 'C'
+	deltaOpLiteral     = 'L'
+	deltaOpEnd         = 'E'
+	deltaMaxLiteralRun = 1 << 20
+)
+
+// DELTA_ERROR_BASE_CHANGED - the receiver's copy of the file changed after it sent its signature
+var DELTA_ERROR_BASE_CHANGED = errors.New("Replicat: base file changed since its signature was taken")
+
+// DELTA_ERROR_BAD_STREAM - the delta instructions could not be understood
+var DELTA_ERROR_BAD_STREAM = errors.New("Replicat: malformed delta stream")
+
+// BlockSignature - the checksums for one block of a file
+type BlockSignature struct {
+	Weak   uint32
+	Strong []byte
+}
+
+// FileSignature - the block signatures for the receiver's copy of a file along with enough information to be sure the
+// delta is applied to the same copy that was signed
+type FileSignature struct {
+	RelativePath string
+	BlockSize    int
+	Size         int64
+	ModTime      time.Time
+	Blocks       []BlockSignature
+}
+
+// deltaBlockSize - pick a block size for a file so the signature stays a manageable size
+func deltaBlockSize(size int64) int {
+	blockSize := int64(DELTA_BLOCK_SIZE)
+	for size/blockSize > DELTA_MAX_BLOCKS {
+		blockSize *= 2
+	}
+	return int(blockSize)
+}
+
+// rollingChecksum - the rsync weak checksum. It can be slid along a byte at a time without looking at the whole window.
+type rollingChecksum struct {
+	a, b   uint32
+	length uint32
+}
+
+func newRollingChecksum(window []byte) (sum rollingChecksum) {
+	sum.length = uint32(len(window))
+	for i, value := range window {
+		sum.a += uint32(value)
+		sum.b += (sum.length - uint32(i)) * uint32(value)
+	}
+	return
+}
+
+func (sum *rollingChecksum) roll(out, in byte) {
+	sum.a += uint32(in) - uint32(out)
+	sum.b += sum.a - sum.length*uint32(out)
+}
+
+func (sum *rollingChecksum) value() uint32 {
+	return (sum.a & 0xffff) | (sum.b&0xffff)<<16
+}
+
+func strongChecksum(block []byte) []byte {
+	sum := md5.Sum(block)
+	return sum[:]
+}
+
+// computeSignature - sign a file block by block
+func computeSignature(reader io.Reader, blockSize int) (blocks []BlockSignature, err error) {
+	block := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(reader, block)
+		if n > 0 {
+			weak := newRollingChecksum(block[:n])
+			blocks = append(blocks, BlockSignature{Weak: weak.value(), Strong: strongChecksum(block[:n])})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return blocks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// deltaWriter - encodes delta instructions, merging runs of consecutive block copies
+type deltaWriter struct {
+	out        *bufio.Writer
+	copyStart  int
+	copyCount  int
+	totalBytes int64
+	scratch    [binary.MaxVarintLen64]byte
+}
+
+func newDeltaWriter(out io.Writer, blockSize int) (*deltaWriter, error) {
+	writer := &deltaWriter{out: bufio.NewWriter(out)}
+	writer.out.WriteString(deltaMagic)
+	writer.out.WriteByte(deltaVersion)
+	writer.writeNumber(uint64(blockSize))
+	return writer, nil
+}
+
+func (writer *deltaWriter) writeNumber(value uint64) {
+	n := binary.PutUvarint(writer.scratch[:], value)
+	writer.out.Write(writer.scratch[:n])
+}
+
+func (writer *deltaWriter) flushCopy() {
+	if writer.copyCount == 0 {
+		return
+	}
+	writer.out.WriteByte(deltaOpCopy)
+	writer.writeNumber(uint64(writer.copyStart))
+	writer.writeNumber(uint64(writer.copyCount))
+	writer.copyCount = 0
+}
+
+func (writer *deltaWriter) copyBlock(index int, length int) {
+	writer.totalBytes += int64(length)
+	if writer.copyCount > 0 && writer.copyStart+writer.copyCount == index {
+		writer.copyCount++
+		return
+	}
+	writer.flushCopy()
+	writer.copyStart = index
+	writer.copyCount = 1
+}
+
+func (writer *deltaWriter) literal(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	writer.flushCopy()
+	writer.totalBytes += int64(len(data))
+	writer.out.WriteByte(deltaOpLiteral)
+	writer.writeNumber(uint64(len(data)))
+	_, err := writer.out.Write(data)
+	return err
+}
+
+func (writer *deltaWriter) close() error {
+	writer.flushCopy()
+	writer.out.WriteByte(deltaOpEnd)
+	writer.writeNumber(uint64(writer.totalBytes))
+	return writer.out.Flush()
+}
+
+// computeDelta - compare a new version of a file against the signature of an old one and write the instructions needed
+// to rebuild the new version from the old. Memory use is bounded by a few blocks regardless of the file size.
+func computeDelta(signature FileSignature, reader io.Reader, out io.Writer) error {
+	blockSize := signature.BlockSize
+	if blockSize <= 0 {
+		return DELTA_ERROR_BAD_STREAM
+	}
+
+	writer, err := newDeltaWriter(out, blockSize)
+	if err != nil {
+		return err
+	}
+
+	// Only full size blocks can be found by the rolling window. A short last block is checked for at the end.
+	weakIndex := make(map[uint32][]int, len(signature.Blocks))
+	lastBlockLength := int(signature.Size % int64(blockSize))
+	for index, block := range signature.Blocks {
+		if index == len(signature.Blocks)-1 && lastBlockLength != 0 {
+			continue
+		}
+		weakIndex[block.Weak] = append(weakIndex[block.Weak], index)
+	}
+
+	findBlock := func(weak uint32, window []byte) int {
+		candidates, exists := weakIndex[weak]
+		if !exists {
+			return -1
+		}
+		strong := strongChecksum(window)
+		for _, index := range candidates {
+			if bytes.Equal(strong, signature.Blocks[index].Strong) {
+				return index
+			}
+		}
+		return -1
+	}
+
+	input := bufio.NewReaderSize(reader, blockSize)
+
+	// buffer holds unmatched literal bytes followed by the current window
+	buffer := make([]byte, 0, blockSize+deltaMaxLiteralRun)
+	fill := func() error {
+		start := len(buffer)
+		buffer = buffer[:start+blockSize]
+		n, err := io.ReadFull(input, buffer[start:])
+		buffer = buffer[:start+n]
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return err
+	}
+
+	err = fill()
+	for err == nil {
+		sum := newRollingChecksum(buffer[len(buffer)-blockSize:])
+		for {
+			windowStart := len(buffer) - blockSize
+			if index := findBlock(sum.value(), buffer[windowStart:]); index >= 0 {
+				if err = writer.literal(buffer[:windowStart]); err != nil {
+					return err
+				}
+				writer.copyBlock(index, blockSize)
+				buffer = buffer[:0]
+				break
+			}
+
+			var next byte
+			next, err = input.ReadByte()
+			if err != nil {
+				break
+			}
+			out := buffer[windowStart]
+			buffer = append(buffer, next)
+			sum.roll(out, next)
+
+			// Keep the literal run bounded by sending it along and sliding the window back to the front
+			if len(buffer)-blockSize >= deltaMaxLiteralRun {
+				literalLength := len(buffer) - blockSize
+				if err = writer.literal(buffer[:literalLength]); err != nil {
+					return err
+				}
+				copy(buffer, buffer[literalLength:])
+				buffer = buffer[:blockSize]
+			}
+		}
+
+		if err == nil {
+			err = fill()
+		}
+	}
+	if err != io.EOF {
+		return err
+	}
+
+	// Whatever is left is literal, except possibly the short last block of the old file
+	if lastBlockLength != 0 && len(buffer) >= lastBlockLength {
+		lastIndex := len(signature.Blocks) - 1
+		tail := buffer[len(buffer)-lastBlockLength:]
+		if bytes.Equal(strongChecksum(tail), signature.Blocks[lastIndex].Strong) {
+			if err = writer.literal(buffer[:len(buffer)-lastBlockLength]); err != nil {
+				return err
+			}
+			writer.copyBlock(lastIndex, lastBlockLength)
+			buffer = buffer[:0]
+		}
+	}
+
+	if err = writer.literal(buffer); err != nil {
+		return err
+	}
+
+	return writer.close()
+}
+
+// applyDelta - rebuild a file from the old copy and a delta stream. Returns the number of bytes written.
+func applyDelta(base io.ReaderAt, delta io.Reader, out io.Writer) (written int64, err error) {
+	input := bufio.NewReader(delta)
+
+	header := make([]byte, len(deltaMagic)+1)
+	_, err = io.ReadFull(input, header)
+	if err != nil || string(header[:len(deltaMagic)]) != deltaMagic || header[len(deltaMagic)] != deltaVersion {
+		return 0, DELTA_ERROR_BAD_STREAM
+	}
+
+	blockSize, err := binary.ReadUvarint(input)
+	if err != nil || blockSize == 0 {
+		return 0, DELTA_ERROR_BAD_STREAM
+	}
+
+	for {
+		op, err := input.ReadByte()
+		if err != nil {
+			return written, DELTA_ERROR_BAD_STREAM
+		}
+
+		switch op {
+		case deltaOpCopy:
+			start, err1 := binary.ReadUvarint(input)
+			count, err2 := binary.ReadUvarint(input)
+			if err1 != nil || err2 != nil {
+				return written, DELTA_ERROR_BAD_STREAM
+			}
+			n, err := io.Copy(out, io.NewSectionReader(base, int64(start*blockSize), int64(count*blockSize)))
+			written += n
+			if err != nil {
+				return written, err
+			}
+		case deltaOpLiteral:
+			length, err := binary.ReadUvarint(input)
+			if err != nil {
+				return written, DELTA_ERROR_BAD_STREAM
+			}
+			n, err := io.CopyN(out, input, int64(length))
+			written += n
+			if err != nil {
+				return written, DELTA_ERROR_BAD_STREAM
+			}
+		case deltaOpEnd:
+			expected, err := binary.ReadUvarint(input)
+			if err != nil || int64(expected) != written {
+				return written, DELTA_ERROR_BAD_STREAM
+			}
+			return written, nil
+		default:
+			return written, DELTA_ERROR_BAD_STREAM
+		}
+	}
+}
+
+// signatureHandler - sign our copy of a file so the sender can work out a delta against it
+func signatureHandler(w http.ResponseWriter, r *http.Request) {
+	relativePath, validPath := cleanRelativePath(r.URL.Query().Get("path"))
+	if !validPath {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	lock := lockUpload(relativePath)
+	defer lock.Unlock()
+
+	file, err := os.Open(filepath.Join(globalSettings.Directory, relativePath))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	signature := FileSignature{RelativePath: relativePath, BlockSize: deltaBlockSize(info.Size()), Size: info.Size(), ModTime: info.ModTime()}
+	signature.Blocks, err = computeSignature(file, signature.BlockSize)
+	if err != nil {
+		log.Printf("Error signing %s: %s", relativePath, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(signature)
+}
+
+// receiveDelta - rebuild a file from a streamed delta next to the old copy, then move it into place
+func receiveDelta(w http.ResponseWriter, part *multipart.Part, fields map[string]string) error {
+	relativePath, validPath := cleanRelativePath(fields["PATH"])
+	baseSize, err1 := strconv.ParseInt(fields["BASESIZE"], 10, 64)
+	baseModTime, err2 := strconv.ParseInt(fields["BASEMODTIME"], 10, 64)
+	if !validPath || err1 != nil || err2 != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return fmt.Errorf("delta for (%s) is missing its base information or has a bad path", fields["PATH"])
+	}
+
+	lock := lockUpload(relativePath)
+	defer lock.Unlock()
+
+	if uploadCancelled(relativePath) {
+		w.WriteHeader(http.StatusGone)
+		return TRANSFER_ERROR_CANCELLED
+	}
+
+	fullPath := filepath.Join(globalSettings.Directory, relativePath)
+	base, err := os.Open(fullPath)
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		return DELTA_ERROR_BASE_CHANGED
+	}
+	defer base.Close()
+
+	info, err := base.Stat()
+	if err != nil || info.Size() != baseSize || info.ModTime().UnixNano() != baseModTime {
+		w.WriteHeader(http.StatusConflict)
+		return DELTA_ERROR_BASE_CHANGED
+	}
+
+	key := md5.Sum([]byte(relativePath))
+	stagingPath := metadataPath(DELTA_STAGING_DIRECTORY, hex.EncodeToString(key[:]))
+	err = os.MkdirAll(filepath.Dir(stagingPath), os.ModeDir+os.ModePerm)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return err
+	}
+
+	staging, err := os.OpenFile(stagingPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return err
+	}
+
+	written, err := applyDelta(base, part, staging)
+	if err == nil {
+		err = staging.Sync()
+	}
+	closeErr := staging.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Printf("Error applying delta to %s after %d bytes: %s", relativePath, written, err)
+		os.Remove(stagingPath)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 - Error applying delta"))
+		return err
+	}
+
+	err = finishUpload(relativePath, stagingPath, "", fields["HASH"], fields["EntryJSON"])
+	if err == UPLOAD_ERROR_HASH_MISMATCH {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return err
+	} else if err == TRANSFER_ERROR_CANCELLED {
+		w.WriteHeader(http.StatusGone)
+		return err
+	} else if err != nil {
+		os.Remove(stagingPath)
+		w.WriteHeader(http.StatusInternalServerError)
+		return err
+	}
+
+	fmt.Printf("Rebuilt (%s) from delta. bytes (%d)", relativePath, written)
+	json.NewEncoder(w).Encode(UploadStatus{RelativePath: relativePath, Offset: written, Complete: true})
+	return nil
+}
+
+// querySignature - ask the receiving node for the signature of its copy of a file. found is false when it has no copy.
+func querySignature(filename, address, credentials string) (signature FileSignature, found bool, err error) {
+	values := url.Values{}
+	values.Set("path", filename)
+	values.Set("signature", "true")
+
+	req, err := http.NewRequest("GET", address+"?"+values.Encode(), nil)
+	if err != nil {
+		return
+	}
+
+	data := []byte(credentials)
+	authHash := base64.StdEncoding.EncodeToString(data)
+	req.Header.Add("Authorization", "Basic "+authHash)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = json.NewDecoder(resp.Body).Decode(&signature)
+		found = err == nil
+	case http.StatusNotFound:
+	default:
+		err = fmt.Errorf("signature request for %s returned %s", filename, resp.Status)
+	}
+
+	return
+}
+
+// postFileDelta - send only the changes between our copy of a file and the receiver's copy
+func postFileDelta(filename string, file *os.File, signature FileSignature, entryString, hash, address, credentials string) error {
+	fields := [][2]string{
+		{"EntryJSON", entryString},
+		{"HASH", hash},
+		{"PATH", filename},
+		{"BASESIZE", strconv.FormatInt(signature.Size, 10)},
+		{"BASEMODTIME", strconv.FormatInt(signature.ModTime.UnixNano(), 10)},
+	}
+
+	_, err := file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	bodyWriter := multipart.NewWriter(pipeWriter)
+	contentType := bodyWriter.FormDataContentType()
+
+	go func() {
+		pipeWriter.CloseWithError(writeMultipartDelta(bodyWriter, filename, file, signature, fields))
+	}()
+
+	req, err := http.NewRequest("POST", address, pipeReader)
+	if err != nil {
+		pipeReader.CloseWithError(err)
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	data := []byte(credentials)
+	authHash := base64.StdEncoding.EncodeToString(data)
+	req.Header.Add("Authorization", "Basic "+authHash)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		pipeReader.CloseWithError(err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		return DELTA_ERROR_BASE_CHANGED
+	case http.StatusUnprocessableEntity:
+		return UPLOAD_ERROR_HASH_MISMATCH
+	case http.StatusGone:
+		return TRANSFER_ERROR_CANCELLED
+	default:
+		return fmt.Errorf("delta for %s returned %s", filename, resp.Status)
+	}
+}
+
+func writeMultipartDelta(bodyWriter *multipart.Writer, filename string, file io.Reader, signature FileSignature, fields [][2]string) error {
+	for _, field := range fields {
+		err := bodyWriter.WriteField(field[0], field[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	deltaWriter, err := bodyWriter.CreateFormFile("deltafile", filename)
+	if err != nil {
+		return err
+	}
+
+	err = computeDelta(signature, file, deltaWriter)
+	if err != nil {
+		return err
+	}
+
+	return bodyWriter.Close()
+}
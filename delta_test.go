@@ -0,0 +1,110 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// deltaRoundTrip - sign the old contents, compute a delta to the new contents and rebuild. Returns the delta size.
+func deltaRoundTrip(t *testing.T, oldContents, newContents []byte, blockSize int) int {
+	blocks, err := computeSignature(bytes.NewReader(oldContents), blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := FileSignature{BlockSize: blockSize, Size: int64(len(oldContents)), Blocks: blocks}
+
+	delta := &bytes.Buffer{}
+	err = computeDelta(signature, bytes.NewReader(newContents), delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deltaSize := delta.Len()
+
+	rebuilt := &bytes.Buffer{}
+	written, err := applyDelta(bytes.NewReader(oldContents), delta, rebuilt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != int64(len(newContents)) || !bytes.Equal(rebuilt.Bytes(), newContents) {
+		t.Fatalf("rebuilt file does not match. expected %d bytes, got %d", len(newContents), written)
+	}
+
+	return deltaSize
+}
+
+func randomBytes(size int) []byte {
+	data := make([]byte, size)
+	rand.Read(data)
+	return data
+}
+
+func TestDeltaRoundTrips(t *testing.T) {
+	blockSize := 1024
+	original := randomBytes(50*blockSize + 300)
+
+	changed := append([]byte{}, original...)
+	copy(changed[10*blockSize+5:], []byte("a few changed bytes"))
+
+	inserted := append(append(append([]byte{}, original[:20*blockSize+17]...), randomBytes(999)...), original[20*blockSize+17:]...)
+	removed := append(append([]byte{}, original[:3*blockSize]...), original[7*blockSize+11:]...)
+	appended := append(append([]byte{}, original...), randomBytes(5000)...)
+
+	cases := map[string][]byte{
+		"unchanged": original,
+		"changed":   changed,
+		"inserted":  inserted,
+		"removed":   removed,
+		"appended":  appended,
+		"truncated": original[:blockSize/2],
+		"empty":     {},
+		"unrelated": randomBytes(len(original)),
+	}
+
+	for name, newContents := range cases {
+		deltaSize := deltaRoundTrip(t, original, newContents, blockSize)
+		t.Logf("%s: %d bytes of delta for %d bytes of file", name, deltaSize, len(newContents))
+
+		if name == "unchanged" || name == "changed" || name == "inserted" || name == "removed" {
+			if deltaSize > 3*blockSize {
+				t.Fatalf("%s: delta of %d bytes is too large for a small change", name, deltaSize)
+			}
+		}
+	}
+
+	// An empty original can only produce literals
+	deltaRoundTrip(t, []byte{}, original, blockSize)
+}
+
+func TestDeltaRejectsCorruptStream(t *testing.T) {
+	original := randomBytes(4096)
+	blocks, _ := computeSignature(bytes.NewReader(original), 512)
+	signature := FileSignature{BlockSize: 512, Size: int64(len(original)), Blocks: blocks}
+
+	delta := &bytes.Buffer{}
+	err := computeDelta(signature, bytes.NewReader(original), delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	truncated := delta.Bytes()[:delta.Len()-1]
+	_, err = applyDelta(bytes.NewReader(original), bytes.NewReader(truncated), &bytes.Buffer{})
+	if err == nil {
+		t.Fatal("a truncated delta should not apply cleanly")
+	}
+}
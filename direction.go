@@ -0,0 +1,263 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// The direction of each folder is set per directory prefix in the settings, for example
+//
+//	"FolderDirections": {"artifacts": "send-only", "signage": "receive-only"}
+//
+// The longest matching prefix applies, and paths that match nothing are two-way. A send-only folder publishes its
+// changes and ignores everything that comes from other nodes. A receive-only folder takes every change from other
+// nodes and publishes none of its own. A change made in it here is flagged as divergent instead, and stays until it
+// is reverted, which brings back what the other nodes have.
+
+const (
+	// FOLDER_DIRECTION_TWO_WAY - Changes go out and come in
+	FOLDER_DIRECTION_TWO_WAY = "two-way"
+	// FOLDER_DIRECTION_SEND_ONLY - Changes go out. Changes from other nodes are ignored.
+	FOLDER_DIRECTION_SEND_ONLY = "send-only"
+	// FOLDER_DIRECTION_RECEIVE_ONLY - Changes come in. Changes made here are flagged as divergent and not sent.
+	FOLDER_DIRECTION_RECEIVE_ONLY = "receive-only"
+)
+
+// FolderDirection - which way changes flow for a folder
+type FolderDirection string
+
+// sends - check if changes made here go out to other nodes
+func (direction FolderDirection) sends() bool {
+	return direction != FOLDER_DIRECTION_RECEIVE_ONLY
+}
+
+// receives - check if changes from other nodes are applied here
+func (direction FolderDirection) receives() bool {
+	return direction != FOLDER_DIRECTION_SEND_ONLY
+}
+
+// validateFolderDirections - check every configured direction is one we know
+func validateFolderDirections(directions map[string]string) error {
+	for prefix, direction := range directions {
+		switch direction {
+		case FOLDER_DIRECTION_TWO_WAY, FOLDER_DIRECTION_SEND_ONLY, FOLDER_DIRECTION_RECEIVE_ONLY:
+		default:
+			return fmt.Errorf("folder direction for %q: unknown direction %q", prefix, direction)
+		}
+	}
+	return nil
+}
+
+// folderDirectionFor - the direction configured for the longest prefix of a path
+func folderDirectionFor(relativePath string) FolderDirection {
+	direction, longest := FOLDER_DIRECTION_TWO_WAY, -1
+	for prefix, configured := range globalSettings.FolderDirections {
+		if len(prefix) > longest && prefixMatches(prefix, relativePath) {
+			direction, longest = configured, len(prefix)
+		}
+	}
+	return FolderDirection(direction)
+}
+
+// receivesEvent - check if an event from another node touches only folders that take changes from other nodes. Events
+// that are not about a path always do.
+func receivesEvent(event Event) bool {
+	if event.Path != "" && !folderDirectionFor(event.Path).receives() {
+		return false
+	}
+	return event.SourcePath == "" || folderDirectionFor(event.SourcePath).receives()
+}
+
+// Divergence - a change made here in a receive-only folder. It is not sent to the other nodes.
+type Divergence struct {
+	RelativePath string
+	Deleted      bool // the change was a delete
+	Detected     time.Time
+}
+
+// flagDivergence - remember a change made here if it is in a receive-only folder, and report whether it was. Call when
+// inside of a lock!
+func (handler *FilesystemTracker) flagDivergence(relativePath string, deleted bool) bool {
+	if relativePath == "" || folderDirectionFor(relativePath).sends() {
+		return false
+	}
+
+	_, known := handler.divergent[relativePath]
+	if !known {
+		log.Printf("%s was changed here in a receive-only folder. Not sending it", relativePath)
+	}
+	handler.divergent[relativePath] = Divergence{RelativePath: relativePath, Deleted: deleted, Detected: time.Now()}
+	handler.scheduleStateSave()
+	return true
+}
+
+// shouldPublish - check if a change made here goes out to the other nodes. Changes in receive-only folders are
+// flagged as divergent instead, and a tripped outgoing breaker holds deletes and modifications. Call when inside of a
+// lock!
+func (handler *FilesystemTracker) shouldPublish(event Event) bool {
+	change := BREAKER_CHANGE_CREATE
+	switch event.Name {
+	case "notify.Remove":
+		change = BREAKER_CHANGE_DELETE
+	case "notify.Write", METADATA_EVENT:
+		change = BREAKER_CHANGE_MODIFY
+	}
+
+	held := handler.holdLocalChange(event.Path, change)
+	if handler.holdLocalChange(event.SourcePath, BREAKER_CHANGE_DELETE) {
+		held = true
+	}
+	return !held
+}
+
+// isDivergent - check if a path has a change of ours that is not sent to the other nodes. Call when inside of a lock!
+func (handler *FilesystemTracker) isDivergent(relativePath string) bool {
+	_, divergent := handler.divergent[relativePath]
+	return divergent
+}
+
+// clearDivergence - a change from another node has replaced ours. Call when inside of a lock!
+func (handler *FilesystemTracker) clearDivergence(relativePath string) {
+	_, divergent := handler.divergent[relativePath]
+	if divergent {
+		delete(handler.divergent, relativePath)
+		handler.scheduleStateSave()
+	}
+}
+
+// divergenceList - the changes made here in receive-only folders, oldest first
+func (handler *FilesystemTracker) divergenceList() []Divergence {
+	handler.fsLock.RLock()
+	defer handler.fsLock.RUnlock()
+
+	divergences := make([]Divergence, 0, len(handler.divergent))
+	for _, divergence := range handler.divergent {
+		divergences = append(divergences, divergence)
+	}
+	sort.Slice(divergences, func(i, j int) bool { return divergences[i].Detected.Before(divergences[j].Detected) })
+	return divergences
+}
+
+// revertDivergence - throw away a change made here in a receive-only folder and get what the other nodes have. A
+// path that only ever existed here is moved to the trash. Otherwise our version is dropped so that theirs replaces it.
+func (handler *FilesystemTracker) revertDivergence(relativePath string) bool {
+	handler.fsLock.Lock()
+	_, divergent := handler.divergent[relativePath]
+	if !divergent {
+		handler.fsLock.Unlock()
+		return false
+	}
+
+	delete(handler.divergent, relativePath)
+	handler.revertLocalChange(relativePath)
+	handler.fsLock.Unlock()
+
+	handler.merkleLock.Lock()
+	handler.merkle = nil
+	handler.merkleLock.Unlock()
+
+	handler.resyncWithPeers()
+	return true
+}
+
+// revertLocalChange - throw away a change made here so that what the other nodes have replaces it. Call when inside
+// of a lock!
+func (handler *FilesystemTracker) revertLocalChange(relativePath string) {
+	log.Printf("Reverting the change made here to %s", relativePath)
+	entry, exists := handler.contents[relativePath]
+	if exists && entry.FileInfo != nil {
+		if len(entry.version.NodesAhead(VersionVector{globalSettings.Name: entry.version[globalSettings.Name]})) == 0 {
+			// Nothing but us ever changed it. The tombstone is only there so deleting it is not taken as a change.
+			delete(handler.contents, relativePath)
+			handler.addTombstone(Tombstone{RelativePath: relativePath, IsDirectory: entry.IsDir(), Deleted: time.Now(),
+				Origin: globalSettings.Name, Version: entry.version})
+			err := handler.moveToTrash(relativePath, globalSettings.Name)
+			if err != nil {
+				log.Printf("Unable to move %s to the trash: %s", relativePath, err)
+			}
+		} else {
+			entry.version = nil
+			handler.contents[relativePath] = entry
+		}
+	} else {
+		handler.clearTombstone(relativePath)
+	}
+	handler.recordChange(relativePath)
+}
+
+// resyncWithPeers - compare with every other node in the background. waitForResync waits for the comparisons started
+// here to finish.
+func (handler *FilesystemTracker) resyncWithPeers() {
+	handler.resyncs.Add(1)
+	go func() {
+		defer handler.resyncs.Done()
+		handler.compareWithPeers()
+	}()
+}
+
+// waitForResync - wait for the comparisons started by resyncWithPeers. Call when outside of the lock!
+func (handler *FilesystemTracker) waitForResync() {
+	handler.resyncs.Wait()
+}
+
+// compareWithPeers - walk the tree of every other node for anything we need from them
+func (handler *FilesystemTracker) compareWithPeers() {
+	peers := make(map[string]string)
+	serverMapLock.RLock()
+	for name, server := range serverMap {
+		if name != globalSettings.Name && server.Address != "" {
+			peers[name] = server.Address
+		}
+	}
+	serverMapLock.RUnlock()
+
+	for name, address := range peers {
+		walk := &merkleWalk{handler: handler, remoteServer: name, address: address, tree: handler.merkleSnapshot(), pending: []string{""}}
+		count, err := handler.processCatalogSource(name, walk)
+		log.Printf("compareWithPeers: %d entries differ from %s. err: %v", count, name, err)
+	}
+}
+
+// divergentHandler - list the changes made here in receive-only folders, or throw one away with
+// DELETE /divergent/?path=<path>
+func divergentHandler(w http.ResponseWriter, r *http.Request) {
+	server, exists := serverMap[globalSettings.Name]
+	if !exists || server.storage == nil {
+		http.Error(w, "Storage is not set up", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(server.storage.divergenceList())
+	case "DELETE":
+		relativePath := r.URL.Query().Get("path")
+		if !server.storage.revertDivergence(relativePath) {
+			http.Error(w, "No such divergent path", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,155 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFolderDirectionFor(t *testing.T) {
+	useTestSettings(t)
+	globalSettings.FolderDirections = map[string]string{"out": FOLDER_DIRECTION_SEND_ONLY, "in": FOLDER_DIRECTION_RECEIVE_ONLY,
+		"in/shared": FOLDER_DIRECTION_TWO_WAY}
+	cases := map[string]FolderDirection{
+		"out/a.txt":          FOLDER_DIRECTION_SEND_ONLY,
+		"outside.txt":        FOLDER_DIRECTION_TWO_WAY,
+		"in":                 FOLDER_DIRECTION_RECEIVE_ONLY,
+		"in/a/b.txt":         FOLDER_DIRECTION_RECEIVE_ONLY,
+		"in/shared/c.txt":    FOLDER_DIRECTION_TWO_WAY,
+		"elsewhere/in/d.txt": FOLDER_DIRECTION_TWO_WAY,
+	}
+	for path, expected := range cases {
+		if direction := folderDirectionFor(path); direction != expected {
+			t.Errorf("%s should be %s, not %s", path, expected, direction)
+		}
+	}
+
+	if receivesEvent(Event{Name: "notify.Rename", Path: "outside.txt", SourcePath: "out/a.txt"}) {
+		t.Error("a rename out of a send-only folder should not be taken")
+	}
+	if validateFolderDirections(map[string]string{"x": "sideways"}) == nil {
+		t.Error("an unknown direction should be rejected")
+	}
+}
+
+func TestSendOnlyFolderIgnoresRemoteChanges(t *testing.T) {
+	useTestSettings(t)
+	globalSettings.FolderDirections = map[string]string{"out": FOLDER_DIRECTION_SEND_ONLY}
+
+	tracker := createTracker("sendOnlyTracker")
+	defer cleanupTracker(tracker)
+	globalSettings.Directory = tracker.directory
+	tracker.CreatePath("out", true)
+	watchTestTracker(tracker)
+
+	kept := editTestFile(t, tracker, "out/kept.txt", "out/kept.txt")
+	seen := kept.Increment("sendOnlyPeer")
+	tracker.ProcessCatalog(catalogEvent(t, "sendOnlyPeer",
+		EntryJSON{RelativePath: "out/new.txt", ModTime: time.Now(), Hash: []byte{1}, Size: 1, Version: VersionVector{"sendOnlyPeer": 1}},
+		EntryJSON{RelativePath: "other.txt", ModTime: time.Now(), Hash: []byte{2}, Size: 1, Version: VersionVector{"sendOnlyPeer": 1}},
+		EntryJSON{RelativePath: "out/kept.txt", ModTime: time.Now(), Deleted: true, Origin: "sendOnlyPeer", Version: seen}))
+
+	tracker.fsLock.RLock()
+	_, sendOnlyNeeded := tracker.neededFiles["out/new.txt"]
+	_, needed := tracker.neededFiles["other.txt"]
+	_, deleted := tracker.tombstones["out/kept.txt"]
+	tracker.fsLock.RUnlock()
+	if sendOnlyNeeded || !needed || deleted {
+		t.Fatalf("only changes outside of the send-only folder should be taken. out/new.txt: %v other.txt: %v out/kept.txt deleted: %v",
+			sendOnlyNeeded, needed, deleted)
+	}
+
+	err := tracker.applyRemoteChange(EntryJSON{RelativePath: "out/kept.txt", Version: seen},
+		func(string) error {
+			t.Error("a change in a send-only folder should not be applied")
+			return nil
+		})
+	if err != TRACKER_ERROR_STALE_VERSION {
+		t.Fatalf("a change in a send-only folder should be turned away. err: %v", err)
+	}
+}
+
+func TestReceiveOnlyFolderFlagsAndRevertsLocalChanges(t *testing.T) {
+	useTestSettings(t)
+	globalSettings.FolderDirections = map[string]string{"in": FOLDER_DIRECTION_RECEIVE_ONLY}
+
+	tracker := createTracker("receiveOnlyTracker")
+	defer cleanupTracker(tracker)
+	globalSettings.Directory = tracker.directory
+
+	// The folder came from the other nodes. One file in it only ever existed here, one was edited here after it
+	// arrived and one was edited on both sides.
+	tracker.CreatePath("in", true)
+	watchTestTracker(tracker)
+	receiveTestFile(t, tracker, "in/edited.txt", "in/edited.txt", "receiveOnlyPeer", VersionVector{"receiveOnlyPeer": 1})
+	receiveTestFile(t, tracker, "in/both.txt", "in/both.txt", "receiveOnlyPeer", VersionVector{"receiveOnlyPeer": 1})
+	editTestFile(t, tracker, "in/mine.txt", "mine")
+	editTestFile(t, tracker, "in/edited.txt", "edited here")
+	editTestFile(t, tracker, "in/both.txt", "edited on both sides")
+	editTestFile(t, tracker, "out.txt", "out.txt")
+
+	tracker.fsLock.Lock()
+	publish := map[string]bool{}
+	for _, path := range []string{"in/mine.txt", "in/edited.txt", "in/both.txt", "out.txt"} {
+		publish[path] = tracker.shouldPublish(Event{Name: "notify.Write", Path: path})
+	}
+	tree := tracker.buildMerkleTree()
+	tracker.fsLock.Unlock()
+	if publish["in/mine.txt"] || publish["in/edited.txt"] || !publish["out.txt"] {
+		t.Fatalf("only changes outside of the receive-only folder should be sent: %v", publish)
+	}
+	if _, found := tree[merklePath("in/mine.txt")]; found {
+		t.Fatal("a divergent change should not be in the catalog")
+	}
+	if len(tracker.divergenceList()) != 3 {
+		t.Fatalf("every change in the receive-only folder should be flagged: %v", tracker.divergenceList())
+	}
+
+	// Their concurrent edit replaces ours without a conflict
+	tracker.ProcessCatalog(catalogEvent(t, "receiveOnlyPeer",
+		EntryJSON{RelativePath: "in/both.txt", ModTime: time.Now().Add(-time.Hour), Hash: []byte{3}, Size: 1,
+			Version: VersionVector{"receiveOnlyPeer": 2}}))
+	tracker.fsLock.RLock()
+	_, needed := tracker.neededFiles["in/both.txt"]
+	conflicts := len(tracker.conflicts)
+	tracker.fsLock.RUnlock()
+	if !needed || conflicts != 0 {
+		t.Fatalf("a remote edit should win in a receive-only folder. needed: %v conflicts: %d", needed, conflicts)
+	}
+
+	if !tracker.revertDivergence("in/mine.txt") || !tracker.revertDivergence("in/edited.txt") {
+		t.Fatal("divergent changes should be revertible")
+	}
+	if tracker.revertDivergence("out.txt") {
+		t.Fatal("a change outside of the receive-only folder is not divergent")
+	}
+	tracker.waitForResync()
+
+	_, err := os.Stat(filepath.Join(tracker.directory, "in/mine.txt"))
+	tracker.fsLock.RLock()
+	edited := tracker.contents["in/edited.txt"]
+	_, stillFlagged := tracker.divergent["in/edited.txt"]
+	tracker.fsLock.RUnlock()
+	if !os.IsNotExist(err) {
+		t.Fatalf("a file that only existed here should be removed by a revert. err: %v", err)
+	}
+	if len(edited.version) != 0 || stillFlagged {
+		t.Fatalf("a reverted edit should give way to any version from the other nodes: %s (flagged: %v)", edited.version, stillFlagged)
+	}
+}
@@ -135,47 +135,41 @@ func checkForChanges(originalState, newState DirTreeMap) (changed bool, updatedS
 
 func scanDirectoryContents() (DirTreeMap, error) {
 	fmt.Println("scanning directory contents - start")
-	pendingPaths := make([]string, 0, 100)
-	pendingPaths = append(pendingPaths, globalSettings.Directory)
 	listOfFileInfo := make(DirTreeMap)
 
-	for len(pendingPaths) > 0 {
-		currentPath := pendingPaths[0]
-		// Strip off of the base path before adding it to the list of folders
-		//paths = append(paths, currentPath[len(globalSettings.Directory)+1:])
-		fileList := make([]string, 0, 100)
-		//fileList := make([]os.FileInfo, 0, 100)
-		pendingPaths = pendingPaths[1:]
-
-		// Read the directories in the path
-		f, err := os.Open(currentPath)
+	var scanErr error
+	walker := newDirectoryWalker(globalSettings.Directory, []string{""}, false)
+	err := walker.run(func(relativeDirectory string, dirEntries []os.FileInfo, err error) ([]string, bool) {
 		if err != nil {
-			return nil, err
+			scanErr = err
+			return nil, false
 		}
-		dirEntries, err := f.Readdir(-1)
+
+		fileList := make([]string, 0, 100)
+		subdirectories := make([]string, 0)
 		for _, entry := range dirEntries {
 			if entry.IsDir() {
-				newDirectory := filepath.Join(currentPath, entry.Name())
-				pendingPaths = append(pendingPaths, newDirectory)
+				newDirectory := filepath.Join(relativeDirectory, entry.Name())
+				if isMetadataPath(newDirectory) {
+					continue
+				}
+				subdirectories = append(subdirectories, newDirectory)
 			} else {
 				fileList = append(fileList, entry.Name())
 			}
 		}
-		f.Close()
-		if err != nil {
-			return nil, err
-		}
 
 		sort.Strings(fileList)
 
-		// Strip the base path off of the current path
 		// make sure all of the paths are still '/' prefixed
-		relativePath := currentPath[len(globalSettings.Directory):]
-		if relativePath == "" {
-			relativePath = "/"
-		}
-
-		listOfFileInfo[relativePath] = fileList
+		listOfFileInfo["/"+relativeDirectory] = fileList
+		return subdirectories, true
+	})
+	if err == nil {
+		err = scanErr
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	fmt.Println("scanning directory contents - end")
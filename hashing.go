@@ -0,0 +1,254 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/blake2b"
+	"hash"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Every content hash in replicat (catalog entries, upload verification, duplicate detection) comes from here so that
+// hashes computed on different nodes and in different places can always be compared with each other.
+
+const (
+	// HASH_ALGORITHM_BLAKE2B - 256 bit BLAKE2b, the default
+	HASH_ALGORITHM_BLAKE2B = "blake2b"
+	// HASH_ALGORITHM_SHA256 - SHA-256
+	HASH_ALGORITHM_SHA256 = "sha256"
+	// HASH_ALGORITHM_MD5 - MD5. Fast, but only suitable for detecting accidental changes
+	HASH_ALGORITHM_MD5 = "md5"
+	// CONTENT_HASH_WORKERS - Number of background hashing workers when the settings do not say
+	CONTENT_HASH_WORKERS = 4
+)
+
+// validateHashAlgorithm - refuse a hash algorithm we do not know before anything gets hashed with it
+func validateHashAlgorithm(algorithm string) error {
+	switch algorithm {
+	case "", HASH_ALGORITHM_BLAKE2B, HASH_ALGORITHM_SHA256, HASH_ALGORITHM_MD5:
+		return nil
+	default:
+		return fmt.Errorf("unknown hash algorithm %q", algorithm)
+	}
+}
+
+// newContentHash - create a hash for the configured algorithm. Every node in a cluster must use the same one.
+func newContentHash() (hash.Hash, error) {
+	switch globalSettings.HashAlgorithm {
+	case HASH_ALGORITHM_SHA256:
+		return sha256.New(), nil
+	case HASH_ALGORITHM_MD5:
+		return md5.New(), nil
+	case "", HASH_ALGORITHM_BLAKE2B:
+		return blake2b.New256(nil)
+	default:
+		return nil, validateHashAlgorithm(globalSettings.HashAlgorithm)
+	}
+}
+
+// hashToString - the form a content hash takes when it travels outside of JSON
+func hashToString(contentHash []byte) string {
+	return hex.EncodeToString(contentHash)
+}
+
+// hashFile - hash the contents of a file, bypassing the cache
+func hashFile(filePath string) ([]byte, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	contentHash, err := newContentHash()
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(contentHash, file)
+	if err != nil {
+		return nil, err
+	}
+
+	return contentHash.Sum(nil), nil
+}
+
+// hashCacheKey - files are identified by device and inode so a rename or hard link does not cost a rehash
+type hashCacheKey struct {
+	Device uint64
+	Inode  uint64
+}
+
+type hashCacheEntry struct {
+	Size    int64
+	ModTime time.Time
+	Hash    []byte
+}
+
+// ContentHashCache - remembers the hash of every file we have looked at. An entry is only used while the size and
+// modification time still match, so any change to a file causes it to be hashed again.
+type ContentHashCache struct {
+	entries map[hashCacheKey]hashCacheEntry
+	lock    sync.RWMutex
+}
+
+var contentHashes = &ContentHashCache{entries: make(map[hashCacheKey]hashCacheEntry)}
+
+func hashCacheKeyFromInfo(info os.FileInfo) (key hashCacheKey, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	return hashCacheKey{Device: uint64(stat.Dev), Inode: uint64(stat.Ino)}, true
+}
+
+// lookup - return the cached hash for a file if the file is unchanged since it was hashed
+func (cache *ContentHashCache) lookup(info os.FileInfo) []byte {
+	key, ok := hashCacheKeyFromInfo(info)
+	if !ok {
+		return nil
+	}
+
+	cache.lock.RLock()
+	entry, exists := cache.entries[key]
+	cache.lock.RUnlock()
+
+	if exists && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) {
+		return entry.Hash
+	}
+	return nil
+}
+
+// store - remember the hash of a file as of the provided file information
+func (cache *ContentHashCache) store(info os.FileInfo, contentHash []byte) {
+	key, ok := hashCacheKeyFromInfo(info)
+	if !ok {
+		return
+	}
+
+	cache.lock.Lock()
+	cache.entries[key] = hashCacheEntry{Size: info.Size(), ModTime: info.ModTime(), Hash: contentHash}
+	cache.lock.Unlock()
+}
+
+// seed - remember a hash worked out before this run, for the file as it was then
+func (cache *ContentHashCache) seed(key hashCacheKey, size int64, modTime time.Time, contentHash []byte) {
+	cache.lock.Lock()
+	cache.entries[key] = hashCacheEntry{Size: size, ModTime: modTime, Hash: contentHash}
+	cache.lock.Unlock()
+}
+
+// cachedFileHash - hash a file, using the cache when the file has not changed. The file information the hash belongs to
+// is returned as well. If the file changes while it is being hashed, it is hashed again.
+func cachedFileHash(filePath string) (contentHash []byte, info os.FileInfo, err error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		info, err = os.Stat(filePath)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		contentHash = contentHashes.lookup(info)
+		if contentHash != nil {
+			return
+		}
+
+		contentHash, err = hashFile(filePath)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		after, err := os.Stat(filePath)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if after.Size() == info.Size() && after.ModTime().Equal(info.ModTime()) {
+			contentHashes.store(info, contentHash)
+			return contentHash, info, nil
+		}
+		log.Printf("File changed while it was being hashed. Trying again: %s", filePath)
+	}
+
+	return nil, nil, fmt.Errorf("file keeps changing while being hashed: %s", filePath)
+}
+
+// hashRequest - a file waiting on a background worker. done is called with the result.
+type hashRequest struct {
+	fullPath string
+	done     func(contentHash []byte, info os.FileInfo, err error)
+}
+
+// hashWorkQueue - an unbounded queue in front of the hashing workers. Queuing never blocks, so it is safe to queue work
+// while holding a lock that the completion callbacks also need.
+type hashWorkQueue struct {
+	lock    sync.Mutex
+	ready   *sync.Cond
+	pending []hashRequest
+	started bool
+}
+
+var hashWork = &hashWorkQueue{}
+
+// queueFileHash - hash a file on one of the background workers
+func queueFileHash(fullPath string, done func(contentHash []byte, info os.FileInfo, err error)) {
+	hashWork.lock.Lock()
+	defer hashWork.lock.Unlock()
+
+	if !hashWork.started {
+		hashWork.ready = sync.NewCond(&hashWork.lock)
+		workers := globalSettings.HashWorkers
+		if workers <= 0 {
+			workers = CONTENT_HASH_WORKERS
+		}
+		for i := 0; i < workers; i++ {
+			go hashWork.worker()
+		}
+		hashWork.started = true
+	}
+
+	hashWork.pending = append(hashWork.pending, hashRequest{fullPath: fullPath, done: done})
+	hashWork.ready.Signal()
+}
+
+// pendingHashes - number of files waiting to be hashed
+func pendingHashes() int {
+	hashWork.lock.Lock()
+	defer hashWork.lock.Unlock()
+	return len(hashWork.pending)
+}
+
+func (queue *hashWorkQueue) worker() {
+	for {
+		queue.lock.Lock()
+		for len(queue.pending) == 0 {
+			queue.ready.Wait()
+		}
+		request := queue.pending[0]
+		queue.pending[0] = hashRequest{}
+		queue.pending = queue.pending[1:]
+		queue.lock.Unlock()
+
+		contentHash, info, err := cachedFileHash(request.fullPath)
+		request.done(contentHash, info, err)
+	}
+}
@@ -0,0 +1,107 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCachedFileHashNoticesChanges(t *testing.T) {
+	file, err := ioutil.TempFile("", "hashCache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("first version")
+	file.Close()
+
+	first, info, err := cachedFileHash(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached := contentHashes.lookup(info); !bytes.Equal(cached, first) {
+		t.Fatalf("expected the hash to be cached. got %x expected %x", cached, first)
+	}
+
+	err = ioutil.WriteFile(file.Name(), []byte("second version"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(file.Name(), later, later)
+
+	second, _, err := cachedFileHash(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := hashFile(file.Name())
+	if bytes.Equal(first, second) || !bytes.Equal(second, expected) {
+		t.Fatalf("a changed file should be hashed again. first %x second %x expected %x", first, second, expected)
+	}
+}
+
+func TestQueuedHashesComplete(t *testing.T) {
+	file, err := ioutil.TempFile("", "hashQueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("queued contents")
+	file.Close()
+
+	results := make(chan []byte, 1)
+	queueFileHash(file.Name(), func(contentHash []byte, info os.FileInfo, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		results <- contentHash
+	})
+
+	expected, _ := hashFile(file.Name())
+	select {
+	case contentHash := <-results:
+		if !bytes.Equal(contentHash, expected) {
+			t.Fatalf("queued hash %x does not match %x", contentHash, expected)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("queued hash never completed")
+	}
+}
+
+func TestUnknownHashAlgorithmIsAnError(t *testing.T) {
+	useTestSettings(t)
+	if err := validateHashAlgorithm("crc32"); err == nil {
+		t.Fatal("an unknown hash algorithm should not pass validation")
+	}
+
+	globalSettings.HashAlgorithm = "crc32"
+
+	file, err := ioutil.TempFile("", "hashAlgorithm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.Close()
+
+	_, err = hashFile(file.Name())
+	if err == nil {
+		t.Fatal("hashing with an unknown algorithm should fail instead of producing a hash")
+	}
+}
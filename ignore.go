@@ -0,0 +1,315 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Paths can be kept out of replication with .replicatignore files, which work like .gitignore files: one pattern per
+// line, # for comments, ! to take a path back in, a trailing / to only match directories and a leading or inner / to
+// match from the directory the file is in. ** matches any number of directories. A file applies to its own directory
+// and everything below it, and the last pattern that matches wins. Nothing below an ignored directory is synced.
+//
+// The settings can add patterns that apply everywhere, a list of globs that files have to match one of to be synced,
+// and a largest file size, for example
+//
+//	"IgnorePatterns": ["node_modules/", "*.swp"], "IncludePatterns": ["*.jpg", "docs/**"], "MaxFileSize": 1073741824
+//
+// The .replicatignore files themselves are only synced when SyncIgnoreFiles is set.
+
+// IGNORE_FILE_NAME - Name of the files holding the ignore patterns for their directory
+const IGNORE_FILE_NAME = ".replicatignore"
+
+// IGNORE_DEFAULT_PATTERNS - Files that are never worth syncing, whatever the settings say
+var IGNORE_DEFAULT_PATTERNS = []string{".DS_Store", "Thumbs.db"}
+
+// ignoreRule - one pattern from an ignore file or the settings
+type ignoreRule struct {
+	pattern       string
+	negate        bool
+	directoryOnly bool
+	anchored      bool // matched against the path from the ignore file's directory instead of the name alone
+}
+
+// parseIgnoreRule - turn a line of an ignore file into a rule. Blank lines and comments are not rules.
+func parseIgnoreRule(line string) (rule ignoreRule, ok bool, err error) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return
+	}
+
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.directoryOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	rule.anchored = strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return
+	}
+
+	_, err = path.Match(line, "")
+	if err != nil {
+		return rule, false, fmt.Errorf("ignore pattern %q: %s", line, err)
+	}
+	rule.pattern = line
+	return rule, true, nil
+}
+
+// matches - check if the rule matches a path relative to the directory the rule comes from
+func (rule ignoreRule) matches(relativePath string, isDirectory bool) bool {
+	if rule.directoryOnly && !isDirectory {
+		return false
+	}
+	if !rule.anchored {
+		return globMatches(rule.pattern, path.Base(relativePath))
+	}
+	return globMatches(rule.pattern, relativePath)
+}
+
+// globMatches - path.Match with ** standing for any number of directories
+func globMatches(pattern, name string) bool {
+	return globSegmentsMatch(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func globSegmentsMatch(patterns, names []string) bool {
+	for len(patterns) > 0 {
+		if patterns[0] == "**" {
+			for skip := 0; skip <= len(names); skip++ {
+				if globSegmentsMatch(patterns[1:], names[skip:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(names) == 0 {
+			return false
+		}
+		matched, err := path.Match(patterns[0], names[0])
+		if err != nil || !matched {
+			return false
+		}
+		patterns, names = patterns[1:], names[1:]
+	}
+	return len(names) == 0
+}
+
+// parseIgnoreRules - the rules in a list of patterns
+func parseIgnoreRules(lines []string) ([]ignoreRule, error) {
+	rules := make([]ignoreRule, 0, len(lines))
+	for _, line := range lines {
+		rule, ok, err := parseIgnoreRule(line)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// validateIgnoreSettings - check every pattern in the settings can be used
+func validateIgnoreSettings(settings Settings) error {
+	_, err := parseIgnoreRules(settings.IgnorePatterns)
+	if err != nil {
+		return err
+	}
+	for _, include := range settings.IncludePatterns {
+		_, err = path.Match(strings.Trim(include, "/"), "")
+		if err != nil {
+			return fmt.Errorf("include pattern %q: %s", include, err)
+		}
+	}
+	if settings.MaxFileSize < 0 {
+		return fmt.Errorf("MaxFileSize can not be negative: %d", settings.MaxFileSize)
+	}
+	return nil
+}
+
+// ignoreMatcher - decides which paths under a directory are synced. The ignore files are read as they are needed
+// and read again after they change.
+type ignoreMatcher struct {
+	directory string
+	global    []ignoreRule
+	files     map[string][]ignoreRule // directory relative to the root to the rules in its ignore file
+	lock      sync.Mutex
+}
+
+func newIgnoreMatcher(directory string) *ignoreMatcher {
+	patterns := append(append([]string(nil), IGNORE_DEFAULT_PATTERNS...), globalSettings.IgnorePatterns...)
+	global, err := parseIgnoreRules(patterns)
+	if err != nil {
+		log.Printf("Unable to use the ignore patterns in the settings: %s", err)
+		global, _ = parseIgnoreRules(IGNORE_DEFAULT_PATTERNS)
+	}
+	return &ignoreMatcher{directory: directory, global: global, files: make(map[string][]ignoreRule)}
+}
+
+// rulesFor - the rules in the ignore file of a directory. Call with the matcher locked.
+func (matcher *ignoreMatcher) rulesFor(relativeDirectory string) []ignoreRule {
+	rules, loaded := matcher.files[relativeDirectory]
+	if loaded {
+		return rules
+	}
+
+	file, err := os.Open(filepath.Join(matcher.directory, relativeDirectory, IGNORE_FILE_NAME))
+	if err == nil {
+		lines := make([]string, 0)
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		file.Close()
+
+		for _, line := range lines {
+			rule, ok, err := parseIgnoreRule(line)
+			if err != nil {
+				log.Printf("Skipping a line of %s: %s", filepath.Join(relativeDirectory, IGNORE_FILE_NAME), err)
+				continue
+			}
+			if ok {
+				rules = append(rules, rule)
+			}
+		}
+	}
+
+	matcher.files[relativeDirectory] = rules
+	return rules
+}
+
+// changed - an ignore file was written or removed. Its rules are read again the next time they are needed.
+func (matcher *ignoreMatcher) changed(relativePath string) {
+	matcher.lock.Lock()
+	defer matcher.lock.Unlock()
+
+	relativeDirectory := filepath.ToSlash(filepath.Dir(relativePath))
+	if relativeDirectory == "." {
+		relativeDirectory = ""
+	}
+	delete(matcher.files, relativeDirectory)
+}
+
+// excluded - check if the patterns leave out a path. Call with the matcher locked.
+func (matcher *ignoreMatcher) excluded(relativePath string, isDirectory bool) bool {
+	excluded := false
+	apply := func(rules []ignoreRule, relativeToRules string) {
+		for _, rule := range rules {
+			if rule.matches(relativeToRules, isDirectory) {
+				excluded = !rule.negate
+			}
+		}
+	}
+
+	apply(matcher.global, relativePath)
+	parts := strings.Split(relativePath, "/")
+	for i := range parts {
+		apply(matcher.rulesFor(strings.Join(parts[:i], "/")), strings.Join(parts[i:], "/"))
+	}
+	return excluded
+}
+
+// ignored - check if a path is kept out of replication. size is only looked at for files.
+func (matcher *ignoreMatcher) ignored(relativePath string, isDirectory bool, size int64) bool {
+	relativePath = strings.Trim(filepath.ToSlash(relativePath), "/")
+	if relativePath == "" {
+		return false
+	}
+	if isMetadataPath(relativePath) {
+		return true
+	}
+	if !globalSettings.SyncIgnoreFiles && path.Base(relativePath) == IGNORE_FILE_NAME {
+		return true
+	}
+	if !isDirectory && globalSettings.MaxFileSize > 0 && size > globalSettings.MaxFileSize {
+		return true
+	}
+	if !isDirectory && !includePatternsMatch(relativePath) {
+		return true
+	}
+
+	matcher.lock.Lock()
+	defer matcher.lock.Unlock()
+
+	// Nothing below an ignored directory can be taken back in
+	parts := strings.Split(relativePath, "/")
+	for i := 1; i < len(parts); i++ {
+		if matcher.excluded(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return matcher.excluded(relativePath, isDirectory)
+}
+
+// includePatternsMatch - check if a file matches one of the include patterns in the settings, when there are any
+func includePatternsMatch(relativePath string) bool {
+	if len(globalSettings.IncludePatterns) == 0 {
+		return true
+	}
+	for _, include := range globalSettings.IncludePatterns {
+		include = strings.Trim(include, "/")
+		if strings.Contains(include, "/") {
+			if globMatches(include, relativePath) {
+				return true
+			}
+		} else if globMatches(include, path.Base(relativePath)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ignoresInfo - check if a path found on disk is kept out of replication
+func (handler *FilesystemTracker) ignoresInfo(relativePath string, info os.FileInfo) bool {
+	return handler.ignore.ignored(relativePath, info.IsDir(), info.Size())
+}
+
+// ignoresEntry - check if a path in a catalog is kept out of replication
+func (handler *FilesystemTracker) ignoresEntry(entry EntryJSON) bool {
+	return handler.ignore.ignored(entry.RelativePath, entry.IsDirectory, entry.Size)
+}
+
+// ignoresEvent - check if a path a filesystem event is for is kept out of replication. A path that is gone is
+// described by what we tracked it as. So are paths an archive node only keeps.
+func (handler *FilesystemTracker) ignoresEvent(relativePath, fullPath string) bool {
+	handler.fsLock.RLock()
+	entry, exists := handler.contents[relativePath]
+	archived := handler.isArchived(relativePath)
+	handler.fsLock.RUnlock()
+	if archived {
+		return true
+	}
+
+	info, err := os.Stat(fullPath)
+	if err == nil {
+		return handler.ignoresInfo(relativePath, info)
+	}
+	return handler.ignore.ignored(relativePath, exists && entry.FileInfo != nil && entry.IsDir(), 0)
+}
@@ -0,0 +1,162 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIgnoreFilesFollowGitignoreRules(t *testing.T) {
+	directory := t.TempDir()
+	writeTestFile(t, directory, IGNORE_FILE_NAME, "# editor files\n*.swp\n!keep.swp\nbuild/\n/top.txt\ndocs/**/*.tmp\n*.log\n", time.Time{})
+	writeTestFile(t, directory, filepath.Join("sub", IGNORE_FILE_NAME), "local.txt\n!important.log\n", time.Time{})
+
+	matcher := newIgnoreMatcher(directory)
+	cases := []struct {
+		path        string
+		isDirectory bool
+		ignored     bool
+	}{
+		{"notes.txt", false, false},
+		{".DS_Store", false, true},
+		{"deep/down/Thumbs.db", false, true},
+		{"a/b/.file.swp", false, true},
+		{"a/keep.swp", false, false},
+		{"build", true, true},
+		{"build", false, false},
+		{"build/output.bin", false, true},
+		{"src/build/output.bin", false, true},
+		{"top.txt", false, true},
+		{"a/top.txt", false, false},
+		{"docs/x.tmp", false, true},
+		{"docs/a/b/x.tmp", false, true},
+		{"other/x.tmp", false, false},
+		{"sub/local.txt", false, true},
+		{"local.txt", false, false},
+		{"sub/debug.log", false, true},
+		{"sub/important.log", false, false},
+		{"important.log", false, true},
+		{IGNORE_FILE_NAME, false, true},
+		{filepath.Join(REPLICAT_METADATA_DIRECTORY, "state.json"), false, true},
+	}
+	for _, c := range cases {
+		if matcher.ignored(c.path, c.isDirectory, 1) != c.ignored {
+			t.Errorf("%s (directory: %v) ignored should be %v", c.path, c.isDirectory, c.ignored)
+		}
+	}
+
+	// Nothing below an ignored directory can be taken back in
+	writeTestFile(t, directory, filepath.Join("build", IGNORE_FILE_NAME), "!*\n", time.Time{})
+	matcher.changed(filepath.Join("build", IGNORE_FILE_NAME))
+	if !matcher.ignored("build/output.bin", false, 1) {
+		t.Error("a file below an ignored directory should stay ignored")
+	}
+
+	// A changed ignore file is read again
+	writeTestFile(t, directory, filepath.Join("sub", IGNORE_FILE_NAME), "", time.Time{})
+	matcher.changed(filepath.Join("sub", IGNORE_FILE_NAME))
+	if matcher.ignored("sub/local.txt", false, 1) {
+		t.Error("sub/local.txt should be synced once its ignore file no longer lists it")
+	}
+}
+
+func TestIgnoreSettings(t *testing.T) {
+	useTestSettings(t)
+	globalSettings.IgnorePatterns = []string{"node_modules/"}
+	globalSettings.IncludePatterns = []string{"*.jpg", "docs/**"}
+	globalSettings.MaxFileSize = 100
+	globalSettings.SyncIgnoreFiles = true
+
+	matcher := newIgnoreMatcher(t.TempDir())
+	cases := []struct {
+		path        string
+		isDirectory bool
+		size        int64
+		ignored     bool
+	}{
+		{"photos/a.jpg", false, 10, false},
+		{"photos/a.png", false, 10, true},
+		{"photos", true, 0, false},
+		{"docs/readme.md", false, 10, false},
+		{"photos/big.jpg", false, 101, true},
+		{"web/node_modules/x.jpg", false, 10, true},
+		{"web/node_modules", true, 0, true},
+	}
+	for _, c := range cases {
+		if matcher.ignored(c.path, c.isDirectory, c.size) != c.ignored {
+			t.Errorf("%s (directory: %v size: %d) ignored should be %v", c.path, c.isDirectory, c.size, c.ignored)
+		}
+	}
+
+	globalSettings.IncludePatterns = nil
+	if matcher.ignored(IGNORE_FILE_NAME, false, 10) {
+		t.Error("ignore files should be synced when SyncIgnoreFiles is set")
+	}
+
+	globalSettings.IgnorePatterns = []string{"[unterminated"}
+	if validateIgnoreSettings(globalSettings) == nil {
+		t.Error("a malformed pattern should be rejected")
+	}
+}
+
+func TestIgnoredPathsAreNotScannedSentOrRequested(t *testing.T) {
+	useTestSettings(t)
+	tracker := createTracker("ignoreTracker")
+	globalSettings.Directory = tracker.directory
+
+	writeTestFile(t, tracker.directory, "kept.txt", "kept", time.Time{})
+	writeTestFile(t, tracker.directory, "old.log", "tracked before it was ignored", time.Time{})
+	writeTestFile(t, tracker.directory, "node_modules/x.js", "dependency", time.Time{})
+	tracker = restartTracker(tracker)
+	waitForScan(t, tracker)
+
+	writeTestFile(t, tracker.directory, IGNORE_FILE_NAME, "node_modules/\n*.log\n*.tmp\n", time.Time{})
+	tracker = restartTracker(tracker)
+	defer cleanupTracker(tracker)
+	waitForScan(t, tracker)
+
+	tracker.fsLock.RLock()
+	_, kept := tracker.contents["kept.txt"]
+	_, oldLog := tracker.contents["old.log"]
+	_, logTombstone := tracker.tombstones["old.log"]
+	_, modules := tracker.contents["node_modules"]
+	_, ignoreFile := tracker.contents[IGNORE_FILE_NAME]
+	tree := tracker.buildMerkleTree()
+	tracker.fsLock.RUnlock()
+	if !kept || oldLog || logTombstone || modules || ignoreFile {
+		t.Fatalf("the scan should only track what is not ignored. kept: %v old.log: %v (tombstone: %v) node_modules: %v ignore file: %v",
+			kept, oldLog, logTombstone, modules, ignoreFile)
+	}
+	if _, found := tree[merklePath("node_modules/x.js")]; found {
+		t.Fatal("an ignored path should not be sent in the catalog")
+	}
+
+	tracker.ProcessCatalog(catalogEvent(t, "ignorePeer",
+		EntryJSON{RelativePath: "remote.tmp", ModTime: time.Now(), Hash: []byte{1}, Size: 1, Version: VersionVector{"ignorePeer": 1}},
+		EntryJSON{RelativePath: "remote.txt", ModTime: time.Now(), Hash: []byte{2}, Size: 1, Version: VersionVector{"ignorePeer": 1}},
+		EntryJSON{RelativePath: "kept.log", ModTime: time.Now(), Deleted: true, Origin: "ignorePeer", Version: VersionVector{"ignorePeer": 1}}))
+
+	tracker.fsLock.RLock()
+	_, ignoredNeeded := tracker.neededFiles["remote.tmp"]
+	_, needed := tracker.neededFiles["remote.txt"]
+	_, ignoredTombstone := tracker.tombstones["kept.log"]
+	tracker.fsLock.RUnlock()
+	if ignoredNeeded || !needed || ignoredTombstone {
+		t.Fatalf("only what is not ignored should be requested. remote.tmp: %v remote.txt: %v kept.log tombstone: %v", ignoredNeeded, needed, ignoredTombstone)
+	}
+}
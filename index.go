@@ -0,0 +1,466 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The tracker keeps what it knows about every path (size, times, inode, hash and version) in an index under the
+// metadata directory, so a restart can start from it instead of from nothing. The index is a log of records. A record
+// either puts the current state of a path or removes the path, and the last record for a path wins. Changes are
+// appended as they are saved, and the whole log is rewritten with one record per path once it holds too many that
+// have been replaced.
+//
+// The file starts with TRACKER_INDEX_MAGIC and the format version. Each record is the length of its body, the body,
+// and a CRC-32 of the body. A record that is cut short or fails its check ends the log. It is the tail of a write that
+// never finished, and is cut off when the index is opened.
+
+const (
+	// TRACKER_INDEX_FILE - File under the metadata directory holding the index
+	TRACKER_INDEX_FILE = "index.db"
+	// TRACKER_INDEX_MAGIC - The first bytes of the index
+	TRACKER_INDEX_MAGIC = "RPIX"
+	// TRACKER_INDEX_VERSION - The version of the format written. An index with any other version is started over.
+	TRACKER_INDEX_VERSION = 1
+	// TRACKER_INDEX_COMPACT_RATIO - The index is rewritten once it holds this many records for each path it describes
+	TRACKER_INDEX_COMPACT_RATIO = 2
+	// TRACKER_INDEX_COMPACT_MINIMUM - Indexes with fewer records than this are never rewritten
+	TRACKER_INDEX_COMPACT_MINIMUM = 10000
+)
+
+const (
+	indexOpPut = iota + 1
+	indexOpRemove
+)
+
+const (
+	indexFlagDirectory = 1 << iota
+	indexFlagModTime
+)
+
+// indexRecord - what the index holds for a path
+type indexRecord struct {
+	IsDirectory bool
+	Mode        os.FileMode
+	Size        int64
+	ModTime     time.Time
+	Device      uint64
+	Inode       uint64
+	Hash        []byte
+	Version     VersionVector
+}
+
+// indexedFileInfo - the file information for a path as the index has it. Entries carry this until a scan finds the
+// path on disk and replaces it.
+type indexedFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	device  uint64
+	inode   uint64
+}
+
+func (info *indexedFileInfo) Name() string       { return info.name }
+func (info *indexedFileInfo) Size() int64        { return info.size }
+func (info *indexedFileInfo) Mode() os.FileMode  { return info.mode }
+func (info *indexedFileInfo) ModTime() time.Time { return info.modTime }
+func (info *indexedFileInfo) IsDir() bool        { return info.mode.IsDir() }
+func (info *indexedFileInfo) Sys() interface{}   { return nil }
+
+// trackerIndex - the index file, open for appending
+type trackerIndex struct {
+	path    string
+	file    *os.File
+	writer  *bufio.Writer
+	records int // records in the file
+	live    int // paths the records describe
+}
+
+// openTrackerIndex - open the index, creating it if needed. Every path it describes is handed to found, in no
+// particular order.
+func openTrackerIndex(indexPath string, found func(relativePath string, record indexRecord)) (*trackerIndex, error) {
+	err := os.MkdirAll(filepath.Dir(indexPath), os.ModeDir+os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	index := &trackerIndex{path: indexPath}
+	live, records, good, err := readTrackerIndex(indexPath)
+	if err != nil {
+		log.Printf("Unable to use the index at %s. Starting it over: %s", indexPath, err)
+		live, records, good = nil, 0, 0
+	}
+	index.records = records
+	for relativePath, record := range live {
+		found(relativePath, record)
+	}
+	index.live = len(live)
+
+	index.file, err = os.OpenFile(indexPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = index.file.Truncate(good)
+	if err == nil {
+		_, err = index.file.Seek(good, io.SeekStart)
+	}
+	if err != nil {
+		index.file.Close()
+		return nil, err
+	}
+	index.writer = bufio.NewWriter(index.file)
+
+	if good == 0 {
+		index.writer.WriteString(TRACKER_INDEX_MAGIC)
+		index.writer.WriteByte(TRACKER_INDEX_VERSION)
+	}
+	return index, nil
+}
+
+// readTrackerIndex - replay the index into the state of each path. good is how much of the file holds whole records.
+func readTrackerIndex(indexPath string) (live map[string]indexRecord, records int, good int64, err error) {
+	file, err := os.Open(indexPath)
+	if os.IsNotExist(err) {
+		return nil, 0, 0, nil
+	}
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, len(TRACKER_INDEX_MAGIC)+1)
+	_, err = io.ReadFull(reader, header)
+	if err == io.EOF {
+		return nil, 0, 0, nil
+	}
+	if err != nil || string(header[:len(TRACKER_INDEX_MAGIC)]) != TRACKER_INDEX_MAGIC || header[len(TRACKER_INDEX_MAGIC)] != TRACKER_INDEX_VERSION {
+		return nil, 0, 0, fmt.Errorf("not an index this version understands")
+	}
+
+	live = make(map[string]indexRecord)
+	good = int64(len(header))
+	var body []byte
+	for {
+		length, err := binary.ReadUvarint(reader)
+		if err != nil || length > CATALOG_MAX_RECORD_SIZE {
+			break
+		}
+		if uint64(cap(body)) < length+4 {
+			body = make([]byte, length+4)
+		}
+		frame := body[:length+4]
+		_, err = io.ReadFull(reader, frame)
+		if err != nil || crc32.ChecksumIEEE(frame[:length]) != binary.LittleEndian.Uint32(frame[length:]) {
+			break
+		}
+
+		op, relativePath, record, err := decodeIndexRecord(frame[:length])
+		if err != nil {
+			break
+		}
+		if op == indexOpPut {
+			live[relativePath] = record
+		} else {
+			delete(live, relativePath)
+		}
+		records++
+
+		var lengthPrefix [binary.MaxVarintLen64]byte
+		good += int64(binary.PutUvarint(lengthPrefix[:], length)) + int64(length) + 4
+	}
+
+	info, statErr := file.Stat()
+	if statErr == nil && info.Size() > good {
+		log.Printf("Index %s ends in an unfinished write. Dropping the last %d bytes", indexPath, info.Size()-good)
+	}
+	return live, records, good, nil
+}
+
+// encodeIndexRecord - the body of a record
+func encodeIndexRecord(buffer *bytes.Buffer, op byte, relativePath string, record indexRecord) {
+	buffer.WriteByte(op)
+	putString(buffer, relativePath)
+	if op != indexOpPut {
+		return
+	}
+
+	var flags byte
+	if record.IsDirectory {
+		flags |= indexFlagDirectory
+	}
+	if !record.ModTime.IsZero() {
+		flags |= indexFlagModTime
+	}
+	buffer.WriteByte(flags)
+	putUvarint(buffer, uint64(record.Mode))
+	putVarint(buffer, record.Size)
+	if !record.ModTime.IsZero() {
+		putVarint(buffer, record.ModTime.UnixNano())
+	}
+	putUvarint(buffer, record.Device)
+	putUvarint(buffer, record.Inode)
+	putUvarint(buffer, uint64(len(record.Hash)))
+	buffer.Write(record.Hash)
+	putUvarint(buffer, uint64(len(record.Version)))
+	for node, counter := range record.Version {
+		putString(buffer, node)
+		putUvarint(buffer, counter)
+	}
+}
+
+// decodeIndexRecord - take the body of a record apart
+func decodeIndexRecord(body []byte) (op byte, relativePath string, record indexRecord, err error) {
+	fields := recordReader{data: body}
+	op = fields.byte()
+	relativePath = string(fields.bytes())
+	if op == indexOpPut {
+		flags := fields.byte()
+		record.IsDirectory = flags&indexFlagDirectory != 0
+		record.Mode = os.FileMode(fields.uvarint())
+		record.Size = fields.varint()
+		if flags&indexFlagModTime != 0 {
+			record.ModTime = time.Unix(0, fields.varint())
+		}
+		record.Device = fields.uvarint()
+		record.Inode = fields.uvarint()
+		hash := fields.bytes()
+		if len(hash) > 0 {
+			record.Hash = append([]byte(nil), hash...)
+		}
+
+		nodes := fields.uvarint()
+		if nodes > uint64(len(body)) {
+			return 0, "", record, ErrCatalogStreamFormat
+		}
+		if nodes > 0 {
+			record.Version = make(VersionVector, nodes)
+			for i := uint64(0); i < nodes; i++ {
+				node := string(fields.bytes())
+				record.Version[node] = fields.uvarint()
+			}
+		}
+	} else if op != indexOpRemove {
+		fields.err = ErrCatalogStreamFormat
+	}
+
+	if fields.err == nil && len(fields.data) != 0 {
+		fields.err = ErrCatalogStreamFormat
+	}
+	return op, relativePath, record, fields.err
+}
+
+// append - add a record to the end of the index. It is on disk once the index is synced.
+func (index *trackerIndex) append(op byte, relativePath string, record indexRecord) error {
+	var body bytes.Buffer
+	encodeIndexRecord(&body, op, relativePath, record)
+
+	var frame [binary.MaxVarintLen64]byte
+	index.writer.Write(frame[:binary.PutUvarint(frame[:], uint64(body.Len()))])
+	index.writer.Write(body.Bytes())
+	binary.LittleEndian.PutUint32(frame[:4], crc32.ChecksumIEEE(body.Bytes()))
+	_, err := index.writer.Write(frame[:4])
+	index.records++
+	return err
+}
+
+// sync - get everything appended so far onto the disk
+func (index *trackerIndex) sync() error {
+	err := index.writer.Flush()
+	if err != nil {
+		return err
+	}
+	return index.file.Sync()
+}
+
+// needsCompaction - check if the index holds enough replaced records that it is worth rewriting
+func (index *trackerIndex) needsCompaction() bool {
+	return index.records >= TRACKER_INDEX_COMPACT_MINIMUM && index.records > index.live*TRACKER_INDEX_COMPACT_RATIO
+}
+
+// compact - rewrite the index with one record for each path that each hands out, and carry on appending to that
+func (index *trackerIndex) compact(each func(put func(relativePath string, record indexRecord) error) error) error {
+	temporaryPath := index.path + ".tmp"
+	temporary, err := os.Create(temporaryPath)
+	if err != nil {
+		return err
+	}
+
+	rewritten := &trackerIndex{path: index.path, file: temporary, writer: bufio.NewWriter(temporary)}
+	rewritten.writer.WriteString(TRACKER_INDEX_MAGIC)
+	rewritten.writer.WriteByte(TRACKER_INDEX_VERSION)
+	err = each(func(relativePath string, record indexRecord) error {
+		rewritten.live++
+		return rewritten.append(indexOpPut, relativePath, record)
+	})
+	if err == nil {
+		err = rewritten.sync()
+	}
+	if err == nil {
+		err = os.Rename(temporaryPath, index.path)
+	}
+	if err != nil {
+		temporary.Close()
+		os.Remove(temporaryPath)
+		return err
+	}
+	syncDirectory(filepath.Dir(index.path))
+
+	index.file.Close()
+	*index = *rewritten
+	return nil
+}
+
+// close - sync the index and let go of the file
+func (index *trackerIndex) close() error {
+	err := index.sync()
+	closeErr := index.file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (handler *FilesystemTracker) indexPath() string {
+	return filepath.Join(handler.directory, REPLICAT_METADATA_DIRECTORY, TRACKER_INDEX_FILE)
+}
+
+// loadIndex - open the index and start the tracked contents from it. The hash cache is seeded with the hashes it holds
+// so files that have not changed are not read again. Returns how many paths the index described. Call when inside of a
+// lock!
+func (handler *FilesystemTracker) loadIndex() (loaded int, err error) {
+	handler.indexDirty = make(map[string]bool)
+	handler.indexChildren = make(map[string][]string)
+	handler.index, err = openTrackerIndex(handler.indexPath(), func(relativePath string, record indexRecord) {
+		info := &indexedFileInfo{name: filepath.Base(relativePath), size: record.Size, mode: record.Mode, modTime: record.ModTime,
+			device: record.Device, inode: record.Inode}
+		handler.contents[relativePath] = Entry{FileInfo: info, setup: true, hash: record.Hash, version: record.Version}
+
+		parent := filepath.Dir(relativePath)
+		if parent == "." {
+			parent = ""
+		}
+		handler.indexChildren[parent] = append(handler.indexChildren[parent], info.name)
+
+		if record.IsDirectory {
+			handler.stats.TotalFolders++
+			return
+		}
+		handler.stats.TotalFiles++
+		if record.Hash != nil {
+			handler.hashIndex[hashToString(record.Hash)] = relativePath
+			if record.Inode != 0 {
+				contentHashes.seed(hashCacheKey{Device: record.Device, Inode: record.Inode}, record.Size, record.ModTime, record.Hash)
+			}
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("Loaded %d paths from the index", handler.index.live)
+	return handler.index.live, nil
+}
+
+// indexRecordFor - what the index holds for an entry
+func indexRecordFor(entry Entry) indexRecord {
+	record := indexRecord{IsDirectory: entry.IsDir(), Mode: entry.Mode(), Size: entry.Size(), ModTime: entry.ModTime(),
+		Hash: entry.hash, Version: entry.version}
+
+	indexed, fromIndex := entry.FileInfo.(*indexedFileInfo)
+	if fromIndex {
+		record.Device, record.Inode = indexed.device, indexed.inode
+	} else if key, ok := hashCacheKeyFromInfo(entry.FileInfo); ok {
+		record.Device, record.Inode = key.Device, key.Inode
+	}
+	return record
+}
+
+// markIndexDirty - note that the index no longer has the current state of a path. Call when inside of a lock!
+func (handler *FilesystemTracker) markIndexDirty(relativePath string) {
+	if handler.indexDirty != nil {
+		handler.indexDirty[relativePath] = true
+	}
+}
+
+// flushIndex - write out the state of every path that changed since the last flush, and rewrite the index when it
+// has grown too large. Call when inside of a lock!
+func (handler *FilesystemTracker) flushIndex() error {
+	index := handler.index
+	if index == nil {
+		return nil
+	}
+
+	var err error
+	for relativePath := range handler.indexDirty {
+		entry, exists := handler.contents[relativePath]
+		if exists && entry.FileInfo != nil {
+			err = index.append(indexOpPut, relativePath, indexRecordFor(entry))
+		} else {
+			err = index.append(indexOpRemove, relativePath, indexRecord{})
+		}
+		if err != nil {
+			return err
+		}
+		delete(handler.indexDirty, relativePath)
+	}
+	index.live = len(handler.contents)
+
+	if index.needsCompaction() {
+		log.Printf("Rewriting the index. %d records for %d paths", index.records, index.live)
+		return index.compact(func(put func(relativePath string, record indexRecord) error) error {
+			for relativePath, entry := range handler.contents {
+				if entry.FileInfo == nil {
+					continue
+				}
+				err := put(relativePath, indexRecordFor(entry))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	return index.sync()
+}
+
+// closeIndex - write out what has not been and close the index. Nothing is saved after this. Call when inside of a
+// lock!
+func (handler *FilesystemTracker) closeIndex() {
+	if handler.index != nil {
+		err := handler.flushIndex()
+		if err == nil {
+			err = handler.index.close()
+		}
+		if err != nil {
+			log.Printf("Unable to close the index: %s", err)
+		}
+	}
+	handler.index = nil
+	handler.indexDirty = nil
+}
@@ -0,0 +1,172 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrackerIndexReplaysAndDropsUnfinishedWrites(t *testing.T) {
+	folder := createExtraFolder("indexReplay")
+	defer cleanupExtraFolder(folder)
+	indexPath := filepath.Join(folder, TRACKER_INDEX_FILE)
+
+	index, err := openTrackerIndex(indexPath, func(string, indexRecord) { t.Fatal("a new index should be empty") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2016, 10, 16, 9, 0, 0, 0, time.UTC)
+	index.append(indexOpPut, "a.txt", indexRecord{Size: 1})
+	index.append(indexOpPut, "b.txt", indexRecord{Size: 2, Mode: 0644, ModTime: modTime, Device: 7, Inode: 42, Hash: []byte{1, 2}, Version: VersionVector{"nodeA": 3}})
+	index.append(indexOpRemove, "a.txt", indexRecord{})
+	err = index.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A write that never finished
+	file, _ := os.OpenFile(indexPath, os.O_WRONLY|os.O_APPEND, 0644)
+	file.Write([]byte{40, indexOpPut, 5, 'c'})
+	file.Close()
+
+	found := make(map[string]indexRecord)
+	index, err = openTrackerIndex(indexPath, func(relativePath string, record indexRecord) { found[relativePath] = record })
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, exists := found["b.txt"]
+	if len(found) != 1 || !exists || record.Size != 2 || record.Mode != 0644 || !record.ModTime.Equal(modTime) || record.Device != 7 ||
+		record.Inode != 42 || len(record.Hash) != 2 || record.Version["nodeA"] != 3 {
+		t.Fatalf("expected only b.txt as it was last put. found: %#v", found)
+	}
+
+	// Appending carries on from the last whole record
+	index.append(indexOpPut, "c.txt", indexRecord{Size: 3})
+	index.close()
+	found = make(map[string]indexRecord)
+	index, _ = openTrackerIndex(indexPath, func(relativePath string, record indexRecord) { found[relativePath] = record })
+	defer index.close()
+	if len(found) != 2 || found["c.txt"].Size != 3 {
+		t.Fatalf("expected the record written after the unfinished one. found: %#v", found)
+	}
+}
+
+// restartTracker - save and close a tracker, then start a new one on the same directory as a restart would
+func restartTracker(tracker *FilesystemTracker) *FilesystemTracker {
+	tracker.saveState()
+	tracker.shutdown()
+
+	restarted := new(FilesystemTracker)
+	restarted.Initialize(tracker.directory, &ReplicatServer{})
+	return restarted
+}
+
+// waitForScan - wait for the background scan to get through the directory
+func waitForScan(t *testing.T, tracker *FilesystemTracker) {
+	for i := 0; i < 100; i++ {
+		tracker.fsLock.RLock()
+		complete := tracker.scan.Complete
+		tracker.fsLock.RUnlock()
+		if complete {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("the scan did not finish")
+}
+
+func TestRestartStartsFromIndexAndReconciles(t *testing.T) {
+	folder := createExtraFolder("indexRestart")
+	os.MkdirAll(filepath.Join(folder, "sub"), os.ModePerm)
+	for _, name := range []string{"keep.txt", "change.txt", "gone.txt", "sub/inner.txt"} {
+		ioutil.WriteFile(filepath.Join(folder, name), []byte(name), 0644)
+	}
+	first := new(FilesystemTracker)
+	first.Initialize(folder, &ReplicatServer{})
+	before := make(map[string]VersionVector)
+	first.fsLock.RLock()
+	for path, entry := range first.contents {
+		before[path] = entry.version
+	}
+	first.fsLock.RUnlock()
+
+	writeTestFile(t, first.directory, "change.txt", "changed while we were not running", time.Time{})
+	writeTestFile(t, first.directory, "new.txt", "new", time.Time{})
+	os.Remove(filepath.Join(folder, "gone.txt"))
+	os.RemoveAll(filepath.Join(folder, "sub"))
+
+	tracker := restartTracker(first)
+	defer cleanupTracker(tracker)
+	waitForScan(t, tracker)
+
+	tracker.fsLock.RLock()
+	defer tracker.fsLock.RUnlock()
+	if tracker.contents["keep.txt"].version.Compare(before["keep.txt"]) != VERSION_EQUAL {
+		t.Fatalf("an unchanged file should keep its version. before: %s after: %s", before["keep.txt"], tracker.contents["keep.txt"].version)
+	}
+	if tracker.contents["change.txt"].version.Compare(before["change.txt"]) != VERSION_DOMINATES {
+		t.Fatalf("a file changed while we were away should get a new version. before: %s after: %s", before["change.txt"], tracker.contents["change.txt"].version)
+	}
+	if _, exists := tracker.contents["new.txt"]; !exists {
+		t.Fatal("a new file should be tracked")
+	}
+	for _, gone := range []string{"gone.txt", "sub", filepath.Join("sub", "inner.txt")} {
+		_, exists := tracker.contents[gone]
+		_, deleted := tracker.tombstones[gone]
+		if exists || !deleted {
+			t.Fatalf("%s was deleted while we were away. exists: %v tombstone: %v", gone, exists, deleted)
+		}
+	}
+}
+
+func TestInterruptedScanResumesFromCheckpoint(t *testing.T) {
+	folder := createExtraFolder("indexResume")
+	for _, name := range []string{"a/file.txt", "b/file.txt"} {
+		os.MkdirAll(filepath.Join(folder, filepath.Dir(name)), os.ModePerm)
+		ioutil.WriteFile(filepath.Join(folder, name), []byte(name), 0644)
+	}
+	first := new(FilesystemTracker)
+	first.Initialize(folder, &ReplicatServer{})
+	first.fsLock.RLock()
+	beforeA := first.contents[filepath.Join("a", "file.txt")].version
+	beforeB := first.contents[filepath.Join("b", "file.txt")].version
+	first.fsLock.RUnlock()
+
+	// The last scan stopped with only b left to do, so a is not looked at again
+	first.saveState()
+	data, _ := json.Marshal(scanCheckpoint{Pending: []string{"b"}})
+	writeFileAtomic(first.scanCheckpointPath(), data)
+	writeTestFile(t, first.directory, filepath.Join("a", "file.txt"), "changed after a was scanned", time.Time{})
+	writeTestFile(t, first.directory, filepath.Join("b", "file.txt"), "changed before b was scanned", time.Time{})
+
+	tracker := restartTracker(first)
+	defer cleanupTracker(tracker)
+	waitForScan(t, tracker)
+
+	tracker.fsLock.RLock()
+	defer tracker.fsLock.RUnlock()
+	if tracker.contents[filepath.Join("a", "file.txt")].version.Compare(beforeA) != VERSION_EQUAL {
+		t.Fatal("a directory scanned before the interruption should not be scanned again")
+	}
+	if tracker.contents[filepath.Join("b", "file.txt")].version.Compare(beforeB) != VERSION_DOMINATES {
+		t.Fatal("the directory left to scan should be scanned")
+	}
+}
@@ -0,0 +1,435 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Instead of sending every entry, a node sends the root of a hash tree over everything it tracks. Each directory in
+// the tree hashes its own entry together with the hashes of its children. A node that gets a root different from its
+// own, and has no usable cursor into the sender's change log, walks down the sender's tree through /merkle/, only into
+// the subtrees that differ, and processes the entries it finds there as a catalog.
+
+// MERKLE_TREE_CACHE_TIME - How long a built tree is used to answer requests before it is built again. Long enough for
+// another node to walk down it without the tree changing underneath
+const MERKLE_TREE_CACHE_TIME = 2 * time.Second
+
+// merkleNode - a tracked path, or a directory that is only there because of what is inside of it
+type merkleNode struct {
+	hash      []byte
+	entryHash []byte
+	entry     *EntryJSON
+	children  []string // names, sorted
+}
+
+// merkleTree - every node of the tree by relative path. The root is "".
+type merkleTree map[string]*merkleNode
+
+// MerkleChild - one child of a directory in the tree, as sent to another node
+type MerkleChild struct {
+	Name        string
+	Hash        []byte
+	Entry       *EntryJSON `json:",omitempty"`
+	HasChildren bool
+}
+
+// MerkleResponse - a directory in the tree and its children
+type MerkleResponse struct {
+	Path     string
+	Hash     []byte
+	Children []MerkleChild
+}
+
+// merkleEntryHash - what identifies the state of a single path. Times and directory sizes differ between nodes that
+// agree on everything else, so they are left out.
+func merkleEntryHash(entry EntryJSON) []byte {
+	size := entry.Size
+	if entry.IsDirectory {
+		size = 0
+	}
+
+	sum := sha256.New()
+	fmt.Fprintf(sum, "%s\x00%t\x00%t\x00%x\x00%d\x00%s", entry.RelativePath, entry.IsDirectory, entry.Deleted, entry.Hash, size, entry.Version)
+	return sum.Sum(nil)
+}
+
+// merkleParent - the directory a path is in. The parent of a top level path is the root.
+func merkleParent(relativePath string) string {
+	parent := path.Dir(relativePath)
+	if parent == "." || parent == "/" {
+		return ""
+	}
+	return parent
+}
+
+// nodeFor - the node for a path, adding it and any missing directories above it
+func (tree merkleTree) nodeFor(relativePath string) *merkleNode {
+	node, exists := tree[relativePath]
+	if exists {
+		return node
+	}
+
+	node = &merkleNode{}
+	tree[relativePath] = node
+	if relativePath != "" {
+		parent := tree.nodeFor(merkleParent(relativePath))
+		parent.children = append(parent.children, path.Base(relativePath))
+	}
+	return node
+}
+
+// computeHash - hash a node from its own entry and its children, filling in the children first
+func (tree merkleTree) computeHash(relativePath string) []byte {
+	node := tree[relativePath]
+	sort.Strings(node.children)
+
+	sum := sha256.New()
+	sum.Write(node.entryHash)
+	for _, name := range node.children {
+		childHash := tree.computeHash(path.Join(relativePath, name))
+		fmt.Fprintf(sum, "\x00%s\x00", name)
+		sum.Write(childHash)
+	}
+	node.hash = sum.Sum(nil)
+	return node.hash
+}
+
+// buildMerkleTree - build the tree over the tracked contents and tombstones. Call when inside of a lock!
+func (handler *FilesystemTracker) buildMerkleTree() merkleTree {
+	tree := make(merkleTree, len(handler.contents)+len(handler.tombstones)+1)
+	tree.nodeFor("")
+
+	add := func(entry EntryJSON) {
+		node := tree.nodeFor(merklePath(entry.RelativePath))
+		node.entry = &entry
+		node.entryHash = merkleEntryHash(entry)
+	}
+	for relativePath, value := range handler.contents {
+		if value.FileInfo == nil || isMetadataPath(relativePath) || handler.ignore.ignored(relativePath, value.IsDir(), value.Size()) ||
+			handler.isHeldBack(relativePath) {
+			continue
+		}
+		add(catalogEntry(relativePath, value))
+	}
+	for _, entry := range handler.tombstoneEntries() {
+		if !handler.ignoresEntry(entry) && !handler.isHeldBack(entry.RelativePath) {
+			add(entry)
+		}
+	}
+
+	tree.computeHash("")
+	return tree
+}
+
+// merklePath - the form a relative path takes in the tree
+func merklePath(relativePath string) string {
+	return strings.Trim(strings.Replace(relativePath, "\\", "/", -1), "/")
+}
+
+// merkleSnapshot - a recent tree, building a new one if the last one is too old
+func (handler *FilesystemTracker) merkleSnapshot() merkleTree {
+	handler.merkleLock.Lock()
+	defer handler.merkleLock.Unlock()
+
+	if handler.merkle == nil || time.Since(handler.merkleBuilt) > MERKLE_TREE_CACHE_TIME {
+		handler.fsLock.RLock()
+		handler.merkle = handler.buildMerkleTree()
+		handler.fsLock.RUnlock()
+		handler.merkleBuilt = time.Now()
+	}
+	return handler.merkle
+}
+
+// merkleChildren - describe a directory of the tree and its children for another node
+func (handler *FilesystemTracker) merkleChildren(relativePath string) (response MerkleResponse, found bool) {
+	tree := handler.merkleSnapshot()
+	relativePath = merklePath(relativePath)
+	node, found := tree[relativePath]
+	if !found {
+		return
+	}
+
+	response = MerkleResponse{Path: relativePath, Hash: node.hash, Children: make([]MerkleChild, 0, len(node.children))}
+	for _, name := range node.children {
+		child := tree[path.Join(relativePath, name)]
+		response.Children = append(response.Children, MerkleChild{Name: name, Hash: child.hash, Entry: child.entry, HasChildren: len(child.children) > 0})
+	}
+	return response, true
+}
+
+// CatalogAnnouncement - what a node sends when it announces its catalog. The root of its tree, and how far its change
+// log has got.
+type CatalogAnnouncement struct {
+	Root     []byte
+	LogID    string
+	Sequence uint64
+}
+
+// ProcessMerkleRoot - bring in whatever another node has that we do not. If we have a cursor into its change log, the
+// changes since then are enough. Otherwise its tree is compared with ours and whatever differs is processed.
+func (handler *FilesystemTracker) ProcessMerkleRoot(event Event) {
+	remoteServer := event.Source
+	var announcement CatalogAnnouncement
+	err := json.Unmarshal(event.RawData, &announcement)
+	if err != nil {
+		log.Printf("ProcessMerkleRoot: unable to read the announcement from %s: %s", remoteServer, err)
+		return
+	}
+	latest := ChangeCursor{LogID: announcement.LogID, Sequence: announcement.Sequence}
+
+	tree := handler.merkleSnapshot()
+	if bytes.Equal(tree[""].hash, announcement.Root) {
+		log.Printf("ProcessMerkleRoot: %s has the same contents as we do", remoteServer)
+		handler.acknowledgeTombstones(remoteServer, "", true)
+		handler.setChangeCursor(remoteServer, latest)
+		return
+	}
+
+	serverMapLock.RLock()
+	server, exists := serverMap[remoteServer]
+	serverMapLock.RUnlock()
+	if !exists || server.Address == "" {
+		log.Printf("ProcessMerkleRoot: no address for %s. Unable to compare contents", remoteServer)
+		return
+	}
+
+	cursor, known := handler.changeCursor(remoteServer)
+	if known && cursor.LogID == announcement.LogID {
+		if cursor.Sequence >= announcement.Sequence {
+			log.Printf("ProcessMerkleRoot: already have every change from %s through %d", remoteServer, cursor.Sequence)
+			return
+		}
+
+		response, changes, body, err := fetchChanges(server.Address, cursor)
+		if err == nil && !response.Truncated {
+			count, err := handler.processCatalogSource(remoteServer, changes)
+			body.Close()
+			log.Printf("ProcessMerkleRoot: %d paths changed on %s since %d", count, remoteServer, cursor.Sequence)
+			if err != nil {
+				log.Printf("ProcessMerkleRoot: the changes from %s stopped early: %s", remoteServer, err)
+				return
+			}
+			handler.setChangeCursor(remoteServer, ChangeCursor{LogID: response.LogID, Sequence: response.Sequence})
+			return
+		}
+		log.Printf("ProcessMerkleRoot: unable to get the changes from %s since %d. Comparing everything. err: %v", remoteServer, cursor.Sequence, err)
+	}
+
+	walk := &merkleWalk{handler: handler, remoteServer: remoteServer, address: server.Address, tree: tree, pending: []string{""}}
+	count, err := handler.processCatalogSource(remoteServer, walk)
+	log.Printf("ProcessMerkleRoot: %d entries differ from %s", count, remoteServer)
+	if err != nil {
+		log.Printf("ProcessMerkleRoot: unable to compare contents with %s: %s", remoteServer, err)
+		return
+	}
+	handler.setChangeCursor(remoteServer, latest)
+}
+
+// merkleWalk - walks down another node's tree from the root, into the subtrees that differ from ours only, and hands
+// out their entries that are not the same as ours as it finds them
+type merkleWalk struct {
+	handler      *FilesystemTracker
+	remoteServer string
+	address      string
+	tree         merkleTree
+	pending      []string
+	found        []EntryJSON // differing entries from the directory fetched last
+}
+
+// Next - the next differing entry, fetching directories of the other tree as they are needed
+func (walk *merkleWalk) Next() (EntryJSON, error) {
+	for len(walk.found) == 0 {
+		if len(walk.pending) == 0 {
+			return EntryJSON{}, io.EOF
+		}
+		current := walk.pending[len(walk.pending)-1]
+		walk.pending = walk.pending[:len(walk.pending)-1]
+
+		response, err := fetchMerkleNode(walk.address, current)
+		if err != nil {
+			return EntryJSON{}, err
+		}
+
+		for _, child := range response.Children {
+			childPath := path.Join(current, child.Name)
+			local := walk.tree[childPath]
+			if local != nil && bytes.Equal(local.hash, child.Hash) {
+				// Everything below here is the same, including any deletions. The other side has seen them.
+				walk.handler.acknowledgeTombstones(walk.remoteServer, childPath, true)
+				continue
+			}
+
+			if child.Entry != nil && (local == nil || !bytes.Equal(local.entryHash, merkleEntryHash(*child.Entry))) {
+				walk.found = append(walk.found, *child.Entry)
+			} else if child.Entry != nil && child.Entry.Deleted {
+				walk.handler.acknowledgeTombstones(walk.remoteServer, childPath, false)
+			}
+			if child.HasChildren {
+				walk.pending = append(walk.pending, childPath)
+			}
+		}
+	}
+
+	entry := walk.found[0]
+	walk.found = walk.found[1:]
+	return entry, nil
+}
+
+// writeMerkleStream - send a directory of the tree and its children as a catalog stream
+func writeMerkleStream(w io.Writer, response MerkleResponse) error {
+	encoder, err := newCatalogEncoder(w)
+	if err == nil {
+		err = encoder.EncodeTreeNode(response.Path, response.Hash, len(response.Children) > 0)
+	}
+	for _, child := range response.Children {
+		if err != nil {
+			break
+		}
+		childPath := path.Join(response.Path, child.Name)
+		err = encoder.EncodeTreeNode(childPath, child.Hash, child.HasChildren)
+		if err == nil && child.Entry != nil {
+			entry := *child.Entry
+			entry.RelativePath = childPath
+			err = encoder.Encode(entry)
+		}
+	}
+	if err == nil {
+		err = encoder.Close()
+	}
+	return err
+}
+
+// readMerkleStream - read a directory of the tree and its children from a catalog stream
+func readMerkleStream(r io.Reader) (response MerkleResponse, err error) {
+	decoder, err := newCatalogDecoder(r)
+	if err != nil {
+		return
+	}
+	directory, treeNode, err := decoder.nextRecord()
+	if err == nil && !treeNode {
+		err = ErrCatalogStreamFormat
+	}
+	if err != nil {
+		return
+	}
+	response = MerkleResponse{Path: directory.RelativePath, Hash: directory.Hash, Children: make([]MerkleChild, 0)}
+
+	for {
+		record, treeNode, err := decoder.nextRecord()
+		if err == io.EOF {
+			return response, nil
+		} else if err != nil {
+			return response, err
+		}
+
+		if treeNode {
+			if merkleParent(record.RelativePath) != response.Path {
+				return response, ErrCatalogStreamFormat
+			}
+			response.Children = append(response.Children, MerkleChild{Name: path.Base(record.RelativePath), Hash: record.Hash, HasChildren: record.IsDirectory})
+			continue
+		}
+
+		// An entry belongs to the tree node right before it
+		last := len(response.Children) - 1
+		if last < 0 || response.Children[last].Entry != nil || path.Join(response.Path, response.Children[last].Name) != record.RelativePath {
+			return response, ErrCatalogStreamFormat
+		}
+		entry := record
+		response.Children[last].Entry = &entry
+	}
+}
+
+// fetchMerkleNode - ask another node for a directory of its tree
+func fetchMerkleNode(address, relativePath string) (response MerkleResponse, err error) {
+	values := url.Values{}
+	values.Set("path", relativePath)
+
+	req, err := http.NewRequest("GET", "http://"+address+"/merkle/?"+values.Encode(), nil)
+	if err != nil {
+		return
+	}
+
+	data := []byte(globalSettings.ManagerCredentials)
+	authHash := base64.StdEncoding.EncodeToString(data)
+	req.Header.Add("Authorization", "Basic "+authHash)
+	req.Header.Set("Accept", CATALOG_STREAM_CONTENT_TYPE)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("merkle tree for %q returned %s", relativePath, resp.Status)
+		return
+	}
+
+	if resp.Header.Get("Content-Type") == CATALOG_STREAM_CONTENT_TYPE {
+		return readMerkleStream(resp.Body)
+	}
+	// A node that does not stream its tree yet answers with JSON
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	return
+}
+
+// merkleHandler - answer another node walking down our tree
+func merkleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	server, exists := serverMap[globalSettings.Name]
+	if !exists || server.storage == nil {
+		http.Error(w, "Storage is not set up", http.StatusServiceUnavailable)
+		return
+	}
+
+	response, found := server.storage.merkleChildren(r.URL.Query().Get("path"))
+	if !found {
+		http.Error(w, "No such path", http.StatusNotFound)
+		return
+	}
+
+	if !strings.Contains(r.Header.Get("Accept"), CATALOG_STREAM_CONTENT_TYPE) {
+		// An older node that only reads JSON
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	w.Header().Set("Content-Type", CATALOG_STREAM_CONTENT_TYPE)
+	err := writeMerkleStream(w, response)
+	if err != nil {
+		log.Printf("Unable to send the tree under %q: %s", response.Path, err)
+	}
+}
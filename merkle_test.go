@@ -0,0 +1,151 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMerkleRootMatchesForSameContents(t *testing.T) {
+	first := createTracker("merkleFirst")
+	defer cleanupTracker(first)
+	second := createTracker("merkleSecond")
+	defer cleanupTracker(second)
+
+	for _, tracker := range []*FilesystemTracker{first, second} {
+		receiveTestFile(t, tracker, "docs/a.txt", "a", "nodeA", VersionVector{"nodeA": 1})
+		receiveTestFile(t, tracker, "docs/deep/b.txt", "b", "nodeB", VersionVector{"nodeB": 2})
+	}
+
+	first.fsLock.RLock()
+	firstRoot := first.buildMerkleTree()[""].hash
+	first.fsLock.RUnlock()
+	second.fsLock.RLock()
+	secondRoot := second.buildMerkleTree()[""].hash
+	second.fsLock.RUnlock()
+	if !bytes.Equal(firstRoot, secondRoot) {
+		t.Fatalf("the same contents should have the same root. %x %x", firstRoot, secondRoot)
+	}
+
+	receiveTestFile(t, second, "docs/deep/b.txt", "b", "nodeB", VersionVector{"nodeB": 3})
+	second.fsLock.RLock()
+	secondRoot = second.buildMerkleTree()[""].hash
+	second.fsLock.RUnlock()
+	if bytes.Equal(firstRoot, secondRoot) {
+		t.Fatal("a new version deep in the tree should change the root")
+	}
+}
+
+func TestMerkleExchangeOnlyDescendsIntoDifferences(t *testing.T) {
+	useTestSettings(t)
+	local := createTracker("merkleLocal")
+	defer cleanupTracker(local)
+	remote := createTracker("merkleRemote")
+	defer cleanupTracker(remote)
+
+	for _, tracker := range []*FilesystemTracker{local, remote} {
+		receiveTestFile(t, tracker, "same/inner/a.txt", "a", "nodeA", VersionVector{"nodeA": 1})
+	}
+	receiveTestFile(t, remote, "changed/b.txt", "b", "merklePeer", VersionVector{"merklePeer": 1})
+
+	// The remote tracker answers for this process while the local one compares against it
+	requested := make([]string, 0)
+	var requestedLock sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestedLock.Lock()
+		requested = append(requested, r.URL.Query().Get("path"))
+		requestedLock.Unlock()
+		merkleHandler(w, r)
+	}))
+	defer server.Close()
+
+	serverMapLock.Lock()
+	serverMap[globalSettings.Name] = &ReplicatServer{Name: globalSettings.Name, storage: remote}
+	serverMap["merklePeer"] = &ReplicatServer{Name: "merklePeer", Address: strings.TrimPrefix(server.URL, "http://")}
+	serverMapLock.Unlock()
+
+	announcement, _ := json.Marshal(CatalogAnnouncement{Root: remote.merkleSnapshot()[""].hash})
+	local.ProcessMerkleRoot(Event{Name: "replicat.MerkleRoot", Source: "merklePeer", RawData: announcement})
+
+	local.fsLock.RLock()
+	_, needed := local.neededFiles["changed/b.txt"]
+	_, sameNeeded := local.neededFiles["same/inner/a.txt"]
+	local.fsLock.RUnlock()
+	if !needed || sameNeeded {
+		t.Fatalf("only the changed file should be requested. changed: %v same: %v", needed, sameNeeded)
+	}
+
+	for _, path := range requested {
+		if strings.HasPrefix(path, "same") {
+			t.Fatalf("walked into a subtree that is the same on both sides: %v", requested)
+		}
+	}
+}
+
+func TestMerkleNodeStreamsAndFallsBackToJSON(t *testing.T) {
+	useTestSettings(t)
+	tracker := createTracker("merkleStream")
+	defer cleanupTracker(tracker)
+	receiveTestFile(t, tracker, "docs/a.txt", "a", "nodeA", VersionVector{"nodeA": 1})
+	receiveTestFile(t, tracker, "docs/deep/b.txt", "b", "nodeB", VersionVector{"nodeB": 2})
+
+	serverMapLock.Lock()
+	serverMap[globalSettings.Name] = &ReplicatServer{Name: globalSettings.Name, storage: tracker}
+	serverMapLock.Unlock()
+	server := httptest.NewServer(http.HandlerFunc(merkleHandler))
+	defer server.Close()
+
+	expected, found := tracker.merkleChildren("docs")
+	if !found {
+		t.Fatal("docs should be in the tree")
+	}
+
+	// A node that asks for a stream gets one
+	streamed, err := fetchMerkleNode(strings.TrimPrefix(server.URL, "http://"), "docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streamed.Path != expected.Path || !bytes.Equal(streamed.Hash, expected.Hash) || len(streamed.Children) != len(expected.Children) {
+		t.Fatalf("the streamed directory does not match. got %#v expected %#v", streamed, expected)
+	}
+	for i, child := range streamed.Children {
+		want := expected.Children[i]
+		if child.Name != want.Name || !bytes.Equal(child.Hash, want.Hash) || child.HasChildren != want.HasChildren || (child.Entry == nil) != (want.Entry == nil) {
+			t.Fatalf("child %d does not match. got %#v expected %#v", i, child, want)
+		}
+		if child.Entry != nil && !bytes.Equal(merkleEntryHash(*child.Entry), merkleEntryHash(*want.Entry)) {
+			t.Fatalf("the entry of %s does not match. got %#v expected %#v", child.Name, child.Entry, want.Entry)
+		}
+	}
+
+	// An older node that does not ask for one still gets JSON
+	resp, err := http.Get(server.URL + "/merkle/?path=docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var answered MerkleResponse
+	err = json.NewDecoder(resp.Body).Decode(&answered)
+	if err != nil || !bytes.Equal(answered.Hash, expected.Hash) || len(answered.Children) != len(expected.Children) {
+		t.Fatalf("an older node should get the directory as JSON. got %#v err: %v", answered, err)
+	}
+}
@@ -0,0 +1,550 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Besides their contents, files carry their metadata to the other nodes as set per directory prefix in the settings,
+// for example
+//
+//	"FolderMetadata": {"bin": ["mode", "owner"], "shared": ["mode", "xattrs", "symlinks", "hardlinks"]}
+//
+// The longest matching prefix applies, and paths that match nothing replicate their mode only. The owner goes out as
+// the numeric uid and gid, which OwnerUIDMap and OwnerGIDMap turn into the ids used here. In folders that replicate
+// symbolic links, a link is tracked as the link itself and made again from where it points on the other nodes,
+// instead of being followed. Files that are hard links to each other on the node that sent them are linked here too,
+// instead of each one being transferred. Directories have no metadata replicated.
+//
+// A change to the metadata alone is a change of the file with a version of its own. It goes out as a METADATA_EVENT
+// carrying the entry, and comes in through catalogs as an entry with the contents we already have, so the contents
+// are never sent again for it.
+
+const (
+	// METADATA_MODE - Permission bits, along with setuid, setgid and sticky
+	METADATA_MODE = "mode"
+	// METADATA_OWNER - Numeric uid and gid
+	METADATA_OWNER = "owner"
+	// METADATA_XATTRS - Extended attributes, which is where ACLs are kept
+	METADATA_XATTRS = "xattrs"
+	// METADATA_SYMLINKS - Symbolic links are replicated as links instead of as what they point to
+	METADATA_SYMLINKS = "symlinks"
+	// METADATA_HARDLINKS - Files that are hard links to each other are linked on the other nodes too
+	METADATA_HARDLINKS = "hardlinks"
+	// METADATA_EVENT - Event sent for a change that needs no contents sent with it. RawData holds the entry.
+	METADATA_EVENT = "replicat.Metadata"
+	// METADATA_MODE_BITS - The part of a mode that is replicated
+	METADATA_MODE_BITS = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+)
+
+// METADATA_ERROR_LINK_IN_PATH - a directory on the way to a path is a symbolic link, which could lead outside of the
+// synced directory
+var METADATA_ERROR_LINK_IN_PATH = errors.New("Replicat: The path goes through a symbolic link")
+
+// FileMetadata - what a file has besides its contents. Whatever its folder does not replicate is left empty.
+type FileMetadata struct {
+	Mode      os.FileMode       `json:",omitempty"`
+	Owner     *FileOwner        `json:",omitempty"`
+	Xattrs    map[string][]byte `json:",omitempty"`
+	Symlink   string            `json:",omitempty"` // where a symbolic link points. Empty for anything else
+	LinkGroup string            `json:",omitempty"` // the same for files that are hard links to each other on the node that sent them
+}
+
+// FileOwner - numeric owner of a file on the node it came from
+type FileOwner struct {
+	UID int
+	GID int
+}
+
+// metadataOptions - the metadata replicated for a folder
+type metadataOptions struct {
+	mode      bool
+	owner     bool
+	xattrs    bool
+	symlinks  bool
+	hardlinks bool
+}
+
+// validateFolderMetadata - check every configured kind of metadata is one we know
+func validateFolderMetadata(folders map[string][]string) error {
+	for prefix, kinds := range folders {
+		for _, kind := range kinds {
+			switch kind {
+			case METADATA_MODE, METADATA_OWNER, METADATA_XATTRS, METADATA_SYMLINKS, METADATA_HARDLINKS:
+			default:
+				return fmt.Errorf("folder metadata for %q: unknown metadata %q", prefix, kind)
+			}
+		}
+	}
+	return nil
+}
+
+// metadataOptionsFor - the metadata configured for the longest prefix of a path
+func metadataOptionsFor(relativePath string) (options metadataOptions) {
+	kinds, longest := []string{METADATA_MODE}, -1
+	for prefix, configured := range globalSettings.FolderMetadata {
+		if len(prefix) > longest && prefixMatches(prefix, relativePath) {
+			kinds, longest = configured, len(prefix)
+		}
+	}
+
+	for _, kind := range kinds {
+		switch kind {
+		case METADATA_MODE:
+			options.mode = true
+		case METADATA_OWNER:
+			options.owner = true
+		case METADATA_XATTRS:
+			options.xattrs = true
+		case METADATA_SYMLINKS:
+			options.symlinks = true
+		case METADATA_HARDLINKS:
+			options.hardlinks = true
+		}
+	}
+	return
+}
+
+// isEmpty - check if there is no metadata at all
+func (metadata FileMetadata) isEmpty() bool {
+	return metadata.Mode == 0 && metadata.Owner == nil && len(metadata.Xattrs) == 0 && metadata.Symlink == "" &&
+		metadata.LinkGroup == ""
+}
+
+// sameMetadata - check if two files have the same metadata
+func sameMetadata(a, b FileMetadata) bool {
+	if a.Mode != b.Mode || a.Symlink != b.Symlink || a.LinkGroup != b.LinkGroup || len(a.Xattrs) != len(b.Xattrs) {
+		return false
+	}
+	if (a.Owner == nil) != (b.Owner == nil) || (a.Owner != nil && *a.Owner != *b.Owner) {
+		return false
+	}
+	for name, value := range a.Xattrs {
+		other, found := b.Xattrs[name]
+		if !found || !bytes.Equal(value, other) {
+			return false
+		}
+	}
+	return true
+}
+
+// entryMetadata - the metadata a tracked file goes into catalogs with
+func entryMetadata(relativePath string, value Entry) (metadata FileMetadata) {
+	if value.FileInfo == nil || value.IsDir() {
+		return
+	}
+
+	options := metadataOptionsFor(relativePath)
+	if options.mode && !isSymlinkEntry(value) {
+		metadata.Mode = value.Mode() & METADATA_MODE_BITS
+	}
+	// Entries read back from the index have no owner or inode until the scan gets to them
+	stat, haveStat := value.Sys().(*syscall.Stat_t)
+	if options.owner && haveStat {
+		metadata.Owner = &FileOwner{UID: int(stat.Uid), GID: int(stat.Gid)}
+	}
+	if options.hardlinks && haveStat && uint64(stat.Nlink) > 1 {
+		metadata.LinkGroup = fmt.Sprintf("%x:%x", uint64(stat.Dev), uint64(stat.Ino))
+	}
+	if options.xattrs {
+		metadata.Xattrs = value.xattrs
+	}
+	if options.symlinks {
+		metadata.Symlink = value.symlink
+	}
+	return
+}
+
+// isSymlinkEntry - check if a path is tracked as a symbolic link
+func isSymlinkEntry(value Entry) bool {
+	return value.FileInfo != nil && value.Mode()&os.ModeSymlink != 0
+}
+
+// statTracked - the file information a path is tracked with. In folders that replicate symbolic links a link is
+// described by the link itself, everywhere else by what it points to.
+func statTracked(relativePath, fullPath string) (os.FileInfo, error) {
+	if metadataOptionsFor(relativePath).symlinks {
+		return os.Lstat(fullPath)
+	}
+	return os.Stat(fullPath)
+}
+
+// symlinkHash - the hash a symbolic link is tracked with. A link has no contents of its own, so it is where it points.
+func symlinkHash(target string) ([]byte, error) {
+	contentHash, err := newContentHash()
+	if err != nil {
+		return nil, err
+	}
+	contentHash.Write([]byte("symlink:" + target))
+	return contentHash.Sum(nil), nil
+}
+
+// captureMetadata - read the metadata of a file that its file information does not have, as far as its folder
+// replicates it. Call when inside of a lock!
+func (handler *FilesystemTracker) captureMetadata(relativePath string, entry *Entry) {
+	entry.symlink, entry.xattrs = "", nil
+	if entry.FileInfo == nil || entry.IsDir() {
+		return
+	}
+
+	fullPath := filepath.Join(handler.directory, relativePath)
+	if isSymlinkEntry(*entry) {
+		target, err := os.Readlink(fullPath)
+		if err != nil {
+			log.Printf("Unable to read the symbolic link %s: %s", relativePath, err)
+		}
+		entry.symlink = target
+		return
+	}
+
+	if metadataOptionsFor(relativePath).xattrs {
+		xattrs, err := readXattrs(fullPath)
+		if err != nil {
+			log.Printf("Unable to read the extended attributes of %s: %s", relativePath, err)
+		}
+		entry.xattrs = xattrs
+	}
+}
+
+// mapOwnerID - the id used here for an id from another node
+func mapOwnerID(mapping map[int]int, id int) int {
+	mapped, found := mapping[id]
+	if found {
+		return mapped
+	}
+	return id
+}
+
+// applyMetadata - give a file the metadata that came with it from another node, as far as its folder here replicates
+// it. Whatever can not be applied is logged and skipped, so the contents are still taken.
+func (handler *FilesystemTracker) applyMetadata(relativePath string, metadata FileMetadata) {
+	options := metadataOptionsFor(relativePath)
+	fullPath := filepath.Join(handler.directory, relativePath)
+
+	// The owner goes first, since changing it clears setuid and setgid
+	if options.owner && metadata.Owner != nil {
+		uid := mapOwnerID(globalSettings.OwnerUIDMap, metadata.Owner.UID)
+		gid := mapOwnerID(globalSettings.OwnerGIDMap, metadata.Owner.GID)
+		err := os.Lchown(fullPath, uid, gid)
+		if err != nil {
+			log.Printf("Unable to change the owner of %s to %d:%d: %s", relativePath, uid, gid, err)
+		}
+	}
+
+	// A symbolic link has no mode or extended attributes of its own
+	if metadata.Symlink != "" {
+		return
+	}
+
+	if options.mode && metadata.Mode != 0 {
+		err := os.Chmod(fullPath, metadata.Mode&METADATA_MODE_BITS)
+		if err != nil {
+			log.Printf("Unable to change the mode of %s to %s: %s", relativePath, metadata.Mode, err)
+		}
+	}
+
+	if options.xattrs {
+		current, err := readXattrs(fullPath)
+		if err != nil {
+			log.Printf("Unable to read the extended attributes of %s: %s", relativePath, err)
+		}
+		for name, value := range metadata.Xattrs {
+			existing, found := current[name]
+			if found && bytes.Equal(existing, value) {
+				continue
+			}
+			err = writeXattr(fullPath, name, value)
+			if err != nil {
+				log.Printf("Unable to set the extended attribute %s of %s: %s", name, relativePath, err)
+			}
+		}
+		for name := range current {
+			_, wanted := metadata.Xattrs[name]
+			if wanted {
+				continue
+			}
+			err = removeXattr(fullPath, name)
+			if err != nil {
+				log.Printf("Unable to remove the extended attribute %s of %s: %s", name, relativePath, err)
+			}
+		}
+	}
+}
+
+// checkParents - make sure none of the directories on the way to a path is a symbolic link, so whatever is written,
+// renamed or removed there stays inside of the directory. Directories that do not exist yet are made as real ones.
+func checkParents(directory, relativePath string) error {
+	parent := filepath.Dir(filepath.Clean(relativePath))
+	if parent == "." {
+		return nil
+	}
+
+	current := directory
+	for _, component := range strings.Split(parent, string(filepath.Separator)) {
+		current = filepath.Join(current, component)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return METADATA_ERROR_LINK_IN_PATH
+		}
+	}
+	return nil
+}
+
+// placeLink - put a link in place of a path. It is made next to the other partial files and renamed into place, so
+// the path never goes missing on the way.
+func (handler *FilesystemTracker) placeLink(relativePath string, link func(stagingPath string) error) error {
+	stagingPath := metadataPath(UPLOAD_PARTIAL_DIRECTORY, fmt.Sprintf("link-%d", time.Now().UnixNano()))
+	fullPath := filepath.Join(handler.directory, relativePath)
+
+	err := checkParents(handler.directory, relativePath)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(stagingPath), os.ModeDir+os.ModePerm)
+	}
+	if err == nil {
+		err = link(stagingPath)
+	}
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(fullPath), os.ModeDir+os.ModePerm)
+	}
+	if err == nil {
+		err = os.Rename(stagingPath, fullPath)
+	}
+	// Renaming a hard link onto another link to the same file leaves both names where they were
+	os.Remove(stagingPath)
+	return err
+}
+
+// placeSymlink - an apply for applyRemoteChange that makes a symbolic link
+func (handler *FilesystemTracker) placeSymlink(target string) func(relativePath string) error {
+	return func(relativePath string) error {
+		return handler.placeLink(relativePath, func(stagingPath string) error {
+			return os.Symlink(target, stagingPath)
+		})
+	}
+}
+
+// placeHardlink - an apply for applyRemoteChange that makes a hard link to a path we already have
+func (handler *FilesystemTracker) placeHardlink(sourcePath string) func(relativePath string) error {
+	return func(relativePath string) error {
+		return handler.placeLink(relativePath, func(stagingPath string) error {
+			err := checkParents(handler.directory, sourcePath)
+			if err != nil {
+				return err
+			}
+			return os.Link(filepath.Join(handler.directory, sourcePath), stagingPath)
+		})
+	}
+}
+
+// metadataEvent - the event that sends the entry of a path without its contents. Call when inside of a lock!
+func (handler *FilesystemTracker) metadataEvent(relativePath string) Event {
+	entry := catalogEntry(relativePath, handler.contents[relativePath])
+	rawData, _ := json.Marshal(entry)
+	return Event{Name: METADATA_EVENT, Path: relativePath, Source: globalSettings.Name, ModTime: entry.ModTime,
+		Version: entry.Version, RawData: rawData}
+}
+
+// handleNotifyAttrib - the metadata of a path changed. A change that came along with new contents is a write. A change
+// to the metadata alone is sent without the contents. Call when inside of a lock!
+func (handler *FilesystemTracker) handleNotifyAttrib(event Event, pathName, fullPath string) (err error) {
+	entry, exists := handler.contents[pathName]
+	if !exists || entry.FileInfo == nil || entry.IsDir() {
+		// New paths come with events of their own, and directories have no metadata replicated
+		return
+	}
+	if _, fromIndex := entry.FileInfo.(*indexedFileInfo); fromIndex {
+		// The scan compares it with what the index had when it gets to it
+		return
+	}
+
+	info, statErr := statTracked(pathName, fullPath)
+	if statErr != nil {
+		return
+	}
+	if !sameFileState(entry, info) {
+		event.Name = "notify.Write"
+		return handler.handleNotifyWrite(event, pathName, fullPath)
+	}
+
+	updated := entry
+	updated.FileInfo = info
+	handler.captureMetadata(pathName, &updated)
+	if sameMetadata(entryMetadata(pathName, entry), entryMetadata(pathName, updated)) {
+		// Metadata we applied on behalf of another node, or metadata that is not replicated for this folder
+		handler.contents[pathName] = updated
+		return
+	}
+
+	log.Printf("notify.InAttrib: the metadata of %s changed", pathName)
+	updated.version = updated.version.Increment(globalSettings.Name)
+	handler.contents[pathName] = updated
+	handler.contentOrigins[pathName] = globalSettings.Name
+	handler.recordChange(pathName)
+
+	metadataEvent := handler.metadataEvent(pathName)
+	if handler.shouldPublish(metadataEvent) {
+		SendEvent(metadataEvent, fullPath)
+	}
+	return
+}
+
+// applyRemoteMetadata - take a change that another node sent without contents. The metadata of a file is applied when
+// we have the same contents and their version is newer. A symbolic link is all metadata, so it is made from where it
+// points.
+func (handler *FilesystemTracker) applyRemoteMetadata(remote EntryJSON) error {
+	handler.fsLock.Lock()
+	sameContents, err := handler.mergeRemoteMetadata(remote)
+	handler.fsLock.Unlock()
+	if sameContents || err != nil || remote.Symlink == "" {
+		return err
+	}
+
+	if !metadataOptionsFor(remote.RelativePath).symlinks {
+		log.Printf("Not making the symbolic link %s. Links are not replicated in its folder here", remote.RelativePath)
+		return nil
+	}
+	return handler.applyRemoteChange(remote, handler.placeSymlink(remote.Symlink))
+}
+
+// mergeRemoteMetadata - apply the metadata of a file from another node if we have the same contents, and merge its
+// version. Reports whether the contents were the same. Call when inside of a lock!
+func (handler *FilesystemTracker) mergeRemoteMetadata(remote EntryJSON) (sameContents bool, err error) {
+	relativePath := remote.RelativePath
+	local, exists := handler.contents[relativePath]
+	if !exists || local.FileInfo == nil || local.IsDir() || remote.Hash == nil {
+		return false, nil
+	}
+
+	fullPath := filepath.Join(handler.directory, relativePath)
+	if local.hash == nil {
+		local.hash, _, _ = cachedFileHash(fullPath)
+	}
+	if !bytes.Equal(local.hash, remote.Hash) {
+		// The metadata comes along with their contents when those are transferred
+		return false, nil
+	}
+
+	if local.version.Compare(remote.Version) == VERSION_DOMINATED && folderDirectionFor(relativePath).receives() {
+		if handler.holdRemoteChange(relativePath, BREAKER_CHANGE_MODIFY, remote.ServerName, remote.Version) {
+			return true, nil
+		}
+
+		handler.applyMetadata(relativePath, remote.FileMetadata)
+		info, err := statTracked(relativePath, fullPath)
+		if err != nil {
+			return true, err
+		}
+		local.FileInfo = info
+		handler.captureMetadata(relativePath, &local)
+		handler.clearDivergence(relativePath)
+		handler.recordLinkGroup(remote, relativePath)
+	}
+
+	// With the same contents, whatever else was changed on either side is included in the merged version
+	local.version = local.version.Merge(remote.Version)
+	handler.contents[relativePath] = local
+	handler.recordChange(relativePath)
+	return true, nil
+}
+
+// linkGroupKey - names a hard link group from another node. Each node numbers its own groups.
+func linkGroupKey(server, group string) string {
+	return server + "/" + group
+}
+
+// linkToGroup - take care of a file that is a hard link on the node it comes from without transferring it. It is
+// linked to the path here that holds its group, or waits for the first path of its group to arrive. Reports whether
+// the file is taken care of.
+func (handler *FilesystemTracker) linkToGroup(remoteServer string, remote EntryJSON) bool {
+	if remote.LinkGroup == "" || !metadataOptionsFor(remote.RelativePath).hardlinks {
+		return false
+	}
+	remote.ServerName = remoteServer
+	key := linkGroupKey(remoteServer, remote.LinkGroup)
+
+	handler.fsLock.Lock()
+	defer handler.fsLock.Unlock()
+
+	linked, found := handler.linkGroups[key]
+	if found && linked != remote.RelativePath {
+		entry, exists := handler.contents[linked]
+		if exists && entry.hash == nil {
+			entry.hash, _, _ = cachedFileHash(filepath.Join(handler.directory, linked))
+		}
+		if exists && bytes.Equal(entry.hash, remote.Hash) {
+			err := handler.applyRemoteChangeLocked(remote, handler.placeHardlink(linked))
+			if err == nil || err == TRACKER_ERROR_STALE_VERSION {
+				log.Printf("Linked %s to %s, its hard link from %s", remote.RelativePath, linked, remoteServer)
+				return true
+			}
+			log.Printf("Unable to link %s to %s: %s", remote.RelativePath, linked, err)
+			return false
+		}
+	}
+
+	// Only the first path of a group is transferred. The others are linked to it when it arrives.
+	first, requested := handler.linkRequests[key]
+	needed, stillNeeded := handler.neededFiles[first]
+	if requested && first != remote.RelativePath && stillNeeded && bytes.Equal(needed.Hash, remote.Hash) {
+		if handler.pendingLinks[key] == nil {
+			handler.pendingLinks[key] = make(map[string]EntryJSON)
+		}
+		handler.pendingLinks[key][remote.RelativePath] = remote
+		return true
+	}
+	handler.linkRequests[key] = remote.RelativePath
+	return false
+}
+
+// recordLinkGroup - remember the path here that holds a hard link group from another node, and link the paths of the
+// group that were waiting for it. Call when inside of a lock!
+func (handler *FilesystemTracker) recordLinkGroup(remote EntryJSON, relativePath string) {
+	if remote.LinkGroup == "" || !metadataOptionsFor(relativePath).hardlinks {
+		return
+	}
+
+	key := linkGroupKey(remote.ServerName, remote.LinkGroup)
+	handler.linkGroups[key] = relativePath
+	waiting := handler.pendingLinks[key]
+	delete(handler.pendingLinks, key)
+	delete(handler.linkRequests, key)
+
+	for _, member := range waiting {
+		if member.RelativePath == relativePath || !bytes.Equal(member.Hash, remote.Hash) {
+			continue
+		}
+		err := handler.applyRemoteChangeLocked(member, handler.placeHardlink(relativePath))
+		if err != nil && err != TRACKER_ERROR_STALE_VERSION {
+			log.Printf("Unable to link %s to %s: %s", member.RelativePath, relativePath, err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"github.com/rjeczalik/notify"
+	"golang.org/x/sys/unix"
+	"strings"
+)
+
+// Extended attributes are read and written with the l* calls, so a symbolic link is never followed. Attributes in the
+// security namespace, such as SELinux labels and file capabilities, follow the policy of each node and are left alone.
+
+// metadataWatchEvents - what the watcher listens for besides notify.All, so changes to metadata alone are seen
+const metadataWatchEvents = notify.InAttrib
+
+// readXattrs - the extended attributes of a file. A filesystem without them has none.
+func readXattrs(fullPath string) (map[string][]byte, error) {
+	size, err := unix.Llistxattr(fullPath, nil)
+	if err == unix.ENOTSUP {
+		return nil, nil
+	}
+	if err != nil || size == 0 {
+		return nil, err
+	}
+
+	names := make([]byte, size)
+	size, err = unix.Llistxattr(fullPath, names)
+	if err != nil {
+		return nil, err
+	}
+
+	var xattrs map[string][]byte
+	for _, name := range strings.Split(string(names[:size]), "\x00") {
+		if name == "" || strings.HasPrefix(name, "security.") {
+			continue
+		}
+		value, err := readXattr(fullPath, name)
+		if err == unix.ENODATA {
+			continue
+		}
+		if err != nil {
+			return xattrs, err
+		}
+		if xattrs == nil {
+			xattrs = make(map[string][]byte)
+		}
+		xattrs[name] = value
+	}
+	return xattrs, nil
+}
+
+// readXattr - the value of one extended attribute
+func readXattr(fullPath, name string) ([]byte, error) {
+	size, err := unix.Lgetxattr(fullPath, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, size)
+	size, err = unix.Lgetxattr(fullPath, name, value)
+	if err != nil {
+		return nil, err
+	}
+	return value[:size], nil
+}
+
+// writeXattr - set an extended attribute, creating it if it is not there
+func writeXattr(fullPath, name string, value []byte) error {
+	if strings.HasPrefix(name, "security.") {
+		return nil
+	}
+	return unix.Lsetxattr(fullPath, name, value, 0)
+}
+
+// removeXattr - remove an extended attribute
+func removeXattr(fullPath, name string) error {
+	return unix.Lremovexattr(fullPath, name)
+}
@@ -0,0 +1,48 @@
+//go:build !linux
+// +build !linux
+
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"errors"
+	"github.com/rjeczalik/notify"
+)
+
+// Outside of Linux the mode, owner and links of files are replicated, but extended attributes are not.
+
+// metadataWatchEvents - what the watcher listens for besides notify.All. Nothing here reports changes to metadata
+// alone, which the scan picks up instead.
+const metadataWatchEvents notify.Event = 0
+
+// METADATA_ERROR_NO_XATTRS - Extended attributes are not supported on this platform
+var METADATA_ERROR_NO_XATTRS = errors.New("Replicat: Extended attributes are not supported here")
+
+// readXattrs - the extended attributes of a file, of which there are none here
+func readXattrs(fullPath string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// writeXattr - set an extended attribute
+func writeXattr(fullPath, name string, value []byte) error {
+	return METADATA_ERROR_NO_XATTRS
+}
+
+// removeXattr - remove an extended attribute
+func removeXattr(fullPath, name string) error {
+	return METADATA_ERROR_NO_XATTRS
+}
@@ -0,0 +1,311 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFolderMetadataOptions(t *testing.T) {
+	useTestSettings(t)
+
+	globalSettings.FolderMetadata = map[string][]string{"bin": {METADATA_MODE, METADATA_OWNER}, "bin/links": {METADATA_SYMLINKS}}
+	cases := map[string]metadataOptions{
+		"notes.txt":         {mode: true},
+		"bin/tool":          {mode: true, owner: true},
+		"bin/links/current": {symlinks: true},
+	}
+	for relativePath, expected := range cases {
+		options := metadataOptionsFor(relativePath)
+		if options != expected {
+			t.Errorf("%s: expected %+v found %+v", relativePath, expected, options)
+		}
+	}
+
+	if validateFolderMetadata(map[string][]string{"x": {"colour"}}) == nil {
+		t.Fatal("an unknown kind of metadata should be rejected")
+	}
+}
+
+func TestRemoteChangeAppliesModeAndMappedOwner(t *testing.T) {
+	useTestSettings(t)
+	globalSettings.FolderMetadata = map[string][]string{"": {METADATA_MODE, METADATA_OWNER}}
+	globalSettings.OwnerUIDMap = map[int]int{5001: os.Getuid()}
+	globalSettings.OwnerGIDMap = map[int]int{5002: os.Getgid()}
+
+	tracker := createTracker("metadataApply")
+	defer cleanupTracker(tracker)
+	globalSettings.Directory = tracker.directory
+
+	err := tracker.applyRemoteChange(EntryJSON{RelativePath: "run.sh", ServerName: "metadataPeer", Version: VersionVector{"metadataPeer": 1},
+		FileMetadata: FileMetadata{Mode: 0750, Owner: &FileOwner{UID: 5001, GID: 5002}}},
+		func(relativePath string) error {
+			return ioutil.WriteFile(filepath.Join(tracker.directory, relativePath), []byte("#!/bin/sh\n"), 0600)
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(tracker.directory, "run.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0750 {
+		t.Fatalf("the mode from the other node should be applied: %s", info.Mode())
+	}
+	stat := info.Sys().(*syscall.Stat_t)
+	if int(stat.Uid) != os.Getuid() || int(stat.Gid) != os.Getgid() {
+		t.Fatalf("the owner should be mapped to the ids used here: %d:%d", stat.Uid, stat.Gid)
+	}
+
+	// It goes out to the other nodes with the ids used here
+	entry, err := tracker.getEntryJSON("run.sh")
+	if err != nil || entry.Mode != 0750 || entry.Owner == nil || entry.Owner.UID != os.Getuid() {
+		t.Fatalf("the entry should carry the metadata. entry: %#v err: %v", entry, err)
+	}
+}
+
+func TestMetadataOnlyChangeIsNotTransferred(t *testing.T) {
+	useTestSettings(t)
+	tracker := createTracker("metadataOnly")
+	defer cleanupTracker(tracker)
+	globalSettings.Directory = tracker.directory
+
+	contentHash := trackTestFile(t, tracker, "tool", "tool", VersionVector{"metadataPeer": 1}, time.Time{})
+	fullPath := filepath.Join(tracker.directory, "tool")
+	err := os.Chmod(fullPath, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracker.ProcessCatalog(catalogEvent(t, "metadataPeer", EntryJSON{RelativePath: "tool", Hash: contentHash, Size: 4,
+		ServerName: "metadataPeer", Version: VersionVector{"metadataPeer": 2}, FileMetadata: FileMetadata{Mode: 0755}}))
+
+	info, _ := os.Stat(fullPath)
+	if info.Mode().Perm() != 0755 {
+		t.Fatalf("the newer mode should be applied: %s", info.Mode())
+	}
+	tracker.fsLock.RLock()
+	_, needed := tracker.neededFiles["tool"]
+	tracker.fsLock.RUnlock()
+	if needed {
+		t.Fatal("contents we already have should not be requested again")
+	}
+	if tracker.currentVersion("tool").Compare(VersionVector{"metadataPeer": 2}) != VERSION_EQUAL {
+		t.Fatalf("the version of the change should be taken: %s", tracker.currentVersion("tool"))
+	}
+
+	// Metadata older than what we have is not applied
+	tracker.ProcessCatalog(catalogEvent(t, "metadataPeer", EntryJSON{RelativePath: "tool", Hash: contentHash, Size: 4,
+		ServerName: "metadataPeer", Version: VersionVector{"metadataPeer": 1}, FileMetadata: FileMetadata{Mode: 0600}}))
+	info, _ = os.Stat(fullPath)
+	if info.Mode().Perm() != 0755 {
+		t.Fatalf("an older mode should not be applied: %s", info.Mode())
+	}
+}
+
+func TestSymlinkIsReplicatedAsALink(t *testing.T) {
+	useTestSettings(t)
+	globalSettings.FolderMetadata = map[string][]string{"links": {METADATA_SYMLINKS}}
+
+	tracker := createTracker("metadataSymlink")
+	defer cleanupTracker(tracker)
+	globalSettings.Directory = tracker.directory
+
+	target := "../releases/2"
+	targetHash, err := symlinkHash(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tracker.applyRemoteMetadata(EntryJSON{RelativePath: "links/current", Hash: targetHash, ServerName: "metadataPeer",
+		Version: VersionVector{"metadataPeer": 1}, FileMetadata: FileMetadata{Symlink: target}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := os.Readlink(filepath.Join(tracker.directory, "links/current"))
+	if err != nil || found != target {
+		t.Fatalf("the link should be made. target: %q err: %v", found, err)
+	}
+
+	// It is tracked as the link itself, and goes out that way
+	entry, err := tracker.getEntryJSON("links/current")
+	if err != nil || entry.Symlink != target || !bytes.Equal(entry.Hash, targetHash) {
+		t.Fatalf("the link should be tracked as a link. entry: %#v err: %v", entry, err)
+	}
+
+	// Outside of folders that replicate them, links are not made
+	err = tracker.applyRemoteMetadata(EntryJSON{RelativePath: "elsewhere", Hash: targetHash, ServerName: "metadataPeer",
+		Version: VersionVector{"metadataPeer": 1}, FileMetadata: FileMetadata{Symlink: target}})
+	_, statErr := os.Lstat(filepath.Join(tracker.directory, "elsewhere"))
+	if err != nil || !os.IsNotExist(statErr) {
+		t.Fatalf("a link should not be made where links are not replicated. err: %v stat: %v", err, statErr)
+	}
+}
+
+func TestLinksOnTheWayToAPathAreNotFollowed(t *testing.T) {
+	useTestSettings(t)
+	tracker := createTracker("metadataParents")
+	defer cleanupTracker(tracker)
+	globalSettings.Directory = tracker.directory
+
+	outside, err := ioutil.TempDir("", "metadataOutside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	err = ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(outside, filepath.Join(tracker.directory, "escape"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracker.fsLock.Lock()
+	defer tracker.fsLock.Unlock()
+
+	err = tracker.placeSymlink("/etc")("escape/planted")
+	if err != METADATA_ERROR_LINK_IN_PATH {
+		t.Fatalf("a link should not be made through a linked directory. err: %v", err)
+	}
+	err = tracker.placeHardlink("escape/secret")("copied")
+	if err != METADATA_ERROR_LINK_IN_PATH {
+		t.Fatalf("a hard link should not be made to a file through a linked directory. err: %v", err)
+	}
+	err = tracker.moveToTrash("escape/secret", "")
+	if err != METADATA_ERROR_LINK_IN_PATH {
+		t.Fatalf("nothing should be moved to the trash through a linked directory. err: %v", err)
+	}
+
+	names, _ := ioutil.ReadDir(outside)
+	if len(names) != 1 || names[0].Name() != "secret" {
+		t.Fatalf("nothing outside of the directory should change: %v", names)
+	}
+	_, err = os.Lstat(filepath.Join(tracker.directory, "copied"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("the hard link should not be made. err: %v", err)
+	}
+}
+
+func TestHardLinksWaitForTheFirstOfTheirGroup(t *testing.T) {
+	useTestSettings(t)
+	globalSettings.FolderMetadata = map[string][]string{"": {METADATA_HARDLINKS}}
+
+	tracker := createTracker("metadataHardlinks")
+	defer cleanupTracker(tracker)
+	globalSettings.Directory = tracker.directory
+
+	contents := []byte("shared library")
+	probe := filepath.Join(t.TempDir(), "probe")
+	err := ioutil.WriteFile(probe, contents, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contentHash, err := hashFile(probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := EntryJSON{RelativePath: "lib/libfoo.so.1", Hash: contentHash, Size: int64(len(contents)), ServerName: "metadataPeer",
+		Version: VersionVector{"metadataPeer": 1}, FileMetadata: FileMetadata{LinkGroup: "fd01:42"}}
+	second := first
+	second.RelativePath = "lib/libfoo.so"
+
+	if tracker.linkToGroup("metadataPeer", first) {
+		t.Fatal("the first path of a group should be transferred")
+	}
+	tracker.fsLock.Lock()
+	tracker.neededFiles[first.RelativePath] = first
+	tracker.fsLock.Unlock()
+	if !tracker.linkToGroup("metadataPeer", second) {
+		t.Fatal("the rest of a group should wait for the first instead of being transferred")
+	}
+
+	err = tracker.applyRemoteChange(first, func(relativePath string) error {
+		fullPath := filepath.Join(tracker.directory, relativePath)
+		err := os.MkdirAll(filepath.Dir(fullPath), os.ModePerm)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(fullPath, contents, 0644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	firstInfo, err := os.Stat(filepath.Join(tracker.directory, first.RelativePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondInfo, err := os.Stat(filepath.Join(tracker.directory, second.RelativePath))
+	if err != nil || !os.SameFile(firstInfo, secondInfo) {
+		t.Fatalf("the waiting path should be linked to the first when it arrives. err: %v", err)
+	}
+	if tracker.currentVersion(second.RelativePath).Compare(second.Version) != VERSION_EQUAL {
+		t.Fatalf("the linked path should take its version: %s", tracker.currentVersion(second.RelativePath))
+	}
+	entry, err := tracker.getEntryJSON(second.RelativePath)
+	if err != nil || entry.LinkGroup == "" {
+		t.Fatalf("the paths should go out as a hard link group. entry: %#v err: %v", entry, err)
+	}
+}
+
+func TestExtendedAttributesFollowTheFile(t *testing.T) {
+	useTestSettings(t)
+	globalSettings.FolderMetadata = map[string][]string{"": {METADATA_XATTRS}}
+
+	probe := filepath.Join(t.TempDir(), "probe")
+	err := ioutil.WriteFile(probe, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if writeXattr(probe, "user.probe", []byte("1")) != nil {
+		t.Skip("extended attributes are not supported here")
+	}
+
+	tracker := createTracker("metadataXattrs")
+	defer cleanupTracker(tracker)
+	globalSettings.Directory = tracker.directory
+
+	contentHash := trackTestFile(t, tracker, "photo.jpg", "photo.jpg", VersionVector{"metadataPeer": 1}, time.Time{})
+	fullPath := filepath.Join(tracker.directory, "photo.jpg")
+	err = writeXattr(fullPath, "user.stale", []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tracker.applyRemoteMetadata(EntryJSON{RelativePath: "photo.jpg", Hash: contentHash, ServerName: "metadataPeer",
+		Version: VersionVector{"metadataPeer": 2}, FileMetadata: FileMetadata{Xattrs: map[string][]byte{"user.origin": []byte("camera")}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xattrs, err := readXattrs(fullPath)
+	if err != nil || len(xattrs) != 1 || string(xattrs["user.origin"]) != "camera" {
+		t.Fatalf("the attributes should be those of the other node. found: %q err: %v", xattrs, err)
+	}
+	entry, err := tracker.getEntryJSON("photo.jpg")
+	if err != nil || string(entry.Xattrs["user.origin"]) != "camera" {
+		t.Fatalf("the entry should carry the attributes. entry: %#v err: %v", entry, err)
+	}
+}
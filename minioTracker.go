@@ -22,10 +22,12 @@ import (
 	"fmt"
 	"github.com/minio/minio-go"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"os"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 // MinioTracker - Track a filesystem and keep it in sync
@@ -453,6 +455,129 @@ func (tracker *MinioTracker) getEntryJSON(relativePath string) (entry EntryJSON,
 	return
 }
 
+func (tracker *MinioTracker) applyRemoteDelete(relativePath string, isDirectory bool, origin string, deleted time.Time, version VersionVector) error {
+	return MINOIO_TRACKER_NOT_IMPLEMENTED
+}
+
+func (tracker *MinioTracker) currentVersion(relativePath string) (version VersionVector) {
+	return
+}
+
+func (tracker *MinioTracker) mergeVersion(relativePath string, version VersionVector) {
+	return
+}
+
+func (tracker *MinioTracker) applyRemoteChange(remote EntryJSON, apply func(relativePath string) error) error {
+	return apply(remote.RelativePath)
+}
+
+func (tracker *MinioTracker) applyRemoteMetadata(remote EntryJSON) error {
+	return MINOIO_TRACKER_NOT_IMPLEMENTED
+}
+
+func (tracker *MinioTracker) ProcessMerkleRoot(event Event) {
+}
+
+func (tracker *MinioTracker) changesSince(logID string, since uint64) (response ChangesResponse) {
+	response.Truncated = true
+	return
+}
+
+func (tracker *MinioTracker) changedEntry(relativePath string) (entry EntryJSON, found bool) {
+	return
+}
+
+func (tracker *MinioTracker) merkleChildren(relativePath string) (response MerkleResponse, found bool) {
+	return
+}
+
+func (tracker *MinioTracker) conflictList() []Conflict {
+	return nil
+}
+
+func (tracker *MinioTracker) dismissConflict(path string) bool {
+	return false
+}
+
+func (tracker *MinioTracker) transferList() []Transfer {
+	return nil
+}
+
+func (tracker *MinioTracker) requestFile(entry EntryJSON) {
+}
+
+func (tracker *MinioTracker) cancelTransfer(relativePath string) bool {
+	return false
+}
+
+func (tracker *MinioTracker) transferCancelled(relativePath string) bool {
+	return false
+}
+
+func (tracker *MinioTracker) divergenceList() []Divergence {
+	return nil
+}
+
+func (tracker *MinioTracker) revertDivergence(relativePath string) bool {
+	return false
+}
+
+func (tracker *MinioTracker) trashDeletedPath(relativePath, origin string, version VersionVector) error {
+	return MINOIO_TRACKER_NOT_IMPLEMENTED
+}
+
+func (tracker *MinioTracker) trashList() []TrashItem {
+	return nil
+}
+
+func (tracker *MinioTracker) restoreFromTrash(id, relativePath string) error {
+	return MINOIO_TRACKER_NOT_IMPLEMENTED
+}
+
+func (tracker *MinioTracker) purgeTrashItem(id string) bool {
+	return false
+}
+
+func (tracker *MinioTracker) versionList(relativePath string) []FileVersion {
+	return nil
+}
+
+func (tracker *MinioTracker) restoreFileVersion(relativePath, id string) error {
+	return MINOIO_TRACKER_NOT_IMPLEMENTED
+}
+
+func (tracker *MinioTracker) createSnapshot(name string) (Snapshot, error) {
+	return Snapshot{}, MINOIO_TRACKER_NOT_IMPLEMENTED
+}
+
+func (tracker *MinioTracker) snapshotList() ([]Snapshot, error) {
+	return nil, MINOIO_TRACKER_NOT_IMPLEMENTED
+}
+
+func (tracker *MinioTracker) diffSnapshots(from, to string) ([]SnapshotChange, error) {
+	return nil, MINOIO_TRACKER_NOT_IMPLEMENTED
+}
+
+func (tracker *MinioTracker) exportSnapshot(name, prefix string, w io.Writer) error {
+	return MINOIO_TRACKER_NOT_IMPLEMENTED
+}
+
+func (tracker *MinioTracker) restoreSnapshot(name, prefix string) error {
+	return MINOIO_TRACKER_NOT_IMPLEMENTED
+}
+
+func (tracker *MinioTracker) deleteSnapshot(name string) error {
+	return MINOIO_TRACKER_NOT_IMPLEMENTED
+}
+
+func (tracker *MinioTracker) breakerList() []CircuitBreaker {
+	return nil
+}
+
+func (tracker *MinioTracker) settleBreaker(direction string, confirm bool) error {
+	return MINOIO_TRACKER_NOT_IMPLEMENTED
+}
+
 func (tracker *MinioTracker) GetStatistics() (stats map[string]string) {
 	return
 }
@@ -0,0 +1,784 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Events for each peer go through an outbound queue. Every queued event is written to a journal under the metadata
+// directory before anything is sent, so events for a peer that is down or restarting are kept (even across our own
+// restarts) and delivered in order once the peer can be reached again. An event the peer refuses outright is set aside
+// as a dead letter, where it can be looked at through the queue status, so it does not hold up the events behind it.
+//
+// Journal writes are flushed to disk together, when the sender is about to deliver or after
+// OUTBOUND_JOURNAL_SYNC_INTERVAL, so a burst of changes costs one sync instead of one for every event.
+//
+// A peer that leaves the cluster configuration may only be away for a while, so its journal is kept, and it still
+// counts for the tombstones, until it is decommissioned through the queue API or has been gone for
+// OUTBOUND_DEPARTED_RETENTION.
+
+const (
+	// OUTBOUND_QUEUE_DIRECTORY - Directory under the metadata directory holding one event journal per peer
+	OUTBOUND_QUEUE_DIRECTORY = "queue"
+	// OUTBOUND_JOURNAL_EXTENSION - Extension of the per peer journal files
+	OUTBOUND_JOURNAL_EXTENSION = ".journal"
+	// OUTBOUND_RETRY_INITIAL_DELAY - Delay before the first retry of an event that could not be delivered
+	OUTBOUND_RETRY_INITIAL_DELAY = time.Second
+	// OUTBOUND_RETRY_MAX_DELAY - The retry delay doubles with every failure in a row up to this limit
+	OUTBOUND_RETRY_MAX_DELAY = 5 * time.Minute
+	// OUTBOUND_JOURNAL_COMPACT_THRESHOLD - Number of delivered records in a journal before it is rewritten
+	OUTBOUND_JOURNAL_COMPACT_THRESHOLD = 1000
+	// OUTBOUND_JOURNAL_SYNC_INTERVAL - Longest a journal write waits before it is flushed to disk
+	OUTBOUND_JOURNAL_SYNC_INTERVAL = 50 * time.Millisecond
+	// OUTBOUND_DEPARTED_FILE - File under the queue directory with the peers that left the cluster and when
+	OUTBOUND_DEPARTED_FILE = "departed.json"
+	// OUTBOUND_DEPARTED_RETENTION - How long what is kept for a peer that left the cluster waits for it to come back
+	OUTBOUND_DEPARTED_RETENTION = 7 * 24 * time.Hour
+	// OUTBOUND_MAX_DEAD_LETTERS - Number of refused events kept for each peer. The oldest are dropped first.
+	OUTBOUND_MAX_DEAD_LETTERS = 100
+)
+
+// queuedEvent - an event waiting to be delivered to a peer
+type queuedEvent struct {
+	ID     uint64
+	Event  Event
+	Queued time.Time
+}
+
+// OUTBOUND_ERROR_PEER_ACTIVE - only a peer that has left the cluster can be decommissioned
+var OUTBOUND_ERROR_PEER_ACTIVE = errors.New("Replicat: The peer is still part of the cluster")
+
+// DeadLetter - an event a peer refused. It is not sent again.
+type DeadLetter struct {
+	ID     uint64
+	Event  Event
+	Queued time.Time
+	Failed time.Time
+	Error  string
+}
+
+// outboundJournalRecord - one line of a peer journal. A record either adds an event, marks one as delivered or sets one
+// aside as a dead letter.
+type outboundJournalRecord struct {
+	ID         uint64
+	Event      *Event `json:",omitempty"`
+	Queued     time.Time
+	Delivered  bool        `json:",omitempty"`
+	DeadLetter *DeadLetter `json:",omitempty"`
+}
+
+// OutboundQueueStatus - what is known about the events waiting for one peer
+type OutboundQueueStatus struct {
+	Peer          string
+	Depth         int
+	OldestPending time.Time
+	OldestAge     time.Duration
+	Failures      int
+	LastError     string
+	NextAttempt   time.Time
+	Departed      time.Time    `json:",omitempty"` // when the peer left the cluster, if it has
+	DeadLetters   []DeadLetter `json:",omitempty"`
+}
+
+// OutboundQueue - the ordered, journaled list of events waiting to be delivered to one peer
+type OutboundQueue struct {
+	Peer        string
+	lock        sync.Mutex
+	pending     []queuedEvent
+	deadLetters []DeadLetter
+	nextID      uint64
+	journal     *os.File
+	journalPath string
+	unsynced    bool // the journal has writes that are not flushed to disk yet
+	delivered   int
+	failures    int
+	lastError   string
+	nextAttempt time.Time
+	ready       chan struct{}
+	retry       chan struct{}
+	stop        chan struct{}
+}
+
+var outboundQueues = make(map[string]*OutboundQueue)
+var outboundQueuesLock sync.Mutex
+
+// departedPeers - the peers that left the cluster and when. Loaded on first use.
+var departedPeers map[string]time.Time
+var departedPeersLock sync.Mutex
+
+// outboundJournalPath - journal file for a peer. Peer names are escaped since they are not guaranteed to be valid file names.
+func outboundJournalPath(peer string) string {
+	return metadataPath(OUTBOUND_QUEUE_DIRECTORY, url.QueryEscape(peer)+OUTBOUND_JOURNAL_EXTENSION)
+}
+
+// getOutboundQueue - find the queue for a peer, opening its journal and starting its sender if needed
+func getOutboundQueue(peer string) (*OutboundQueue, error) {
+	outboundQueuesLock.Lock()
+	defer outboundQueuesLock.Unlock()
+
+	queue, exists := outboundQueues[peer]
+	if exists {
+		return queue, nil
+	}
+
+	queue = &OutboundQueue{
+		Peer:        peer,
+		journalPath: outboundJournalPath(peer),
+		ready:       make(chan struct{}, 1),
+		retry:       make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+	}
+
+	err := queue.load()
+	if err != nil {
+		return nil, err
+	}
+
+	outboundQueues[peer] = queue
+	go queue.run()
+
+	return queue, nil
+}
+
+// loadOutboundQueues - pick up the journals left behind by a previous run so their events get delivered
+func loadOutboundQueues() {
+	files, err := ioutil.ReadDir(metadataPath(OUTBOUND_QUEUE_DIRECTORY))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Unable to read the outbound queue directory: %s", err)
+		}
+		return
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), OUTBOUND_JOURNAL_EXTENSION) {
+			continue
+		}
+		peer, err := url.QueryUnescape(strings.TrimSuffix(file.Name(), OUTBOUND_JOURNAL_EXTENSION))
+		if err != nil {
+			log.Printf("Skipping outbound journal with an unexpected name: %s", file.Name())
+			continue
+		}
+
+		queue, err := getOutboundQueue(peer)
+		if err != nil {
+			log.Printf("Unable to load the outbound queue for %s: %s", peer, err)
+			continue
+		}
+		log.Printf("Loaded %d pending events for %s", queue.status().Depth, peer)
+	}
+}
+
+// enqueueEvent - journal an event for a peer and hand it to the sender for that peer
+func enqueueEvent(peer string, event Event) {
+	queue, err := getOutboundQueue(peer)
+	if err != nil {
+		log.Printf("Unable to open the outbound queue for %s. Event for %s will not be sent: %s", peer, event.Path, err)
+		return
+	}
+
+	err = queue.add(event)
+	if err != nil {
+		log.Printf("Unable to journal event for %s. Event for %s will not be sent: %s", peer, event.Path, err)
+	}
+}
+
+// wakeOutboundQueues - retry every peer right away instead of waiting out the backoff. Used when the cluster
+// configuration changes, which is usually what happens when a peer comes back.
+func wakeOutboundQueues() {
+	outboundQueuesLock.Lock()
+	defer outboundQueuesLock.Unlock()
+
+	for _, queue := range outboundQueues {
+		select {
+		case queue.retry <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// loadDepartedPeers - read the departed peers from disk if they have not been yet. Called with the lock held.
+func loadDepartedPeers() {
+	if departedPeers != nil {
+		return
+	}
+	departedPeers = make(map[string]time.Time)
+
+	data, err := ioutil.ReadFile(metadataPath(OUTBOUND_QUEUE_DIRECTORY, OUTBOUND_DEPARTED_FILE))
+	if err == nil {
+		err = json.Unmarshal(data, &departedPeers)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Unable to read the departed peers: %s", err)
+	}
+}
+
+// saveDepartedPeers - write the departed peers to disk. Called with the lock held.
+func saveDepartedPeers() {
+	path := metadataPath(OUTBOUND_QUEUE_DIRECTORY, OUTBOUND_DEPARTED_FILE)
+	if len(departedPeers) == 0 {
+		os.Remove(path)
+		return
+	}
+
+	data, err := json.Marshal(departedPeers)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), os.ModeDir+os.ModePerm)
+	}
+	if err == nil {
+		err = writeFileAtomic(path, data)
+	}
+	if err != nil {
+		log.Printf("Unable to save the departed peers: %s", err)
+	}
+}
+
+// peerDeparted - a peer is no longer in the cluster configuration. What is queued for it is kept in case it comes back.
+func peerDeparted(peer string) {
+	departedPeersLock.Lock()
+	defer departedPeersLock.Unlock()
+
+	loadDepartedPeers()
+	if _, exists := departedPeers[peer]; exists {
+		return
+	}
+	log.Printf("%s left the cluster. Keeping its events for %s or until it is decommissioned", peer, OUTBOUND_DEPARTED_RETENTION)
+	departedPeers[peer] = time.Now()
+	saveDepartedPeers()
+}
+
+// peerReturned - a peer is in the cluster configuration again
+func peerReturned(peer string) {
+	departedPeersLock.Lock()
+	defer departedPeersLock.Unlock()
+
+	loadDepartedPeers()
+	if _, exists := departedPeers[peer]; !exists {
+		return
+	}
+	log.Printf("%s is back in the cluster", peer)
+	delete(departedPeers, peer)
+	saveDepartedPeers()
+}
+
+// departedPeerNames - the peers that left the cluster and are not decommissioned yet
+func departedPeerNames() []string {
+	departedPeersLock.Lock()
+	defer departedPeersLock.Unlock()
+
+	loadDepartedPeers()
+	names := make([]string, 0, len(departedPeers))
+	for peer := range departedPeers {
+		names = append(names, peer)
+	}
+	return names
+}
+
+// expireDepartedPeers - decommission the peers that have been gone for longer than OUTBOUND_DEPARTED_RETENTION
+func expireDepartedPeers(now time.Time) {
+	departedPeersLock.Lock()
+	loadDepartedPeers()
+	var expired []string
+	for peer, departed := range departedPeers {
+		if now.Sub(departed) > OUTBOUND_DEPARTED_RETENTION {
+			expired = append(expired, peer)
+			delete(departedPeers, peer)
+		}
+	}
+	if len(expired) > 0 {
+		saveDepartedPeers()
+	}
+	departedPeersLock.Unlock()
+
+	for _, peer := range expired {
+		log.Printf("%s has been gone for more than %s. Decommissioning it", peer, OUTBOUND_DEPARTED_RETENTION)
+		discardOutboundQueue(peer)
+	}
+}
+
+// decommissionPeer - drop everything kept for a peer that left the cluster and is not coming back
+func decommissionPeer(peer string) error {
+	serverMapLock.RLock()
+	_, active := serverMap[peer]
+	serverMapLock.RUnlock()
+	if active {
+		return OUTBOUND_ERROR_PEER_ACTIVE
+	}
+
+	departedPeersLock.Lock()
+	loadDepartedPeers()
+	if _, exists := departedPeers[peer]; exists {
+		delete(departedPeers, peer)
+		saveDepartedPeers()
+	}
+	departedPeersLock.Unlock()
+
+	log.Printf("Decommissioning %s", peer)
+	discardOutboundQueue(peer)
+	return nil
+}
+
+// discardOutboundQueue - drop everything queued for a peer that is decommissioned
+func discardOutboundQueue(peer string) {
+	outboundQueuesLock.Lock()
+	queue, exists := outboundQueues[peer]
+	delete(outboundQueues, peer)
+	outboundQueuesLock.Unlock()
+
+	if !exists {
+		os.Remove(outboundJournalPath(peer))
+		return
+	}
+
+	close(queue.stop)
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	log.Printf("Discarding %d pending events for %s", len(queue.pending), peer)
+	queue.pending = nil
+	if queue.journal != nil {
+		queue.journal.Close()
+		queue.journal = nil
+	}
+	os.Remove(queue.journalPath)
+}
+
+// outboundQueueStatuses - the status of every peer queue, sorted by peer name
+func outboundQueueStatuses() []OutboundQueueStatus {
+	outboundQueuesLock.Lock()
+	queues := make([]*OutboundQueue, 0, len(outboundQueues))
+	for _, queue := range outboundQueues {
+		queues = append(queues, queue)
+	}
+	outboundQueuesLock.Unlock()
+
+	statuses := make([]OutboundQueueStatus, 0, len(queues))
+	for _, queue := range queues {
+		statuses = append(statuses, queue.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Peer < statuses[j].Peer })
+
+	departedPeersLock.Lock()
+	loadDepartedPeers()
+	for i := range statuses {
+		statuses[i].Departed = departedPeers[statuses[i].Peer]
+	}
+	departedPeersLock.Unlock()
+
+	return statuses
+}
+
+// outboundQueueHandler - report the depth and age of the outbound queue for each peer, or decommission a peer that
+// left the cluster with DELETE /queue/?peer=<name>
+func outboundQueueHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(outboundQueueStatuses())
+	case "DELETE":
+		peer := r.URL.Query().Get("peer")
+		if peer == "" {
+			http.Error(w, "A peer is required", http.StatusBadRequest)
+			return
+		}
+		err := decommissionPeer(peer)
+		if err == OUTBOUND_ERROR_PEER_ACTIVE {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// load - replay the journal into memory and rewrite it so it only holds the pending events and dead letters
+func (queue *OutboundQueue) load() error {
+	journal, err := os.Open(queue.journalPath)
+	if err == nil {
+		decoder := json.NewDecoder(journal)
+		index := make(map[uint64]int)
+		for {
+			var record outboundJournalRecord
+			err = decoder.Decode(&record)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				// A crash part way through an append leaves a damaged last record. Everything before it is good.
+				log.Printf("Outbound journal for %s ends with a damaged record. Ignoring the rest: %s", queue.Peer, err)
+				break
+			}
+
+			if record.ID >= queue.nextID {
+				queue.nextID = record.ID + 1
+			}
+
+			if record.Delivered || record.DeadLetter != nil {
+				position, exists := index[record.ID]
+				if exists {
+					queue.pending[position].ID = 0
+				}
+				if record.DeadLetter != nil {
+					queue.addDeadLetter(*record.DeadLetter)
+				}
+				continue
+			}
+
+			if record.Event != nil {
+				index[record.ID] = len(queue.pending)
+				queue.pending = append(queue.pending, queuedEvent{ID: record.ID, Event: *record.Event, Queued: record.Queued})
+			}
+		}
+		journal.Close()
+
+		// IDs start at one, so zero marks the events that were delivered
+		remaining := queue.pending[:0]
+		for _, item := range queue.pending {
+			if item.ID != 0 {
+				remaining = append(remaining, item)
+			}
+		}
+		queue.pending = remaining
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if queue.nextID == 0 {
+		queue.nextID = 1
+	}
+
+	return queue.compact()
+}
+
+// compact - rewrite the journal with just the pending events and dead letters. Called with the lock held.
+func (queue *OutboundQueue) compact() error {
+	// The journal is replaced as a whole, so what was not flushed yet does not matter
+	if queue.journal != nil {
+		queue.journal.Close()
+		queue.journal = nil
+	}
+	queue.unsynced = false
+
+	if len(queue.pending) == 0 && len(queue.deadLetters) == 0 {
+		err := os.Remove(queue.journalPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		queue.delivered = 0
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(queue.journalPath), os.ModeDir+os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	temporaryPath := queue.journalPath + ".tmp"
+	temporary, err := os.Create(temporaryPath)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(temporary)
+	for i := range queue.deadLetters {
+		deadLetter := &queue.deadLetters[i]
+		err = encoder.Encode(outboundJournalRecord{ID: deadLetter.ID, DeadLetter: deadLetter})
+		if err != nil {
+			temporary.Close()
+			return err
+		}
+	}
+	for i := range queue.pending {
+		item := &queue.pending[i]
+		err = encoder.Encode(outboundJournalRecord{ID: item.ID, Event: &item.Event, Queued: item.Queued})
+		if err != nil {
+			temporary.Close()
+			return err
+		}
+	}
+
+	err = temporary.Sync()
+	temporary.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(temporaryPath, queue.journalPath)
+	if err != nil {
+		return err
+	}
+	syncDirectory(filepath.Dir(queue.journalPath))
+
+	queue.delivered = 0
+	return nil
+}
+
+// appendRecord - add a record to the end of the journal. It is flushed to disk along with the records written around
+// it. Called with the lock held.
+func (queue *OutboundQueue) appendRecord(record outboundJournalRecord) error {
+	if queue.journal == nil {
+		err := os.MkdirAll(filepath.Dir(queue.journalPath), os.ModeDir+os.ModePerm)
+		if err != nil {
+			return err
+		}
+
+		queue.journal, err = os.OpenFile(queue.journalPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	_, err = queue.journal.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+
+	if !queue.unsynced {
+		queue.unsynced = true
+		time.AfterFunc(OUTBOUND_JOURNAL_SYNC_INTERVAL, queue.syncJournal)
+	}
+	return nil
+}
+
+// syncJournal - flush whatever was written to the journal since the last flush to disk
+func (queue *OutboundQueue) syncJournal() {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	if !queue.unsynced || queue.journal == nil {
+		return
+	}
+	queue.unsynced = false
+
+	err := queue.journal.Sync()
+	if err != nil {
+		log.Printf("Unable to flush the outbound journal for %s: %s", queue.Peer, err)
+	}
+}
+
+// add - journal an event and wake the sender
+func (queue *OutboundQueue) add(event Event) error {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	item := queuedEvent{ID: queue.nextID, Event: event, Queued: time.Now()}
+	err := queue.appendRecord(outboundJournalRecord{ID: item.ID, Event: &item.Event, Queued: item.Queued})
+	if err != nil {
+		return err
+	}
+
+	queue.nextID++
+	queue.pending = append(queue.pending, item)
+
+	select {
+	case queue.ready <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// head - the oldest pending event, if there is one
+func (queue *OutboundQueue) head() (item queuedEvent, exists bool) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	if len(queue.pending) == 0 {
+		return
+	}
+	return queue.pending[0], true
+}
+
+// markDelivered - remove the oldest pending event now that the peer has it
+func (queue *OutboundQueue) markDelivered(id uint64) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	queue.failures = 0
+	queue.lastError = ""
+	queue.nextAttempt = time.Time{}
+
+	if len(queue.pending) == 0 || queue.pending[0].ID != id {
+		return
+	}
+	queue.pending[0] = queuedEvent{}
+	queue.pending = queue.pending[1:]
+	queue.delivered++
+
+	var err error
+	if len(queue.pending) == 0 || queue.delivered >= OUTBOUND_JOURNAL_COMPACT_THRESHOLD {
+		err = queue.compact()
+	} else {
+		err = queue.appendRecord(outboundJournalRecord{ID: id, Delivered: true})
+	}
+	if err != nil {
+		// The event may be sent again after a restart. Peers already have to cope with repeated events.
+		log.Printf("Unable to record delivery of event %d to %s: %s", id, queue.Peer, err)
+	}
+}
+
+// markDeadLetter - set the oldest pending event aside after the peer refused it
+func (queue *OutboundQueue) markDeadLetter(id uint64, reason error) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	queue.failures = 0
+	queue.lastError = ""
+	queue.nextAttempt = time.Time{}
+
+	if len(queue.pending) == 0 || queue.pending[0].ID != id {
+		return
+	}
+	item := queue.pending[0]
+	queue.pending[0] = queuedEvent{}
+	queue.pending = queue.pending[1:]
+
+	deadLetter := DeadLetter{ID: item.ID, Event: item.Event, Queued: item.Queued, Failed: time.Now(), Error: reason.Error()}
+	queue.addDeadLetter(deadLetter)
+
+	err := queue.appendRecord(outboundJournalRecord{ID: id, DeadLetter: &deadLetter})
+	if err != nil {
+		// The event will be sent again after a restart and most likely refused again
+		log.Printf("Unable to record the refusal of event %d by %s: %s", id, queue.Peer, err)
+	}
+}
+
+// addDeadLetter - keep a refused event, dropping the oldest once there are too many. Called with the lock held.
+func (queue *OutboundQueue) addDeadLetter(deadLetter DeadLetter) {
+	queue.deadLetters = append(queue.deadLetters, deadLetter)
+	if len(queue.deadLetters) > OUTBOUND_MAX_DEAD_LETTERS {
+		queue.deadLetters = append([]DeadLetter(nil), queue.deadLetters[len(queue.deadLetters)-OUTBOUND_MAX_DEAD_LETTERS:]...)
+	}
+}
+
+// markFailed - remember why the oldest pending event could not be delivered and when it will be tried again
+func (queue *OutboundQueue) markFailed(err error, delay time.Duration) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	queue.failures++
+	queue.lastError = err.Error()
+	queue.nextAttempt = time.Now().Add(delay)
+}
+
+// status - the current depth and age of the queue
+func (queue *OutboundQueue) status() OutboundQueueStatus {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	status := OutboundQueueStatus{Peer: queue.Peer, Depth: len(queue.pending), Failures: queue.failures, LastError: queue.lastError, NextAttempt: queue.nextAttempt}
+	if len(queue.pending) > 0 {
+		status.OldestPending = queue.pending[0].Queued
+		status.OldestAge = time.Since(status.OldestPending)
+	}
+	status.DeadLetters = append(status.DeadLetters, queue.deadLetters...)
+
+	return status
+}
+
+// outboundAddress - where events for a peer go right now. The address is looked up on every attempt since a peer that
+// restarts may come back somewhere else.
+func outboundAddress(peer string) (address string, err error) {
+	if peer == REPLICAT_MANAGER_NAME {
+		address = globalSettings.ManagerAddress
+	} else {
+		serverMapLock.RLock()
+		server, exists := serverMap[peer]
+		if exists {
+			address = server.Address
+		}
+		serverMapLock.RUnlock()
+	}
+
+	if address == "" {
+		err = fmt.Errorf("no address known for %s", peer)
+	}
+	return
+}
+
+// run - deliver the events for this peer in order, backing off while the peer can not be reached
+func (queue *OutboundQueue) run() {
+	delay := OUTBOUND_RETRY_INITIAL_DELAY
+
+	for {
+		item, exists := queue.head()
+		if !exists {
+			select {
+			case <-queue.ready:
+			case <-queue.retry:
+			case <-queue.stop:
+				return
+			}
+			continue
+		}
+
+		// Nothing goes out before it is on disk here, so a peer never has an event we could lose
+		queue.syncJournal()
+
+		address, err := outboundAddress(queue.Peer)
+		if err == nil {
+			err = deliverEvent(queue.Peer, &item.Event, address, globalSettings.ManagerCredentials)
+		}
+
+		if err == nil {
+			queue.markDelivered(item.ID)
+			delay = OUTBOUND_RETRY_INITIAL_DELAY
+			continue
+		}
+
+		if _, rejected := err.(*EventRejectedError); rejected {
+			log.Printf("%s refused %s for %s. Moving on to the next event: %s", queue.Peer, item.Event.Name, item.Event.Path, err)
+			queue.markDeadLetter(item.ID, err)
+			delay = OUTBOUND_RETRY_INITIAL_DELAY
+			continue
+		}
+
+		queue.markFailed(err, delay)
+		log.Printf("Unable to deliver %s for %s to %s. Trying again in %s: %s", item.Event.Name, item.Event.Path, queue.Peer, delay, err)
+
+		select {
+		case <-time.After(delay):
+			delay *= 2
+			if delay > OUTBOUND_RETRY_MAX_DELAY {
+				delay = OUTBOUND_RETRY_MAX_DELAY
+			}
+		case <-queue.retry:
+			delay = OUTBOUND_RETRY_INITIAL_DELAY
+		case <-queue.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,309 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOutboundJournalSurvivesRestart(t *testing.T) {
+	useTestSettings(t)
+	directory, err := ioutil.TempDir("", "outboundJournal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	globalSettings.Directory = directory
+
+	first := &OutboundQueue{Peer: "restartPeer", journalPath: outboundJournalPath("restartPeer")}
+	err = first.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"a.txt", "b.txt", "c.txt"} {
+		err = first.add(Event{Name: "notify.Remove", Path: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	item, _ := first.head()
+	first.markDelivered(item.ID)
+	first.journal.Close()
+
+	// Simulate a crash part way through writing a record
+	journal, _ := os.OpenFile(first.journalPath, os.O_WRONLY|os.O_APPEND, 0600)
+	journal.WriteString(`{"ID":9,"Event":{"Na`)
+	journal.Close()
+
+	second := &OutboundQueue{Peer: "restartPeer", journalPath: outboundJournalPath("restartPeer")}
+	err = second.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := second.status()
+	if status.Depth != 2 {
+		t.Fatalf("expected 2 pending events after the restart, got %d", status.Depth)
+	}
+	item, _ = second.head()
+	if item.Event.Path != "b.txt" {
+		t.Fatalf("expected b.txt to be next, got %s", item.Event.Path)
+	}
+
+	err = second.add(Event{Name: "notify.Remove", Path: "d.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.pending[2].ID <= item.ID {
+		t.Fatalf("event ids should keep increasing across restarts: %#v", second.pending)
+	}
+	second.journal.Close()
+}
+
+func TestOutboundQueueDrainsWhenPeerReturns(t *testing.T) {
+	useTestSettings(t)
+	directory, err := ioutil.TempDir("", "outboundDrain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	globalSettings.Directory = directory
+
+	var received []string
+	var receivedLock sync.Mutex
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event Event
+		json.NewDecoder(r.Body).Decode(&event)
+		receivedLock.Lock()
+		received = append(received, event.Path)
+		receivedLock.Unlock()
+	}))
+	defer peer.Close()
+
+	// The peer is not part of the cluster yet, so nothing can be delivered
+	enqueueEvent("drainPeer", Event{Name: "notify.Remove", Path: "first"})
+	enqueueEvent("drainPeer", Event{Name: "notify.Remove", Path: "second"})
+	defer discardOutboundQueue("drainPeer")
+
+	queue, _ := getOutboundQueue("drainPeer")
+	time.Sleep(100 * time.Millisecond)
+	status := queue.status()
+	if status.Depth != 2 || status.OldestPending.IsZero() || status.LastError == "" {
+		t.Fatalf("expected two undelivered events, got %#v", status)
+	}
+
+	serverMapLock.Lock()
+	serverMap["drainPeer"] = &ReplicatServer{Name: "drainPeer", Address: strings.TrimPrefix(peer.URL, "http://")}
+	serverMapLock.Unlock()
+	wakeOutboundQueues()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for queue.status().Depth != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("queue never drained: %#v", queue.status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	receivedLock.Lock()
+	defer receivedLock.Unlock()
+	if len(received) != 2 || received[0] != "first" || received[1] != "second" {
+		t.Fatalf("events were not delivered in order: %v", received)
+	}
+
+	_, err = os.Stat(queue.journalPath)
+	if !os.IsNotExist(err) {
+		t.Fatalf("an empty queue should not leave a journal behind. err: %v", err)
+	}
+}
+
+func TestOutboundQueueSetsRefusedEventsAside(t *testing.T) {
+	useTestSettings(t)
+	directory, err := ioutil.TempDir("", "outboundRefused")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	globalSettings.Directory = directory
+
+	var received []string
+	var receivedLock sync.Mutex
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event Event
+		json.NewDecoder(r.Body).Decode(&event)
+		if event.Path == "refused" {
+			http.Error(w, "bad path", http.StatusBadRequest)
+			return
+		}
+		receivedLock.Lock()
+		received = append(received, event.Path)
+		receivedLock.Unlock()
+	}))
+	defer peer.Close()
+
+	serverMapLock.Lock()
+	serverMap["refusingPeer"] = &ReplicatServer{Name: "refusingPeer", Address: strings.TrimPrefix(peer.URL, "http://")}
+	serverMapLock.Unlock()
+
+	enqueueEvent("refusingPeer", Event{Name: "notify.Remove", Path: "before"})
+	enqueueEvent("refusingPeer", Event{Name: "notify.Remove", Path: "refused"})
+	enqueueEvent("refusingPeer", Event{Name: "notify.Remove", Path: "after"})
+	defer discardOutboundQueue("refusingPeer")
+
+	queue, _ := getOutboundQueue("refusingPeer")
+	deadline := time.Now().Add(10 * time.Second)
+	for queue.status().Depth != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("a refused event should not hold up the queue: %#v", queue.status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	receivedLock.Lock()
+	if len(received) != 2 || received[0] != "before" || received[1] != "after" {
+		t.Fatalf("expected the events around the refused one to be delivered in order: %v", received)
+	}
+	receivedLock.Unlock()
+
+	status := queue.status()
+	if len(status.DeadLetters) != 1 || status.DeadLetters[0].Event.Path != "refused" || status.DeadLetters[0].Error == "" {
+		t.Fatalf("expected the refused event to be a dead letter: %#v", status)
+	}
+
+	// Dead letters are journaled like pending events
+	reloaded := &OutboundQueue{Peer: "refusingPeer", journalPath: queue.journalPath}
+	err = reloaded.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	status = reloaded.status()
+	if status.Depth != 0 || len(status.DeadLetters) != 1 || status.DeadLetters[0].Event.Path != "refused" {
+		t.Fatalf("expected the dead letter to survive a restart: %#v", status)
+	}
+}
+
+func TestOutboundJournalIsFlushedTogether(t *testing.T) {
+	useTestSettings(t)
+	directory, err := ioutil.TempDir("", "outboundFlush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	globalSettings.Directory = directory
+
+	queue := &OutboundQueue{Peer: "flushPeer", journalPath: outboundJournalPath("flushPeer")}
+	err = queue.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"a.txt", "b.txt", "c.txt"} {
+		err = queue.add(Event{Name: "notify.Remove", Path: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	queue.lock.Lock()
+	unsynced := queue.unsynced
+	queue.lock.Unlock()
+	if !unsynced {
+		t.Fatal("adding an event should not wait for the journal to be flushed")
+	}
+
+	deadline := time.Now().Add(20 * OUTBOUND_JOURNAL_SYNC_INTERVAL)
+	for {
+		queue.lock.Lock()
+		unsynced = queue.unsynced
+		queue.lock.Unlock()
+		if !unsynced {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the journal should be flushed shortly after the events were added")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	queue.journal.Close()
+
+	reloaded := &OutboundQueue{Peer: "flushPeer", journalPath: queue.journalPath}
+	err = reloaded.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if depth := reloaded.status().Depth; depth != 3 {
+		t.Fatalf("expected all 3 events in the journal, got %d", depth)
+	}
+}
+
+func TestDepartedPeerQueueIsKeptUntilDecommissioned(t *testing.T) {
+	useTestSettings(t)
+	directory, err := ioutil.TempDir("", "outboundDeparted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	globalSettings.Directory = directory
+	departedPeers = nil
+	defer func() { departedPeers = nil }()
+
+	serverMapLock.Lock()
+	serverMap["departingPeer"] = &ReplicatServer{Name: "departingPeer"}
+	serverMapLock.Unlock()
+
+	enqueueEvent("departingPeer", Event{Name: "notify.Remove", Path: "waiting"})
+	queue, _ := getOutboundQueue("departingPeer")
+	defer discardOutboundQueue("departingPeer")
+	if decommissionPeer("departingPeer") != OUTBOUND_ERROR_PEER_ACTIVE {
+		t.Fatal("a peer still in the cluster should not be decommissioned")
+	}
+
+	serverMapLock.Lock()
+	delete(serverMap, "departingPeer")
+	serverMapLock.Unlock()
+	peerDeparted("departingPeer")
+
+	// Gone for less than the retention, so everything is kept. The list survives a restart.
+	expireDepartedPeers(time.Now())
+	departedPeers = nil
+	var status OutboundQueueStatus
+	for _, status = range outboundQueueStatuses() {
+		if status.Peer == "departingPeer" {
+			break
+		}
+	}
+	if status.Peer != "departingPeer" || status.Depth != 1 || status.Departed.IsZero() {
+		t.Fatalf("the events for a departed peer should be kept: %#v", status)
+	}
+	_, err = os.Stat(queue.journalPath)
+	if err != nil {
+		t.Fatalf("the journal of a departed peer should be kept. err: %v", err)
+	}
+
+	expireDepartedPeers(time.Now().Add(OUTBOUND_DEPARTED_RETENTION + time.Hour))
+	_, err = os.Stat(queue.journalPath)
+	if !os.IsNotExist(err) || len(departedPeerNames()) != 0 {
+		t.Fatalf("a peer gone for longer than the retention should be decommissioned. err: %v", err)
+	}
+}
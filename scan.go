@@ -0,0 +1,321 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// A scan walks the directory with a directoryWalker and brings the tracked contents up to date with what it finds.
+// When the tracker starts from its index, the scan runs in the background and only has to stat each path. Paths whose
+// size, modification time or inode changed get a new version and are hashed again, paths that are gone get a
+// tombstone, and new paths are added. Progress is checkpointed every TRACKER_SCAN_CHECKPOINT_DIRECTORIES directories so
+// a scan that is interrupted carries on from where it was instead of starting over.
+
+const (
+	// TRACKER_SCAN_CHECKPOINT_FILE - File under the metadata directory holding the progress of the current scan
+	TRACKER_SCAN_CHECKPOINT_FILE = "scan.json"
+	// TRACKER_SCAN_CHECKPOINT_DIRECTORIES - A checkpoint is taken after scanning this many directories
+	TRACKER_SCAN_CHECKPOINT_DIRECTORIES = 1000
+)
+
+// scanCheckpoint - how far a scan has got. The directories already scanned are in the index.
+type scanCheckpoint struct {
+	Pending  []string // directories still to be scanned, relative to the tracked directory
+	Complete bool
+}
+
+func (handler *FilesystemTracker) scanCheckpointPath() string {
+	return filepath.Join(handler.directory, REPLICAT_METADATA_DIRECTORY, TRACKER_SCAN_CHECKPOINT_FILE)
+}
+
+// startScan - pick up an interrupted scan where its checkpoint left off, or start a new one. Call when inside of a lock!
+func (handler *FilesystemTracker) startScan(indexed int) {
+	var checkpoint scanCheckpoint
+	data, err := ioutil.ReadFile(handler.scanCheckpointPath())
+	if err == nil {
+		err = json.Unmarshal(data, &checkpoint)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Unable to read the scan checkpoint. Scanning everything: %s", err)
+	}
+
+	// Without an index there is nothing the directories already scanned could have been kept in
+	if err == nil && indexed > 0 && !checkpoint.Complete {
+		log.Printf("Resuming the interrupted scan with %d directories to go", len(checkpoint.Pending))
+		handler.scan = checkpoint
+		return
+	}
+	handler.scan = scanCheckpoint{Pending: []string{""}}
+}
+
+// checkpointScan - write out the index and then how far the scan has got. Call when inside of a lock!
+func (handler *FilesystemTracker) checkpointScan() {
+	// Without an index there is nothing to resume from. It is also gone once the tracker has been shut down.
+	if handler.index == nil {
+		return
+	}
+
+	err := handler.flushIndex()
+	if err == nil {
+		var data []byte
+		data, err = json.Marshal(handler.scan)
+		if err == nil {
+			err = writeFileAtomic(handler.scanCheckpointPath(), data)
+		}
+	}
+	if err != nil {
+		log.Printf("Unable to checkpoint the scan: %s", err)
+	}
+}
+
+// scanFolders - scan what is left of the current scan. Call when inside of a lock, unless background is set. In the
+// background the lock is only taken while applying what each directory holds, so the tracker carries on meanwhile.
+func (handler *FilesystemTracker) scanFolders(background bool) error {
+	log.Printf("FileSystemTracker ScanFolders - start. File Root: '%s' background: %v", handler.directory, background)
+	lock := func() {
+		if background {
+			handler.fsLock.Lock()
+		}
+	}
+	unlock := func() {
+		if background {
+			handler.fsLock.Unlock()
+		}
+	}
+
+	lock()
+	startSequence := handler.changes.lastSequence()
+	walker := newDirectoryWalker(handler.directory, handler.scan.Pending, true)
+	unlock()
+
+	scanned := 0
+	stopped := false
+	var scanErr error
+	err := walker.run(func(relativeDirectory string, infos []os.FileInfo, err error) ([]string, bool) {
+		lock()
+		defer unlock()
+
+		if background && handler.index == nil {
+			log.Printf("scanFolders: the tracker has been shut down. Stopping")
+			stopped = true
+			return nil, false
+		}
+		if err != nil && relativeDirectory == "" {
+			scanErr = err
+			return nil, false
+		}
+
+		var subdirectories []string
+		if os.IsNotExist(err) {
+			// Gone since its parent was scanned
+			handler.removeMissingPath(relativeDirectory)
+		} else if err != nil {
+			log.Printf("scanFolders: unable to scan %s: %s", relativeDirectory, err)
+		} else {
+			subdirectories = handler.applyScanDirectory(relativeDirectory, infos)
+		}
+
+		scanned++
+		if scanned%TRACKER_SCAN_CHECKPOINT_DIRECTORIES == 0 {
+			// The directory being applied is still pending, so an interrupted scan looks at it again
+			handler.scan.Pending = append(walker.remaining(), subdirectories...)
+			handler.checkpointScan()
+		}
+		return subdirectories, true
+	})
+	if err == nil {
+		err = scanErr
+	}
+	if err != nil || stopped {
+		return err
+	}
+
+	lock()
+	handler.scan.Pending = nil
+	handler.scan.Complete = true
+	handler.indexChildren = nil
+	handler.checkpointScan()
+	log.Printf("FileSystemTracker ScanFolders - end. %d directories, %d paths", scanned, len(handler.contents))
+
+	// Anything that changed while we were not running has to reach the other nodes
+	if background && handler.changes.lastSequence() != startSequence {
+		handler.SendCatalog()
+	}
+	unlock()
+	return nil
+}
+
+// applyScanDirectory - bring the tracked contents of a directory up to date with what is on disk, and return the
+// directories inside of it. Call when inside of a lock!
+func (handler *FilesystemTracker) applyScanDirectory(relativeDirectory string, infos []os.FileInfo) (subdirectories []string) {
+	found := make(map[string]bool, len(infos))
+	for _, info := range infos {
+		relativePath := filepath.Join(relativeDirectory, info.Name())
+		// replicat's own state is not part of the content
+		if isMetadataPath(relativePath) {
+			continue
+		}
+		found[info.Name()] = true
+
+		// In folders that replicate symbolic links, a link is tracked as itself instead of as what it points to
+		if metadataOptionsFor(relativePath).symlinks {
+			linkInfo, err := os.Lstat(filepath.Join(handler.directory, relativePath))
+			if err == nil && linkInfo.Mode()&os.ModeSymlink != 0 {
+				info = linkInfo
+			}
+		}
+
+		// Neither is what the ignore files and settings leave out. It is dropped if it was tracked before, without
+		// being deleted anywhere else.
+		if handler.ignoresInfo(relativePath, info) {
+			handler.forgetIgnoredPath(relativePath)
+			continue
+		}
+		// Paths deleted elsewhere that an archive node keeps are not tracked, and neither is anything below them
+		if handler.isArchived(relativePath) {
+			continue
+		}
+		if info.IsDir() {
+			subdirectories = append(subdirectories, relativePath)
+		}
+
+		entry, exists := handler.contents[relativePath]
+		if exists {
+			indexed, fromIndex := entry.FileInfo.(*indexedFileInfo)
+			if !fromIndex {
+				// Already being tracked from the filesystem itself
+				continue
+			}
+
+			entry.FileInfo = info
+			handler.captureMetadata(relativePath, &entry)
+			if !indexed.matches(info) {
+				entry.hash = nil
+				entry.version = versionChangedWhileAway(entry.version, handler.tombstones[relativePath])
+				handler.recordChange(relativePath)
+				if info.IsDir() {
+					handler.flagDivergence(relativePath, false)
+				} else {
+					handler.holdLocalChange(relativePath, BREAKER_CHANGE_MODIFY)
+				}
+			}
+			handler.contents[relativePath] = entry
+			if !info.IsDir() && entry.hash == nil {
+				handler.queueHash(relativePath)
+			}
+			continue
+		}
+
+		if info.IsDir() {
+			handler.stats.TotalFolders++
+		} else {
+			handler.stats.TotalFiles++
+		}
+
+		entry = *NewDirectoryFromFileInfo(&info)
+		if handler.setup {
+			// Before the tracker is set up, loadState gives new paths their versions
+			entry.version = versionChangedWhileAway(nil, handler.tombstones[relativePath])
+			handler.clearTombstone(relativePath)
+			handler.recordChange(relativePath)
+			handler.holdLocalChange(relativePath, BREAKER_CHANGE_CREATE)
+		} else {
+			handler.markIndexDirty(relativePath)
+		}
+		handler.contents[relativePath] = entry
+
+		// Hashes are filled in by the background workers so the scan does not wait on reading every file
+		if !info.IsDir() {
+			handler.queueHash(relativePath)
+		}
+	}
+
+	// Whatever the index had here that is no longer on disk was deleted while we were not running
+	for _, name := range handler.indexChildren[relativeDirectory] {
+		if !found[name] {
+			handler.removeMissingPath(filepath.Join(relativeDirectory, name))
+		}
+	}
+	delete(handler.indexChildren, relativeDirectory)
+
+	return subdirectories
+}
+
+// matches - check if a path is still what the index says it was
+func (info *indexedFileInfo) matches(current os.FileInfo) bool {
+	if info.IsDir() != current.IsDir() {
+		return false
+	}
+	if info.IsDir() {
+		return true
+	}
+	if info.mode != current.Mode() || info.size != current.Size() || !info.modTime.Equal(current.ModTime()) {
+		return false
+	}
+	key, ok := hashCacheKeyFromInfo(current)
+	return !ok || info.inode == 0 || (key.Device == info.device && key.Inode == info.inode)
+}
+
+// removeMissingPath - a path the index has was deleted while we were not running. It gets a tombstone, as does
+// everything the index has below it. Call when inside of a lock!
+func (handler *FilesystemTracker) removeMissingPath(relativePath string) {
+	for _, name := range handler.indexChildren[relativePath] {
+		handler.removeMissingPath(filepath.Join(relativePath, name))
+	}
+	delete(handler.indexChildren, relativePath)
+
+	entry, exists := handler.contents[relativePath]
+	_, fromIndex := entry.FileInfo.(*indexedFileInfo)
+	if !exists || !fromIndex {
+		// Being tracked from the filesystem itself, so anything that happened to it is already known
+		return
+	}
+
+	log.Printf("scanFolders: %s was deleted while we were not running", relativePath)
+	delete(handler.contents, relativePath)
+	handler.addLocalTombstone(relativePath, entry.IsDir(), entry.version.Increment(globalSettings.Name))
+	handler.holdLocalChange(relativePath, BREAKER_CHANGE_DELETE)
+}
+
+// forgetIgnoredPath - stop tracking a path the index has that is now ignored, and everything the index has below it.
+// Call when inside of a lock!
+func (handler *FilesystemTracker) forgetIgnoredPath(relativePath string) {
+	for _, name := range handler.indexChildren[relativePath] {
+		handler.forgetIgnoredPath(filepath.Join(relativePath, name))
+	}
+	delete(handler.indexChildren, relativePath)
+
+	entry, exists := handler.contents[relativePath]
+	_, fromIndex := entry.FileInfo.(*indexedFileInfo)
+	if exists && fromIndex {
+		delete(handler.contents, relativePath)
+		handler.markIndexDirty(relativePath)
+	}
+}
+
+// versionChangedWhileAway - the version for a path that was changed here while we were not watching. Something
+// recreated after it was deleted has seen the delete.
+func versionChangedWhileAway(version VersionVector, tombstone Tombstone) VersionVector {
+	if tombstone.Version != nil {
+		version = tombstone.Version.Merge(version)
+	}
+	return version.Increment(globalSettings.Name)
+}
@@ -0,0 +1,271 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every event a node sends out carries a sequence number that only ever goes up. A receiving node applies the events
+// from each source one at a time and remembers the last sequence it applied, so an event that shows up again (because
+// the acknowledgement was lost, or the sender restarted before recording it) is recognized and skipped.
+//
+// The numbers are only comparable within one epoch. A node that loses its metadata directory starts over at 1 under a
+// new epoch, and a receiving node that sees a new epoch from a source forgets what it applied from the old one.
+
+const (
+	// EVENT_SEQUENCE_FILE - File under the metadata directory holding the highest sequence number reserved by this node
+	EVENT_SEQUENCE_FILE = "sequence"
+	// EVENT_EPOCH_FILE - File under the metadata directory holding the epoch the sequence numbers of this node belong to
+	EVENT_EPOCH_FILE = "epoch"
+	// EVENT_SEQUENCE_RESERVATION - Sequence numbers reserved on disk at a time, so the file is not written for every event
+	EVENT_SEQUENCE_RESERVATION = 1000
+	// EVENT_RECEIVED_FILE - File under the metadata directory holding the last applied sequence for each source node
+	EVENT_RECEIVED_FILE = "received.json"
+)
+
+// EventAck - the reply to an event. Sequence is the last sequence from Source in Epoch that has been applied.
+type EventAck struct {
+	Source    string
+	Epoch     string `json:",omitempty"`
+	Sequence  uint64
+	Duplicate bool
+}
+
+// eventSequencer - hands out the sequence numbers for outgoing events
+type eventSequencer struct {
+	lock     sync.Mutex
+	loaded   bool
+	epoch    string
+	last     uint64
+	reserved uint64
+}
+
+var outgoingSequence = &eventSequencer{}
+
+// next - the sequence number for the next outgoing event. After a restart numbering continues past everything that
+// could have been handed out before, even if it was never used.
+func (sequencer *eventSequencer) next() uint64 {
+	sequencer.lock.Lock()
+	defer sequencer.lock.Unlock()
+
+	if !sequencer.loaded {
+		sequencer.loadEpoch()
+		data, err := ioutil.ReadFile(metadataPath(EVENT_SEQUENCE_FILE))
+		if err == nil {
+			sequencer.reserved, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Unable to read the event sequence. Starting over: %s", err)
+		}
+		sequencer.last = sequencer.reserved
+		sequencer.loaded = true
+	}
+
+	sequencer.last++
+	if sequencer.last > sequencer.reserved {
+		reserved := sequencer.last + EVENT_SEQUENCE_RESERVATION
+		err := writeFileAtomic(metadataPath(EVENT_SEQUENCE_FILE), []byte(strconv.FormatUint(reserved, 10)))
+		if err != nil {
+			// Without the reservation on disk a restart could hand out these numbers again
+			log.Printf("Unable to reserve event sequence numbers: %s", err)
+		}
+		sequencer.reserved = reserved
+	}
+
+	return sequencer.last
+}
+
+// loadEpoch - read the epoch of our sequence numbers, or start a new one when there is none. Without an epoch on disk
+// the sequence numbers can not be trusted either, so they start over. Called with the lock held.
+func (sequencer *eventSequencer) loadEpoch() {
+	data, err := ioutil.ReadFile(metadataPath(EVENT_EPOCH_FILE))
+	if err == nil && strings.TrimSpace(string(data)) != "" {
+		sequencer.epoch = strings.TrimSpace(string(data))
+		return
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Unable to read the event epoch. Starting a new one: %s", err)
+	}
+
+	sequencer.epoch = fmt.Sprintf("%s-%d", globalSettings.Name, time.Now().UnixNano())
+	os.Remove(metadataPath(EVENT_SEQUENCE_FILE))
+	err = writeFileAtomic(metadataPath(EVENT_EPOCH_FILE), []byte(sequencer.epoch))
+	if err != nil {
+		log.Printf("Unable to save the event epoch: %s", err)
+	}
+}
+
+// assignEventSequence - stamp an outgoing event with our name, our epoch and the next sequence number
+func assignEventSequence(event *Event) {
+	if event.Source == "" {
+		event.Source = globalSettings.Name
+	}
+	event.Sequence = outgoingSequence.next()
+	outgoingSequence.lock.Lock()
+	event.Epoch = outgoingSequence.epoch
+	outgoingSequence.lock.Unlock()
+}
+
+// appliedSequences - the last sequence applied from each source node, and the epoch it is in
+type appliedSequences struct {
+	lock    sync.Mutex
+	loaded  bool
+	applied map[string]uint64
+	epochs  map[string]string
+	sources map[string]*sync.Mutex
+}
+
+// receivedSequences - how the applied sequences are kept on disk
+type receivedSequences struct {
+	Applied map[string]uint64
+	Epochs  map[string]string
+}
+
+var incomingSequences = &appliedSequences{}
+
+// load - read the applied sequences from disk the first time they are needed. Called with the lock held.
+func (sequences *appliedSequences) load() {
+	if sequences.loaded {
+		return
+	}
+
+	sequences.applied = make(map[string]uint64)
+	sequences.epochs = make(map[string]string)
+	sequences.sources = make(map[string]*sync.Mutex)
+	data, err := ioutil.ReadFile(metadataPath(EVENT_RECEIVED_FILE))
+	if err == nil {
+		var received receivedSequences
+		err = json.Unmarshal(data, &received)
+		if err == nil && received.Applied != nil {
+			sequences.applied = received.Applied
+			if received.Epochs != nil {
+				sequences.epochs = received.Epochs
+			}
+		} else {
+			// Written before there were epochs. Just the sequence of every source.
+			err = json.Unmarshal(data, &sequences.applied)
+		}
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Unable to read the applied event sequences: %s", err)
+	}
+	sequences.loaded = true
+}
+
+// save - write the applied sequences to disk. Called with the lock held.
+func (sequences *appliedSequences) save() {
+	data, err := json.Marshal(receivedSequences{Applied: sequences.applied, Epochs: sequences.epochs})
+	if err == nil {
+		err = writeFileAtomic(metadataPath(EVENT_RECEIVED_FILE), data)
+	}
+	if err != nil {
+		log.Printf("Unable to save the applied event sequences: %s", err)
+	}
+}
+
+// startEpoch - check the epoch of an event from a source. When the source has started a new one, what was applied
+// from the old one no longer says anything about the new sequence numbers, so it is forgotten. Events from nodes
+// without epochs are left as they are.
+func (sequences *appliedSequences) startEpoch(source, epoch string) {
+	sequences.lock.Lock()
+	defer sequences.lock.Unlock()
+	sequences.load()
+
+	if epoch == "" || sequences.epochs[source] == epoch {
+		return
+	}
+	log.Printf("%s started event epoch %s. Forgetting sequence %d of epoch %q", source, epoch, sequences.applied[source], sequences.epochs[source])
+	sequences.epochs[source] = epoch
+	delete(sequences.applied, source)
+	sequences.save()
+}
+
+// lockSource - events from one source are applied one at a time
+func (sequences *appliedSequences) lockSource(source string) *sync.Mutex {
+	sequences.lock.Lock()
+	defer sequences.lock.Unlock()
+	sequences.load()
+
+	lock, exists := sequences.sources[source]
+	if !exists {
+		lock = &sync.Mutex{}
+		sequences.sources[source] = lock
+	}
+	return lock
+}
+
+// lastApplied - the last sequence applied from a source node
+func (sequences *appliedSequences) lastApplied(source string) uint64 {
+	sequences.lock.Lock()
+	defer sequences.lock.Unlock()
+	sequences.load()
+
+	return sequences.applied[source]
+}
+
+// recordApplied - remember that an event from a source node has been applied
+func (sequences *appliedSequences) recordApplied(source string, sequence uint64) {
+	sequences.lock.Lock()
+	defer sequences.lock.Unlock()
+	sequences.load()
+
+	if sequence <= sequences.applied[source] {
+		return
+	}
+	sequences.applied[source] = sequence
+	sequences.save()
+}
+
+// writeFileAtomic - replace a file so that readers only ever see the old or the new contents, even after a crash
+func writeFileAtomic(filename string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(filename), os.ModeDir+os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	temporaryPath := filename + ".tmp"
+	temporary, err := os.Create(temporaryPath)
+	if err != nil {
+		return err
+	}
+
+	_, err = temporary.Write(data)
+	if err == nil {
+		err = temporary.Sync()
+	}
+	temporary.Close()
+	if err != nil {
+		os.Remove(temporaryPath)
+		return err
+	}
+
+	err = os.Rename(temporaryPath, filename)
+	if err != nil {
+		return err
+	}
+
+	return syncDirectory(filepath.Dir(filename))
+}
@@ -0,0 +1,236 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func postTestEvent(t *testing.T, address string, event Event) (ack EventAck) {
+	data, _ := json.Marshal(event)
+	resp, err := http.Post(address, "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(&ack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestDuplicateEventsAreIgnored(t *testing.T) {
+	useTestSettings(t)
+	tracker := createTracker("sequenceReceiver")
+	defer cleanupTracker(tracker)
+	globalSettings.Directory = tracker.directory
+	serverMap[globalSettings.Name] = &ReplicatServer{Name: globalSettings.Name, storage: tracker}
+	incomingSequences = &appliedSequences{}
+
+	server := httptest.NewServer(http.HandlerFunc(eventHandler))
+	defer server.Close()
+
+	ack := postTestEvent(t, server.URL, Event{Name: "notify.Create", Source: "sequenceSender", Path: "first", IsDirectory: true, Sequence: 5})
+	if ack.Sequence != 5 || ack.Duplicate {
+		t.Fatalf("unexpected acknowledgement: %#v", ack)
+	}
+
+	// The same event again, and an older one, must not be applied
+	os.Remove(filepath.Join(tracker.directory, "first"))
+	ack = postTestEvent(t, server.URL, Event{Name: "notify.Create", Source: "sequenceSender", Path: "first", IsDirectory: true, Sequence: 5})
+	if ack.Sequence != 5 || !ack.Duplicate {
+		t.Fatalf("expected a duplicate acknowledgement: %#v", ack)
+	}
+	postTestEvent(t, server.URL, Event{Name: "notify.Create", Source: "sequenceSender", Path: "older", IsDirectory: true, Sequence: 4})
+
+	for _, name := range []string{"first", "older"} {
+		_, err := os.Stat(filepath.Join(tracker.directory, name))
+		if !os.IsNotExist(err) {
+			t.Fatalf("a duplicate event was applied: %s", name)
+		}
+	}
+
+	// The last applied sequence survives a restart
+	incomingSequences = &appliedSequences{}
+	if last := incomingSequences.lastApplied("sequenceSender"); last != 5 {
+		t.Fatalf("expected the last applied sequence to be 5 after a restart, got %d", last)
+	}
+}
+
+func TestEventSequenceContinuesAfterRestart(t *testing.T) {
+	useTestSettings(t)
+	directory, err := ioutil.TempDir("", "eventSequence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	globalSettings.Directory = directory
+
+	sequencer := &eventSequencer{}
+	first := sequencer.next()
+	second := sequencer.next()
+	if second <= first {
+		t.Fatalf("sequence numbers must increase. %d then %d", first, second)
+	}
+
+	restarted := &eventSequencer{}
+	if third := restarted.next(); third <= second {
+		t.Fatalf("sequence numbers must keep increasing after a restart. %d then %d", second, third)
+	}
+	if restarted.epoch != sequencer.epoch {
+		t.Fatalf("a restart should keep the epoch. %s then %s", sequencer.epoch, restarted.epoch)
+	}
+
+	// Losing the metadata directory starts a new epoch, numbered from the start
+	os.RemoveAll(filepath.Join(directory, REPLICAT_METADATA_DIRECTORY))
+	lost := &eventSequencer{}
+	if first := lost.next(); first != 1 || lost.epoch == sequencer.epoch {
+		t.Fatalf("a lost sequence should start over in a new epoch. sequence %d epoch %s", first, lost.epoch)
+	}
+}
+
+func TestPeerQueuesHoldEventsInSequenceOrder(t *testing.T) {
+	useTestSettings(t)
+	directory, err := ioutil.TempDir("", "sequenceOrder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	globalSettings.Directory = directory
+
+	// Neither peer can be reached, so everything sent stays queued
+	peers := []string{"orderPeerA", "orderPeerB"}
+	serverMapLock.Lock()
+	for _, peer := range peers {
+		serverMap[peer] = &ReplicatServer{Name: peer, Address: "127.0.0.1:1"}
+	}
+	serverMapLock.Unlock()
+	defer func() {
+		for _, peer := range peers {
+			discardOutboundQueue(peer)
+		}
+	}()
+
+	var senders sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		senders.Add(1)
+		go func() {
+			defer senders.Done()
+			SendEvent(Event{Name: "notify.Remove", Path: "ordered"}, "")
+		}()
+	}
+	senders.Wait()
+
+	for _, peer := range peers {
+		queue, _ := getOutboundQueue(peer)
+		queue.lock.Lock()
+		pending := append([]queuedEvent{}, queue.pending...)
+		queue.lock.Unlock()
+
+		if len(pending) != 50 {
+			t.Fatalf("expected 50 events queued for %s, got %d", peer, len(pending))
+		}
+		for i := 1; i < len(pending); i++ {
+			if pending[i].Event.Sequence <= pending[i-1].Event.Sequence {
+				t.Fatalf("events for %s are out of sequence order at %d: %d then %d", peer, i, pending[i-1].Event.Sequence, pending[i].Event.Sequence)
+			}
+		}
+	}
+}
+
+func TestNewSenderEpochStartsOver(t *testing.T) {
+	useTestSettings(t)
+	tracker := createTracker("sequenceEpoch")
+	defer cleanupTracker(tracker)
+	globalSettings.Directory = tracker.directory
+	serverMap[globalSettings.Name] = &ReplicatServer{Name: globalSettings.Name, storage: tracker}
+	incomingSequences = &appliedSequences{}
+
+	server := httptest.NewServer(http.HandlerFunc(eventHandler))
+	defer server.Close()
+
+	postTestEvent(t, server.URL, Event{Name: "notify.Create", Source: "epochSender", Epoch: "first", Path: "before", IsDirectory: true, Sequence: 5})
+
+	// The sender lost its metadata and numbers its events from 1 again
+	ack := postTestEvent(t, server.URL, Event{Name: "notify.Create", Source: "epochSender", Epoch: "second", Path: "after", IsDirectory: true, Sequence: 1})
+	if ack.Duplicate || ack.Sequence != 1 || ack.Epoch != "second" {
+		t.Fatalf("the first event of a new epoch should be applied: %#v", ack)
+	}
+	_, err := os.Stat(filepath.Join(tracker.directory, "after"))
+	if err != nil {
+		t.Fatalf("the event of the new epoch was not applied: %s", err)
+	}
+
+	// The new epoch survives a restart
+	incomingSequences = &appliedSequences{}
+	ack = postTestEvent(t, server.URL, Event{Name: "notify.Create", Source: "epochSender", Epoch: "second", Path: "after", IsDirectory: true, Sequence: 1})
+	if !ack.Duplicate {
+		t.Fatalf("an event repeated within an epoch is a duplicate: %#v", ack)
+	}
+}
+
+func TestEventsWithBadPathsAreRefused(t *testing.T) {
+	useTestSettings(t)
+	tracker := createTracker("badPathReceiver")
+	defer cleanupTracker(tracker)
+	globalSettings.Directory = tracker.directory
+	serverMap[globalSettings.Name] = &ReplicatServer{Name: globalSettings.Name, storage: tracker}
+	incomingSequences = &appliedSequences{}
+
+	server := httptest.NewServer(http.HandlerFunc(eventHandler))
+	defer server.Close()
+
+	outside := filepath.Base(tracker.directory) + "Outside"
+	refused := []Event{
+		{Name: "notify.Create", Source: "badPathSender", Path: "../" + outside, IsDirectory: true, Sequence: 1},
+		{Name: "replicat.Rename", Source: "badPathSender", Path: "renamed", SourcePath: "/etc", IsDirectory: true, Sequence: 2},
+		{Name: "replicat.FileRequest", Source: "badPathSender", RawData: []byte(`{"../../etc/passwd": {}}`), Sequence: 3},
+	}
+	for _, event := range refused {
+		data, _ := json.Marshal(event)
+		resp, err := http.Post(server.URL, "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s for (%s) (%s) should be refused. status: %s", event.Name, event.Path, event.SourcePath, resp.Status)
+		}
+	}
+	_, err := os.Stat(filepath.Join(filepath.Dir(tracker.directory), outside))
+	if !os.IsNotExist(err) {
+		t.Fatalf("nothing should be created outside of the synced directory. err: %v", err)
+	}
+
+	resp, err := http.Post(server.URL, "application/json", bytes.NewReader([]byte("{not json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("a body that is not an event should be refused. status: %s", resp.Status)
+	}
+}
@@ -17,19 +17,16 @@ package main
 
 import (
 	"bytes"
-	"crypto/md5"
 	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/crypto/blake2b"
-	"io"
 	"io/ioutil"
-	"mime/multipart"
 	"net/http"
 	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -37,16 +34,87 @@ import (
 // Settings - for this replicat server. This should include everything needed for this server to run and connect with
 // its manager and cluster. It should not include anything else.
 type Settings struct {
-	Name               string
-	ManagerAddress     string
-	ManagerCredentials string
-	ClusterKey         string
-	Directory          string
-	Address            string
+	Name                    string
+	ManagerAddress          string
+	ManagerCredentials      string
+	ClusterKey              string
+	Directory               string
+	Address                 string
+	HashAlgorithm           string
+	HashWorkers             int
+	ScanWorkers             int
+	ConflictPolicies        map[string]string   // directory prefix to conflict policy
+	IgnorePatterns          []string            // .replicatignore patterns that apply everywhere
+	IncludePatterns         []string            // when set, only files matching one of these are synced
+	MaxFileSize             int64               // files larger than this are not synced. 0 for no limit
+	SyncIgnoreFiles         bool                // replicate the .replicatignore files themselves
+	FolderDirections        map[string]string   // directory prefix to send-only, receive-only or two-way
+	Archive                 bool                // keep everything. Deletions from other nodes are recorded, not applied
+	TrashRetentionDays      int                 // days an item stays in the trash. 0 for TRASH_DEFAULT_RETENTION_DAYS
+	TrashMaxSize            int64               // the oldest items are purged to keep the trash under this many bytes. 0 for no limit
+	KeepVersions            int                 // how many replaced versions of each file are kept
+	KeepVersionsDays        int                 // versions replaced within this many days are kept as well
+	MassChangeWindowSeconds int                 // the window the circuit breakers count changes over. 0 for BREAKER_DEFAULT_WINDOW_SECONDS
+	MassDeletePercent       int                 // share of the files deleted within the window that trips a breaker. 0 for the default, -1 for never
+	MassModifyPercent       int                 // share of the files modified within the window that trips a breaker. 0 for the default, -1 for never
+	MassChangeMinimum       int                 // a breaker never trips on fewer changes than this. 0 for BREAKER_DEFAULT_MINIMUM
+	FolderMetadata          map[string][]string // directory prefix to the metadata replicated: mode, owner, xattrs, symlinks, hardlinks
+	OwnerUIDMap             map[int]int         // uid on other nodes to the uid used here
+	OwnerGIDMap             map[int]int         // gid on other nodes to the gid used here
 }
 
 var globalSettings Settings
 
+// REPLICAT_METADATA_DIRECTORY - directory inside of the synced root where replicat keeps its own state. It is never replicated.
+const REPLICAT_METADATA_DIRECTORY = ".replicat"
+
+// metadataPath - absolute path to an item inside of the metadata directory
+func metadataPath(elements ...string) string {
+	return filepath.Join(append([]string{globalSettings.Directory, REPLICAT_METADATA_DIRECTORY}, elements...)...)
+}
+
+// isMetadataPath - check to see if a relative path is part of replicat's own state
+func isMetadataPath(relativePath string) bool {
+	relativePath = strings.TrimPrefix(relativePath, "/")
+	return relativePath == REPLICAT_METADATA_DIRECTORY || strings.HasPrefix(relativePath, REPLICAT_METADATA_DIRECTORY+"/")
+}
+
+// cleanRelativePath - clean a relative path received from a peer or a client. Paths that would land outside of the
+// synced directory, or inside of our own metadata, are refused.
+func cleanRelativePath(relativePath string) (string, bool) {
+	relativePath = filepath.Clean(relativePath)
+	if relativePath == "." || strings.HasPrefix(relativePath, "..") || filepath.IsAbs(relativePath) || isMetadataPath(relativePath) {
+		return "", false
+	}
+	return relativePath, true
+}
+
+// validRelativePath - check a path from another node is already clean and inside of the synced directory
+func validRelativePath(relativePath string) bool {
+	cleaned, valid := cleanRelativePath(relativePath)
+	return valid && cleaned == relativePath
+}
+
+// validEventPaths - check every path an event from another node names. Paths left empty are not named.
+func validEventPaths(event Event) bool {
+	if event.Path != "" && !validRelativePath(event.Path) {
+		return false
+	}
+	if event.SourcePath != "" && !validRelativePath(event.SourcePath) {
+		return false
+	}
+	if event.Name == "replicat.FileRequest" {
+		fileMap := make(map[string]EntryJSON)
+		json.Unmarshal(event.RawData, &fileMap)
+		for path := range fileMap {
+			if !validRelativePath(path) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 // Event stores the relevant information on events or updates to the storage layer.
 type Event struct {
 	Source        string
@@ -58,6 +126,9 @@ type Event struct {
 	IsDirectory   bool
 	NetworkSource string
 	RawData       []byte
+	Sequence      uint64
+	Epoch         string `json:",omitempty"`
+	Version       VersionVector
 }
 
 var events = make([]Event, 0, 100)
@@ -74,7 +145,7 @@ func SetGlobalSettings(newSettings Settings) {
 
 func sendCatalogToManagerAndSiblings(event Event) {
 	fmt.Println("sendCatalogToManagerAndSiblings")
-	sendEventToManagerAndSiblings(event, "")
+	sendEventToManagerAndSiblings(event)
 	fmt.Println("/sendCatalogToManagerAndSiblings")
 }
 
@@ -85,70 +156,81 @@ func SendEvent(event Event, fullPath string) {
 	event.Source = globalSettings.Name
 	event.Time = time.Now()
 
-	// Get the current owner of this entry if any
-	path := event.Path
-	if path == "" {
-		path = event.SourcePath
-	}
-	ownershipLock.RLock()
-	originalEntry, exists := ownership[path]
-	ownershipLock.RUnlock()
-
-	if exists {
-		log.Printf("Original ownership: %#v", originalEntry)
-		timeDelta := time.Since(originalEntry.Time)
-		if timeDelta > OWNERSHIP_EXPIRATION_TIMEOUT {
-			log.Printf("Ownership expired. Delta is: %v", timeDelta)
-		} else if originalEntry.Source != globalSettings.Name {
-			// At this point, someone owns this item.
-			// If we are not the owner, we are done.
-			log.Println("We do not own this. Do not send")
-			return
-		}
-	} else {
-		log.Printf("Send event called. No prior ownership: %s", fullPath)
-	}
-
-	// At this point, it is our change and our event. Store our ownership
-	ownershipLock.Lock()
-	ownership[event.Path] = event
-	ownershipLock.Unlock()
+	// Changes made here on behalf of other nodes are recognized by the tracker and never get this far, so this is a
+	// local change. The version attached by the tracker lets the other nodes tell it apart from anything older.
+	log.Printf("Sending %s for %s at version %s", event.Name, fullPath, event.Version)
 
-	sendEventToManagerAndSiblings(event, fullPath)
+	sendEventToManagerAndSiblings(event)
 }
 
 // REPLICAT_MANAGER_NAME - the name passed on event send to explicitly send the event to the manager.
 const REPLICAT_MANAGER_NAME = "Manager"
 
-func sendEventToManagerAndSiblings(event Event, fullPath string) {
+// eventSendLock - held from handing out a sequence number until the event is in every queue, so each peer queue holds
+// its events in sequence order
+var eventSendLock sync.Mutex
+
+func sendEventToManagerAndSiblings(event Event) {
+	eventSendLock.Lock()
+	defer eventSendLock.Unlock()
+
+	// Every node sees the same event under the same sequence number
+	assignEventSequence(&event)
+
 	// sendEvent to manager
-	go sendEvent(REPLICAT_MANAGER_NAME, &event, fullPath, globalSettings.ManagerAddress, globalSettings.ManagerCredentials)
+	if globalSettings.ManagerAddress != "" {
+		enqueueEvent(REPLICAT_MANAGER_NAME, event)
+	}
 
 	// SendEvent to all peers
 	for k, v := range serverMap {
 		if k != globalSettings.Name {
-			go sendEvent(v.Name, &event, fullPath, v.Address, globalSettings.ManagerCredentials)
+			enqueueEvent(v.Name, event)
 		}
 	}
 }
 
-func sendFileRequestToServer(serverName string, event Event) {
-	go sendEvent(serverName, &event, "", globalSettings.ManagerAddress, globalSettings.ManagerCredentials)
-
+// sendFileRequestToServer - queue a request for files to a node. An error means the node is not known here.
+func sendFileRequestToServer(serverName string, event Event) error {
+	serverMapLock.RLock()
 	server := serverMap[serverName]
+	serverMapLock.RUnlock()
+
+	eventSendLock.Lock()
+	defer eventSendLock.Unlock()
+
+	assignEventSequence(&event)
+
+	if globalSettings.ManagerAddress != "" {
+		enqueueEvent(REPLICAT_MANAGER_NAME, event)
+	}
+
 	if server == nil {
 		//panic("Server no longer exists when trying to send a file request\n")
 		fmt.Printf("Server cannot be reached, skipping sending file: (%s) %s", serverName, event.Path)
-		return
+		return fmt.Errorf("%s is not a known node", serverName)
 	}
 
-	go sendEvent(serverName, &event, "", server.Address, globalSettings.ManagerCredentials)
+	enqueueEvent(serverName, event)
+	return nil
+}
+
+// EventRejectedError - a node refused an event outright. Sending it again would get the same answer.
+type EventRejectedError struct {
+	Peer   string
+	Status string
 }
 
-func sendEvent(serverName string, event *Event, fullPath string, address string, credentials string) {
+func (err *EventRejectedError) Error() string {
+	return fmt.Sprintf("event rejected by %s: %s", err.Peer, err.Status)
+}
+
+// deliverEvent - send one event to a node. The node fetches the contents of files through its transfers, so a file
+// it can not take never holds up the events behind it. An error means the node may not have the change and the event
+// has to be sent again, unless it is an EventRejectedError.
+func deliverEvent(serverName string, event *Event, address string, credentials string) error {
 	if address == "" {
-		fmt.Println("sendEvent: no address specified. Skipping, returning")
-		return
+		return fmt.Errorf("no address specified for %s", serverName)
 	}
 
 	protocolString := "http://"
@@ -161,6 +243,9 @@ func sendEvent(serverName string, event *Event, fullPath string, address string,
 
 	jsonStr, _ := json.Marshal(event)
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonStr))
+	if err != nil {
+		return err
+	}
 	req.Header.Set("Content-Type", "application/json")
 
 	data := []byte(credentials)
@@ -170,31 +255,35 @@ func sendEvent(serverName string, event *Event, fullPath string, address string,
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
 
 	defer resp.Body.Close()
 
-	_, _ = ioutil.ReadAll(resp.Body)
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		// A client error is about the event itself. Timeouts and rate limits are about the node and pass.
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+			return &EventRejectedError{Peer: serverName, Status: resp.Status}
+		}
+		return fmt.Errorf("event rejected by %s: %s", serverName, resp.Status)
+	}
 
-	switch event.Name {
-	case "replicat.Rename", "notify.Create", "notify.Write":
-		if event.SourcePath == "" {
-			fmt.Printf("sendEvent We have a rename in. destination: %s", event.Path)
-			postHelper(event.Path, fullPath, address, credentials)
-		} else if event.Name == "notify.Write" {
-			fmt.Printf("WE ARE HERE")
-			panic("hello")
-		} else {
-
-			fmt.Printf("sendEvent - %s, full event: %#v", event.Name, event)
+	// Peers acknowledge the last event from us they have applied. Anything else answering (the manager) is taken at its word.
+	var ack EventAck
+	if event.Sequence != 0 && json.Unmarshal(body, &ack) == nil && ack.Source == event.Source {
+		if ack.Epoch != "" && ack.Epoch != event.Epoch {
+			return fmt.Errorf("%s acknowledged epoch %s instead of %s", serverName, ack.Epoch, event.Epoch)
+		}
+		if ack.Sequence < event.Sequence {
+			return fmt.Errorf("%s acknowledged sequence %d instead of %d", serverName, ack.Sequence, event.Sequence)
 		}
 	}
 
+	return nil
 }
 
-func postHelper(path, fullPath, address, credentials string) {
+func postHelper(path, fullPath, address, credentials string) error {
 	protocolString := "http://"
 	if address == globalSettings.ManagerAddress {
 		protocolString = "https://"
@@ -202,16 +291,24 @@ func postHelper(path, fullPath, address, credentials string) {
 	url := protocolString + address + "/upload/"
 
 	fmt.Printf("Sending file to: %s\npath: %s URL: %s", address, path, url)
-	postFile(path, fullPath, url, credentials)
+	return postFile(path, fullPath, url, credentials)
 }
 
-var ownership = make(map[string]Event, 100)
-var ownershipLock = sync.RWMutex{}
+// eventIsStale - check if an event is about a version of a path that we already have, or have changed since. A
+// deletion or rename of something we changed without seeing it is stale too, so the changed data is kept.
+func eventIsStale(event Event, local VersionVector) bool {
+	if event.Version == nil {
+		return false
+	}
 
-const (
-	// OWNERSHIP_EXPIRATION_TIMEOUT - Duration for a replicated change to hold ownership after they make changes. This leaves time for multiple filesystem events to come back without being reported to other nodes
-	OWNERSHIP_EXPIRATION_TIMEOUT = 20 * time.Second
-)
+	switch local.Compare(event.Version) {
+	case VERSION_DOMINATES, VERSION_EQUAL:
+		return true
+	case VERSION_CONCURRENT:
+		return event.Name == "notify.Remove" || event.Name == "replicat.Rename"
+	}
+	return false
+}
 
 func eventHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
@@ -223,28 +320,44 @@ func eventHandler(w http.ResponseWriter, r *http.Request) {
 		var event Event
 		err := decoder.Decode(&event)
 		if err != nil {
-			panic("bad json body")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - bad json body"))
+			return
 		}
 
 		log.Println(event.Name + ", path: " + event.Path)
 		log.Printf("Event info: %#v", event)
 
-		// At this point, the other side should have ownership of this path.
+		// A path outside of the synced directory is refused before anything is done with it. The sender sets the
+		// event aside instead of sending it again.
+		if !validEventPaths(event) {
+			log.Printf("Refusing %s from %s. (%s) or (%s) is not a path inside of the synced directory", event.Name, event.Source, event.Path, event.SourcePath)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - a path of the event is outside of the synced directory"))
+			return
+		}
 
-		path := event.Path
-		if path == "" {
-			path = event.SourcePath
+		// Events from one node are applied one at a time, in the order they were sent. Anything at or below the last
+		// sequence applied from that node has already been applied, so it is acknowledged and otherwise ignored.
+		if event.Sequence != 0 {
+			sourceLock := incomingSequences.lockSource(event.Source)
+			sourceLock.Lock()
+			defer sourceLock.Unlock()
+
+			incomingSequences.startEpoch(event.Source, event.Epoch)
+			lastApplied := incomingSequences.lastApplied(event.Source)
+			if event.Sequence <= lastApplied {
+				log.Printf("Ignoring duplicate event %d from %s. Already applied through %d", event.Sequence, event.Source, lastApplied)
+				json.NewEncoder(w).Encode(EventAck{Source: event.Source, Epoch: event.Epoch, Sequence: lastApplied, Duplicate: true})
+				return
+			}
 		}
 
-		ownershipLock.Lock()
-		originalEntry, exists := ownership[path]
-		if exists {
-			log.Printf("Original ownership: %#v", originalEntry)
-		} else {
-			log.Println("No original ownership found")
+		// A rename is about the path being moved
+		path := event.Path
+		if path == "" || event.SourcePath != "" {
+			path = event.SourcePath
 		}
-		ownership[path] = event
-		ownershipLock.Unlock()
 
 		pathName := globalSettings.Directory + "/" + event.Path
 		relativePath := event.Path
@@ -254,32 +367,79 @@ func eventHandler(w http.ResponseWriter, r *http.Request) {
 			panic("Unable to find server definition")
 		}
 
-		switch event.Name {
-		case "notify.Create":
+		stale := false
+		if path != "" {
+			localVersion := server.storage.currentVersion(path)
+			stale = eventIsStale(event, localVersion)
+			if stale {
+				log.Printf("Ignoring %s for %s. Their version %s is not newer than ours %s", event.Name, path, event.Version, localVersion)
+			}
+		}
+
+		// Send-only folders do not take changes from other nodes
+		unwanted := !stale && !receivesEvent(event)
+		if unwanted {
+			log.Printf("Ignoring %s for %s. It is in a send-only folder", event.Name, path)
+		}
+
+		switch {
+		case stale, unwanted:
+			// Acknowledged below like any other event so it is not sent again
+		case event.Name == "notify.Create":
 			fmt.Printf("notify.Create: %s", pathName)
 			fmt.Println("eventHandler->CreatePath")
 			server.storage.CreatePath(relativePath, event.IsDirectory)
+			// A file takes the version when its contents arrive, where an edit of ours made at the same time is caught
+			if event.IsDirectory {
+				server.storage.mergeVersion(relativePath, event.Version)
+			} else {
+				requestEventContents(server.storage, event)
+			}
 			fmt.Println("eventHandler->/CreatePath")
-		case "notify.Remove":
+		case event.Name == "notify.Write":
+			requestEventContents(server.storage, event)
+		case event.Name == "notify.Remove":
 			fmt.Printf("notify.Remove: %s", pathName)
-			err = os.Remove(pathName)
+			err = server.storage.applyRemoteDelete(relativePath, event.IsDirectory, event.Source, event.Time, event.Version)
 			if err != nil && !os.IsNotExist(err) {
 				panic(fmt.Sprintf("Error deleting folder %s: %v", pathName, err))
 			}
-		case "notify.Rename":
+		case event.Name == "notify.Rename":
 			fmt.Printf("notify.Rename: %s", pathName)
 			fmt.Println("eventHandler->CreatePath")
 			server.storage.CreatePath(relativePath, event.IsDirectory)
+			if event.IsDirectory {
+				server.storage.mergeVersion(relativePath, event.Version)
+			}
 			fmt.Println("eventHandler->/CreatePath")
-		case "replicat.Rename":
+		case event.Name == "replicat.Rename":
 			fmt.Println("eventHandler->Rename")
 			server.storage.Rename(event.SourcePath, event.Path, event.IsDirectory)
+			server.storage.mergeVersion(event.Path, event.Version)
+			server.storage.mergeVersion(event.SourcePath, event.Version)
+			if event.SourcePath == "" && !event.IsDirectory {
+				requestEventContents(server.storage, event)
+			}
 			fmt.Println("eventHandler->/Rename")
-		case "replicat.Catalog":
+		case event.Name == METADATA_EVENT:
+			var entry EntryJSON
+			err = json.Unmarshal(event.RawData, &entry)
+			if err == nil {
+				entry.ServerName = event.Source
+				err = server.storage.applyRemoteMetadata(entry)
+			}
+			if err != nil && err != TRACKER_ERROR_STALE_VERSION {
+				log.Printf("Unable to apply the metadata of %s from %s: %s", relativePath, event.Source, err)
+			}
+		case event.Name == "replicat.Catalog":
 			fmt.Printf("eventHandler->Catalog\n%#v", event)
 			server.storage.ProcessCatalog(event)
 			fmt.Println("eventHandler->/Catalog")
-		case "replicat.FileRequest":
+		case event.Name == "replicat.MerkleRoot":
+			fmt.Println("eventHandler->MerkleRoot")
+			server.storage.ProcessMerkleRoot(event)
+			fmt.Println("eventHandler->/MerkleRoot")
+		case event.Name == "replicat.FileRequest":
 			fmt.Printf("Received request to send files from: %s", event.Source)
 			fileMap := make(map[string]EntryJSON)
 			json.Unmarshal(event.RawData, &fileMap)
@@ -288,6 +448,11 @@ func eventHandler(w http.ResponseWriter, r *http.Request) {
 			fmt.Printf("Unknown event found, doing nothing. Event: %v", event)
 		}
 
+		if event.Sequence != 0 {
+			incomingSequences.recordApplied(event.Source, event.Sequence)
+			json.NewEncoder(w).Encode(EventAck{Source: event.Source, Epoch: event.Epoch, Sequence: event.Sequence})
+		}
+
 		// todo make this simpler
 		//events = append([]Event{event}, events...)
 		//if len(events) > 100 {
@@ -296,6 +461,11 @@ func eventHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// requestEventContents - have the transfers fetch the contents of a changed file from the node that changed it
+func requestEventContents(storage StorageTracker, event Event) {
+	storage.requestFile(EntryJSON{RelativePath: event.Path, ModTime: event.ModTime, ServerName: event.Source, Version: event.Version})
+}
+
 /*
 Send the folder tree from this node to another node for comparison
 */
@@ -367,6 +537,10 @@ func deletePaths(deletedPaths []string) {
 	}
 
 	fmt.Println("Paths were deleted on the other side. Delete them here")
+	if globalSettings.Archive {
+		log.Printf("Archive: keeping %d paths deleted on the other side", len(deletedPaths))
+		return
+	}
 
 	fmt.Printf("Paths to delete\nBefore sort:\n%v", deletedPaths)
 	// Reverse sort the paths so the most specific is first. This allows us to get away without a recursive delete
@@ -383,7 +557,7 @@ func deletePaths(deletedPaths []string) {
 		fmt.Printf("%s: about to remove", fullPath)
 
 		// stop on any error except for not exist. We are trying to delete it anyway (or rather, it should have been deleted already)
-		err := os.Remove(fullPath)
+		err := serverMap[globalSettings.Name].storage.trashDeletedPath(strings.TrimPrefix(relativePath, "/"), "", nil)
 		if err != nil && !os.IsNotExist(err) {
 			panic(err)
 		}
@@ -453,11 +627,22 @@ func postFile(filename string, fullPath string, address string, credentials stri
 
 	// Check to see if this is a file or a directory (somehow directories are getting in here)
 	fileInfo, err := os.Lstat(fullPath)
+	if os.IsNotExist(err) {
+		// Queued events can outlive the file they describe. Whatever removed it sends its own event.
+		log.Printf("PostFile - (%s) no longer exists, nothing to send (%s)", filename, fullPath)
+		return nil
+	}
 	if err != nil {
-		log.Fatalf("PostFile Error: found an error (%s) when I was supposed to be sending a file: %s (%s)", err.Error(), filename, fullPath)
+		log.Printf("PostFile Error: found an error (%s) when I was supposed to be sending a file: %s (%s)", err.Error(), filename, fullPath)
 		return err
 	}
 
+	// A symbolic link replicated as a link is made from its entry on the other side
+	if fileInfo.Mode()&os.ModeSymlink != 0 && metadataOptionsFor(filename).symlinks {
+		log.Printf("PostFile - (%s) is a symbolic link. Nothing to send", filename)
+		return nil
+	}
+
 	if fileInfo.IsDir() {
 		log.Printf("PostFile Error: found a directory when I was supposed to be sending a file: %s (%s)", filename, fullPath)
 		fmt.Printf("Creating path: %s", fullPath)
@@ -465,109 +650,77 @@ func postFile(filename string, fullPath string, address string, credentials stri
 
 		return err
 	}
-	body := &bytes.Buffer{}
-	bodyWriter := multipart.NewWriter(body)
-	fileWriter, err := bodyWriter.CreateFormFile("uploadfile", filename)
-	if err != nil {
-		fmt.Println("error writing to buffer")
-		return err
-	}
 
-	file, err := os.Open(fullPath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
+	// If the file changes while it is being sent, what the receiver ends up with is not what we have. Send it again.
+	for attempt := 1; ; attempt++ {
+		before, after, err := sendFileContents(filename, fullPath, address, credentials)
+		if err == TRANSFER_ERROR_CANCELLED {
+			log.Printf("PostFile - (%s) is no longer wanted by (%s)", filename, address)
+			return err
+		}
+		if err != nil && err != UPLOAD_ERROR_HASH_MISMATCH {
+			return err
+		}
 
-	// Copy the file to the request
-	_, err = io.CopyBuffer(fileWriter, file, nil)
-	if err != nil {
-		fmt.Printf("error copying file: %s (%s)", filename, err)
-		//panic("again?")
-		return err
+		changed := after == nil || before.Size() != after.Size() || !before.ModTime().Equal(after.ModTime())
+		if err == nil && !changed {
+			serverMap[globalSettings.Name].storage.IncrementStatistic(TRACKER_FILES_SENT, 1, true)
+			return nil
+		}
+
+		if attempt >= UPLOAD_MAX_SOURCE_CHANGES {
+			log.Printf("PostFile - (%s) kept changing while being sent to (%s). Giving up for now", filename, address)
+			return UPLOAD_ERROR_HASH_MISMATCH
+		}
+		log.Printf("PostFile - (%s) changed or arrived damaged at (%s). Sending again (changed: %v, err: %v)", filename, address, changed, err)
 	}
+}
 
-	// File data
+// sendFileContents - send one version of a file. The file information from before and after the send is returned so the
+// caller can tell if the file changed underneath us.
+func sendFileContents(filename, fullPath, address, credentials string) (before, after os.FileInfo, err error) {
 	server := serverMap[globalSettings.Name]
 	entryJSON, err := server.storage.getEntryJSON(filename)
 	entryString, err := json.Marshal(&entryJSON)
-	bodyWriter.WriteField("EntryJSON", string(entryString))
-
-	myHash, err := fileMd5Hash(fullPath)
-	if err != nil {
-		fmt.Printf("failed to calculate MD5 Hash for %s", fullPath)
-		return err
-	}
-
-	// Get the mod time and blake2 and filesize from the contents
-
-	bodyWriter.WriteField("HASH", myHash)
-	contentType := bodyWriter.FormDataContentType()
-	err = bodyWriter.Close()
-	if err != nil {
-		return err
-	}
 
-	req, err := http.NewRequest("POST", address, body)
-	req.Header.Set("Content-Type", contentType)
-
-	data := []byte(credentials)
-	authHash := base64.StdEncoding.EncodeToString(data)
-	req.Header.Add("Authorization", "Basic "+authHash)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("PostFile - Error sending a file (%s) to another node(%s) error(%s)", filename, address, err)
-		return err
-	}
-
-	resp.Body.Close()
-
-	serverMap[globalSettings.Name].storage.IncrementStatistic(TRACKER_FILES_SENT, 1, true)
-
-	return nil
-}
-
-func fileMd5Hash(filePath string) (string, error) {
-	var returnMD5String string
-	file, err := os.Open(filePath)
+	file, err := os.Open(fullPath)
 	if err != nil {
-		return returnMD5String, err
+		return
 	}
 	defer file.Close()
 
-	hash := md5.New()
-	_, err = io.Copy(hash, file)
+	before, err = file.Stat()
 	if err != nil {
-		return returnMD5String, err
+		return
 	}
 
-	hashInBytes := hash.Sum(nil)[:16]
-
-	returnMD5String = hex.EncodeToString(hashInBytes)
-
-	return returnMD5String, nil
-
-}
-
-func fileBlake2bHash(filePath string) ([]byte, error) {
-	var hashResult []byte
-	file, err := os.Open(filePath)
+	contentHash, _, err := cachedFileHash(fullPath)
 	if err != nil {
-		return hashResult, err
+		fmt.Printf("failed to calculate the content hash for %s", fullPath)
+		return
 	}
-	defer file.Close()
+	myHash := hashToString(contentHash)
 
-	hash, _ := blake2b.New256(nil)
-	_, err = io.Copy(hash, file)
-	if err != nil {
-		return hashResult, err
+	// If the other side already has a copy of a large file, try to send just the changes
+	sent := false
+	if before.Size() >= DELTA_MIN_FILE_SIZE {
+		signature, found, err := querySignature(filename, address, credentials)
+		if err == nil && found {
+			err = postFileDelta(filename, file, signature, string(entryString), myHash, address, credentials)
+			sent = err == nil
+		}
+		if err == TRANSFER_ERROR_CANCELLED {
+			return before, nil, err
+		}
+		if err != nil {
+			log.Printf("PostFile - delta transfer of (%s) to (%s) failed, sending the whole file: %s", filename, address, err)
+		}
 	}
 
-	hashResult = hash.Sum(nil)
-
-	fmt.Printf("%v - %s", hex.EncodeToString(hashResult), filePath)
+	if !sent {
+		err = postFileChunked(filename, file, before.Size(), string(entryString), myHash, address, credentials)
+	}
 
-	return hashResult, nil
+	after, _ = os.Stat(fullPath)
+	return
 }
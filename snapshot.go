@@ -0,0 +1,606 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A snapshot records every path the tracker has, with its hash and version, at one moment under a name. The contents
+// of its files go into a store shared by all snapshots, named by hash, so a file that did not change between snapshots
+// is only kept once. They are copied rather than linked, as a file edited in place would change the linked copy too.
+// Restoring a snapshot puts a part of the tree back the way it was as changes made here, and the other nodes take
+// them like any other.
+
+const (
+	// SNAPSHOTS_DIRECTORY - Where snapshots are kept, inside of the metadata directory
+	SNAPSHOTS_DIRECTORY = "snapshots"
+	// SNAPSHOT_OBJECTS_DIRECTORY - Where the contents of the files in snapshots are kept, inside of SNAPSHOTS_DIRECTORY
+	SNAPSHOT_OBJECTS_DIRECTORY = "objects"
+	// SNAPSHOT_CHANGE_ADDED - The path is only in the newer state
+	SNAPSHOT_CHANGE_ADDED = "added"
+	// SNAPSHOT_CHANGE_REMOVED - The path is only in the older state
+	SNAPSHOT_CHANGE_REMOVED = "removed"
+	// SNAPSHOT_CHANGE_MODIFIED - The path is in both, with different contents
+	SNAPSHOT_CHANGE_MODIFIED = "modified"
+)
+
+var (
+	// SNAPSHOT_ERROR_NOT_FOUND - There is no snapshot with the name
+	SNAPSHOT_ERROR_NOT_FOUND = errors.New("Replicat: No such snapshot")
+	// SNAPSHOT_ERROR_EXISTS - There is already a snapshot with the name
+	SNAPSHOT_ERROR_EXISTS = errors.New("Replicat: A snapshot with that name already exists")
+	// SNAPSHOT_ERROR_BAD_NAME - Snapshot names are plain file names
+	SNAPSHOT_ERROR_BAD_NAME = errors.New("Replicat: Snapshot names can not be empty, start with a dot or contain a path separator")
+	// SNAPSHOT_ERROR_CONTENTS_CHANGED - The kept contents of a file no longer match its hash
+	SNAPSHOT_ERROR_CONTENTS_CHANGED = errors.New("Replicat: The contents kept for a file in the snapshot have changed")
+)
+
+// Snapshot - the tracked paths at a moment. Entries is left out when snapshots are listed.
+type Snapshot struct {
+	Name        string
+	Node        string
+	Created     time.Time
+	Files       int
+	Directories int
+	Size        int64
+	Entries     []EntryJSON `json:",omitempty"`
+}
+
+// SnapshotChange - a path that differs between two states of the tree. From is nil for an added path, To for a removed one.
+type SnapshotChange struct {
+	RelativePath string
+	Change       string
+	From         *EntryJSON `json:",omitempty"`
+	To           *EntryJSON `json:",omitempty"`
+}
+
+// snapshotPath - where a snapshot is kept
+func snapshotPath(name string) string {
+	return metadataPath(SNAPSHOTS_DIRECTORY, name+".json")
+}
+
+// snapshotObjectPath - where the contents with a hash are kept
+func snapshotObjectPath(contentHash []byte) string {
+	return metadataPath(SNAPSHOTS_DIRECTORY, SNAPSHOT_OBJECTS_DIRECTORY, hex.EncodeToString(contentHash))
+}
+
+// validSnapshotName - check a name can be used for a snapshot
+func validSnapshotName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\`)
+}
+
+// readSnapshot - load a snapshot with its entries
+func readSnapshot(name string) (snapshot Snapshot, err error) {
+	if !validSnapshotName(name) {
+		return snapshot, SNAPSHOT_ERROR_BAD_NAME
+	}
+
+	data, err := ioutil.ReadFile(snapshotPath(name))
+	if os.IsNotExist(err) {
+		return snapshot, SNAPSHOT_ERROR_NOT_FOUND
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &snapshot)
+	}
+	return snapshot, err
+}
+
+// snapshotEntries - the entries of a snapshot at or below a directory prefix, by path
+func snapshotEntries(snapshot Snapshot, prefix string) map[string]EntryJSON {
+	entries := make(map[string]EntryJSON)
+	for _, entry := range snapshot.Entries {
+		if prefixMatches(prefix, entry.RelativePath) {
+			entries[entry.RelativePath] = entry
+		}
+	}
+	return entries
+}
+
+// sameSnapshotContents - check if two entries for a path hold the same thing. Paths that are not hashed yet are
+// compared by size and time.
+func sameSnapshotContents(from, to EntryJSON) bool {
+	if from.IsDirectory || to.IsDirectory {
+		return from.IsDirectory == to.IsDirectory
+	}
+	if from.Hash != nil && to.Hash != nil {
+		return bytes.Equal(from.Hash, to.Hash)
+	}
+	return from.Size == to.Size && from.ModTime.Equal(to.ModTime)
+}
+
+// diffSnapshotEntries - the paths that were added, removed or modified going from one state of the tree to another.
+// Each path is its own entry in the tree maps, so checkForChanges sorts them into new, deleted and matching paths.
+func diffSnapshotEntries(from, to map[string]EntryJSON) []SnapshotChange {
+	fromTree, toTree := make(DirTreeMap), make(DirTreeMap)
+	for relativePath := range from {
+		fromTree["/"+relativePath] = nil
+	}
+	for relativePath := range to {
+		toTree["/"+relativePath] = nil
+	}
+	_, _, newPaths, deletedPaths, matchingPaths := checkForChanges(fromTree, toTree)
+
+	changes := make([]SnapshotChange, 0, len(newPaths)+len(deletedPaths))
+	for _, path := range newPaths {
+		entry := to[path[1:]]
+		changes = append(changes, SnapshotChange{RelativePath: entry.RelativePath, Change: SNAPSHOT_CHANGE_ADDED, To: &entry})
+	}
+	for _, path := range deletedPaths {
+		entry := from[path[1:]]
+		changes = append(changes, SnapshotChange{RelativePath: entry.RelativePath, Change: SNAPSHOT_CHANGE_REMOVED, From: &entry})
+	}
+	for _, path := range matchingPaths {
+		fromEntry, toEntry := from[path[1:]], to[path[1:]]
+		if !sameSnapshotContents(fromEntry, toEntry) {
+			changes = append(changes, SnapshotChange{RelativePath: fromEntry.RelativePath, Change: SNAPSHOT_CHANGE_MODIFIED,
+				From: &fromEntry, To: &toEntry})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].RelativePath < changes[j].RelativePath })
+	return changes
+}
+
+// snapshotObject - where the kept contents of a file in a snapshot are, once they are checked against its hash
+func snapshotObject(entry EntryJSON) (string, error) {
+	objectPath := snapshotObjectPath(entry.Hash)
+	contentHash, _, err := cachedFileHash(objectPath)
+	if os.IsNotExist(err) || (err == nil && !bytes.Equal(contentHash, entry.Hash)) {
+		log.Printf("Snapshots: the contents kept for %s are missing or changed", entry.RelativePath)
+		return "", SNAPSHOT_ERROR_CONTENTS_CHANGED
+	}
+	return objectPath, err
+}
+
+// currentEntries - the tracked paths at or below a directory prefix as they are now. Call when inside of a lock!
+func (handler *FilesystemTracker) currentEntries(prefix string) map[string]EntryJSON {
+	entries := make(map[string]EntryJSON)
+	for relativePath, value := range handler.contents {
+		if value.FileInfo == nil || relativePath == "" || isMetadataPath(relativePath) || !prefixMatches(prefix, relativePath) {
+			continue
+		}
+		entries[relativePath] = catalogEntry(relativePath, value)
+	}
+	return entries
+}
+
+// createSnapshot - record every tracked path under a name, and keep the contents of the files. Nothing changes while
+// the snapshot is taken, so it is one consistent state of the tree.
+func (handler *FilesystemTracker) createSnapshot(name string) (Snapshot, error) {
+	if !validSnapshotName(name) {
+		return Snapshot{}, SNAPSHOT_ERROR_BAD_NAME
+	}
+
+	handler.fsLock.Lock()
+	defer handler.fsLock.Unlock()
+
+	_, err := os.Stat(snapshotPath(name))
+	if err == nil {
+		return Snapshot{}, SNAPSHOT_ERROR_EXISTS
+	}
+	err = os.MkdirAll(metadataPath(SNAPSHOTS_DIRECTORY, SNAPSHOT_OBJECTS_DIRECTORY), os.ModeDir+os.ModePerm)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	snapshot := Snapshot{Name: name, Node: globalSettings.Name, Created: time.Now()}
+	for relativePath, entry := range handler.currentEntries("") {
+		if entry.IsDirectory {
+			snapshot.Directories++
+			snapshot.Entries = append(snapshot.Entries, entry)
+			continue
+		}
+
+		fullPath := filepath.Join(handler.directory, relativePath)
+		if entry.Hash == nil {
+			entry.Hash, _, err = cachedFileHash(fullPath)
+			if err != nil {
+				return Snapshot{}, err
+			}
+		}
+
+		objectPath := snapshotObjectPath(entry.Hash)
+		_, err = os.Stat(objectPath)
+		if os.IsNotExist(err) {
+			var info os.FileInfo
+			info, err = os.Stat(fullPath)
+			if err == nil {
+				err = copyArchiveFile(fullPath, objectPath, info)
+			}
+		}
+		if err != nil {
+			return Snapshot{}, err
+		}
+
+		snapshot.Files++
+		snapshot.Size += entry.Size
+		snapshot.Entries = append(snapshot.Entries, entry)
+	}
+	sort.Slice(snapshot.Entries, func(i, j int) bool { return snapshot.Entries[i].RelativePath < snapshot.Entries[j].RelativePath })
+
+	data, err := json.Marshal(snapshot)
+	if err == nil {
+		err = ioutil.WriteFile(snapshotPath(name), data, 0666)
+	}
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	log.Printf("Snapshots: took %s. %d files, %d directories", name, snapshot.Files, snapshot.Directories)
+	snapshot.Entries = nil
+	return snapshot, nil
+}
+
+// snapshotList - the snapshots on this node without their entries, oldest first
+func (handler *FilesystemTracker) snapshotList() ([]Snapshot, error) {
+	names, err := filepath.Glob(snapshotPath("*"))
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]Snapshot, 0, len(names))
+	for _, name := range names {
+		snapshot, err := readSnapshot(strings.TrimSuffix(filepath.Base(name), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Entries = nil
+		snapshots = append(snapshots, snapshot)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Created.Before(snapshots[j].Created) })
+	return snapshots, nil
+}
+
+// diffSnapshots - what changed going from a snapshot to another one, or to the current state when to is empty
+func (handler *FilesystemTracker) diffSnapshots(from, to string) ([]SnapshotChange, error) {
+	fromSnapshot, err := readSnapshot(from)
+	if err != nil {
+		return nil, err
+	}
+
+	var toEntries map[string]EntryJSON
+	if to == "" {
+		handler.fsLock.RLock()
+		toEntries = handler.currentEntries("")
+		handler.fsLock.RUnlock()
+	} else {
+		toSnapshot, err := readSnapshot(to)
+		if err != nil {
+			return nil, err
+		}
+		toEntries = snapshotEntries(toSnapshot, "")
+	}
+
+	return diffSnapshotEntries(snapshotEntries(fromSnapshot, ""), toEntries), nil
+}
+
+// exportSnapshot - write the paths of a snapshot at or below a directory prefix as a tar archive
+func (handler *FilesystemTracker) exportSnapshot(name, prefix string, w io.Writer) error {
+	snapshot, err := readSnapshot(name)
+	if err != nil {
+		return err
+	}
+
+	archive := tar.NewWriter(w)
+	for _, entry := range snapshot.Entries {
+		if !prefixMatches(prefix, entry.RelativePath) {
+			continue
+		}
+
+		header := &tar.Header{Name: filepath.ToSlash(entry.RelativePath), ModTime: entry.ModTime, Mode: 0644}
+		if entry.IsDirectory {
+			header.Name += "/"
+			header.Typeflag = tar.TypeDir
+			header.Mode = 0755
+			err = archive.WriteHeader(header)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		objectPath, err := snapshotObject(entry)
+		if err != nil {
+			return err
+		}
+		header.Typeflag = tar.TypeReg
+		header.Size = entry.Size
+		err = archive.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+		err = copySnapshotObject(archive, objectPath)
+		if err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// copySnapshotObject - write out the kept contents of a file
+func copySnapshotObject(w io.Writer, objectPath string) error {
+	object, err := os.Open(objectPath)
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+
+	_, err = io.Copy(w, object)
+	return err
+}
+
+// restoreSnapshot - put the paths at or below a directory prefix back the way a snapshot has them. Paths the snapshot
+// does not have are moved to the trash, and files it replaces are kept as versions or in the trash. Every path that is
+// put back is a change made here, and the other nodes are told about them once they are all done.
+func (handler *FilesystemTracker) restoreSnapshot(name, prefix string) error {
+	snapshot, err := readSnapshot(name)
+	if err != nil {
+		return err
+	}
+	prefix = strings.Trim(filepath.ToSlash(filepath.Clean("/"+prefix)), "/")
+	wanted := snapshotEntries(snapshot, prefix)
+
+	// Nothing is changed unless all of the contents are there
+	for _, entry := range wanted {
+		if !entry.IsDirectory {
+			_, err = snapshotObject(entry)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	handler.fsLock.Lock()
+	defer handler.fsLock.Unlock()
+
+	me := globalSettings.Name
+	changes := diffSnapshotEntries(handler.currentEntries(prefix), wanted)
+
+	// Children go before their directories
+	for i := len(changes) - 1; i >= 0; i-- {
+		change := changes[i]
+		if change.From == nil || (change.To != nil && change.From.IsDirectory == change.To.IsDirectory) {
+			continue
+		}
+		relativePath := change.RelativePath
+		entry := handler.contents[relativePath]
+		delete(handler.contents, relativePath)
+		handler.addLocalTombstone(relativePath, change.From.IsDirectory, entry.version.Increment(me))
+		handler.recordChange(relativePath)
+		handler.holdLocalChange(relativePath, BREAKER_CHANGE_DELETE)
+		err = handler.moveToTrash(relativePath, me)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// Directories go before what is in them
+	for _, change := range changes {
+		if change.To == nil {
+			continue
+		}
+		err = handler.restoreSnapshotEntry(*change.To)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Snapshots: restored %d paths under '%s' from %s", len(changes), prefix, name)
+	if len(changes) > 0 {
+		handler.SendCatalog()
+	}
+	return nil
+}
+
+// restoreSnapshotEntry - put one path from a snapshot in place and track it as a change made here. Call when inside
+// of a lock!
+func (handler *FilesystemTracker) restoreSnapshotEntry(snapshotEntry EntryJSON) error {
+	relativePath := snapshotEntry.RelativePath
+	fullPath := filepath.Join(handler.directory, relativePath)
+	me := globalSettings.Name
+
+	err := checkParents(handler.directory, relativePath)
+	if err != nil {
+		return err
+	}
+
+	if snapshotEntry.IsDirectory {
+		err := os.MkdirAll(fullPath, os.ModeDir+os.ModePerm)
+		if err != nil {
+			return err
+		}
+	} else {
+		err := handler.keepReplacedContents(relativePath, me)
+		if err != nil {
+			return err
+		}
+
+		// Copied next to the other partial files and renamed into place, so readers never see half of it
+		objectPath := snapshotObjectPath(snapshotEntry.Hash)
+		info, err := os.Stat(objectPath)
+		if err != nil {
+			return err
+		}
+		stagingPath := metadataPath(UPLOAD_PARTIAL_DIRECTORY, "snapshot-"+hex.EncodeToString(snapshotEntry.Hash))
+		err = os.MkdirAll(filepath.Dir(stagingPath), os.ModeDir+os.ModePerm)
+		if err == nil {
+			os.Remove(stagingPath)
+			err = copyArchiveFile(objectPath, stagingPath, info)
+		}
+		if err == nil {
+			err = os.Chtimes(stagingPath, time.Now(), snapshotEntry.ModTime)
+		}
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(fullPath), os.ModeDir+os.ModePerm)
+		}
+		if err == nil {
+			err = os.Rename(stagingPath, fullPath)
+		}
+		if err != nil {
+			os.Remove(stagingPath)
+			return err
+		}
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return err
+	}
+	change := BREAKER_CHANGE_MODIFY
+	entry, exists := handler.contents[relativePath]
+	if !exists || entry.FileInfo == nil || info.IsDir() {
+		change = BREAKER_CHANGE_CREATE
+		entry = *NewDirectoryFromFileInfo(&info)
+	}
+	entry.FileInfo = info
+	entry.setup = true
+	entry.hash = snapshotEntry.Hash
+	entry.version = handler.versionOf(relativePath).Increment(me)
+	handler.contents[relativePath] = entry
+	handler.clearTombstone(relativePath)
+	handler.recordChange(relativePath)
+	handler.holdLocalChange(relativePath, change)
+	if !info.IsDir() {
+		handler.contentOrigins[relativePath] = me
+		handler.queueHash(relativePath)
+	}
+	return nil
+}
+
+// deleteSnapshot - drop a snapshot, and the contents no other snapshot has
+func (handler *FilesystemTracker) deleteSnapshot(name string) error {
+	_, err := readSnapshot(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(snapshotPath(name))
+	if err != nil {
+		return err
+	}
+
+	names, err := filepath.Glob(snapshotPath("*"))
+	if err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	for _, other := range names {
+		snapshot, err := readSnapshot(strings.TrimSuffix(filepath.Base(other), ".json"))
+		if err != nil {
+			return err
+		}
+		for _, entry := range snapshot.Entries {
+			used[hex.EncodeToString(entry.Hash)] = true
+		}
+	}
+
+	objects, err := ioutil.ReadDir(metadataPath(SNAPSHOTS_DIRECTORY, SNAPSHOT_OBJECTS_DIRECTORY))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, object := range objects {
+		if !used[object.Name()] {
+			os.Remove(metadataPath(SNAPSHOTS_DIRECTORY, SNAPSHOT_OBJECTS_DIRECTORY, object.Name()))
+		}
+	}
+
+	log.Printf("Snapshots: deleted %s", name)
+	return nil
+}
+
+// snapshotsHandler - the snapshots on this node
+//
+//	GET    /snapshots/                                    list them
+//	POST   /snapshots/?name=<name>                        take one
+//	DELETE /snapshots/?name=<name>                        drop one
+//	GET    /snapshots/diff/?from=<name>[&to=<name>]       what changed since one, or between two
+//	GET    /snapshots/export/?name=<name>[&path=<path>]   a tar archive of one
+//	POST   /snapshots/restore/?name=<name>[&path=<path>]  put a subtree back the way one has it
+func snapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	server, exists := serverMap[globalSettings.Name]
+	if !exists || server.storage == nil {
+		http.Error(w, "Storage is not set up", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/snapshots"), "/")
+	var result interface{}
+	var err error
+	switch {
+	case action == "" && r.Method == "GET":
+		result, err = server.storage.snapshotList()
+	case action == "" && r.Method == "POST":
+		result, err = server.storage.createSnapshot(query.Get("name"))
+	case action == "" && r.Method == "DELETE":
+		err = server.storage.deleteSnapshot(query.Get("name"))
+	case action == "diff" && r.Method == "GET":
+		result, err = server.storage.diffSnapshots(query.Get("from"), query.Get("to"))
+	case action == "export" && r.Method == "GET":
+		_, err = readSnapshot(query.Get("name"))
+		if err == nil {
+			w.Header().Set("Content-Type", "application/x-tar")
+			err = server.storage.exportSnapshot(query.Get("name"), query.Get("path"), w)
+			if err != nil {
+				// The archive has been started, so all that can be done is to cut it short
+				log.Printf("Unable to export snapshot %s: %s", query.Get("name"), err)
+			}
+			return
+		}
+	case action == "restore" && r.Method == "POST":
+		err = server.storage.restoreSnapshot(query.Get("name"), query.Get("path"))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch err {
+	case nil:
+	case SNAPSHOT_ERROR_NOT_FOUND:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case SNAPSHOT_ERROR_EXISTS:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case SNAPSHOT_ERROR_BAD_NAME:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if result == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,159 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSnapshotDiffAndExport(t *testing.T) {
+	useTestSettings(t)
+	tracker := createTracker("snapshotDiff")
+	defer cleanupTracker(tracker)
+	globalSettings.Directory = tracker.directory
+
+	receiveTestFile(t, tracker, "docs/keep.txt", "docs/keep.txt", "snapshotPeer", VersionVector{"snapshotPeer": 1})
+	receiveTestFile(t, tracker, "docs/edit.txt", "docs/edit.txt", "snapshotPeer", VersionVector{"snapshotPeer": 1})
+	receiveTestFile(t, tracker, "gone.txt", "gone.txt", "snapshotPeer", VersionVector{"snapshotPeer": 1})
+	snapshot, err := tracker.createSnapshot("before")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Files != 3 {
+		t.Fatalf("the snapshot should have every tracked file: %#v", snapshot)
+	}
+	_, err = tracker.createSnapshot("before")
+	if err != SNAPSHOT_ERROR_EXISTS {
+		t.Fatalf("a snapshot name should only be used once. err: %v", err)
+	}
+
+	// Edited in place, which must not change what the snapshot kept
+	err = ioutil.WriteFile(filepath.Join(tracker.directory, "docs/edit.txt"), []byte("edited"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.fsLock.Lock()
+	entry := tracker.contents["docs/edit.txt"]
+	entry.FileInfo, _ = os.Stat(filepath.Join(tracker.directory, "docs/edit.txt"))
+	entry.hash = nil
+	tracker.contents["docs/edit.txt"] = entry
+	delete(tracker.contents, "gone.txt")
+	tracker.fsLock.Unlock()
+	receiveTestFile(t, tracker, "new.txt", "new.txt", "snapshotPeer", VersionVector{"snapshotPeer": 1})
+
+	changes, err := tracker.diffSnapshots("before", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]string)
+	for _, change := range changes {
+		found[change.RelativePath] = change.Change
+	}
+	expected := map[string]string{"docs/edit.txt": SNAPSHOT_CHANGE_MODIFIED, "gone.txt": SNAPSHOT_CHANGE_REMOVED,
+		"new.txt": SNAPSHOT_CHANGE_ADDED}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("the diff against the current state is wrong: %v", found)
+	}
+
+	var archive bytes.Buffer
+	err = tracker.exportSnapshot("before", "docs", &archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported := make(map[string]string)
+	reader := tar.NewReader(&archive)
+	for {
+		header, err := reader.Next()
+		if err != nil {
+			break
+		}
+		contents, _ := ioutil.ReadAll(reader)
+		exported[header.Name] = string(contents)
+	}
+	expected = map[string]string{"docs/keep.txt": "docs/keep.txt", "docs/edit.txt": "docs/edit.txt"}
+	if !reflect.DeepEqual(exported, expected) {
+		t.Fatalf("the export should have the subtree as the snapshot had it: %v", exported)
+	}
+}
+
+func TestSnapshotRestoresSubtreeAsLocalChanges(t *testing.T) {
+	useTestSettings(t)
+	tracker := createTracker("snapshotRestore")
+	defer cleanupTracker(tracker)
+	globalSettings.Directory = tracker.directory
+
+	receiveTestFile(t, tracker, "project/a.txt", "project/a.txt", "snapshotPeer", VersionVector{"snapshotPeer": 1})
+	receiveTestFile(t, tracker, "project/b.txt", "project/b.txt", "snapshotPeer", VersionVector{"snapshotPeer": 1})
+	receiveTestFile(t, tracker, "other.txt", "other.txt", "snapshotPeer", VersionVector{"snapshotPeer": 1})
+	_, err := tracker.createSnapshot("reorganize")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A bulk reorganization that went wrong
+	for _, relativePath := range []string{"project/a.txt", "other.txt"} {
+		os.Remove(filepath.Join(tracker.directory, relativePath))
+		tracker.fsLock.Lock()
+		delete(tracker.contents, relativePath)
+		tracker.fsLock.Unlock()
+	}
+	receiveTestFile(t, tracker, "project/stray.txt", "project/stray.txt", "snapshotPeer", VersionVector{"snapshotPeer": 1})
+
+	err = tracker.restoreSnapshot("reorganize", "project")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := ioutil.ReadFile(filepath.Join(tracker.directory, "project/a.txt"))
+	if err != nil || string(restored) != "project/a.txt" {
+		t.Fatalf("the deleted file should be back. restored: %q err: %v", restored, err)
+	}
+	_, err = os.Stat(filepath.Join(tracker.directory, "project/stray.txt"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("a file the snapshot does not have should be taken out. err: %v", err)
+	}
+	_, err = os.Stat(filepath.Join(tracker.directory, "other.txt"))
+	if !os.IsNotExist(err) {
+		t.Fatal("paths outside of the restored directory should be left alone")
+	}
+
+	version := tracker.currentVersion("project/a.txt")
+	if version[globalSettings.Name] == 0 {
+		t.Fatalf("the restored file should be a change made here: %s", version)
+	}
+	tracker.fsLock.RLock()
+	_, deleted := tracker.tombstones["project/stray.txt"]
+	tracker.fsLock.RUnlock()
+	items := tracker.trashList()
+	if !deleted || len(items) != 1 || items[0].RelativePath != "project/stray.txt" {
+		t.Fatalf("the removed file should be deleted everywhere and kept in the trash. tombstone: %v trash: %#v", deleted, items)
+	}
+
+	err = tracker.deleteSnapshot("reorganize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, _ := ioutil.ReadDir(metadataPath(SNAPSHOTS_DIRECTORY, SNAPSHOT_OBJECTS_DIRECTORY))
+	if len(objects) != 0 {
+		t.Fatalf("contents no snapshot has should be dropped: %d left", len(objects))
+	}
+}
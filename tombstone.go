@@ -0,0 +1,254 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// A tombstone remembers that a path was deleted. Tombstones travel in the catalog next to the live entries so a node
+// that was offline when something was deleted deletes it too, instead of sending it back to everyone. Once every
+// known peer has shown the same tombstone in its own catalog it has done its job and is dropped.
+
+// Tombstone - a deleted path and where the deletion came from. The version is that of the path as it was deleted.
+type Tombstone struct {
+	RelativePath string
+	IsDirectory  bool
+	Deleted      time.Time
+	Origin       string
+	Version      VersionVector
+	Acknowledged map[string]bool
+}
+
+// entryJSON - the catalog form of a tombstone
+func (tombstone Tombstone) entryJSON() EntryJSON {
+	return EntryJSON{RelativePath: tombstone.RelativePath, IsDirectory: tombstone.IsDirectory, ModTime: tombstone.Deleted,
+		Deleted: true, Origin: tombstone.Origin, Version: tombstone.Version}
+}
+
+// addTombstone - remember that a path was deleted. Call when inside of a lock!
+func (handler *FilesystemTracker) addTombstone(tombstone Tombstone) {
+	if tombstone.Acknowledged == nil {
+		tombstone.Acknowledged = make(map[string]bool)
+	}
+	handler.tombstones[tombstone.RelativePath] = tombstone
+	handler.recordChange(tombstone.RelativePath)
+}
+
+// addLocalTombstone - remember a deletion made on this node. If the path already has a tombstone, the deletion we are
+// seeing is the result of applying that one. It is kept as is and false is returned. Call when inside of a lock!
+func (handler *FilesystemTracker) addLocalTombstone(relativePath string, isDirectory bool, version VersionVector) bool {
+	_, exists := handler.tombstones[relativePath]
+	if exists {
+		return false
+	}
+
+	handler.addTombstone(Tombstone{RelativePath: relativePath, IsDirectory: isDirectory, Deleted: time.Now(),
+		Origin: globalSettings.Name, Version: version})
+	return true
+}
+
+// clearTombstone - a path that has been created again is no longer deleted, or only kept here by an archive node.
+// Call when inside of a lock!
+func (handler *FilesystemTracker) clearTombstone(relativePath string) {
+	_, exists := handler.tombstones[relativePath]
+	_, archived := handler.archived[relativePath]
+	if exists || archived {
+		delete(handler.tombstones, relativePath)
+		delete(handler.archived, relativePath)
+		handler.scheduleStateSave()
+	}
+}
+
+// applyRemoteDelete - apply a deletion that arrived from another node. An archive node remembers it and keeps the path.
+// Anywhere else it is remembered and the path goes to the trash, unless the incoming breaker holds it back. A held
+// delete leaves no tombstone, so a delete of the path made here later is not taken for this one.
+func (handler *FilesystemTracker) applyRemoteDelete(relativePath string, isDirectory bool, origin string, deleted time.Time, version VersionVector) error {
+	handler.fsLock.Lock()
+	defer handler.fsLock.Unlock()
+
+	tombstone := Tombstone{RelativePath: relativePath, IsDirectory: isDirectory, Deleted: deleted, Origin: origin,
+		Version: version, Acknowledged: map[string]bool{origin: true}}
+	if globalSettings.Archive {
+		handler.addTombstone(tombstone)
+		handler.keepDeletedPath(relativePath)
+		return nil
+	}
+
+	if handler.holdRemoteChange(relativePath, BREAKER_CHANGE_DELETE, origin, version) {
+		return nil
+	}
+	handler.addTombstone(tombstone)
+	return handler.moveToTrash(relativePath, origin)
+}
+
+// tombstoneEntries - the tombstones in the form they take in a catalog. Call when inside of a lock!
+func (handler *FilesystemTracker) tombstoneEntries() []EntryJSON {
+	entries := make([]EntryJSON, 0, len(handler.tombstones))
+	for _, tombstone := range handler.tombstones {
+		entries = append(entries, tombstone.entryJSON())
+	}
+	return entries
+}
+
+// processRemoteTombstone - apply a deletion found in another node's catalog. Directories are returned instead of being
+// removed so the caller can remove them once the files inside of them are gone.
+func (handler *FilesystemTracker) processRemoteTombstone(remoteServer string, remoteEntry EntryJSON) (directoryToRemove string) {
+	handler.fsLock.Lock()
+	defer handler.fsLock.Unlock()
+
+	path := remoteEntry.RelativePath
+	existing, hasTombstone := handler.tombstones[path]
+	if hasTombstone {
+		switch existing.Version.Compare(remoteEntry.Version) {
+		case VERSION_EQUAL:
+			// The other side having the same tombstone is its acknowledgement
+			if !existing.Acknowledged[remoteServer] {
+				existing.Acknowledged[remoteServer] = true
+				handler.scheduleStateSave()
+			}
+		case VERSION_DOMINATED:
+			handler.addTombstone(Tombstone{RelativePath: path, IsDirectory: remoteEntry.IsDirectory, Deleted: remoteEntry.ModTime,
+				Origin: remoteEntry.Origin, Version: remoteEntry.Version, Acknowledged: map[string]bool{remoteServer: true}})
+		case VERSION_CONCURRENT:
+			// Deleted independently on both sides. Both end up with the combined version.
+			existing.Version = existing.Version.Merge(remoteEntry.Version)
+			existing.Acknowledged = make(map[string]bool)
+			handler.addTombstone(existing)
+		}
+		return
+	}
+
+	local, exists := handler.contents[path]
+	if exists {
+		// In a receive-only folder their delete replaces an edit made here
+		ordering := local.version.Compare(remoteEntry.Version)
+		if ordering == VERSION_DOMINATES || (ordering == VERSION_CONCURRENT && folderDirectionFor(path).sends()) {
+			log.Printf("ProcessCatalog: %s was changed here without seeing the delete on %s (%s). Keeping it", path, remoteServer, ordering)
+			return
+		}
+		if handler.holdRemoteChange(path, BREAKER_CHANGE_DELETE, remoteEntry.Origin, remoteEntry.Version) {
+			return
+		}
+	}
+
+	handler.addTombstone(Tombstone{RelativePath: path, IsDirectory: remoteEntry.IsDirectory, Deleted: remoteEntry.ModTime,
+		Origin: remoteEntry.Origin, Version: remoteEntry.Version, Acknowledged: map[string]bool{remoteServer: true, remoteEntry.Origin: true}})
+	delete(handler.neededFiles, path)
+	handler.clearDivergence(path)
+
+	if !exists {
+		return
+	}
+
+	if globalSettings.Archive {
+		handler.keepDeletedPath(path)
+		return
+	}
+	if local.IsDir() {
+		return path
+	}
+
+	log.Printf("ProcessCatalog: %s was deleted on %s while we were away. Moving it to the trash", path, remoteEntry.Origin)
+	delete(handler.contents, path)
+	err := handler.moveToTrash(path, remoteEntry.Origin)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("ProcessCatalog: unable to delete %s: %s", path, err)
+	}
+	return
+}
+
+// acknowledgeTombstones - record that another node has the same tombstone for a path, and for everything below it
+// when below is set. Used when comparing trees, where matching hashes stand in for the tombstones themselves.
+func (handler *FilesystemTracker) acknowledgeTombstones(remoteServer, relativePath string, below bool) {
+	handler.fsLock.Lock()
+	defer handler.fsLock.Unlock()
+
+	changed := false
+	for path, tombstone := range handler.tombstones {
+		if path != relativePath && !(below && prefixMatches(relativePath, path)) {
+			continue
+		}
+		if !tombstone.Acknowledged[remoteServer] {
+			tombstone.Acknowledged[remoteServer] = true
+			changed = true
+		}
+	}
+	if changed {
+		handler.scheduleStateSave()
+	}
+}
+
+// removeTombstonedDirectories - remove directories deleted elsewhere, deepest first. A directory that still has
+// something in it was added to after the delete, so it stays.
+func (handler *FilesystemTracker) removeTombstonedDirectories(directories []string) {
+	sort.Slice(directories, func(i, j int) bool { return len(directories[i]) > len(directories[j]) })
+
+	handler.fsLock.Lock()
+	defer handler.fsLock.Unlock()
+
+	for _, path := range directories {
+		err := os.Remove(filepath.Join(handler.directory, path))
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("ProcessCatalog: not deleting directory %s: %s", path, err)
+			handler.clearTombstone(path)
+			continue
+		}
+		delete(handler.contents, path)
+	}
+}
+
+// collectTombstones - drop the tombstones that every peer has acknowledged
+func (handler *FilesystemTracker) collectTombstones() {
+	serverMapLock.RLock()
+	peers := make([]string, 0, len(serverMap))
+	for name := range serverMap {
+		if name != globalSettings.Name {
+			peers = append(peers, name)
+		}
+	}
+	serverMapLock.RUnlock()
+	// A peer that left may come back, and has to learn about the deletes it missed
+	peers = append(peers, departedPeerNames()...)
+
+	handler.fsLock.Lock()
+	defer handler.fsLock.Unlock()
+
+	collected := 0
+	for path, tombstone := range handler.tombstones {
+		acknowledged := true
+		for _, peer := range peers {
+			if !tombstone.Acknowledged[peer] {
+				acknowledged = false
+				break
+			}
+		}
+		if acknowledged {
+			delete(handler.tombstones, path)
+			collected++
+		}
+	}
+
+	if collected > 0 {
+		fmt.Printf("Collected %d tombstones acknowledged by all peers", collected)
+		handler.scheduleStateSave()
+	}
+}
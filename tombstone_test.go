@@ -0,0 +1,142 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// catalogEvent - build a catalog event as another node would send it
+func catalogEvent(t *testing.T, source string, entries ...EntryJSON) Event {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Event{Name: "replicat.Catalog", Source: source, RawData: data}
+}
+
+func TestTombstoneDeletesFileOnNodeThatWasOffline(t *testing.T) {
+	useTestSettings(t)
+	tracker := createTracker("tombstoneOffline")
+	defer cleanupTracker(tracker)
+	globalSettings.Directory = tracker.directory
+
+	filename := filepath.Join(tracker.directory, "gone.txt")
+	err := ioutil.WriteFile(filename, []byte("deleted elsewhere"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _ := os.Stat(filename)
+	tracker.fsLock.Lock()
+	tracker.contents["gone.txt"] = *NewDirectoryFromFileInfo(&info)
+	tracker.fsLock.Unlock()
+
+	deleted := info.ModTime().Add(time.Minute)
+	tracker.ProcessCatalog(catalogEvent(t, "tombstonePeer",
+		EntryJSON{RelativePath: "gone.txt", ModTime: deleted, Deleted: true, Origin: "tombstoneOrigin", Version: VersionVector{"tombstoneOrigin": 1}}))
+
+	_, err = os.Stat(filename)
+	if !os.IsNotExist(err) {
+		t.Fatalf("a file deleted while we were away should be deleted. err: %v", err)
+	}
+
+	tracker.fsLock.RLock()
+	tombstone, exists := tracker.tombstones["gone.txt"]
+	tracker.fsLock.RUnlock()
+	if exists && (tombstone.Origin != "tombstoneOrigin" || !tombstone.Deleted.Equal(deleted)) {
+		t.Fatalf("tombstone does not describe the original deletion: %#v", tombstone)
+	}
+}
+
+func TestTombstonePreventsResurrection(t *testing.T) {
+	useTestSettings(t)
+	tracker := createTracker("tombstoneResurrection")
+	defer cleanupTracker(tracker)
+	globalSettings.Directory = tracker.directory
+
+	serverMapLock.Lock()
+	serverMap["tombstonePeer"] = &ReplicatServer{Name: "tombstonePeer"}
+	serverMapLock.Unlock()
+
+	before := VersionVector{"tombstonePeer": 1}
+	deletedVersion := before.Increment(globalSettings.Name)
+	tracker.fsLock.Lock()
+	tracker.addLocalTombstone("old.txt", false, deletedVersion)
+	deleted := tracker.tombstones["old.txt"].Deleted
+	tracker.fsLock.Unlock()
+
+	// The peer still has the file as it was before the delete. It must not be requested.
+	tracker.ProcessCatalog(catalogEvent(t, "tombstonePeer",
+		EntryJSON{RelativePath: "old.txt", ModTime: deleted.Add(time.Hour), Hash: []byte{1, 2, 3}, Size: 10, Version: before}))
+
+	tracker.fsLock.RLock()
+	_, needed := tracker.neededFiles["old.txt"]
+	_, stillDeleted := tracker.tombstones["old.txt"]
+	tracker.fsLock.RUnlock()
+	if needed || !stillDeleted {
+		t.Fatalf("a deleted file was brought back. needed: %v tombstone: %v", needed, stillDeleted)
+	}
+
+	// Once the peer shows the tombstone in its own catalog, every peer has it and it can be dropped
+	tracker.ProcessCatalog(catalogEvent(t, "tombstonePeer",
+		EntryJSON{RelativePath: "old.txt", ModTime: deleted, Deleted: true, Origin: globalSettings.Name, Version: deletedVersion}))
+
+	tracker.fsLock.RLock()
+	_, stillDeleted = tracker.tombstones["old.txt"]
+	tracker.fsLock.RUnlock()
+	if stillDeleted {
+		t.Fatal("a tombstone acknowledged by every peer should be collected")
+	}
+}
+
+func TestTombstoneWaitsForDepartedPeer(t *testing.T) {
+	useTestSettings(t)
+	tracker := createTracker("tombstoneDeparted")
+	defer cleanupTracker(tracker)
+	globalSettings.Directory = tracker.directory
+	departedPeers = nil
+	defer func() { departedPeers = nil }()
+
+	peerDeparted("tombstoneAway")
+	tracker.fsLock.Lock()
+	tracker.addLocalTombstone("away.txt", false, VersionVector{globalSettings.Name: 1})
+	tracker.fsLock.Unlock()
+
+	tracker.collectTombstones()
+	tracker.fsLock.RLock()
+	_, kept := tracker.tombstones["away.txt"]
+	tracker.fsLock.RUnlock()
+	if !kept {
+		t.Fatal("a tombstone should be kept for a peer that left and may come back")
+	}
+
+	err := decommissionPeer("tombstoneAway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.collectTombstones()
+	tracker.fsLock.RLock()
+	_, kept = tracker.tombstones["away.txt"]
+	tracker.fsLock.RUnlock()
+	if kept {
+		t.Fatal("a tombstone should be collected once the peer it waited for is decommissioned")
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"github.com/rjeczalik/notify"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -51,8 +52,39 @@ type StorageTracker interface {
 	ListFolders(getLocks bool) (folderList []string, err error)
 	SendCatalog()
 	ProcessCatalog(event Event)
+	ProcessMerkleRoot(event Event)
+	changesSince(logID string, since uint64) ChangesResponse
+	changedEntry(relativePath string) (entry EntryJSON, found bool)
+	merkleChildren(relativePath string) (response MerkleResponse, found bool)
 	sendRequestedPaths(pathEntries map[string]EntryJSON, targetServerName string)
 	getEntryJSON(relativePath string) (EntryJSON, error)
+	applyRemoteDelete(relativePath string, isDirectory bool, origin string, deleted time.Time, version VersionVector) error
+	currentVersion(relativePath string) VersionVector
+	mergeVersion(relativePath string, version VersionVector)
+	applyRemoteChange(remote EntryJSON, apply func(relativePath string) error) error
+	applyRemoteMetadata(remote EntryJSON) error
+	conflictList() []Conflict
+	dismissConflict(path string) bool
+	transferList() []Transfer
+	requestFile(entry EntryJSON)
+	cancelTransfer(relativePath string) bool
+	transferCancelled(relativePath string) bool
+	divergenceList() []Divergence
+	revertDivergence(relativePath string) bool
+	trashDeletedPath(relativePath, origin string, version VersionVector) error
+	trashList() []TrashItem
+	restoreFromTrash(id, relativePath string) error
+	purgeTrashItem(id string) bool
+	versionList(relativePath string) []FileVersion
+	restoreFileVersion(relativePath, id string) error
+	createSnapshot(name string) (Snapshot, error)
+	snapshotList() ([]Snapshot, error)
+	diffSnapshots(from, to string) ([]SnapshotChange, error)
+	exportSnapshot(name, prefix string, w io.Writer) error
+	restoreSnapshot(name, prefix string) error
+	deleteSnapshot(name string) error
+	breakerList() []CircuitBreaker
+	settleBreaker(direction string, confirm bool) error
 	GetStatistics() map[string]string
 	IncrementStatistic(name string, delta int, getLocks bool)
 	printLockable(lock bool)
@@ -78,7 +110,39 @@ type FilesystemTracker struct {
 	fsLock            sync.RWMutex
 	server            *ReplicatServer
 	neededFiles       map[string]EntryJSON
+	transfers         transferQueue
+	ignore            *ignoreMatcher
+	hashIndex         map[string]string // content hash to a path that has that content, for finding local duplicates
+	tombstones        map[string]Tombstone
+	conflicts         []Conflict
+	divergent         map[string]Divergence // changes made here in receive-only folders, which are not sent
+	archived          map[string]Tombstone  // paths deleted on other nodes that an archive node keeps
+	trash             []TrashItem
+	versions          map[string][]FileVersion // contents of files that newer copies replaced
+	contentOrigins    map[string]string        // the node the contents of each file came from, since this run began
+	breakers          map[string]*CircuitBreaker
+	linkGroups        map[string]string               // hard link group on another node to the path here that holds it
+	linkRequests      map[string]string               // hard link group on another node to the path of it being transferred
+	pendingLinks      map[string]map[string]EntryJSON // paths of a hard link group waiting for the one being transferred
+	changes           changeLog
+	cursors           map[string]ChangeCursor // how far into each peer's change log we have processed
+	merkle            merkleTree
+	merkleBuilt       time.Time
+	merkleLock        sync.Mutex
+	stateSaveLock     sync.Mutex
+	index             *trackerIndex
+	indexDirty        map[string]bool     // paths the index does not have the current state of
+	indexChildren     map[string][]string // what the index had in each directory that the scan has not got to yet
+	scan              scanCheckpoint
 	stats             TrackerStats
+	resyncs           sync.WaitGroup // comparisons with the other nodes running in the background
+	monitoring        sync.WaitGroup // the loop taking in filesystem events
+	hashing           sync.WaitGroup // files of ours waiting on the hash workers
+	transferring      sync.WaitGroup // the loop working through the transfers
+	requesting        sync.WaitGroup // requests for files on their way to other nodes
+	monitorStop       chan struct{}
+
+	stateSaveScheduled bool
 }
 
 // TrackerStats - Basic statistics that the tracker will monitor and report on.
@@ -107,6 +171,10 @@ const (
 	TRACKER_CATALOGS_SENT = "CatalogsSent"
 	// TRACKER_CATALOGS_RECEIVED - Number of times we have received a catalog from someone else
 	TRACKER_CATALOGS_RECEIVED = "CatalogsRecieved"
+	// TRACKER_QUEUE_DEPTH - Prefix of the per peer statistic for the number of events waiting to be delivered
+	TRACKER_QUEUE_DEPTH = "QueueDepth."
+	// TRACKER_QUEUE_OLDEST_SECONDS - Prefix of the per peer statistic for the age of the oldest undelivered event
+	TRACKER_QUEUE_OLDEST_SECONDS = "QueueOldestSeconds."
 	// TRACKER_CONCURRENT_SENDS_PER_SERVER - Number of concurrent sends allowed per peer request
 	TRACKER_CONCURRENT_SENDS_PER_SERVER = 20
 )
@@ -114,11 +182,17 @@ const (
 // TRACKER_ERROR_NO_STATS - Could not run stat on an item
 var TRACKER_ERROR_NO_STATS error = errors.New("Replicat: Could not get stats on directory")
 
+// TRACKER_ERROR_STALE_VERSION - A change from another node is older than what we already have
+var TRACKER_ERROR_STALE_VERSION error = errors.New("Replicat: Change is older than the local version")
+
 // Entry - contains the data for a file
 type Entry struct {
 	os.FileInfo
-	setup bool
-	hash  []byte
+	setup   bool
+	hash    []byte
+	version VersionVector
+	symlink string            // where it points, for a symbolic link tracked as a link
+	xattrs  map[string][]byte // extended attributes, in folders that replicate them
 }
 
 // NewDirectory - creates and returns a new Directory
@@ -128,7 +202,7 @@ func NewDirectory() *Entry {
 
 // NewDirectoryFromFileInfo - creates and returns a new Directory based on a fileinfo structure
 func NewDirectoryFromFileInfo(info *os.FileInfo) *Entry {
-	return &Entry{*info, true, nil}
+	return &Entry{FileInfo: *info, setup: true}
 }
 
 // IncrementStatistic - Increment one of the named statistics on the tracker.
@@ -244,6 +318,10 @@ func (handler *FilesystemTracker) GetStatistics() (stats map[string]string) {
 	stats[TRACKER_FILES_DELETED] = strconv.Itoa(handler.stats.FilesDeleted)
 	stats[TRACKER_CATALOGS_SENT] = strconv.Itoa(handler.stats.CatalogsSent)
 	stats[TRACKER_CATALOGS_RECEIVED] = strconv.Itoa(handler.stats.CatalogsReceived)
+	for _, queue := range outboundQueueStatuses() {
+		stats[TRACKER_QUEUE_DEPTH+queue.Peer] = strconv.Itoa(queue.Depth)
+		stats[TRACKER_QUEUE_OLDEST_SECONDS+queue.Peer] = strconv.Itoa(int(queue.OldestAge.Seconds()))
+	}
 
 	address := serverMap[globalSettings.Name].Address
 
@@ -272,11 +350,13 @@ func (handler *FilesystemTracker) Initialize(directory string, server *ReplicatS
 	}
 
 	fmt.Printf("FilesystemTracker:init called with %s", directory)
+	handler.server = server
 	handler.directory = directory
 
 	// Make the channel buffered to ensure no event is dropped. Notify will drop
 	// an event if the receiver is not able to keep up the sending pace.
 	handler.fsEventsChannel = make(chan notify.EventInfo, 10000)
+	handler.monitorStop = make(chan struct{})
 
 	// Update the path that traffic is served from to be the filesystem canonical path. This will allow the event folders that come in to match what we have.
 	fullPath := validatePath(directory)
@@ -289,26 +369,85 @@ func (handler *FilesystemTracker) Initialize(directory string, server *ReplicatS
 
 	handler.renamesInProgress = make(map[uint64]renameInformation, 100)
 	handler.neededFiles = make(map[string]EntryJSON, 100)
+	handler.transfers = newTransferQueue()
+	handler.hashIndex = make(map[string]string, 100)
+	handler.divergent = make(map[string]Divergence)
+	handler.archived = make(map[string]Tombstone)
+	handler.versions = make(map[string][]FileVersion)
+	handler.contentOrigins = make(map[string]string)
+	handler.breakers = map[string]*CircuitBreaker{BREAKER_OUTGOING: newCircuitBreaker(BREAKER_OUTGOING),
+		BREAKER_INCOMING: newCircuitBreaker(BREAKER_INCOMING)}
+	handler.linkGroups = make(map[string]string)
+	handler.linkRequests = make(map[string]string)
+	handler.pendingLinks = make(map[string]map[string]EntryJSON)
+	handler.ignore = newIgnoreMatcher(fullPath)
 
 	fmt.Println("Setting up filesystemTracker!")
 	handler.printLockable(false)
 
-	fmt.Println("FilesystemTracker:init starting folder scan looking for initial files")
-	err = handler.scanFolders()
+	// Start from the index when there is one. The directory is then checked against it in the background.
+	handler.contents = make(map[string]Entry)
+	indexed, err := handler.loadIndex()
 	if err != nil {
-		panic(err)
+		log.Printf("Unable to open the index. Scanning everything: %s", err)
+	}
+	handler.startScan(indexed)
+
+	if indexed == 0 {
+		fmt.Println("FilesystemTracker:init starting folder scan looking for initial files")
+		err = handler.scanFolders(false)
+		if err != nil {
+			panic(err)
+		}
 	}
+	handler.loadState()
+
+	// The catalog goes out once the versions from the last run are back
+	handler.SendCatalog()
+	fmt.Println("Done sending catalog")
 
 	// Set the status to be done with initial scan
 	server.SetStatus(REPLICAT_STATUS_JOINING_CLUSTER)
 	handler.printLockable(false)
 	handler.setup = true
+	handler.transferring.Add(1)
+	go handler.runTransfers(handler.transfers.stop)
+
+	if indexed > 0 {
+		go func() {
+			err := handler.scanFolders(true)
+			if err != nil {
+				log.Printf("Unable to check the directory against the index: %s", err)
+			}
+		}()
+	}
 
 	return
 }
 
+// shutdown - stop taking in changes and working through the transfers, wait for what is under way and close the index.
+// The directory is left as it is.
+func (handler *FilesystemTracker) shutdown() {
+	handler.waitForResync()
+
+	// Nothing is taken in from the filesystem once we are shutting down
+	notify.Stop(handler.fsEventsChannel)
+	close(handler.monitorStop)
+	handler.monitoring.Wait()
+	handler.hashing.Wait()
+	close(handler.transfers.stop)
+	handler.transferring.Wait()
+	handler.requesting.Wait()
+
+	handler.fsLock.Lock()
+	handler.closeIndex()
+	handler.fsLock.Unlock()
+}
+
 func (handler *FilesystemTracker) cleanupAndDelete() {
 	fmt.Println("FilesystemTracker:cleanup")
+	handler.shutdown()
+
 	handler.fsLock.Lock()
 	defer handler.fsLock.Unlock()
 	fmt.Println("FilesystemTracker:/cleanup")
@@ -319,8 +458,6 @@ func (handler *FilesystemTracker) cleanupAndDelete() {
 	}
 
 	os.RemoveAll(handler.directory)
-
-	notify.Stop(handler.fsEventsChannel)
 }
 
 func (handler *FilesystemTracker) watchDirectory(watcher *ChangeHandler) {
@@ -337,10 +474,11 @@ func (handler *FilesystemTracker) watchDirectory(watcher *ChangeHandler) {
 
 	handler.watcher = watcher
 
-	go handler.monitorLoop(handler.fsEventsChannel)
+	handler.monitoring.Add(1)
+	go handler.monitorLoop(handler.fsEventsChannel, handler.monitorStop)
 
 	// Set up a watch point listening for events within a directory tree rooted at the specified folder
-	err := notify.Watch(handler.directory+"/...", handler.fsEventsChannel, notify.All)
+	err := notify.Watch(handler.directory+"/...", handler.fsEventsChannel, notify.All|metadataWatchEvents)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -456,14 +594,7 @@ func (handler *FilesystemTracker) getEntryJSON(relativePath string) (EntryJSON,
 		return EntryJSON{}, errors.New("File information is unset")
 	}
 
-	result := EntryJSON{RelativePath: relativePath,
-		IsDirectory: currentEntry.IsDir(),
-		Hash:        currentEntry.hash,
-		ModTime:     currentEntry.ModTime(),
-		Size:        currentEntry.Size(),
-		ServerName:  globalSettings.Name}
-
-	return result, nil
+	return catalogEntry(relativePath, currentEntry), nil
 }
 
 // createPath implements the new path/file creation. Locking is done outside this call.
@@ -492,6 +623,8 @@ func (handler *FilesystemTracker) createPath(pathName string, isDirectory bool)
 
 	if pathCreated {
 		handler.contents[relativePathName] = *NewDirectoryFromFileInfo(&stat)
+		handler.clearTombstone(relativePathName)
+		handler.recordChange(relativePathName)
 	}
 
 	if !isDirectory {
@@ -529,7 +662,13 @@ func (handler *FilesystemTracker) createPath(pathName string, isDirectory bool)
 			panic(fmt.Sprintf("Error creating file %s: %v", completeAbsoluteFilePath, err))
 		}
 
-		handler.contents[relativePathName] = *NewDirectoryFromFileInfo(&stat)
+		// A file that was already here keeps its version so a change arriving for it can be compared against it
+		entry := *NewDirectoryFromFileInfo(&stat)
+		entry.version = handler.contents[pathName].version
+		handler.contents[pathName] = entry
+		handler.clearTombstone(pathName)
+		handler.recordChange(pathName)
+		handler.queueHash(pathName)
 	}
 
 	return
@@ -593,7 +732,17 @@ func (handler *FilesystemTracker) Rename(sourcePath string, destinationPath stri
 	// If we have a source and destination, perform the move to mirror the other side
 	if len(sourcePath) > 0 && len(destinationPath) > 0 {
 		fmt.Println("FilesystemTracker:Rename completing")
-		err = handler.handleCompleteRename(sourcePath, destinationPath, isDirectory)
+		if globalSettings.Archive {
+			err = handler.copyRenamedPath(sourcePath, destinationPath)
+		} else {
+			err = handler.handleCompleteRename(sourcePath, destinationPath, isDirectory)
+		}
+		if err == nil {
+			handler.trackRemoteRename(sourcePath, destinationPath, isDirectory)
+		}
+		if err == nil && globalSettings.Archive {
+			handler.keepDeletedPath(sourcePath)
+		}
 	} else if sourcePath == "" {
 		fmt.Println("FilesystemTracker:Rename creating a new path")
 		// If the file was moved into the monitored folder from nowhere, ...
@@ -602,14 +751,23 @@ func (handler *FilesystemTracker) Rename(sourcePath string, destinationPath stri
 	} else if destinationPath == "" {
 		fmt.Println("FilesystemTracker:Rename deleting existing path")
 		// If the file or folder was moved out of the monitored folder, get rid of it.
+		if handler.holdRemoteChange(sourcePath, BREAKER_CHANGE_DELETE, "", nil) {
+			return
+		}
+		sourceEntry := handler.contents[sourcePath]
 		delete(handler.contents, sourcePath)
+		handler.addLocalTombstone(sourcePath, isDirectory, sourceEntry.version)
+		if globalSettings.Archive {
+			handler.keepDeletedPath(sourcePath)
+			return
+		}
 		// todo - shortcut the events on this one. Should create a bit of a storm.
-		absolutePathForDeletion := filepath.Join(handler.directory, sourcePath)
-		fmt.Printf("About to call os.RemoveAll on: %s", absolutePathForDeletion)
-		err = os.RemoveAll(absolutePathForDeletion)
-		if err != nil {
-			panic(fmt.Sprintf("%v encountered when attempting to os.RemoveAll(%s)", err, absolutePathForDeletion))
+		fmt.Printf("About to move %s to the trash", sourcePath)
+		err = handler.moveToTrash(sourcePath, "")
+		if err != nil && !os.IsNotExist(err) {
+			panic(fmt.Sprintf("%v encountered when attempting to move %s to the trash", err, sourcePath))
 		}
+		err = nil
 	} else {
 		panic("Enexpected case encountered in rename")
 	}
@@ -681,15 +839,15 @@ func extractPaths(handler *FilesystemTracker, ei *notify.EventInfo) (path, fullP
 }
 
 // Monitor the filesystem looking for changes to files we are keeping track of.
-func (handler *FilesystemTracker) monitorLoop(c chan notify.EventInfo) {
-	// filesToIgnore - If you run into one of these files, do not sync it to other side.
-	filesToIgnore := map[string]bool{
-		".DS_Store": true,
-		"Thumbs.db": true,
-	}
-
+func (handler *FilesystemTracker) monitorLoop(c chan notify.EventInfo, stop chan struct{}) {
+	defer handler.monitoring.Done()
 	for {
-		ei := <-c
+		var ei notify.EventInfo
+		select {
+		case <-stop:
+			return
+		case ei = <-c:
+		}
 
 		fmt.Printf("*****We have an event: %v\nwith Sys: %v\npath: %v\nevent: %v", ei, ei.Sys(), ei.Path(), ei.Event())
 
@@ -700,12 +858,17 @@ func (handler *FilesystemTracker) monitorLoop(c chan notify.EventInfo) {
 			continue
 		}
 
-		//.DS_Store
-		// split out the filename and check to see if it is on the ignore list.
-		_, testFile := filepath.Split(ei.Path())
-		_, exists := filesToIgnore[testFile]
-		if exists {
-			fmt.Printf("Ignoring event for file on ignore list: %s - %s", ei.Event(), testFile)
+		// Changes to replicat's own state are never replicated
+		if isMetadataPath(path) {
+			continue
+		}
+
+		// A changed ignore file is read again before anything else is checked against it
+		if filepath.Base(path) == IGNORE_FILE_NAME {
+			handler.ignore.changed(path)
+		}
+		if handler.ignoresEvent(path, fullPath) {
+			fmt.Printf("Ignoring event for file on ignore list: %s - %s", ei.Event(), path)
 			continue
 		}
 
@@ -793,10 +956,14 @@ func (handler *FilesystemTracker) completeRenameIfAbandoned(iNode uint64) {
 		relativePath := inProgress.sourcePath[len(handler.directory)+1:]
 		fmt.Printf("File at: %s (iNode %d) appears to have been moved away. Removing it", relativePath, iNode)
 		delete(handler.contents, relativePath)
+		version := inProgress.sourceDirectory.version.Increment(globalSettings.Name)
+		handler.addLocalTombstone(relativePath, inProgress.sourceDirectory.IsDir(), version)
 
 		// tell the other nodes that a rename was done.
-		event := Event{Name: "replicat.Rename", Source: globalSettings.Name, SourcePath: relativePath}
-		SendEvent(event, inProgress.sourcePath)
+		event := Event{Name: "replicat.Rename", Source: globalSettings.Name, SourcePath: relativePath, Version: version}
+		if handler.shouldPublish(event) {
+			SendEvent(event, inProgress.sourcePath)
+		}
 	} else if inProgress.destinationSet {
 		fmt.Printf("directory: %s src: %s dest: %s", handler.directory, inProgress.sourcePath, inProgress.destinationPath)
 		fmt.Printf("inProgress: %v", handler.renamesInProgress)
@@ -809,12 +976,21 @@ func (handler *FilesystemTracker) completeRenameIfAbandoned(iNode uint64) {
 		}
 
 		relativePath := inProgress.destinationPath[len(handler.directory)+1:]
-		handler.contents[relativePath] = *NewDirectoryFromFileInfo(&inProgress.destinationStat)
+		destination := NewDirectoryFromFileInfo(&inProgress.destinationStat)
+		destination.version = handler.tombstones[relativePath].Version.Increment(globalSettings.Name)
+		handler.contents[relativePath] = *destination
+		handler.clearTombstone(relativePath)
+		handler.recordChange(relativePath)
+		if !inProgress.destinationStat.IsDir() {
+			handler.queueHash(relativePath)
+		}
 
 		// tell the other nodes that a rename was done.
 		event := Event{Name: "replicat.Rename", Source: globalSettings.Name, Path: relativePath, ModTime: inProgress.destinationStat.ModTime(),
-			IsDirectory: inProgress.destinationStat.IsDir()}
-		SendEvent(event, inProgress.destinationPath)
+			IsDirectory: inProgress.destinationStat.IsDir(), Version: destination.version}
+		if handler.shouldPublish(event) {
+			SendEvent(event, inProgress.destinationPath)
+		}
 
 		// find the source if the destination is an iNode in our system
 		// This is probably expensive. :) Wait until there is a flag of a cleanup
@@ -837,6 +1013,17 @@ func (handler *FilesystemTracker) completeRenameIfAbandoned(iNode uint64) {
 
 func (handler *FilesystemTracker) handleNotifyRename(event Event, pathName, fullPath string) (err error) {
 	fmt.Printf("FilesystemTracker:handleNotifyRename: pathname: %s fullPath: %s", pathName, fullPath)
+
+	// Something moved into place on behalf of another node (a received file or a rename) is already tracked as it is
+	current, tracked := handler.contents[pathName]
+	if tracked {
+		info, statErr := os.Stat(fullPath)
+		if statErr == nil && sameFileState(current, info) {
+			log.Printf("notify.Rename: %s is already tracked as it is on disk. Not a local change", pathName)
+			return
+		}
+	}
+
 	// Either the path should exist in the filesystem or it should exist in the stored tree. Find it.
 
 	// check to see if this folder currently exists. If it does, it is the destination
@@ -885,14 +1072,26 @@ func (handler *FilesystemTracker) handleNotifyRename(event Event, pathName, full
 		relativeSource := inProgress.sourcePath[len(handler.directory)+1:]
 		fmt.Printf("moving from source: %s (%s) to destination: %s (%s)", inProgress.sourcePath, relativeSource, inProgress.destinationPath, relativeDestination)
 
-		handler.contents[relativeDestination] = *NewDirectoryFromFileInfo(&inProgress.destinationStat)
+		// The moved path keeps its history. The old name is deleted as of the same version.
+		version := inProgress.sourceDirectory.version.Increment(globalSettings.Name)
+		destination := NewDirectoryFromFileInfo(&inProgress.destinationStat)
+		destination.version = version
+		handler.contents[relativeDestination] = *destination
 		delete(handler.contents, relativeSource)
+		handler.clearTombstone(relativeDestination)
+		handler.addLocalTombstone(relativeSource, inProgress.destinationStat.IsDir(), version)
+		handler.recordChange(relativeDestination)
 		delete(handler.renamesInProgress, iNode)
+		if !inProgress.destinationStat.IsDir() {
+			handler.queueHash(relativeDestination)
+		}
 
 		// tell the other nodes that a rename was done.
-		event := Event{Name: "replicat.Rename", Path: relativeDestination, Source: globalSettings.Name, SourcePath: relativeSource}
+		event := Event{Name: "replicat.Rename", Path: relativeDestination, Source: globalSettings.Name, SourcePath: relativeSource, Version: version}
 		// todo - verify relativeDestination is the right thing to send here
-		SendEvent(event, relativeDestination)
+		if handler.shouldPublish(event) {
+			SendEvent(event, relativeDestination)
+		}
 
 	} else {
 		fmt.Printf("^^^^^^^We do not have both a source and destination - schedule and save under iNode: %d Current transfer is: %#v", iNode, inProgress)
@@ -908,38 +1107,84 @@ func (handler *FilesystemTracker) handleNotifyCreate(event Event, pathName, full
 	currentValue, exists := handler.contents[pathName]
 
 	log.Printf("processEvent: About to assign from one path to the next. \n\tOriginal: %v \n\tEvent: %v", currentValue, event)
+	info, statErr := statTracked(pathName, fullPath)
+
+	// Creating something on behalf of another node shows up here too, as does a create reported after its first
+	// write. It is already tracked as it is, so the watcher hears about it but nothing is sent.
+	if exists && statErr == nil && sameFileState(currentValue, info) {
+		log.Printf("notify.Create: %s is already tracked as it is on disk. Not a local change", pathName)
+		handler.notifyWatcherCreated(event.IsDirectory, pathName)
+		return
+	}
+
 	// make sure there is an entry in the DirTreeMap for this folder. Since an empty list will always be returned, we can use that
 	if !exists {
-		info, err := os.Stat(fullPath)
-		if err != nil {
+		if statErr != nil {
 			log.Printf("Could not get stats on directory %s", fullPath)
 			return TRACKER_ERROR_NO_STATS
 		}
 		directory := NewDirectory()
-		directory.FileInfo = info
-		handler.contents[pathName] = *directory
+		// Something created again after it was deleted has seen the delete
+		directory.version = handler.tombstones[pathName].Version
+		currentValue = *directory
 	}
+	if statErr == nil {
+		currentValue.FileInfo = info
+	}
+	currentValue.version = currentValue.version.Increment(globalSettings.Name)
+	handler.contents[pathName] = currentValue
+	handler.contentOrigins[pathName] = globalSettings.Name
+	handler.clearTombstone(pathName)
+	handler.recordChange(pathName)
+	event.Version = currentValue.version
 
-	updatedValue, exists := handler.contents[pathName]
-
-	if handler.watcher != nil {
-		if event.IsDirectory {
-			(*handler.watcher).FolderCreated(pathName)
-		} else {
-			(*handler.watcher).FileCreated(pathName)
-		}
+	if !event.IsDirectory {
+		handler.queueHash(pathName)
 	}
 
+	updatedValue, exists := handler.contents[pathName]
+	handler.notifyWatcherCreated(event.IsDirectory, pathName)
+
 	log.Printf("notify.Create: Updated value for %s: %v (%t)", pathName, updatedValue, exists)
 
 	// sendEvent to manager
-	go SendEvent(event, fullPath)
+	if handler.shouldPublish(event) {
+		// A symbolic link goes out as its entry. The other nodes make it from where it points.
+		if isSymlinkEntry(updatedValue) {
+			event = handler.metadataEvent(pathName)
+		}
+		SendEvent(event, fullPath)
+	}
 
 	return
 }
 
+// notifyWatcherCreated - tell the watcher about a new file or folder. Call when inside of a lock!
+func (handler *FilesystemTracker) notifyWatcherCreated(isDirectory bool, pathName string) {
+	if handler.watcher == nil {
+		return
+	}
+	if isDirectory {
+		(*handler.watcher).FolderCreated(pathName)
+	} else {
+		(*handler.watcher).FileCreated(pathName)
+	}
+}
+
+// notifyWatcherUpdated - tell the watcher about a changed file or folder. Call when inside of a lock!
+func (handler *FilesystemTracker) notifyWatcherUpdated(isDirectory bool, pathName string) {
+	if handler.watcher == nil {
+		return
+	}
+	if isDirectory {
+		(*handler.watcher).FolderUpdated(pathName)
+	} else {
+		(*handler.watcher).FileUpdated(pathName)
+	}
+}
+
 func (handler *FilesystemTracker) handleNotifyRemove(event Event, pathName, fullPath string) (err error) {
-	_, exists := handler.contents[pathName]
+	entry, exists := handler.contents[pathName]
 
 	delete(handler.contents, pathName)
 
@@ -949,7 +1194,17 @@ func (handler *FilesystemTracker) handleNotifyRemove(event Event, pathName, full
 		log.Println("In the notify.Remove section but did not see a watcher")
 	}
 
-	go SendEvent(event, "")
+	// Deleting something on behalf of another node shows up here too. That deletion already has its tombstone.
+	version := entry.version.Increment(globalSettings.Name)
+	if !handler.addLocalTombstone(pathName, event.IsDirectory, version) {
+		log.Printf("notify.Remove: %s was deleted on behalf of another node. Not a local change", pathName)
+		return
+	}
+	event.Version = version
+
+	if handler.shouldPublish(event) {
+		SendEvent(event, "")
+	}
 
 	log.Printf("notify.Remove: %s (%t)", pathName, exists)
 	return
@@ -957,14 +1212,31 @@ func (handler *FilesystemTracker) handleNotifyRemove(event Event, pathName, full
 
 func (handler *FilesystemTracker) handleNotifyWrite(event Event, pathName, fullPath string) (err error) {
 	log.Printf("File Write detected: %v", event)
-	if handler.watcher != nil {
-		if event.IsDirectory {
-			(*handler.watcher).FolderUpdated(pathName)
-		} else {
-			(*handler.watcher).FileUpdated(pathName)
-		}
+
+	// Writing a file on behalf of another node, or a write we have already seen, leaves it as we are tracking it
+	info, statErr := statTracked(pathName, fullPath)
+	entry, exists := handler.contents[pathName]
+	if statErr == nil && exists && sameFileState(entry, info) {
+		log.Printf("notify.Write: %s is unchanged from what we are tracking. Not a local change", pathName)
+		handler.notifyWatcherUpdated(event.IsDirectory, pathName)
+		return
 	}
 
+	// Keep our copy of the file information current and get the new contents hashed
+	if statErr == nil && !info.IsDir() {
+		entry.FileInfo = info
+		entry.setup = true
+		entry.hash = nil
+		entry.version = entry.version.Increment(globalSettings.Name)
+		handler.contents[pathName] = entry
+		handler.contentOrigins[pathName] = globalSettings.Name
+		handler.clearTombstone(pathName)
+		handler.recordChange(pathName)
+		handler.queueHash(pathName)
+		event.Version = entry.version
+	}
+	handler.notifyWatcherUpdated(event.IsDirectory, pathName)
+
 	//RelativePath string
 	//IsDirectory  bool
 	//Hash         []byte
@@ -978,7 +1250,9 @@ func (handler *FilesystemTracker) handleNotifyWrite(event Event, pathName, fullP
 	//handler.sendRequestedPaths()
 	//go handler.sendRequestedPaths()
 
-	go SendEvent(event, fullPath)
+	if handler.shouldPublish(event) {
+		SendEvent(event, fullPath)
+	}
 	return
 }
 
@@ -1012,6 +1286,8 @@ func (handler *FilesystemTracker) processEvent(event Event, pathName, fullPath s
 		err = handler.handleNotifyRename(event, pathName, fullPath)
 	case "notify.Write":
 		err = handler.handleNotifyWrite(event, pathName, fullPath)
+	case "notify.InAttrib":
+		err = handler.handleNotifyAttrib(event, pathName, fullPath)
 	default:
 		// do not send the event if we do not recognize it
 		fmt.Printf("%s: %s not known, skipping (%v)", event.Name, pathName, event)
@@ -1027,84 +1303,288 @@ func (handler *FilesystemTracker) processEvent(event Event, pathName, fullPath s
 	}
 }
 
-// Scan for existing files and add them to the list of files that we have with create events. this has to be called inside of a lock
-func (handler *FilesystemTracker) scanFolders() error {
-	log.Printf("FileSystemTracker ScanFolders - start. File Root: '%s'", handler.directory)
-	pendingPaths := make([]string, 0, 100)
-	pendingPaths = append(pendingPaths, handler.directory)
-	handler.contents = make(map[string]Entry)
-
-	for len(pendingPaths) > 0 {
-		currentPath := pendingPaths[0]
-		pendingPaths = pendingPaths[1:]
+// queueHash - have a file hashed in the background. When the hash is ready it is stored on the entry as long as the file
+// has not changed in the meantime, along with the metadata its file information does not have. Call when inside of a
+// lock!
+func (handler *FilesystemTracker) queueHash(relativePath string) {
+	// A symbolic link tracked as a link has nothing to read. It is hashed by where it points, right away.
+	entry, exists := handler.contents[relativePath]
+	if exists && isSymlinkEntry(entry) {
+		handler.captureMetadata(relativePath, &entry)
+		contentHash, err := symlinkHash(entry.symlink)
+		if err != nil {
+			log.Printf("Unable to hash link %s: %s", relativePath, err)
+			return
+		}
+		entry.hash = contentHash
+		handler.contents[relativePath] = entry
+		handler.markIndexDirty(relativePath)
+		return
+	}
 
-		log.Printf("scanFolders: scanning path: %s", currentPath)
-		// Read the directories in the path
-		f, err := os.Open(currentPath)
+	fullPath := filepath.Join(handler.directory, relativePath)
+	handler.hashing.Add(1)
+	queueFileHash(fullPath, func(contentHash []byte, info os.FileInfo, err error) {
+		defer handler.hashing.Done()
 		if err != nil {
-			log.Printf("Error opening '%s': %s", currentPath, err)
-			return err
+			log.Printf("Unable to hash %s: %s", fullPath, err)
+			return
 		}
 
-		dirEntries, err := f.Readdir(-1)
-		for _, entry := range dirEntries {
-			// Determine the relative path for this file or folder
-			absolutePath := filepath.Join(currentPath, entry.Name())
-			relativePath := absolutePath[len(handler.directory)+1:]
-
-			var hash []byte
-
-			if entry.IsDir() {
-				handler.stats.TotalFolders++
-			} else {
-				//hash, err = fileBlake2bHash(absolutePath)
-				//if err != nil {
-				//	log.Printf("Error getting Blake2 Hash for %s: %s", absolutePath, err)
-				//	handler.stats.TotalFolders++
-				//	//todo figure out why I had the folder in here.
-				//	fmt.Printf("Entry data for error: %#v", entry)
-				//	//panic(err)
-				//} else {
-				//	handler.stats.TotalFiles++
-				//}
-				handler.stats.TotalFiles++
-			}
+		handler.fsLock.Lock()
+		defer handler.fsLock.Unlock()
 
-			// add to contents
-			info, err := os.Stat(absolutePath)
-			if err != nil {
-				fmt.Printf("ScanFolders: Could not get stats on directory %s", absolutePath)
-				panic(err)
-			}
+		entry, exists := handler.contents[relativePath]
+		if !exists || entry.FileInfo == nil || entry.IsDir() || entry.Size() != info.Size() || !entry.ModTime().Equal(info.ModTime()) {
+			return
+		}
+
+		entry.hash = contentHash
+		handler.captureMetadata(relativePath, &entry)
+		handler.contents[relativePath] = entry
+		handler.hashIndex[hashToString(contentHash)] = relativePath
+		handler.markIndexDirty(relativePath)
+		handler.scheduleStateSave()
+	})
+}
+
+// findLocalDuplicate - find a path that we already hold with exactly this content. Call with handler.fsLock held.
+func (handler *FilesystemTracker) findLocalDuplicate(contentHash []byte) (relativePath string, found bool) {
+	if contentHash == nil {
+		return "", false
+	}
+
+	key := hashToString(contentHash)
+	relativePath, found = handler.hashIndex[key]
+	if !found {
+		return
+	}
+
+	// The index is only a hint. Make sure the entry still has this content.
+	entry, exists := handler.contents[relativePath]
+	if !exists || !bytes.Equal(entry.hash, contentHash) {
+		delete(handler.hashIndex, key)
+		return "", false
+	}
+
+	return relativePath, true
+}
+
+// copyLocalDuplicate - satisfy a needed file from a copy we already have instead of transferring it across the network
+func (handler *FilesystemTracker) copyLocalDuplicate(sourcePath string, remoteEntry EntryJSON) error {
+	source, err := os.Open(filepath.Join(handler.directory, sourcePath))
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	stagingPath := metadataPath(DELTA_STAGING_DIRECTORY, hashToString(remoteEntry.Hash))
+	err = os.MkdirAll(filepath.Dir(stagingPath), os.ModeDir+os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	staging, err := os.Create(stagingPath)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(staging, source)
+	if err == nil {
+		err = staging.Sync()
+	}
+	closeErr := staging.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(stagingPath)
+		return err
+	}
+
+	entryString, _ := json.Marshal(remoteEntry)
+	lock := lockUpload(remoteEntry.RelativePath)
+	defer lock.Unlock()
+	return finishUpload(remoteEntry.RelativePath, stagingPath, "", hashToString(remoteEntry.Hash), string(entryString))
+}
+
+// sameFileState - check if what is on disk is still what an entry describes. Used to tell our own changes on behalf of
+// other nodes apart from local changes when the filesystem events for them come in.
+func sameFileState(entry Entry, info os.FileInfo) bool {
+	if entry.FileInfo == nil || info == nil || entry.IsDir() != info.IsDir() {
+		return false
+	}
+	if info.IsDir() {
+		return true
+	}
+
+	entryKey, entryOk := hashCacheKeyFromInfo(entry.FileInfo)
+	infoKey, infoOk := hashCacheKeyFromInfo(info)
+	if entryOk && infoOk && entryKey != infoKey {
+		return false
+	}
+
+	return entry.Size() == info.Size() && entry.ModTime().Equal(info.ModTime())
+}
+
+// versionOf - the version of a path, or of its deletion. Call when inside of a lock!
+func (handler *FilesystemTracker) versionOf(relativePath string) VersionVector {
+	entry, exists := handler.contents[relativePath]
+	if exists {
+		return entry.version
+	}
+	return handler.tombstones[relativePath].Version
+}
+
+// currentVersion - the version of a path, or of its deletion
+func (handler *FilesystemTracker) currentVersion(relativePath string) VersionVector {
+	handler.fsLock.RLock()
+	defer handler.fsLock.RUnlock()
+	return handler.versionOf(relativePath)
+}
+
+// mergeVersion - record that a path now includes the changes in a version from another node
+func (handler *FilesystemTracker) mergeVersion(relativePath string, version VersionVector) {
+	if version == nil {
+		return
+	}
+
+	handler.fsLock.Lock()
+	defer handler.fsLock.Unlock()
+
+	entry, exists := handler.contents[relativePath]
+	if exists {
+		entry.version = entry.version.Merge(version)
+		handler.contents[relativePath] = entry
+		handler.recordChange(relativePath)
+		return
+	}
 
-			directory := NewDirectory()
-			directory.FileInfo = info
-			directory.hash = hash
-			handler.contents[relativePath] = *directory
+	tombstone, deleted := handler.tombstones[relativePath]
+	if deleted {
+		tombstone.Version = tombstone.Version.Merge(version)
+		handler.tombstones[relativePath] = tombstone
+		handler.recordChange(relativePath)
+	}
+}
 
-			//fmt.Printf("Packing up: %s = %#v", relativePath, directory)
+// applyRemoteChange - put a change from another node in place and track the result under the merged version. The
+// change is made inside of the lock so the filesystem events it causes find it already tracked. A version that is
+// older than what we have is not applied, and neither is one whose transfer was cancelled. One that conflicts with our
+// own edit is settled by the conflict policy.
+func (handler *FilesystemTracker) applyRemoteChange(remote EntryJSON, apply func(relativePath string) error) (err error) {
+	handler.fsLock.Lock()
+	defer handler.fsLock.Unlock()
+	return handler.applyRemoteChangeLocked(remote, apply)
+}
 
-			if entry.IsDir() {
-				newDirectory := filepath.Join(currentPath, entry.Name())
-				pendingPaths = append(pendingPaths, newDirectory)
+// applyRemoteChangeLocked - applyRemoteChange for callers that hold the lock. Call when inside of a lock!
+func (handler *FilesystemTracker) applyRemoteChangeLocked(remote EntryJSON, apply func(relativePath string) error) (err error) {
+	relativePath, version := remote.RelativePath, remote.Version
+	defer func() {
+		if err == nil || err == TRACKER_ERROR_STALE_VERSION {
+			handler.finishTransfer(relativePath, version)
+		}
+	}()
+
+	if handler.transferCancelledLocked(relativePath) {
+		log.Printf("Not applying %s %s. Its transfer was cancelled", relativePath, version)
+		return TRANSFER_ERROR_CANCELLED
+	}
+
+	direction := folderDirectionFor(relativePath)
+	if !direction.receives() {
+		log.Printf("Not applying %s %s. It is in a send-only folder", relativePath, version)
+		return TRACKER_ERROR_STALE_VERSION
+	}
+
+	current := handler.versionOf(relativePath)
+	switch current.Compare(version) {
+	case VERSION_DOMINATES:
+		log.Printf("Not applying %s %s. We already have the newer %s", relativePath, version, current)
+		return TRACKER_ERROR_STALE_VERSION
+	case VERSION_CONCURRENT:
+		// In a receive-only folder their change replaces whatever was done here
+		if direction.sends() {
+			handled, err := handler.resolveConflict(remote, apply)
+			if handled {
+				return err
 			}
 		}
+	}
 
-		err = f.Close()
-		if err != nil {
-			return err
-		}
+	local, exists := handler.contents[relativePath]
+	if exists && local.FileInfo != nil && !local.IsDir() &&
+		handler.holdRemoteChange(relativePath, BREAKER_CHANGE_MODIFY, remote.ServerName, version) {
+		return TRACKER_ERROR_STALE_VERSION
 	}
 
-	fmt.Println("About to set status of joining cluster")
-	handler.server.SetStatus(REPLICAT_STATUS_JOINING_CLUSTER)
-	fmt.Println("Done set status of joining cluster. About to send catalog")
-	handler.SendCatalog()
-	fmt.Println("Done sending catalog")
+	err = handler.keepReplacedContents(relativePath, remote.ServerName)
+	if err != nil {
+		log.Printf("Unable to keep %s before replacing it: %s", relativePath, err)
+		return err
+	}
+	err = apply(relativePath)
+	if err != nil {
+		return err
+	}
+	if filepath.Base(relativePath) == IGNORE_FILE_NAME {
+		handler.ignore.changed(relativePath)
+	}
+	if !remote.IsDirectory {
+		handler.applyMetadata(relativePath, remote.FileMetadata)
+	}
+
+	info, err := statTracked(relativePath, filepath.Join(handler.directory, relativePath))
+	if err != nil {
+		return err
+	}
+
+	entry := handler.contents[relativePath]
+	entry.FileInfo = info
+	entry.setup = true
+	entry.hash = nil
+	entry.version = current.Merge(version)
+	handler.captureMetadata(relativePath, &entry)
+	handler.contents[relativePath] = entry
+	handler.clearTombstone(relativePath)
+	handler.clearDivergence(relativePath)
+	handler.recordChange(relativePath)
+	if !info.IsDir() {
+		handler.contentOrigins[relativePath] = remote.ServerName
+		handler.queueHash(relativePath)
+		handler.recordLinkGroup(remote, relativePath)
+	}
 
 	return nil
 }
 
+// trackRemoteRename - update the tracked contents for a rename made on behalf of another node, so the filesystem
+// events it causes are not mistaken for a local rename. Call when inside of a lock!
+func (handler *FilesystemTracker) trackRemoteRename(sourcePath, destinationPath string, isDirectory bool) {
+	info, err := statTracked(destinationPath, filepath.Join(handler.directory, destinationPath))
+	if err != nil {
+		return
+	}
+
+	entry := handler.contents[sourcePath]
+	entry.FileInfo = info
+	entry.setup = true
+	handler.contents[destinationPath] = entry
+	delete(handler.contents, sourcePath)
+
+	handler.clearTombstone(destinationPath)
+	handler.addLocalTombstone(sourcePath, isDirectory, entry.version)
+	handler.recordChange(destinationPath)
+}
+
+// catalogEntry - the form a tracked path takes in a catalog
+func catalogEntry(relativePath string, value Entry) EntryJSON {
+	return EntryJSON{RelativePath: relativePath, IsDirectory: value.IsDir(), Hash: value.hash, ModTime: value.ModTime(),
+		Size: value.Size(), ServerName: globalSettings.Name, Version: value.version,
+		FileMetadata: entryMetadata(relativePath, value)}
+}
+
 // EntryJSON - a JSON friendly version of the entry object. It does not have a native filesystem object inside of it.
 type EntryJSON struct {
 	RelativePath string
@@ -1113,39 +1593,38 @@ type EntryJSON struct {
 	ModTime      time.Time
 	Size         int64
 	ServerName   string
+	Deleted      bool          `json:",omitempty"`
+	Origin       string        `json:",omitempty"`
+	Version      VersionVector `json:",omitempty"`
+	FileMetadata
 }
 
-// SendCatalog - Send our catalog out for other nodes to compare. This needs to be called with handler.fsLock engaged
+// SendCatalog - Announce our catalog to the other nodes. They ask for the changes since they last heard from us, or
+// compare the root of our hash tree with theirs and ask for the parts that differ.
+// This needs to be called with handler.fsLock engaged
 func (handler *FilesystemTracker) SendCatalog() {
 	fmt.Printf("FileSystemTracker ScanFolders - end - Found %d items", len(handler.contents))
 
 	handler.IncrementStatistic(TRACKER_CATALOGS_SENT, 1, false)
 
-	// transfer the normal contents structure to the JSON friendly version
-	//rawData := make([]EntryJSON, 0, len(handler.contents))
-	rawData := make([]EntryJSON, 0, len(handler.contents))
-
-	for k, v := range handler.contents {
-		entry := EntryJSON{RelativePath: k, IsDirectory: v.IsDir(), Hash: v.hash, ModTime: v.ModTime(), Size: v.Size()}
-		//fmt.Printf("Packing up: %s=%#v", k, entry)
-		rawData = append(rawData, entry)
-	}
+	// Tombstones are part of the tree so nodes that missed a deletion do not bring it back
+	tree := handler.buildMerkleTree()
+	announcement := CatalogAnnouncement{Root: tree[""].hash, LogID: handler.changes.LogID, Sequence: handler.changes.lastSequence()}
+	fmt.Printf("Built the hash tree over %d paths. Root: %x Change log: %s at %d", len(tree), announcement.Root, announcement.LogID, announcement.Sequence)
 
-	jsonData, err := json.Marshal(rawData)
+	jsonData, err := json.Marshal(announcement)
 	if err != nil {
 		panic(err)
 	}
-	fmt.Printf("Analyzed all files in the folder and the total size is: %d", len(jsonData))
 
 	event := Event{
-		Name:          "replicat.Catalog",
+		Name:          "replicat.MerkleRoot",
 		Source:        globalSettings.Name,
 		Time:          time.Now(),
 		NetworkSource: globalSettings.Name,
 		RawData:       jsonData,
 	}
 
-	//fmt.Printf("About to directly send out full catalog event with: %v", event)
 	sendCatalogToManagerAndSiblings(event)
 	fmt.Println("catalog sent")
 }
@@ -1154,27 +1633,72 @@ func (handler *FilesystemTracker) SendCatalog() {
 func (handler *FilesystemTracker) ProcessCatalog(event Event) {
 	log.Printf("FilesystemTracker ProcessCatalog: from Server: %s", event.Source)
 
-	handler.stats.CatalogsReceived++
-	remoteServer := event.Source
-	// pull the directory tree from the payload
-	remoteContents := make([]EntryJSON, 0)
-	err := json.Unmarshal(event.RawData, &remoteContents)
+	// pull the directory tree from the payload as it is needed
+	source, err := catalogSourceFor(event.RawData)
 	if err != nil {
-		panic(err)
+		log.Printf("ProcessCatalog: unable to read the catalog from %s: %s", event.Source, err)
+		return
 	}
-	//log.Printf("Done unmarshalling event. len %d", len(remoteContents))
-	//log.Printf("Data retrieved from: %s\n%#v", event.Source, remoteContents)
+
+	count, err := handler.processCatalogSource(event.Source, source)
+	if err != nil {
+		log.Printf("ProcessCatalog: catalog from %s stopped after %d entries: %s", event.Source, count, err)
+	}
+}
+
+// processCatalogSource - compare the entries of a catalog from another node with ours as they are read, and request
+// whatever they have that we need. Entries read before an error are still acted on.
+func (handler *FilesystemTracker) processCatalogSource(remoteServer string, source catalogSource) (count int, err error) {
+	handler.stats.CatalogsReceived++
+
+	deletedDirectories := make([]string, 0)
 
 	// Let's go through the other side's files and see if any of them are more up to date than what we have.
-	for _, remoteEntry := range remoteContents {
+	for {
+		remoteEntry, nextErr := source.Next()
+		if nextErr != nil {
+			if nextErr != io.EOF {
+				err = nextErr
+			}
+			break
+		}
+		count++
+
 		// Get the path out
 		path := remoteEntry.RelativePath
 
+		// Whatever our ignore files and settings leave out is neither requested nor deleted here, and neither is
+		// anything in a send-only folder
+		direction := folderDirectionFor(path)
+		if handler.ignoresEntry(remoteEntry) || !direction.receives() {
+			continue
+		}
+
+		// Apply deletions the other side knows about
+		if remoteEntry.Deleted {
+			directory := handler.processRemoteTombstone(remoteServer, remoteEntry)
+			if directory != "" {
+				deletedDirectories = append(deletedDirectories, directory)
+			}
+			continue
+		}
+
 		// check for a local value
 		handler.fsLock.RLock()
 		local, exists := handler.contents[path]
+		tombstone, deleted := handler.tombstones[path]
 		handler.fsLock.RUnlock()
 
+		// The other side still has something we deleted. Unless it changed after it saw the delete, it missed the
+		// deletion and will pick it up from our catalog. Do not bring it back.
+		if !exists && deleted {
+			ordering := tombstone.Version.Compare(remoteEntry.Version)
+			if ordering == VERSION_DOMINATES || ordering == VERSION_EQUAL {
+				log.Printf("ProcessCatalog: %s was deleted here. Not requesting it from %s", path, remoteServer)
+				continue
+			}
+		}
+
 		// Request transfer of the file if we do not have a local copy already
 		transfer := !exists
 
@@ -1197,8 +1721,72 @@ func (handler *FilesystemTracker) ProcessCatalog(event Event) {
 
 		if !transfer {
 			log.Printf("ProcessCatalog(%s) %s\remote: %v\nlocal: %v times remote: %v local: %v", remoteEntry.ServerName, path, remoteEntry, local, remoteEntry.ModTime, local.ModTime())
-			if local.hash == nil || local.ModTime().Before(remoteEntry.ModTime) {
+			// Hash our copy now if the background workers have not gotten to it yet
+			if local.hash == nil && !local.IsDir() {
+				local.hash, _, _ = cachedFileHash(filepath.Join(handler.directory, path))
+			}
+
+			if local.hash != nil && bytes.Equal(local.hash, remoteEntry.Hash) {
+				log.Printf("ProcessCatalog: %s has the same contents on both sides", path)
+				// Whatever changed besides the contents comes with the entry
+				remoteEntry.ServerName = remoteServer
+				err := handler.applyRemoteMetadata(remoteEntry)
+				if err != nil {
+					log.Printf("ProcessCatalog: unable to apply the metadata of %s from %s: %s", path, remoteServer, err)
+				}
+				continue
+			}
+
+			ordering := local.version.Compare(remoteEntry.Version)
+			switch ordering {
+			case VERSION_DOMINATED:
 				transfer = true
+			case VERSION_CONCURRENT:
+				// Changed independently on both sides. The conflict policy for the path decides which edit keeps it.
+				// A losing edit we do not have yet is requested too when the policy keeps it as a conflict copy. In a
+				// receive-only folder their edit always does.
+				if !direction.sends() {
+					transfer = true
+					break
+				}
+				handler.fsLock.Lock()
+				resolution, conflict, isConflict := handler.decideConflict(remoteEntry)
+				if isConflict {
+					handler.recordConflict(conflict)
+					transfer = resolution.RemoteWins || (resolution.KeepLoser && !handler.conflictCopyExists(conflict))
+				}
+				handler.fsLock.Unlock()
+				log.Printf("ProcessCatalog: %s was changed here and on %s. Requesting their copy: %v", path, remoteServer, transfer)
+			}
+		}
+
+		// Symbolic links are made from where they point, and hard links are linked to the path holding their group,
+		// instead of being transferred
+		if transfer && remoteEntry.Symlink != "" {
+			remoteEntry.ServerName = remoteServer
+			err := handler.applyRemoteMetadata(remoteEntry)
+			if err != nil && err != TRACKER_ERROR_STALE_VERSION {
+				log.Printf("ProcessCatalog: unable to make the symbolic link %s: %s", path, err)
+			}
+			continue
+		}
+		if transfer && handler.linkToGroup(remoteServer, remoteEntry) {
+			continue
+		}
+
+		// If we already have these exact contents somewhere else, copy them locally instead of across the network
+		if transfer && !remoteEntry.IsDirectory {
+			handler.fsLock.Lock()
+			duplicatePath, found := handler.findLocalDuplicate(remoteEntry.Hash)
+			handler.fsLock.Unlock()
+
+			if found && duplicatePath != path {
+				err := handler.copyLocalDuplicate(duplicatePath, remoteEntry)
+				if err == nil {
+					log.Printf("ProcessCatalog: %s copied from local duplicate %s", path, duplicatePath)
+					continue
+				}
+				log.Printf("ProcessCatalog: unable to copy %s from local duplicate %s: %s", path, duplicatePath, err)
 			}
 		}
 
@@ -1219,8 +1807,8 @@ func (handler *FilesystemTracker) ProcessCatalog(event Event) {
 
 			log.Printf("ProcessCatalog: We have decided to request transfer of this file: %s\nCurrent(%t): %#v\nRemote: %#v", path, exists, currentEntry, remoteEntry)
 
-			// If the current modification time is before the remote modification time, use the remote one
-			useNew := currentEntry.ModTime.Before(remoteEntry.ModTime)
+			// If the version we are about to request is older than this one, use this one
+			useNew := !exists || currentEntry.Version.Compare(remoteEntry.Version) == VERSION_DOMINATED
 			//log.Printf("Use New: %v HashSame: %v", useNew, hashSame)
 
 			// If the hash and time are the same, randomly decide which server to request the file from. Bias towards the first instance (faster server response time)
@@ -1250,55 +1838,25 @@ func (handler *FilesystemTracker) ProcessCatalog(event Event) {
 		}
 	}
 
-	handler.fsLock.Lock()
-
-	if len(handler.neededFiles) > 0 {
-		handler.server.SetStatus(REPLICAT_STATUS_JOINING_CLUSTER)
-		handler.requestNeededFiles()
-	} else {
-		handler.server.SetStatus(REPLICAT_STATUS_ONLINE)
+	if len(deletedDirectories) > 0 {
+		handler.removeTombstonedDirectories(deletedDirectories)
 	}
+	handler.collectTombstones()
+	handler.collectTrash()
+	handler.collectVersions()
 
+	handler.fsLock.Lock()
+	handler.requestNeededFiles()
+	status := handler.transferStatus()
 	handler.fsLock.Unlock()
-}
-
-// send out the actual requests for needed files when necessary. Call when inside of a lock!
-func (handler *FilesystemTracker) requestNeededFiles() {
-	// Collect the files needed for each server.
-	//fmt.Printf("start collecting what we need from each server %#v", handler.neededFiles)
-	filesToFetch := make(map[string]map[string]EntryJSON)
-
-	// flip the list of needed files from [[path]Entry] to server -> [path] -> Entry
-	for path, entry := range handler.neededFiles {
-		fmt.Printf("%s: %s (%#v)", entry.ServerName, path, entry)
-		server := entry.ServerName
-		fileMap := filesToFetch[server]
-		if fileMap == nil {
-			fileMap = make(map[string]EntryJSON)
-		}
-		fileMap[path] = entry
-		fmt.Printf("requestNeededFiles adding (%s) for file %s", server, path)
-		filesToFetch[server] = fileMap
-	}
-
-	for server, fileMap := range filesToFetch {
-		fmt.Printf("requestNeededFiles: Server %s\t\tfilecount %d", server, len(fileMap))
-	}
-
-	//todo remove this sleep statement once functionality is verified
-	time.Sleep(30 * time.Second)
 
-	for server, fileMap := range filesToFetch {
-		fmt.Printf("requestNeededFiles: Files needed from: %s", server)
-		for filename, entry := range fileMap {
-			fmt.Printf("\t%s - %s(%d) - %v", server, filename, entry.Size, entry.Hash)
-		}
-		go handler.SendRequestForFiles(server, fileMap)
+	if handler.server != nil && handler.server.GetStatus() != status {
+		handler.server.SetStatus(status)
 	}
-	fmt.Println("requestNeededFiles: done requesting what we need from each server")
+	return count, err
 }
 
-// SendRequestForFiles - Request files you need from another Replicat This needs to be called with handler.fsLock engaged
+// SendRequestForFiles - Request files you need from another Replicat. The transfers are failed if the request can not be sent.
 func (handler *FilesystemTracker) SendRequestForFiles(server string, fileMap map[string]EntryJSON) {
 	log.Println("FileSystemTracker SendRequestForFiles - end")
 	//fmt.Printf("FileSystemTracker SendRequestForFiles - end - Found %d items", len(handler.contents))
@@ -1318,6 +1876,10 @@ func (handler *FilesystemTracker) SendRequestForFiles(server string, fileMap map
 	}
 
 	//log.Printf("About to directly send out request for files from %s: %v", server, event)
-	sendFileRequestToServer(server, event)
+	err = sendFileRequestToServer(server, event)
+	if err != nil {
+		handler.transfersFailed(server, fileMap, err)
+		return
+	}
 	log.Printf("File request for %s sent", server)
 }
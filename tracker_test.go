@@ -17,10 +17,116 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
+// useTestSettings - give a test the settings of a node of its own, named testNode, with no other nodes known. The
+// settings and nodes from before the test are put back when it is done.
+func useTestSettings(t *testing.T) {
+	savedSettings := globalSettings
+	serverMapLock.Lock()
+	savedServers := serverMap
+	serverMap = make(map[string]*ReplicatServer)
+	serverMapLock.Unlock()
+	t.Cleanup(func() {
+		serverMapLock.Lock()
+		serverMap = savedServers
+		serverMapLock.Unlock()
+		globalSettings = savedSettings
+	})
+
+	globalSettings.Name = "testNode"
+}
+
+// writeTestFile - write a file below a directory, making the directories above it. A modification time other than
+// zero is set on the file.
+func writeTestFile(t *testing.T, directory, relativePath, contents string, modTime time.Time) {
+	fullPath := filepath.Join(directory, relativePath)
+	err := os.MkdirAll(filepath.Dir(fullPath), os.ModeDir+os.ModePerm)
+	if err == nil {
+		err = ioutil.WriteFile(fullPath, []byte(contents), 0666)
+	}
+	if err == nil && !modTime.IsZero() {
+		err = os.Chtimes(fullPath, modTime, modTime)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// trackTestFile - put a file in place and track it with its contents hashed at a version, as if it had been synced
+// before. A modification time other than zero is set on the file first.
+func trackTestFile(t *testing.T, tracker *FilesystemTracker, relativePath, contents string, version VersionVector, modTime time.Time) []byte {
+	writeTestFile(t, tracker.directory, relativePath, contents, modTime)
+	contentHash, info, err := cachedFileHash(filepath.Join(tracker.directory, relativePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracker.fsLock.Lock()
+	entry := *NewDirectoryFromFileInfo(&info)
+	entry.hash = contentHash
+	entry.version = version
+	tracker.contents[relativePath] = entry
+	tracker.fsLock.Unlock()
+	return contentHash
+}
+
+// watchTestTracker - have a tracker take in the changes made to its directory as they happen. A directory made after
+// this can miss the first changes inside of it, so tests make theirs first.
+func watchTestTracker(tracker *FilesystemTracker) {
+	var watcher ChangeHandler = &LogOnlyChangeHandler{}
+	tracker.watchDirectory(&watcher)
+}
+
+// editTestFile - change a file in a watched directory the way someone using this node would, and wait for the tracker
+// to take the change in. The version the tracker gave the change is returned.
+func editTestFile(t *testing.T, tracker *FilesystemTracker, relativePath, contents string) VersionVector {
+	writeTestFile(t, tracker.directory, relativePath, contents, time.Time{})
+	fullPath := filepath.Join(tracker.directory, relativePath)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info, err := os.Stat(fullPath)
+		tracker.fsLock.RLock()
+		entry, tracked := tracker.contents[relativePath]
+		tracker.fsLock.RUnlock()
+		if err == nil && tracked && sameFileState(entry, info) {
+			return entry.version
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the tracker did not take in the change to %s", relativePath)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// receiveTestFile - put contents from another node in place the way a transfer does, so the tracker takes them in
+// under the version they came with
+func receiveTestFile(t *testing.T, tracker *FilesystemTracker, relativePath, contents, server string, version VersionVector) {
+	remote := EntryJSON{RelativePath: relativePath, ServerName: server, Version: version}
+	err := tracker.applyRemoteChange(remote, func(relativePath string) error {
+		stagingPath := filepath.Join(t.TempDir(), "staged")
+		err := ioutil.WriteFile(stagingPath, []byte(contents), 0666)
+		if err != nil {
+			return err
+		}
+		fullPath := filepath.Join(tracker.directory, relativePath)
+		err = os.MkdirAll(filepath.Dir(fullPath), os.ModeDir+os.ModePerm)
+		if err != nil {
+			return err
+		}
+		return os.Rename(stagingPath, fullPath)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 //REPLICAT_STATUS_INITIAL_SCAN
 //func TestTrackerStatusAndScanInitialFiles(t *testing.T) {
 //	defer causeFailOnPanic(t)
@@ -0,0 +1,259 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// TRACKER_STATE_FILE - File under the metadata directory where the versions and tombstones are kept between runs
+	TRACKER_STATE_FILE = "state.json"
+	// TRACKER_STATE_SAVE_DELAY - The state is written out at most this often, so a burst of changes is not a write per file
+	TRACKER_STATE_SAVE_DELAY = time.Second
+)
+
+// persistedEntry - what was remembered about a tracked path between runs before the index kept it
+type persistedEntry struct {
+	Version     VersionVector
+	IsDirectory bool
+	Size        int64
+	ModTime     time.Time
+}
+
+// trackerState - the part of the tracker that can not be rebuilt by scanning the directory, other than what the index
+// and the change log file have. Entries and ChangeLog are only read, from state saved before they had files of their
+// own.
+type trackerState struct {
+	Entries     map[string]persistedEntry `json:",omitempty"`
+	Tombstones  map[string]Tombstone
+	Conflicts   []Conflict
+	Divergences map[string]Divergence
+	Archived    map[string]Tombstone
+	Trash       []TrashItem
+	Versions    map[string][]FileVersion
+	Breakers    map[string]*CircuitBreaker
+	ChangeLog   *changeLog `json:",omitempty"`
+	Cursors     map[string]ChangeCursor
+}
+
+func (handler *FilesystemTracker) statePath() string {
+	return filepath.Join(handler.directory, REPLICAT_METADATA_DIRECTORY, TRACKER_STATE_FILE)
+}
+
+// loadState - bring back the tombstones, conflicts, divergences and change log from the previous run. Paths that did not come from
+// the index are new, or were saved before there was an index. Anything that is new or different from what was saved
+// was changed here while we were not watching, so it gets a new local version. Call when inside of a lock, after the
+// index is loaded or the initial scan is done.
+func (handler *FilesystemTracker) loadState() {
+	handler.tombstones = make(map[string]Tombstone)
+
+	var state trackerState
+	data, err := ioutil.ReadFile(handler.statePath())
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Unable to read the saved tracker state. Starting without it: %s", err)
+		state = trackerState{}
+	}
+
+	changes, found := loadChangeLog(handler.changeLogPath())
+	if !found && state.ChangeLog != nil {
+		changes = *state.ChangeLog
+		changes.rewrite = true
+	}
+	handler.changes = changes
+	if handler.changes.LogID == "" {
+		handler.changes = newChangeLog()
+	}
+	handler.cursors = state.Cursors
+	if handler.cursors == nil {
+		handler.cursors = make(map[string]ChangeCursor)
+	}
+
+	// A scan made before the state was loaded does not know which paths an archive node only keeps
+	for path, tombstone := range state.Archived {
+		handler.archived[path] = tombstone
+		delete(handler.contents, path)
+	}
+
+	for path, entry := range handler.contents {
+		if entry.version != nil {
+			continue
+		}
+
+		saved, known := state.Entries[path]
+		if known {
+			entry.version = saved.Version
+		}
+
+		if !known || (!entry.IsDir() && (saved.Size != entry.Size() || !saved.ModTime.Equal(entry.ModTime()))) {
+			entry.version = versionChangedWhileAway(entry.version, state.Tombstones[path])
+			handler.recordChange(path)
+			if known {
+				handler.holdLocalChange(path, BREAKER_CHANGE_MODIFY)
+			}
+		} else {
+			handler.markIndexDirty(path)
+		}
+		handler.contents[path] = entry
+	}
+
+	for path, tombstone := range state.Tombstones {
+		_, exists := handler.contents[path]
+		if !exists {
+			handler.tombstones[path] = tombstone
+		}
+	}
+
+	handler.conflicts = state.Conflicts
+	handler.trash = append(state.Trash, handler.trash...)
+	for direction, saved := range state.Breakers {
+		breaker, known := handler.breakers[direction]
+		if !known {
+			continue
+		}
+		if saved.isTripped() && !breaker.isTripped() {
+			breaker.Tripped, breaker.Reason = saved.Tripped, saved.Reason
+		}
+		for path, change := range saved.Held {
+			breaker.Held[path] = change
+		}
+	}
+	for path, versions := range state.Versions {
+		handler.versions[path] = append(versions, handler.versions[path]...)
+	}
+	for path, divergence := range state.Divergences {
+		_, flagged := handler.divergent[path]
+		if !flagged {
+			handler.divergent[path] = divergence
+		}
+	}
+
+	log.Printf("Loaded tracker state. %d tombstones, %d conflicts. Change log %s at %d", len(handler.tombstones),
+		len(handler.conflicts), handler.changes.LogID, handler.changes.lastSequence())
+}
+
+// scheduleStateSave - write the state out soon. Call when inside of a lock!
+func (handler *FilesystemTracker) scheduleStateSave() {
+	if handler.stateSaveScheduled {
+		return
+	}
+	handler.stateSaveScheduled = true
+	time.AfterFunc(TRACKER_STATE_SAVE_DELAY, handler.saveState)
+}
+
+// stateSnapshot - a copy of the state to save that can be written out without holding the lock. Call when inside of a
+// lock!
+func (handler *FilesystemTracker) stateSnapshot() trackerState {
+	state := trackerState{
+		Tombstones:  make(map[string]Tombstone, len(handler.tombstones)),
+		Conflicts:   append([]Conflict(nil), handler.conflicts...),
+		Divergences: make(map[string]Divergence, len(handler.divergent)),
+		Archived:    make(map[string]Tombstone, len(handler.archived)),
+		Trash:       append([]TrashItem(nil), handler.trash...),
+		Versions:    make(map[string][]FileVersion, len(handler.versions)),
+		Breakers:    make(map[string]*CircuitBreaker, len(handler.breakers)),
+		Cursors:     make(map[string]ChangeCursor, len(handler.cursors)),
+	}
+
+	// Acknowledgements are added in place, so every tombstone gets a map of its own
+	for path, tombstone := range handler.tombstones {
+		acknowledged := make(map[string]bool, len(tombstone.Acknowledged))
+		for node, done := range tombstone.Acknowledged {
+			acknowledged[node] = done
+		}
+		tombstone.Acknowledged = acknowledged
+		state.Tombstones[path] = tombstone
+	}
+	for path, tombstone := range handler.archived {
+		state.Archived[path] = tombstone
+	}
+	for path, divergence := range handler.divergent {
+		state.Divergences[path] = divergence
+	}
+	for path, versions := range handler.versions {
+		state.Versions[path] = append([]FileVersion(nil), versions...)
+	}
+	for direction, breaker := range handler.breakers {
+		saved := &CircuitBreaker{Direction: breaker.Direction, Tripped: breaker.Tripped, Reason: breaker.Reason,
+			Held: make(map[string]HeldChange, len(breaker.Held))}
+		for path, change := range breaker.Held {
+			saved.Held[path] = change
+		}
+		state.Breakers[direction] = saved
+	}
+	for node, cursor := range handler.cursors {
+		state.Cursors[node] = cursor
+	}
+
+	return state
+}
+
+// saveState - write the changed paths to the index, the new changes to the change log, and the tombstones, conflicts
+// and the rest to the metadata directory. Only the index and the copying is done with the lock held.
+func (handler *FilesystemTracker) saveState() {
+	handler.stateSaveLock.Lock()
+	defer handler.stateSaveLock.Unlock()
+
+	handler.fsLock.Lock()
+	handler.stateSaveScheduled = false
+
+	// Nothing is saved once the tracker has been shut down
+	if handler.indexDirty == nil {
+		handler.fsLock.Unlock()
+		return
+	}
+
+	err := handler.flushIndex()
+	if err != nil {
+		log.Printf("Unable to save the index: %s", err)
+	}
+
+	state := handler.stateSnapshot()
+	header, records, rewrite := handler.changes.unsaved()
+	handler.fsLock.Unlock()
+
+	// The tracker may have been shut down and its directory removed while the save was waiting
+	_, err = os.Stat(handler.directory)
+	if err != nil {
+		return
+	}
+
+	err = writeChangeLog(handler.changeLogPath(), header, records, rewrite)
+	if err != nil {
+		log.Printf("Unable to save the change log: %s", err)
+		handler.fsLock.Lock()
+		handler.changes.rewrite = true
+		handler.fsLock.Unlock()
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		log.Printf("Unable to save the tracker state: %s", err)
+		return
+	}
+	err = writeFileAtomic(handler.statePath(), data)
+	if err != nil {
+		log.Printf("Unable to save the tracker state: %s", err)
+	}
+}
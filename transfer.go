@@ -0,0 +1,409 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+// Every file we need from another node is a transfer. A transfer is queued when a catalog shows we need the file, is
+// requested from the node that has it and is done when the file arrives and its version is ours. A request that goes
+// without progress for too long, or that can not be sent, is tried again after a delay that doubles every time, and a
+// transfer that keeps failing is given up on until a catalog shows we still need the file. Nothing that arrives for a
+// cancelled transfer is applied, and its sender is told to stop. Failed and cancelled transfers are listed for
+// TRANSFER_EXPIRY before they are dropped. The node is Online once nothing is left to transfer.
+
+const (
+	// TRANSFER_STATE_QUEUED - Waiting to be requested
+	TRANSFER_STATE_QUEUED = "queued"
+	// TRANSFER_STATE_REQUESTED - Requested from the node that has it. Nothing has arrived yet.
+	TRANSFER_STATE_REQUESTED = "requested"
+	// TRANSFER_STATE_RECEIVING - Part of the file has arrived
+	TRANSFER_STATE_RECEIVING = "receiving"
+	// TRANSFER_STATE_FAILED - Given up on after TRANSFER_MAX_ATTEMPTS tries
+	TRANSFER_STATE_FAILED = "failed"
+	// TRANSFER_STATE_CANCELLED - Cancelled through the API
+	TRANSFER_STATE_CANCELLED = "cancelled"
+)
+
+const (
+	// TRANSFER_CHECK_INTERVAL - How often the transfers are checked for progress and the queue is worked through
+	TRANSFER_CHECK_INTERVAL = time.Second
+	// TRANSFER_MAX_REQUESTED_PER_SERVER - Number of files asked of one node at a time
+	TRANSFER_MAX_REQUESTED_PER_SERVER = 64
+	// TRANSFER_STALL_TIMEOUT - A request is tried again when nothing from its node has arrived for this long
+	TRANSFER_STALL_TIMEOUT = 2 * time.Minute
+	// TRANSFER_RETRY_DELAY - Delay before the first retry of a failed transfer. It doubles with every failure in a row
+	TRANSFER_RETRY_DELAY = 5 * time.Second
+	// TRANSFER_MAX_ATTEMPTS - Number of times a file is requested before the transfer is given up on
+	TRANSFER_MAX_ATTEMPTS = 5
+	// TRANSFER_EXPIRY - How long a failed or cancelled transfer is kept in the list
+	TRANSFER_EXPIRY = time.Hour
+)
+
+// TRANSFER_ERROR_STALLED - nothing arrived for a requested file within TRANSFER_STALL_TIMEOUT
+var TRANSFER_ERROR_STALLED = errors.New("Replicat: nothing arrived for the requested file")
+
+// TRANSFER_ERROR_CANCELLED - the receiving node cancelled the transfer of the file
+var TRANSFER_ERROR_CANCELLED = errors.New("Replicat: the transfer of the file was cancelled")
+
+// Transfer - a file we need from another node, and how far it has got
+type Transfer struct {
+	RelativePath string
+	Server       string
+	Size         int64
+	State        string
+	Received     int64
+	Attempts     int
+	LastError    string        `json:",omitempty"`
+	ETA          time.Duration // how much longer the transfer should take at its rate so far. 0 when not known
+	Queued       time.Time
+	Requested    time.Time `json:",omitempty"`
+	NextAttempt  time.Time `json:",omitempty"`
+	Finished     time.Time `json:",omitempty"` // when the transfer failed or was cancelled
+
+	entry        EntryJSON
+	lastProgress time.Time
+}
+
+// transferQueue - the transfers of a tracker. Only used when inside of the tracker's lock.
+type transferQueue struct {
+	transfers      map[string]*Transfer
+	serverProgress map[string]time.Time // when something from each node last arrived
+	stop           chan struct{}
+}
+
+func newTransferQueue() transferQueue {
+	return transferQueue{transfers: make(map[string]*Transfer), serverProgress: make(map[string]time.Time), stop: make(chan struct{})}
+}
+
+// active - check if the transfer still has to be worked on
+func (transfer *Transfer) active() bool {
+	return transfer.State != TRANSFER_STATE_FAILED && transfer.State != TRANSFER_STATE_CANCELLED
+}
+
+// requeue - start the transfer over for a different version of the file or a different node
+func (transfer *Transfer) requeue(entry EntryJSON, now time.Time) {
+	transfer.entry = entry
+	transfer.Server = entry.ServerName
+	transfer.Size = entry.Size
+	transfer.State = TRANSFER_STATE_QUEUED
+	transfer.Received = 0
+	transfer.Attempts = 0
+	transfer.LastError = ""
+	transfer.Queued = now
+	transfer.Requested = time.Time{}
+	transfer.NextAttempt = now
+	transfer.Finished = time.Time{}
+}
+
+// failTransfer - count a failed attempt and try again later, or give up. Call when inside of a lock!
+func (handler *FilesystemTracker) failTransfer(transfer *Transfer, err error, now time.Time) {
+	transfer.LastError = err.Error()
+	transfer.Received = 0
+	if transfer.Attempts >= TRANSFER_MAX_ATTEMPTS {
+		log.Printf("Giving up on %s from %s after %d attempts: %s", transfer.RelativePath, transfer.Server, transfer.Attempts, err)
+		transfer.State = TRANSFER_STATE_FAILED
+		transfer.Finished = now
+		delete(handler.neededFiles, transfer.RelativePath)
+		return
+	}
+
+	delay := TRANSFER_RETRY_DELAY << uint(transfer.Attempts-1)
+	log.Printf("Transfer of %s from %s failed. Trying again in %s: %s", transfer.RelativePath, transfer.Server, delay, err)
+	transfer.State = TRANSFER_STATE_QUEUED
+	transfer.NextAttempt = now.Add(delay)
+}
+
+// requestNeededFiles - queue a transfer for every needed file, and ask for what can be asked for now. Call when inside
+// of a lock!
+func (handler *FilesystemTracker) requestNeededFiles() {
+	now := time.Now()
+	queue := &handler.transfers
+
+	for path, entry := range handler.neededFiles {
+		transfer, exists := queue.transfers[path]
+		if !exists {
+			transfer = &Transfer{RelativePath: path}
+			queue.transfers[path] = transfer
+			transfer.requeue(entry, now)
+		} else if !transfer.active() || transfer.Server != entry.ServerName || transfer.entry.Version.Compare(entry.Version) != VERSION_EQUAL {
+			transfer.requeue(entry, now)
+		}
+	}
+
+	// Count what each node is already sending us
+	requested := make(map[string]int)
+	for _, transfer := range queue.transfers {
+		if transfer.State == TRANSFER_STATE_REQUESTED || transfer.State == TRANSFER_STATE_RECEIVING {
+			requested[transfer.Server]++
+		}
+	}
+
+	filesToFetch := make(map[string]map[string]EntryJSON)
+	for path, transfer := range queue.transfers {
+		if transfer.State != TRANSFER_STATE_QUEUED || transfer.NextAttempt.After(now) || requested[transfer.Server] >= TRANSFER_MAX_REQUESTED_PER_SERVER {
+			continue
+		}
+		requested[transfer.Server]++
+
+		fileMap := filesToFetch[transfer.Server]
+		if fileMap == nil {
+			fileMap = make(map[string]EntryJSON)
+			filesToFetch[transfer.Server] = fileMap
+		}
+		fileMap[path] = transfer.entry
+
+		transfer.State = TRANSFER_STATE_REQUESTED
+		transfer.Attempts++
+		transfer.Requested = now
+		transfer.lastProgress = now
+	}
+
+	for server, fileMap := range filesToFetch {
+		log.Printf("requestNeededFiles: requesting %d files from %s", len(fileMap), server)
+		handler.requesting.Add(1)
+		go func(server string, fileMap map[string]EntryJSON) {
+			defer handler.requesting.Done()
+			handler.SendRequestForFiles(server, fileMap)
+		}(server, fileMap)
+	}
+}
+
+// requestFile - queue a transfer for a file another node told us about, unless we already have that version or are
+// already after a newer one
+func (handler *FilesystemTracker) requestFile(entry EntryJSON) {
+	handler.fsLock.Lock()
+	defer handler.fsLock.Unlock()
+
+	local, exists := handler.contents[entry.RelativePath]
+	if exists && local.FileInfo != nil && len(entry.Version) > 0 {
+		ordering := local.version.Compare(entry.Version)
+		if ordering == VERSION_EQUAL || ordering == VERSION_DOMINATES {
+			return
+		}
+	}
+
+	current, needed := handler.neededFiles[entry.RelativePath]
+	if needed && len(entry.Version) > 0 {
+		ordering := current.Version.Compare(entry.Version)
+		if ordering == VERSION_EQUAL || ordering == VERSION_DOMINATES {
+			return
+		}
+	}
+
+	handler.neededFiles[entry.RelativePath] = entry
+	handler.requestNeededFiles()
+}
+
+// checkTransfers - bring every transfer up to date with what has arrived, drop the ones that are done and retry the
+// ones that have stalled. Call when inside of a lock!
+func (handler *FilesystemTracker) checkTransfers(now time.Time) {
+	queue := &handler.transfers
+
+	for path, entry := range handler.neededFiles {
+		// Anything that brought our copy up to the needed version, or past it, finishes the transfer
+		local, exists := handler.contents[path]
+		if !exists || local.FileInfo == nil || len(entry.Version) == 0 {
+			continue
+		}
+		ordering := local.version.Compare(entry.Version)
+		if ordering == VERSION_EQUAL || ordering == VERSION_DOMINATES {
+			handler.finishTransfer(path, entry.Version)
+		}
+	}
+
+	for path, transfer := range queue.transfers {
+		_, needed := handler.neededFiles[path]
+		if !needed {
+			if transfer.active() || now.Sub(transfer.Finished) > TRANSFER_EXPIRY {
+				delete(queue.transfers, path)
+			}
+			continue
+		}
+
+		if transfer.State != TRANSFER_STATE_REQUESTED && transfer.State != TRANSFER_STATE_RECEIVING {
+			continue
+		}
+
+		dataPath, _ := partialUploadPaths(path)
+		info, err := os.Stat(dataPath)
+		if err == nil && info.Size() != transfer.Received {
+			transfer.Received = info.Size()
+			transfer.State = TRANSFER_STATE_RECEIVING
+			transfer.lastProgress = now
+			queue.serverProgress[transfer.Server] = now
+		}
+
+		lastProgress := transfer.lastProgress
+		if queue.serverProgress[transfer.Server].After(lastProgress) {
+			lastProgress = queue.serverProgress[transfer.Server]
+		}
+		if now.Sub(lastProgress) > TRANSFER_STALL_TIMEOUT {
+			handler.failTransfer(transfer, TRANSFER_ERROR_STALLED, now)
+		}
+	}
+}
+
+// finishTransfer - a version of a needed file has arrived. Unless we need a newer one, there is nothing left to
+// transfer. Call when inside of a lock!
+func (handler *FilesystemTracker) finishTransfer(relativePath string, arrived VersionVector) {
+	entry, needed := handler.neededFiles[relativePath]
+	if !needed {
+		return
+	}
+	if entry.Version.Compare(arrived) == VERSION_DOMINATES {
+		log.Printf("Received %s %s. Still waiting for %s", relativePath, arrived, entry.Version)
+		return
+	}
+
+	delete(handler.neededFiles, relativePath)
+	transfer, exists := handler.transfers.transfers[relativePath]
+	if exists {
+		handler.transfers.serverProgress[transfer.Server] = time.Now()
+		delete(handler.transfers.transfers, relativePath)
+	}
+}
+
+// transfersFailed - a request for files could not be sent
+func (handler *FilesystemTracker) transfersFailed(server string, fileMap map[string]EntryJSON, err error) {
+	handler.fsLock.Lock()
+	defer handler.fsLock.Unlock()
+
+	now := time.Now()
+	for path := range fileMap {
+		transfer, exists := handler.transfers.transfers[path]
+		if exists && transfer.Server == server && transfer.State == TRANSFER_STATE_REQUESTED {
+			handler.failTransfer(transfer, err, now)
+		}
+	}
+}
+
+// transferStatus - the status the node should have for what is left to transfer. Call when inside of a lock!
+func (handler *FilesystemTracker) transferStatus() string {
+	if len(handler.neededFiles) > 0 {
+		return REPLICAT_STATUS_JOINING_CLUSTER
+	}
+	return REPLICAT_STATUS_ONLINE
+}
+
+// runTransfers - work through the transfers until the tracker is shut down
+func (handler *FilesystemTracker) runTransfers(stop chan struct{}) {
+	defer handler.transferring.Done()
+	ticker := time.NewTicker(TRANSFER_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			handler.fsLock.Lock()
+			handler.checkTransfers(now)
+			handler.requestNeededFiles()
+			status := handler.transferStatus()
+			handler.fsLock.Unlock()
+
+			// Joining Cluster is left to the catalogs. The transfers only ever finish joining.
+			if status == REPLICAT_STATUS_ONLINE && handler.server != nil && handler.server.GetStatus() == REPLICAT_STATUS_JOINING_CLUSTER {
+				log.Printf("Every needed file has arrived. Going online")
+				handler.server.SetStatus(REPLICAT_STATUS_ONLINE)
+			}
+		}
+	}
+}
+
+// transferList - every transfer, oldest first, with its ETA
+func (handler *FilesystemTracker) transferList() []Transfer {
+	handler.fsLock.RLock()
+	defer handler.fsLock.RUnlock()
+
+	now := time.Now()
+	transfers := make([]Transfer, 0, len(handler.transfers.transfers))
+	for _, transfer := range handler.transfers.transfers {
+		copied := *transfer
+		elapsed := now.Sub(transfer.Requested)
+		if transfer.State == TRANSFER_STATE_RECEIVING && transfer.Received > 0 && elapsed > 0 {
+			rate := float64(transfer.Received) / elapsed.Seconds()
+			copied.ETA = time.Duration(float64(transfer.Size-transfer.Received) / rate * float64(time.Second))
+		}
+		transfers = append(transfers, copied)
+	}
+	sort.Slice(transfers, func(i, j int) bool { return transfers[i].Queued.Before(transfers[j].Queued) })
+	return transfers
+}
+
+// cancelTransfer - stop waiting for a file and refuse it if it arrives anyway. It is queued again if a later catalog or
+// event shows we still need it.
+func (handler *FilesystemTracker) cancelTransfer(relativePath string) bool {
+	handler.fsLock.Lock()
+	defer handler.fsLock.Unlock()
+
+	transfer, exists := handler.transfers.transfers[relativePath]
+	if !exists || !transfer.active() {
+		return false
+	}
+
+	log.Printf("Cancelling the transfer of %s from %s", relativePath, transfer.Server)
+	transfer.State = TRANSFER_STATE_CANCELLED
+	transfer.Finished = time.Now()
+	delete(handler.neededFiles, relativePath)
+	return true
+}
+
+// transferCancelled - check if the transfer of a file was cancelled. Whatever arrives for it is not applied.
+func (handler *FilesystemTracker) transferCancelled(relativePath string) bool {
+	handler.fsLock.RLock()
+	defer handler.fsLock.RUnlock()
+	return handler.transferCancelledLocked(relativePath)
+}
+
+// transferCancelledLocked - transferCancelled for callers that hold the lock. Call when inside of a lock!
+func (handler *FilesystemTracker) transferCancelledLocked(relativePath string) bool {
+	transfer, exists := handler.transfers.transfers[relativePath]
+	return exists && transfer.State == TRANSFER_STATE_CANCELLED
+}
+
+// transfersHandler - list the transfers on this node, or cancel one with DELETE /transfers/?path=<path>
+func transfersHandler(w http.ResponseWriter, r *http.Request) {
+	server, exists := serverMap[globalSettings.Name]
+	if !exists || server.storage == nil {
+		http.Error(w, "Storage is not set up", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(server.storage.transferList())
+	case "DELETE":
+		relativePath := r.URL.Query().Get("path")
+		if !server.storage.cancelTransfer(relativePath) {
+			http.Error(w, fmt.Sprintf("No transfer of %s to cancel", relativePath), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,191 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTransferFinishesWhenFileArrivesAndGoesOnline(t *testing.T) {
+	useTestSettings(t)
+	tracker := createTracker("transferArrives")
+	defer cleanupTracker(tracker)
+	globalSettings.Directory = tracker.directory
+
+	version := VersionVector{"transferPeer": 1}
+	tracker.ProcessCatalog(catalogEvent(t, "transferPeer",
+		EntryJSON{RelativePath: "wanted.txt", ModTime: time.Now(), Hash: []byte{1, 2, 3}, Size: 7, Version: version}))
+
+	transfers := tracker.transferList()
+	if len(transfers) != 1 || transfers[0].RelativePath != "wanted.txt" || transfers[0].Server != "transferPeer" {
+		t.Fatalf("a needed file should be queued for transfer: %#v", transfers)
+	}
+	if tracker.server.GetStatus() != REPLICAT_STATUS_JOINING_CLUSTER {
+		t.Fatalf("the node should be joining while files are missing. status: %s", tracker.server.GetStatus())
+	}
+
+	err := tracker.applyRemoteChange(EntryJSON{RelativePath: "wanted.txt", Version: version}, func(relativePath string) error {
+		return ioutil.WriteFile(filepath.Join(tracker.directory, relativePath), []byte("arrived"), 0666)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracker.fsLock.RLock()
+	_, needed := tracker.neededFiles["wanted.txt"]
+	tracker.fsLock.RUnlock()
+	if needed || len(tracker.transferList()) != 0 {
+		t.Fatalf("the transfer should be done once the file arrives. needed: %v transfers: %#v", needed, tracker.transferList())
+	}
+
+	deadline := time.Now().Add(5 * TRANSFER_CHECK_INTERVAL)
+	for tracker.server.GetStatus() != REPLICAT_STATUS_ONLINE {
+		if time.Now().After(deadline) {
+			t.Fatalf("the node should go online once nothing is left to transfer. status: %s", tracker.server.GetStatus())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTransferWaitsForTheNeededVersion(t *testing.T) {
+	tracker := createTracker("transferVersion")
+	defer cleanupTracker(tracker)
+
+	needed := VersionVector{"transferPeer": 2}
+	tracker.fsLock.Lock()
+	tracker.neededFiles["later.txt"] = EntryJSON{RelativePath: "later.txt", ServerName: "transferPeer", Version: needed}
+	tracker.finishTransfer("later.txt", VersionVector{"transferPeer": 1})
+	_, stillNeeded := tracker.neededFiles["later.txt"]
+	tracker.finishTransfer("later.txt", needed)
+	_, neededAfter := tracker.neededFiles["later.txt"]
+	tracker.fsLock.Unlock()
+
+	if !stillNeeded || neededAfter {
+		t.Fatalf("only the needed version should finish a transfer. after the older one: %v after the needed one: %v", stillNeeded, neededAfter)
+	}
+}
+
+func TestTransferRetriesStalledRequestsAndGivesUp(t *testing.T) {
+	tracker := createTracker("transferRetries")
+	defer cleanupTracker(tracker)
+
+	tracker.fsLock.Lock()
+	defer tracker.fsLock.Unlock()
+
+	tracker.neededFiles["slow.txt"] = EntryJSON{RelativePath: "slow.txt", ServerName: "transferPeer", Version: VersionVector{"transferPeer": 1}}
+	now := time.Now()
+	transfer := &Transfer{RelativePath: "slow.txt"}
+	transfer.requeue(tracker.neededFiles["slow.txt"], now)
+	transfer.State = TRANSFER_STATE_REQUESTED
+	transfer.Attempts = 1
+	transfer.lastProgress = now
+	tracker.transfers.transfers["slow.txt"] = transfer
+
+	tracker.checkTransfers(now.Add(TRANSFER_STALL_TIMEOUT / 2))
+	if transfer.State != TRANSFER_STATE_REQUESTED {
+		t.Fatalf("a request should get time to make progress. state: %s", transfer.State)
+	}
+
+	now = now.Add(TRANSFER_STALL_TIMEOUT + time.Second)
+	tracker.checkTransfers(now)
+	if transfer.State != TRANSFER_STATE_QUEUED || transfer.LastError != TRANSFER_ERROR_STALLED.Error() || !transfer.NextAttempt.Equal(now.Add(TRANSFER_RETRY_DELAY)) {
+		t.Fatalf("a stalled request should be retried after a delay: %#v", transfer)
+	}
+
+	transfer.Attempts = TRANSFER_MAX_ATTEMPTS
+	tracker.failTransfer(transfer, errors.New("unreachable"), now)
+	_, stillNeeded := tracker.neededFiles["slow.txt"]
+	if transfer.State != TRANSFER_STATE_FAILED || stillNeeded || tracker.transferStatus() != REPLICAT_STATUS_ONLINE {
+		t.Fatalf("a transfer that keeps failing should be given up on. state: %s needed: %v", transfer.State, stillNeeded)
+	}
+
+	tracker.checkTransfers(now.Add(TRANSFER_EXPIRY / 2))
+	if _, listed := tracker.transfers.transfers["slow.txt"]; !listed {
+		t.Fatal("a failed transfer should stay listed for a while")
+	}
+	tracker.checkTransfers(now.Add(TRANSFER_EXPIRY + time.Second))
+	if _, listed := tracker.transfers.transfers["slow.txt"]; listed {
+		t.Fatal("a failed transfer should be dropped once it expires")
+	}
+}
+
+func TestCancelledTransferIsQueuedAgainByALaterCatalog(t *testing.T) {
+	useTestSettings(t)
+	tracker := createTracker("transferCancel")
+	defer cleanupTracker(tracker)
+	globalSettings.Directory = tracker.directory
+
+	event := catalogEvent(t, "transferPeer",
+		EntryJSON{RelativePath: "maybe.txt", ModTime: time.Now(), Hash: []byte{4, 5, 6}, Size: 3, Version: VersionVector{"transferPeer": 1}})
+	tracker.ProcessCatalog(event)
+
+	if tracker.cancelTransfer("other.txt") {
+		t.Fatal("a transfer that does not exist can not be cancelled")
+	}
+	if !tracker.cancelTransfer("maybe.txt") {
+		t.Fatal("a queued transfer should be cancelled")
+	}
+	transfers := tracker.transferList()
+	if len(transfers) != 1 || transfers[0].State != TRANSFER_STATE_CANCELLED {
+		t.Fatalf("a cancelled transfer should be listed as cancelled: %#v", transfers)
+	}
+
+	applied := false
+	err := tracker.applyRemoteChange(EntryJSON{RelativePath: "maybe.txt", Version: VersionVector{"transferPeer": 1}}, func(relativePath string) error {
+		applied = true
+		return nil
+	})
+	if err != TRANSFER_ERROR_CANCELLED || applied {
+		t.Fatalf("a file whose transfer was cancelled should not be applied when it arrives anyway. err: %v", err)
+	}
+
+	tracker.ProcessCatalog(event)
+	transfers = tracker.transferList()
+	if len(transfers) != 1 || !transfers[0].active() {
+		t.Fatalf("a file still needed should be queued again: %#v", transfers)
+	}
+}
+
+func TestFileEventQueuesATransfer(t *testing.T) {
+	useTestSettings(t)
+	tracker := createTracker("transferEvent")
+	defer cleanupTracker(tracker)
+	globalSettings.Directory = tracker.directory
+	serverMap[globalSettings.Name] = &ReplicatServer{Name: globalSettings.Name, storage: tracker}
+	incomingSequences = &appliedSequences{}
+
+	server := httptest.NewServer(http.HandlerFunc(eventHandler))
+	defer server.Close()
+
+	// Nothing is fetched for a version we already have
+	trackTestFile(t, tracker, "current.txt", "current", VersionVector{"transferPeer": 1}, time.Now())
+	postTestEvent(t, server.URL, Event{Name: "notify.Write", Source: "transferPeer", Path: "current.txt", Sequence: 1, Version: VersionVector{"transferPeer": 1}})
+	if transfers := tracker.transferList(); len(transfers) != 0 {
+		t.Fatalf("a version we already have should not be fetched: %#v", transfers)
+	}
+
+	postTestEvent(t, server.URL, Event{Name: "notify.Write", Source: "transferPeer", Path: "edited.txt", Sequence: 2, Version: VersionVector{"transferPeer": 2}})
+	transfers := tracker.transferList()
+	if len(transfers) != 1 || transfers[0].RelativePath != "edited.txt" || transfers[0].Server != "transferPeer" {
+		t.Fatalf("the contents of a changed file should be fetched as a transfer: %#v", transfers)
+	}
+}
@@ -0,0 +1,365 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Whatever a change from another node would destroy, a delete or the contents an overwrite replaces, goes to this
+// node's trash instead. Each item is kept in a directory of its own in the trash, under the name it had, and can be
+// restored to where it was or somewhere else. Restoring is a change made here like any other, so it reaches the other
+// nodes. Items are purged once they are older than the retention, oldest first when the trash is over its size limit.
+
+const (
+	// TRASH_DIRECTORY - Where the trash is kept, inside of the metadata directory
+	TRASH_DIRECTORY = "trash"
+	// TRASH_DEFAULT_RETENTION_DAYS - How long items are kept when TrashRetentionDays is not set
+	TRASH_DEFAULT_RETENTION_DAYS = 30
+	// TRASH_REASON_DELETED - The item was deleted
+	TRASH_REASON_DELETED = "deleted"
+	// TRASH_REASON_REPLACED - The item is the contents a file had before a change from another node replaced them
+	TRASH_REASON_REPLACED = "replaced"
+)
+
+// TRASH_ERROR_NOT_FOUND - There is no trash item with the ID
+var TRASH_ERROR_NOT_FOUND = errors.New("Replicat: No such item in the trash")
+
+// TRASH_ERROR_PATH_EXISTS - Something is already where a trash item would be restored to
+var TRASH_ERROR_PATH_EXISTS = errors.New("Replicat: The path to restore to already exists")
+
+// TRASH_ERROR_BAD_PATH - A trash item can only be restored to somewhere inside of the synced directory
+var TRASH_ERROR_BAD_PATH = errors.New("Replicat: The path to restore to is outside of the synced directory")
+
+// TrashItem - a path, or the earlier contents of one, kept in the trash
+type TrashItem struct {
+	ID           string
+	RelativePath string
+	IsDirectory  bool
+	Size         int64
+	Reason       string
+	Origin       string // the node whose change put it here
+	Trashed      time.Time
+}
+
+// trashItemPath - where the contents of a trash item are kept
+func trashItemPath(item TrashItem) string {
+	return metadataPath(TRASH_DIRECTORY, item.ID, filepath.Base(item.RelativePath))
+}
+
+// trashRetention - how long items stay in the trash
+func trashRetention() time.Duration {
+	days := globalSettings.TrashRetentionDays
+	if days <= 0 {
+		days = TRASH_DEFAULT_RETENTION_DAYS
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// newTrashItem - describe a path going into the trash, with an ID no other item has. Call when inside of a lock!
+func (handler *FilesystemTracker) newTrashItem(relativePath, reason, origin string, info os.FileInfo) TrashItem {
+	now := time.Now()
+	sequence := now.UnixNano()
+	for handler.trashItemIndex(strconv.FormatInt(sequence, 36)) >= 0 {
+		sequence++
+	}
+
+	item := TrashItem{ID: strconv.FormatInt(sequence, 36), RelativePath: relativePath, IsDirectory: info.IsDir(),
+		Size: info.Size(), Reason: reason, Origin: origin, Trashed: now}
+	if info.IsDir() {
+		item.Size = 0
+		filepath.Walk(filepath.Join(handler.directory, relativePath), func(_ string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				item.Size += info.Size()
+			}
+			return nil
+		})
+	}
+	return item
+}
+
+// trashItemIndex - where the item with an ID is in the trash, or -1. Call when inside of a lock!
+func (handler *FilesystemTracker) trashItemIndex(id string) int {
+	for i, item := range handler.trash {
+		if item.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// moveToTrash - take a path out of the synced directory and put it in the trash, instead of deleting it. A directory
+// goes with everything in it. Empty directories hold nothing worth keeping and are just removed. Call when inside of a
+// lock!
+func (handler *FilesystemTracker) moveToTrash(relativePath, origin string) error {
+	err := checkParents(handler.directory, relativePath)
+	if err != nil {
+		return err
+	}
+	fullPath := filepath.Join(handler.directory, relativePath)
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = os.Remove(fullPath)
+		if err == nil {
+			return nil
+		}
+	}
+
+	item := handler.newTrashItem(relativePath, TRASH_REASON_DELETED, origin, info)
+	trashPath := trashItemPath(item)
+	err = os.MkdirAll(filepath.Dir(trashPath), os.ModeDir+os.ModePerm)
+	if err == nil {
+		err = os.Rename(fullPath, trashPath)
+	}
+	if err != nil {
+		os.RemoveAll(filepath.Dir(trashPath))
+		return err
+	}
+
+	log.Printf("Trash: moved %s to the trash as %s", relativePath, item.ID)
+	handler.addTrashItem(item)
+	return nil
+}
+
+// trashReplacedContents - keep the file at a path in the trash before a change from another node replaces it. Call
+// when inside of a lock!
+func (handler *FilesystemTracker) trashReplacedContents(relativePath, origin string) error {
+	err := checkParents(handler.directory, relativePath)
+	if err != nil {
+		return err
+	}
+	fullPath := filepath.Join(handler.directory, relativePath)
+	info, err := os.Lstat(fullPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil || !info.Mode().IsRegular() {
+		return err
+	}
+
+	item := handler.newTrashItem(relativePath, TRASH_REASON_REPLACED, origin, info)
+	trashPath := trashItemPath(item)
+	err = os.MkdirAll(filepath.Dir(trashPath), os.ModeDir+os.ModePerm)
+	if err == nil {
+		// Copied rather than linked, as the file stays where it is if the change is not applied and could be edited
+		// in place later
+		err = copyArchiveFile(fullPath, trashPath, info)
+	}
+	if err != nil {
+		os.RemoveAll(filepath.Dir(trashPath))
+		return err
+	}
+
+	handler.addTrashItem(item)
+	return nil
+}
+
+// addTrashItem - remember an item put in the trash and keep the trash within its limits. Call when inside of a lock!
+func (handler *FilesystemTracker) addTrashItem(item TrashItem) {
+	handler.trash = append(handler.trash, item)
+	handler.purgeTrash(time.Now())
+	handler.scheduleStateSave()
+}
+
+// purgeTrash - drop the items older than the retention, then the oldest items until the trash is within its size
+// limit. Call when inside of a lock!
+func (handler *FilesystemTracker) purgeTrash(now time.Time) {
+	sort.Slice(handler.trash, func(i, j int) bool { return handler.trash[i].Trashed.Before(handler.trash[j].Trashed) })
+
+	var total int64
+	for _, item := range handler.trash {
+		total += item.Size
+	}
+
+	retention := trashRetention()
+	purged := 0
+	for _, item := range handler.trash {
+		expired := now.Sub(item.Trashed) > retention
+		oversize := globalSettings.TrashMaxSize > 0 && total > globalSettings.TrashMaxSize
+		if !expired && !oversize {
+			break
+		}
+		handler.removeTrashContents(item)
+		total -= item.Size
+		purged++
+	}
+
+	if purged > 0 {
+		log.Printf("Trash: purged %d items", purged)
+		handler.trash = append([]TrashItem(nil), handler.trash[purged:]...)
+		handler.scheduleStateSave()
+	}
+}
+
+// removeTrashContents - delete what is kept for a trash item
+func (handler *FilesystemTracker) removeTrashContents(item TrashItem) {
+	err := os.RemoveAll(filepath.Dir(trashItemPath(item)))
+	if err != nil {
+		log.Printf("Trash: unable to purge %s (%s): %s", item.ID, item.RelativePath, err)
+	}
+}
+
+// collectTrash - purge whatever has been in the trash for longer than the retention
+func (handler *FilesystemTracker) collectTrash() {
+	handler.fsLock.Lock()
+	defer handler.fsLock.Unlock()
+
+	handler.purgeTrash(time.Now())
+}
+
+// trashDeletedPath - move a path deleted on another node to the trash. The version is the one the path was deleted at,
+// if it is known.
+func (handler *FilesystemTracker) trashDeletedPath(relativePath, origin string, version VersionVector) error {
+	handler.fsLock.Lock()
+	defer handler.fsLock.Unlock()
+
+	if handler.holdRemoteChange(relativePath, BREAKER_CHANGE_DELETE, origin, version) {
+		return nil
+	}
+	return handler.moveToTrash(relativePath, origin)
+}
+
+// trashList - the items in the trash, oldest first
+func (handler *FilesystemTracker) trashList() []TrashItem {
+	handler.fsLock.RLock()
+	defer handler.fsLock.RUnlock()
+
+	items := make([]TrashItem, len(handler.trash))
+	copy(items, handler.trash)
+	sort.Slice(items, func(i, j int) bool { return items[i].Trashed.Before(items[j].Trashed) })
+	return items
+}
+
+// restoreFromTrash - put a trash item back where it was, or at relativePath when it is set. Nothing is overwritten.
+// Files are moved back one at a time so each one is seen, and sent to the other nodes, as a change made here.
+func (handler *FilesystemTracker) restoreFromTrash(id, relativePath string) error {
+	handler.fsLock.Lock()
+	defer handler.fsLock.Unlock()
+
+	index := handler.trashItemIndex(id)
+	if index < 0 {
+		return TRASH_ERROR_NOT_FOUND
+	}
+	item := handler.trash[index]
+	if relativePath == "" {
+		relativePath = item.RelativePath
+	}
+	relativePath, ok := cleanRelativePath(relativePath)
+	if !ok {
+		return TRASH_ERROR_BAD_PATH
+	}
+
+	err := checkParents(handler.directory, relativePath)
+	if err != nil {
+		return err
+	}
+	destinationRoot := filepath.Join(handler.directory, relativePath)
+	_, err = os.Lstat(destinationRoot)
+	if err == nil {
+		return TRASH_ERROR_PATH_EXISTS
+	}
+
+	sourceRoot := trashItemPath(item)
+	err = filepath.Walk(sourceRoot, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		target := destinationRoot + fullPath[len(sourceRoot):]
+		if info.IsDir() {
+			return os.MkdirAll(target, os.ModeDir+os.ModePerm)
+		}
+		err = os.MkdirAll(filepath.Dir(target), os.ModeDir+os.ModePerm)
+		if err == nil {
+			err = os.Rename(fullPath, target)
+		}
+		return err
+	})
+	if err != nil {
+		log.Printf("Trash: unable to restore %s to %s: %s", item.ID, relativePath, err)
+		return err
+	}
+
+	log.Printf("Trash: restored %s to %s", item.ID, relativePath)
+	handler.removeTrashContents(item)
+	handler.trash = append(handler.trash[:index], handler.trash[index+1:]...)
+	handler.scheduleStateSave()
+	return nil
+}
+
+// purgeTrashItem - delete an item from the trash for good
+func (handler *FilesystemTracker) purgeTrashItem(id string) bool {
+	handler.fsLock.Lock()
+	defer handler.fsLock.Unlock()
+
+	index := handler.trashItemIndex(id)
+	if index < 0 {
+		return false
+	}
+	handler.removeTrashContents(handler.trash[index])
+	handler.trash = append(handler.trash[:index], handler.trash[index+1:]...)
+	handler.scheduleStateSave()
+	return true
+}
+
+// trashHandler - list the trash, restore an item with POST /trash/?id=<id>[&path=<path>], or purge one with
+// DELETE /trash/?id=<id>
+func trashHandler(w http.ResponseWriter, r *http.Request) {
+	server, exists := serverMap[globalSettings.Name]
+	if !exists || server.storage == nil {
+		http.Error(w, "Storage is not set up", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(server.storage.trashList())
+	case "POST":
+		err := server.storage.restoreFromTrash(query.Get("id"), query.Get("path"))
+		switch err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case TRASH_ERROR_NOT_FOUND:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case TRASH_ERROR_PATH_EXISTS:
+			http.Error(w, err.Error(), http.StatusConflict)
+		case TRASH_ERROR_BAD_PATH:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	case "DELETE":
+		if !server.storage.purgeTrashItem(query.Get("id")) {
+			http.Error(w, TRASH_ERROR_NOT_FOUND.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
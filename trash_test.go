@@ -0,0 +1,127 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRemoteDeleteGoesToTrashAndCanBeRestored(t *testing.T) {
+	useTestSettings(t)
+	tracker := createTracker("trashRestore")
+	defer cleanupTracker(tracker)
+	globalSettings.Directory = tracker.directory
+
+	receiveTestFile(t, tracker, "docs/plan.txt", "docs/plan.txt", "trashPeer", VersionVector{"trashPeer": 1})
+	tracker.ProcessCatalog(catalogEvent(t, "trashPeer",
+		EntryJSON{RelativePath: "docs/plan.txt", ModTime: time.Now(), Deleted: true, Origin: "trashPeer", Version: VersionVector{"trashPeer": 2}}))
+
+	fullPath := filepath.Join(tracker.directory, "docs/plan.txt")
+	_, err := os.Stat(fullPath)
+	if !os.IsNotExist(err) {
+		t.Fatalf("a file deleted elsewhere should be gone from the synced directory. err: %v", err)
+	}
+	items := tracker.trashList()
+	if len(items) != 1 || items[0].RelativePath != "docs/plan.txt" || items[0].Reason != TRASH_REASON_DELETED || items[0].Origin != "trashPeer" {
+		t.Fatalf("the deleted file should be in the trash: %#v", items)
+	}
+	kept, err := ioutil.ReadFile(trashItemPath(items[0]))
+	if err != nil || string(kept) != "docs/plan.txt" {
+		t.Fatalf("the trash should have the deleted contents. kept: %q err: %v", kept, err)
+	}
+
+	if tracker.restoreFromTrash(items[0].ID, "../outside.txt") != TRASH_ERROR_BAD_PATH {
+		t.Fatal("an item should not be restored outside of the synced directory")
+	}
+	ioutil.WriteFile(filepath.Join(tracker.directory, "taken.txt"), []byte("here first"), 0666)
+	if tracker.restoreFromTrash(items[0].ID, "taken.txt") != TRASH_ERROR_PATH_EXISTS {
+		t.Fatal("restoring should not overwrite anything")
+	}
+
+	err = tracker.restoreFromTrash(items[0].ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := ioutil.ReadFile(fullPath)
+	if err != nil || string(restored) != "docs/plan.txt" {
+		t.Fatalf("the file should be back where it was. restored: %q err: %v", restored, err)
+	}
+	if len(tracker.trashList()) != 0 || tracker.restoreFromTrash(items[0].ID, "") != TRASH_ERROR_NOT_FOUND {
+		t.Fatal("a restored item should be out of the trash")
+	}
+	_, err = os.Stat(filepath.Dir(trashItemPath(items[0])))
+	if !os.IsNotExist(err) {
+		t.Fatalf("nothing should be left in the trash for a restored item. err: %v", err)
+	}
+}
+
+func TestTrashKeepsReplacedContentsWithinItsLimits(t *testing.T) {
+	useTestSettings(t)
+	tracker := createTracker("trashLimits")
+	defer cleanupTracker(tracker)
+	globalSettings.Directory = tracker.directory
+
+	globalSettings.TrashMaxSize = int64(len("two.txt") + len("three.txt"))
+
+	replace := func(relativePath string) {
+		receiveTestFile(t, tracker, relativePath, relativePath, "trashPeer", VersionVector{"trashPeer": 1})
+		err := tracker.applyRemoteChange(EntryJSON{RelativePath: relativePath, ServerName: "trashPeer", Version: VersionVector{"trashPeer": 2}},
+			func(relativePath string) error {
+				stagingPath := filepath.Join(t.TempDir(), "staged")
+				err := ioutil.WriteFile(stagingPath, []byte("replaced"), 0666)
+				if err != nil {
+					return err
+				}
+				return os.Rename(stagingPath, filepath.Join(tracker.directory, relativePath))
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	replace("one.txt")
+	replace("two.txt")
+
+	items := tracker.trashList()
+	if len(items) != 2 || items[0].Reason != TRASH_REASON_REPLACED || items[0].Origin != "trashPeer" {
+		t.Fatalf("both replaced files should be in the trash: %#v", items)
+	}
+	kept, err := ioutil.ReadFile(trashItemPath(items[0]))
+	if err != nil || string(kept) != "one.txt" {
+		t.Fatalf("the trash should have the contents from before the change. kept: %q err: %v", kept, err)
+	}
+
+	// Over the size limit the oldest item goes first
+	replace("three.txt")
+	items = tracker.trashList()
+	if len(items) != 2 || items[0].RelativePath != "two.txt" {
+		t.Fatalf("the oldest item should be purged to stay within the size limit: %#v", items)
+	}
+
+	tracker.fsLock.Lock()
+	tracker.purgeTrash(time.Now().Add(trashRetention() + time.Hour))
+	tracker.fsLock.Unlock()
+	if len(tracker.trashList()) != 0 {
+		t.Fatalf("items older than the retention should be purged: %#v", tracker.trashList())
+	}
+	_, err = os.Stat(filepath.Dir(trashItemPath(items[0])))
+	if !os.IsNotExist(err) {
+		t.Fatalf("a purged item should be deleted. err: %v", err)
+	}
+}
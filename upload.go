@@ -0,0 +1,536 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// UploadStatus - what the receiving node reports about a file that is being sent to it in chunks
+type UploadStatus struct {
+	RelativePath string
+	Offset       int64
+	Complete     bool
+}
+
+// uploadState - stored next to a partial upload so a resumed transfer can tell it is continuing the same version of the file
+type uploadState struct {
+	RelativePath string
+	Hash         string
+	Size         int64
+}
+
+const (
+	// UPLOAD_CHUNK_SIZE - Number of bytes sent with each upload request
+	UPLOAD_CHUNK_SIZE = 4 << 20
+	// UPLOAD_MAX_RETRIES - Number of failed attempts in a row before a transfer is abandoned
+	UPLOAD_MAX_RETRIES = 8
+	// UPLOAD_RETRY_DELAY - Delay before the first retry of a failed chunk. It doubles with every failure in a row
+	UPLOAD_RETRY_DELAY = time.Second
+	// UPLOAD_PARTIAL_DIRECTORY - Directory under the metadata directory where partially received files are kept
+	UPLOAD_PARTIAL_DIRECTORY = "partial"
+	// UPLOAD_MAX_SOURCE_CHANGES - Number of times a file is resent because it changed while it was being sent
+	UPLOAD_MAX_SOURCE_CHANGES = 5
+)
+
+// UPLOAD_ERROR_HASH_MISMATCH - the file the receiver ended up with does not match the hash the sender provided
+var UPLOAD_ERROR_HASH_MISMATCH = errors.New("Replicat: received file does not match the sender's hash")
+
+// UPLOAD_ERROR_BAD_PATH - the sender named a path outside of the synced directory
+var UPLOAD_ERROR_BAD_PATH = errors.New("Replicat: upload path is outside of the synced directory")
+
+// uploadLock - the lock on one path, and how many uploads hold it or wait for it. It is dropped once nobody does.
+type uploadLock struct {
+	sync.Mutex
+	relativePath string
+	users        int
+}
+
+var uploadLocks = make(map[string]*uploadLock)
+var uploadLocksLock sync.Mutex
+
+// lockUpload - serialize the work done on one path so two chunks for the same file can not interleave
+func lockUpload(relativePath string) *uploadLock {
+	uploadLocksLock.Lock()
+	lock, exists := uploadLocks[relativePath]
+	if !exists {
+		lock = &uploadLock{relativePath: relativePath}
+		uploadLocks[relativePath] = lock
+	}
+	lock.users++
+	uploadLocksLock.Unlock()
+
+	lock.Lock()
+	return lock
+}
+
+// Unlock - release the path, and forget its lock when nobody else is waiting for it
+func (lock *uploadLock) Unlock() {
+	lock.Mutex.Unlock()
+
+	uploadLocksLock.Lock()
+	defer uploadLocksLock.Unlock()
+	lock.users--
+	if lock.users == 0 {
+		delete(uploadLocks, lock.relativePath)
+	}
+}
+
+// uploadCancelled - check if the transfer of a path was cancelled on this node. Any partial data held for it is
+// thrown away. Call with the upload lock held.
+func uploadCancelled(relativePath string) bool {
+	server, exists := serverMap[globalSettings.Name]
+	if !exists || server.storage == nil || !server.storage.transferCancelled(relativePath) {
+		return false
+	}
+
+	dataPath, statePath := partialUploadPaths(relativePath)
+	os.Remove(dataPath)
+	os.Remove(statePath)
+	return true
+}
+
+// partialUploadPaths - location of the partial data and its state file for a relative path
+func partialUploadPaths(relativePath string) (dataPath, statePath string) {
+	key := md5.Sum([]byte(relativePath))
+	name := hex.EncodeToString(key[:])
+	dataPath = metadataPath(UPLOAD_PARTIAL_DIRECTORY, name)
+	statePath = dataPath + ".json"
+	return
+}
+
+// currentUploadStatus - figure out how much of this version of the file we already hold. Any partial data from a different
+// version of the file is thrown away. Call with the upload lock held.
+func currentUploadStatus(relativePath, hash string, size int64) UploadStatus {
+	status := UploadStatus{RelativePath: relativePath}
+	dataPath, statePath := partialUploadPaths(relativePath)
+
+	var state uploadState
+	stateData, err := ioutil.ReadFile(statePath)
+	if err == nil {
+		err = json.Unmarshal(stateData, &state)
+	}
+
+	if err == nil && state.RelativePath == relativePath && state.Hash == hash && state.Size == size {
+		info, err := os.Stat(dataPath)
+		if err == nil && info.Size() <= size {
+			status.Offset = info.Size()
+			return status
+		}
+	}
+
+	os.Remove(dataPath)
+	os.Remove(statePath)
+	return status
+}
+
+// uploadStatusHandler - answer a sender asking how much of a file we already have
+func uploadStatusHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	relativePath, validPath := cleanRelativePath(query.Get("path"))
+	hash := query.Get("hash")
+	size, err := strconv.ParseInt(query.Get("size"), 10, 64)
+	if !validPath || err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - a valid path and size are required"))
+		return
+	}
+
+	lock := lockUpload(relativePath)
+	defer lock.Unlock()
+
+	if uploadCancelled(relativePath) {
+		w.WriteHeader(http.StatusGone)
+		w.Write([]byte("410 - the transfer of this file was cancelled"))
+		return
+	}
+
+	var status UploadStatus
+	storage := serverMap[globalSettings.Name].storage
+	local, _ := storage.getEntryJSON(relativePath)
+	if local.Hash != nil && hashToString(local.Hash) == hash {
+		status = UploadStatus{RelativePath: relativePath, Offset: size, Complete: true}
+	} else {
+		status = currentUploadStatus(relativePath, hash, size)
+	}
+
+	json.NewEncoder(w).Encode(status)
+}
+
+// receiveUploadChunk - append one streamed chunk to the partial copy of a file and acknowledge how much we now hold.
+// Once the last chunk is in, the file is moved into place.
+func receiveUploadChunk(w http.ResponseWriter, part *multipart.Part, fields map[string]string) error {
+	relativePath, validPath := cleanRelativePath(fields["PATH"])
+	hash := fields["HASH"]
+	offset, err := strconv.ParseInt(fields["OFFSET"], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return err
+	}
+	size, err := strconv.ParseInt(fields["SIZE"], 10, 64)
+	if err != nil || !validPath {
+		w.WriteHeader(http.StatusBadRequest)
+		return fmt.Errorf("upload chunk for (%s) is missing its size or has a bad path", fields["PATH"])
+	}
+
+	lock := lockUpload(relativePath)
+	defer lock.Unlock()
+
+	if uploadCancelled(relativePath) {
+		w.WriteHeader(http.StatusGone)
+		return TRANSFER_ERROR_CANCELLED
+	}
+
+	status := currentUploadStatus(relativePath, hash, size)
+	if status.Offset != offset {
+		// The sender is out of step with us. Tell it where to pick up from.
+		log.Printf("Upload of %s received offset %d but we hold %d", relativePath, offset, status.Offset)
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(status)
+		return nil
+	}
+
+	dataPath, statePath := partialUploadPaths(relativePath)
+	err = os.MkdirAll(filepath.Dir(dataPath), os.ModeDir+os.ModePerm)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return err
+	}
+
+	stateData, _ := json.Marshal(uploadState{RelativePath: relativePath, Hash: hash, Size: size})
+	err = ioutil.WriteFile(statePath, stateData, 0666)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return err
+	}
+
+	f, err := os.OpenFile(dataPath, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return err
+	}
+
+	_, err = f.Seek(offset, io.SeekStart)
+	if err == nil {
+		var bytesWritten int64
+		bytesWritten, err = io.Copy(f, io.LimitReader(part, size-offset))
+		status.Offset += bytesWritten
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// Whatever made it to disk is kept. The sender will ask where to resume from.
+		log.Printf("Error copying file: %s, error(%#v)", relativePath, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 - Error copying file"))
+		return err
+	}
+
+	if status.Offset == size {
+		err = finishUpload(relativePath, dataPath, statePath, hash, fields["EntryJSON"])
+		if err == UPLOAD_ERROR_HASH_MISMATCH {
+			// The staged copy is gone. The sender has to start over.
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(UploadStatus{RelativePath: relativePath})
+			return err
+		} else if err == TRANSFER_ERROR_CANCELLED {
+			w.WriteHeader(http.StatusGone)
+			return err
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("500 - Error copying file"))
+			return err
+		}
+		status.Complete = true
+	}
+
+	fmt.Printf("Upload of (%s) is at %d of %d bytes", relativePath, status.Offset, size)
+	json.NewEncoder(w).Encode(status)
+	return nil
+}
+
+// finishUpload - check a completely received (and synced) staging file against the sender's hash and only then move it into
+// place. Readers either see the old file or the new one, never a mix. A staging file that does not match is thrown away.
+func finishUpload(relativePath, stagingPath, statePath, hash, entryString string) error {
+	relativePath, validPath := cleanRelativePath(relativePath)
+	if !validPath {
+		os.Remove(stagingPath)
+		return UPLOAD_ERROR_BAD_PATH
+	}
+
+	// Set the times before checking and renaming so the file shows up complete and its cached hash stays valid
+	var entry EntryJSON
+	if entryString != "" {
+		err := json.Unmarshal([]byte(entryString), &entry)
+		if err != nil {
+			log.Printf("Error copying file (Entry handling): %s, error(%#v)", relativePath, err)
+			return err
+		}
+
+		err = os.Chtimes(stagingPath, time.Now(), entry.ModTime)
+		if err != nil {
+			log.Printf("Error copying file (Changing times): %s, error(%#v)", relativePath, err)
+			return err
+		}
+	}
+
+	stagedHash, _, err := cachedFileHash(stagingPath)
+	if err != nil {
+		return err
+	}
+	if hashToString(stagedHash) != hash {
+		log.Printf("Upload of %s does not match the sender's hash. expected: %s received: %s", relativePath, hash, hashToString(stagedHash))
+		os.Remove(stagingPath)
+		if statePath != "" {
+			os.Remove(statePath)
+		}
+		return UPLOAD_ERROR_HASH_MISMATCH
+	}
+
+	fullPath := globalSettings.Directory + "/" + relativePath
+	moveIntoPlace := func(targetPath string) error {
+		targetFullPath := globalSettings.Directory + "/" + targetPath
+		err := checkParents(globalSettings.Directory, targetPath)
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(filepath.Dir(targetFullPath), os.ModeDir+os.ModePerm)
+		if err != nil {
+			return err
+		}
+		return os.Rename(stagingPath, targetFullPath)
+	}
+
+	server, exists := serverMap[globalSettings.Name]
+	if exists && server.storage != nil {
+		entry.RelativePath = relativePath
+		err = server.storage.applyRemoteChange(entry, moveIntoPlace)
+	} else {
+		err = moveIntoPlace(relativePath)
+	}
+	if statePath != "" && (err == nil || err == TRACKER_ERROR_STALE_VERSION || err == TRANSFER_ERROR_CANCELLED) {
+		os.Remove(statePath)
+	}
+	if err == TRANSFER_ERROR_CANCELLED {
+		os.Remove(stagingPath)
+		return err
+	}
+	if err == TRACKER_ERROR_STALE_VERSION {
+		// We already have something newer, or an edit of our own that wins over this one. There is nothing left to do
+		// for this version.
+		os.Remove(stagingPath)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return syncDirectory(filepath.Dir(fullPath))
+}
+
+// syncDirectory - flush a directory so a rename inside of it survives a crash
+func syncDirectory(directory string) error {
+	dir, err := os.Open(directory)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// postFileChunked - send a file to another node in acknowledged chunks. If the connection drops part way through, the
+// next attempt picks up from whatever the receiver already holds instead of starting again from byte zero.
+func postFileChunked(filename string, file *os.File, size int64, entryString, hash, address, credentials string) error {
+	var status UploadStatus
+	var err error
+	haveStatus := false
+	failures := 0
+
+	for {
+		if !haveStatus {
+			status, err = queryUploadStatus(filename, hash, size, address, credentials)
+			haveStatus = err == nil
+			if err == TRANSFER_ERROR_CANCELLED {
+				return err
+			}
+		}
+
+		if err == nil {
+			if status.Complete {
+				return nil
+			}
+
+			length := size - status.Offset
+			if length > UPLOAD_CHUNK_SIZE {
+				length = UPLOAD_CHUNK_SIZE
+			}
+
+			status, err = postFileChunk(filename, file, status.Offset, length, size, entryString, hash, address, credentials)
+			if err == nil {
+				failures = 0
+				continue
+			} else if err == UPLOAD_ERROR_HASH_MISMATCH || err == TRANSFER_ERROR_CANCELLED {
+				return err
+			}
+			haveStatus = false
+		}
+
+		failures++
+		if failures > UPLOAD_MAX_RETRIES {
+			log.Printf("PostFile - Giving up sending a file (%s) to another node(%s) error(%s)", filename, address, err)
+			return err
+		}
+
+		delay := UPLOAD_RETRY_DELAY << uint(failures-1)
+		log.Printf("PostFile - Error sending a file (%s) to another node(%s) error(%s). Retrying in %v", filename, address, err, delay)
+		time.Sleep(delay)
+	}
+}
+
+// queryUploadStatus - ask the receiving node how much of this file it already has
+func queryUploadStatus(filename, hash string, size int64, address, credentials string) (status UploadStatus, err error) {
+	values := url.Values{}
+	values.Set("path", filename)
+	values.Set("hash", hash)
+	values.Set("size", strconv.FormatInt(size, 10))
+
+	req, err := http.NewRequest("GET", address+"?"+values.Encode(), nil)
+	if err != nil {
+		return
+	}
+
+	data := []byte(credentials)
+	authHash := base64.StdEncoding.EncodeToString(data)
+	req.Header.Add("Authorization", "Basic "+authHash)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		err = TRANSFER_ERROR_CANCELLED
+		return
+	} else if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("upload status for %s returned %s", filename, resp.Status)
+		return
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	return
+}
+
+// postFileChunk - stream one chunk of a file to the receiving node and return its acknowledgement
+func postFileChunk(filename string, file *os.File, offset, length, size int64, entryString, hash, address, credentials string) (status UploadStatus, err error) {
+	fields := [][2]string{
+		{"EntryJSON", entryString},
+		{"HASH", hash},
+		{"PATH", filename},
+		{"OFFSET", strconv.FormatInt(offset, 10)},
+		{"SIZE", strconv.FormatInt(size, 10)},
+	}
+
+	// Stream the body through a pipe so the file goes straight from disk to the connection without being held in memory.
+	// The fields go first so the receiver knows what it is getting before the contents arrive.
+	pipeReader, pipeWriter := io.Pipe()
+	bodyWriter := multipart.NewWriter(pipeWriter)
+	contentType := bodyWriter.FormDataContentType()
+
+	go func() {
+		pipeWriter.CloseWithError(writeMultipartFile(bodyWriter, filename, io.NewSectionReader(file, offset, length), fields))
+	}()
+
+	req, err := http.NewRequest("POST", address, pipeReader)
+	if err != nil {
+		pipeReader.CloseWithError(err)
+		return
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	data := []byte(credentials)
+	authHash := base64.StdEncoding.EncodeToString(data)
+	req.Header.Add("Authorization", "Basic "+authHash)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		pipeReader.CloseWithError(err)
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusConflict:
+		// a conflict carries the offset the receiver actually holds, so we just carry on from there
+		err = json.NewDecoder(resp.Body).Decode(&status)
+	case http.StatusUnprocessableEntity:
+		err = UPLOAD_ERROR_HASH_MISMATCH
+	case http.StatusGone:
+		err = TRANSFER_ERROR_CANCELLED
+	default:
+		err = fmt.Errorf("upload chunk at %d for %s returned %s", offset, filename, resp.Status)
+	}
+
+	return
+}
+
+// writeMultipartFile - write the upload fields followed by the file contents to a multipart writer
+func writeMultipartFile(bodyWriter *multipart.Writer, filename string, file io.Reader, fields [][2]string) error {
+	for _, field := range fields {
+		err := bodyWriter.WriteField(field[0], field[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	fileWriter, err := bodyWriter.CreateFormFile("uploadfile", filename)
+	if err != nil {
+		fmt.Println("error writing to buffer")
+		return err
+	}
+
+	// Copy the file to the request
+	_, err = io.CopyBuffer(fileWriter, file, nil)
+	if err != nil {
+		fmt.Printf("error copying file: %s (%s)", filename, err)
+		return err
+	}
+
+	return bodyWriter.Close()
+}
@@ -0,0 +1,316 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupUploadReceiver - create a tracker to receive files, with settings of its own, and an http server in front of
+// the upload handler
+func setupUploadReceiver(t *testing.T) (tracker *FilesystemTracker, server *httptest.Server) {
+	useTestSettings(t)
+	tracker = createTracker("uploadReceiver")
+	globalSettings.Directory = tracker.directory
+	serverMap[globalSettings.Name] = &ReplicatServer{Name: globalSettings.Name, storage: tracker}
+
+	server = httptest.NewServer(http.HandlerFunc(uploadHandler))
+	return
+}
+
+func createUploadSource(t *testing.T, size int) (file *os.File, contents []byte) {
+	contents = make([]byte, size)
+	rand.Read(contents)
+
+	source, err := ioutil.TempFile("", "uploadSource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = source.Write(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return source, contents
+}
+
+func TestChunkedUploadResumesFromReceiverOffset(t *testing.T) {
+	tracker, server := setupUploadReceiver(t)
+	defer cleanupTracker(tracker)
+	defer server.Close()
+
+	source, contents := createUploadSource(t, 2*UPLOAD_CHUNK_SIZE+1234)
+	defer os.Remove(source.Name())
+	defer source.Close()
+
+	address := server.URL + "/upload/"
+	size := int64(len(contents))
+	contentHash, _ := hashFile(source.Name())
+	hash := hashToString(contentHash)
+
+	// Send only the first chunk, as if the connection dropped right after it
+	status, err := postFileChunk("sub/resume.bin", source, 0, UPLOAD_CHUNK_SIZE, size, "", hash, address, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Offset != UPLOAD_CHUNK_SIZE || status.Complete {
+		t.Fatalf("unexpected status after first chunk: %#v", status)
+	}
+
+	// A chunk at the wrong offset gets told where to resume from
+	status, err = postFileChunk("sub/resume.bin", source, 0, 10, size, "", hash, address, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Offset != UPLOAD_CHUNK_SIZE {
+		t.Fatalf("expected the receiver to report offset %d, got %#v", UPLOAD_CHUNK_SIZE, status)
+	}
+
+	err = postFileChunked("sub/resume.bin", source, size, "", hash, address, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := ioutil.ReadFile(filepath.Join(tracker.directory, "sub/resume.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, contents) {
+		t.Fatalf("received file does not match. expected %d bytes, got %d", len(contents), len(received))
+	}
+}
+
+func TestChunkedUploadRestartsForNewVersion(t *testing.T) {
+	tracker, server := setupUploadReceiver(t)
+	defer cleanupTracker(tracker)
+	defer server.Close()
+
+	source, contents := createUploadSource(t, UPLOAD_CHUNK_SIZE+10)
+	defer os.Remove(source.Name())
+	defer source.Close()
+
+	address := server.URL + "/upload/"
+	size := int64(len(contents))
+
+	_, err := postFileChunk("restart.bin", source, 0, UPLOAD_CHUNK_SIZE, size, "", "oldVersion", address, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := queryUploadStatus("restart.bin", "newVersion", size, address, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Offset != 0 {
+		t.Fatalf("partial data from another version should be discarded. status: %#v", status)
+	}
+}
+
+func TestDeltaUploadRebuildsReceiverCopy(t *testing.T) {
+	tracker, server := setupUploadReceiver(t)
+	defer cleanupTracker(tracker)
+	defer server.Close()
+
+	source, contents := createUploadSource(t, DELTA_MIN_FILE_SIZE+4321)
+	defer os.Remove(source.Name())
+	defer source.Close()
+
+	// The receiver has an older copy that differs in a few places
+	oldContents := append([]byte{}, contents...)
+	copy(oldContents[1000:], []byte("older data"))
+	oldContents = oldContents[:len(oldContents)-100]
+	err := ioutil.WriteFile(filepath.Join(tracker.directory, "delta.bin"), oldContents, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	address := server.URL + "/upload/"
+	signature, found, err := querySignature("delta.bin", address, "")
+	if err != nil || !found {
+		t.Fatalf("expected a signature. found: %v err: %v", found, err)
+	}
+
+	contentHash, _ := hashFile(source.Name())
+	hash := hashToString(contentHash)
+	err = postFileDelta("delta.bin", source, signature, "", hash, address, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := ioutil.ReadFile(filepath.Join(tracker.directory, "delta.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, contents) {
+		t.Fatalf("rebuilt file does not match. expected %d bytes, got %d", len(contents), len(received))
+	}
+
+	// The signature is now stale, so the receiver must refuse another delta against it
+	err = postFileDelta("delta.bin", source, signature, "", hash, address, "")
+	if err != DELTA_ERROR_BASE_CHANGED {
+		t.Fatalf("expected a stale signature to be rejected, got: %v", err)
+	}
+}
+
+func TestUploadWithWrongHashIsNotExposed(t *testing.T) {
+	tracker, server := setupUploadReceiver(t)
+	defer cleanupTracker(tracker)
+	defer server.Close()
+
+	source, contents := createUploadSource(t, 1000)
+	defer os.Remove(source.Name())
+	defer source.Close()
+
+	err := postFileChunked("damaged.bin", source, int64(len(contents)), "", "not the right hash", server.URL+"/upload/", "")
+	if err != UPLOAD_ERROR_HASH_MISMATCH {
+		t.Fatalf("expected a hash mismatch, got: %v", err)
+	}
+
+	_, err = os.Stat(filepath.Join(tracker.directory, "damaged.bin"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("a file that failed verification should not be moved into place. err: %v", err)
+	}
+}
+
+func TestUploadOfACancelledTransferIsRefused(t *testing.T) {
+	tracker, server := setupUploadReceiver(t)
+	defer cleanupTracker(tracker)
+	defer server.Close()
+
+	tracker.requestFile(EntryJSON{RelativePath: "cancelled.bin", ServerName: "uploadSender", Version: VersionVector{"uploadSender": 1}})
+	if !tracker.cancelTransfer("cancelled.bin") {
+		t.Fatal("the requested file should have a transfer to cancel")
+	}
+
+	source, contents := createUploadSource(t, 1000)
+	defer os.Remove(source.Name())
+	defer source.Close()
+
+	hash, _, err := cachedFileHash(source.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = postFileChunked("cancelled.bin", source, int64(len(contents)), "", hashToString(hash), server.URL+"/upload/", "")
+	if err != TRANSFER_ERROR_CANCELLED {
+		t.Fatalf("the sender should be told the transfer was cancelled, got: %v", err)
+	}
+
+	_, err = os.Stat(filepath.Join(tracker.directory, "cancelled.bin"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("a file whose transfer was cancelled should not be moved into place. err: %v", err)
+	}
+}
+
+func TestUploadLockIsDroppedOnceReleased(t *testing.T) {
+	lock := lockUpload("locked.bin")
+	waiting := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		close(waiting)
+		lockUpload("locked.bin").Unlock()
+		close(done)
+	}()
+	<-waiting
+	time.Sleep(10 * time.Millisecond)
+	lock.Unlock()
+	<-done
+
+	uploadLocksLock.Lock()
+	_, kept := uploadLocks["locked.bin"]
+	uploadLocksLock.Unlock()
+	if kept {
+		t.Fatal("the lock of a path should be dropped once nobody holds or waits for it")
+	}
+}
+
+func TestOversizedUploadFieldIsRejected(t *testing.T) {
+	tracker, server := setupUploadReceiver(t)
+	defer cleanupTracker(tracker)
+	defer server.Close()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("EntryJSON", strings.Repeat("x", UPLOAD_MAX_FIELD_SIZE+1))
+	writer.Close()
+
+	resp, err := http.Post(server.URL+"/upload/", writer.FormDataContentType(), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("a field over the limit should be refused, not taken as a success: %s", resp.Status)
+	}
+}
+
+func TestUploadOutsideOfDirectoryIsRejected(t *testing.T) {
+	tracker, server := setupUploadReceiver(t)
+	defer cleanupTracker(tracker)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/upload/?path=../escaped.bin&hash=x&size=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("a status request outside of the directory should be refused: %s", resp.Status)
+	}
+
+	source, contents := createUploadSource(t, 1000)
+	defer os.Remove(source.Name())
+	defer source.Close()
+
+	size := int64(len(contents))
+	_, err = postFileChunk("../escaped.bin", source, 0, size, size, "", "", server.URL+"/upload/", "")
+	if err == nil {
+		t.Fatal("a chunk outside of the directory should be refused")
+	}
+
+	_, err = os.Stat(filepath.Join(filepath.Dir(tracker.directory), "escaped.bin"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("an upload should never be written outside of the directory. err: %v", err)
+	}
+}
+
+func TestSignatureOutsideOfDirectoryIsRejected(t *testing.T) {
+	tracker, server := setupUploadReceiver(t)
+	defer cleanupTracker(tracker)
+	defer server.Close()
+
+	outsideName := filepath.Base(tracker.directory) + ".outside"
+	outsidePath := filepath.Join(filepath.Dir(tracker.directory), outsideName)
+	err := ioutil.WriteFile(outsidePath, make([]byte, DELTA_MIN_FILE_SIZE), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(outsidePath)
+
+	_, found, _ := querySignature("../"+outsideName, server.URL+"/upload/", "")
+	if found {
+		t.Fatal("a file outside of the directory should never be signed")
+	}
+}
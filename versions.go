@@ -0,0 +1,292 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// When a newer copy of a file arrives from another node, the contents it replaces can be kept as a version of the
+// file. The last KeepVersions versions of each file are kept, as is every version replaced within the last
+// KeepVersionsDays days. An archive node keeps them all. Restoring a version puts it in place as a change made here,
+// which reaches the other nodes like any other. With versions turned off, replaced contents go to the trash.
+
+// VERSIONS_DIRECTORY - Where versions of files are kept, inside of the metadata directory
+const VERSIONS_DIRECTORY = "versions"
+
+// VERSION_ERROR_NOT_FOUND - The file has no version with the ID
+var VERSION_ERROR_NOT_FOUND = errors.New("Replicat: No such version of the file")
+
+// FileVersion - contents a file had before a newer copy replaced them
+type FileVersion struct {
+	ID           string
+	RelativePath string
+	Size         int64
+	Hash         []byte
+	Origin       string        // the node the contents came from. Empty when that is not known
+	ModTime      time.Time     // when the contents were written
+	Replaced     time.Time     // when a newer copy replaced them
+	Version      VersionVector `json:",omitempty"`
+}
+
+// fileVersionPath - where the contents of a version are kept
+func fileVersionPath(version FileVersion) string {
+	return metadataPath(VERSIONS_DIRECTORY, version.ID, filepath.Base(version.RelativePath))
+}
+
+// versionsEnabled - check if replaced contents are kept as versions rather than put in the trash
+func versionsEnabled() bool {
+	return globalSettings.Archive || globalSettings.KeepVersions > 0 || globalSettings.KeepVersionsDays > 0
+}
+
+// keepReplacedContents - keep the file at a path before a change from another node replaces it, as a version of the
+// file or in the trash. Call when inside of a lock!
+func (handler *FilesystemTracker) keepReplacedContents(relativePath, replacedBy string) error {
+	if !versionsEnabled() {
+		return handler.trashReplacedContents(relativePath, replacedBy)
+	}
+	return handler.addFileVersion(relativePath)
+}
+
+// addFileVersion - keep what a file holds now as a version of it. The file is copied rather than linked, since the
+// change may not be applied after all and the file edited in place later would change a linked copy too. Call when
+// inside of a lock!
+func (handler *FilesystemTracker) addFileVersion(relativePath string) error {
+	fullPath := filepath.Join(handler.directory, relativePath)
+	info, err := os.Lstat(fullPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil || !info.Mode().IsRegular() {
+		return err
+	}
+
+	entry := handler.contents[relativePath]
+	contentHash := entry.hash
+	if contentHash == nil {
+		contentHash, _, err = cachedFileHash(fullPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Contents that are already the newest version are not kept twice
+	versions := handler.versions[relativePath]
+	if len(versions) > 0 && bytes.Equal(versions[len(versions)-1].Hash, contentHash) {
+		return nil
+	}
+
+	now := time.Now()
+	version := FileVersion{RelativePath: relativePath, Size: info.Size(), Hash: contentHash,
+		Origin: handler.contentOrigins[relativePath], ModTime: info.ModTime(), Replaced: now, Version: entry.version}
+
+	// The directory for a version is made exclusively, which makes its ID unique
+	for sequence := now.UnixNano(); ; sequence++ {
+		version.ID = strconv.FormatInt(sequence, 36)
+		err = os.MkdirAll(metadataPath(VERSIONS_DIRECTORY), os.ModeDir+os.ModePerm)
+		if err == nil {
+			err = os.Mkdir(filepath.Dir(fileVersionPath(version)), os.ModeDir+os.ModePerm)
+		}
+		if !os.IsExist(err) {
+			break
+		}
+	}
+	if err == nil {
+		err = copyArchiveFile(fullPath, fileVersionPath(version), info)
+	}
+	if err != nil {
+		os.RemoveAll(filepath.Dir(fileVersionPath(version)))
+		return err
+	}
+
+	log.Printf("Versions: kept %s as it was at %s as %s", relativePath, info.ModTime(), version.ID)
+	handler.versions[relativePath] = append(versions, version)
+	handler.pruneVersions(relativePath, now)
+	handler.scheduleStateSave()
+	return nil
+}
+
+// pruneVersions - drop the versions of a file that are neither among the last KeepVersions nor replaced within the
+// last KeepVersionsDays days. Call when inside of a lock!
+func (handler *FilesystemTracker) pruneVersions(relativePath string, now time.Time) {
+	if globalSettings.Archive {
+		return
+	}
+
+	versions := handler.versions[relativePath]
+	maxAge := time.Duration(globalSettings.KeepVersionsDays) * 24 * time.Hour
+	kept := make([]FileVersion, 0, len(versions))
+	for i, version := range versions {
+		newest := len(versions) - i
+		if newest <= globalSettings.KeepVersions || now.Sub(version.Replaced) < maxAge {
+			kept = append(kept, version)
+			continue
+		}
+		err := os.RemoveAll(filepath.Dir(fileVersionPath(version)))
+		if err != nil {
+			log.Printf("Versions: unable to drop %s of %s: %s", version.ID, relativePath, err)
+		}
+	}
+
+	if len(kept) == len(versions) {
+		return
+	}
+	if len(kept) == 0 {
+		delete(handler.versions, relativePath)
+	} else {
+		handler.versions[relativePath] = kept
+	}
+	handler.scheduleStateSave()
+}
+
+// collectVersions - drop the versions that are past their retention
+func (handler *FilesystemTracker) collectVersions() {
+	handler.fsLock.Lock()
+	defer handler.fsLock.Unlock()
+
+	now := time.Now()
+	for relativePath := range handler.versions {
+		handler.pruneVersions(relativePath, now)
+	}
+}
+
+// versionList - the versions kept of a file, newest first
+func (handler *FilesystemTracker) versionList(relativePath string) []FileVersion {
+	handler.fsLock.RLock()
+	defer handler.fsLock.RUnlock()
+
+	versions := make([]FileVersion, len(handler.versions[relativePath]))
+	copy(versions, handler.versions[relativePath])
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Replaced.After(versions[j].Replaced) })
+	return versions
+}
+
+// restoreFileVersion - put a version of a file back in place. What the file holds now is kept as a version first, so
+// the restore can be undone. The restored contents are a change made here, and are sent to the other nodes.
+func (handler *FilesystemTracker) restoreFileVersion(relativePath, id string) error {
+	handler.fsLock.Lock()
+	defer handler.fsLock.Unlock()
+
+	var version FileVersion
+	found := false
+	for _, candidate := range handler.versions[relativePath] {
+		if candidate.ID == id {
+			version, found = candidate, true
+		}
+	}
+	if !found {
+		return VERSION_ERROR_NOT_FOUND
+	}
+
+	sourcePath := fileVersionPath(version)
+	info, err := os.Stat(sourcePath)
+	if err != nil {
+		return err
+	}
+
+	err = handler.addFileVersion(relativePath)
+	if err != nil {
+		return err
+	}
+
+	// Copied next to the other partial files and renamed into place, so readers never see half of it
+	fullPath := filepath.Join(handler.directory, relativePath)
+	stagingPath := metadataPath(UPLOAD_PARTIAL_DIRECTORY, "restore-"+version.ID)
+	err = checkParents(handler.directory, relativePath)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(stagingPath), os.ModeDir+os.ModePerm)
+	}
+	if err == nil {
+		os.Remove(stagingPath)
+		err = copyArchiveFile(sourcePath, stagingPath, info)
+	}
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(fullPath), os.ModeDir+os.ModePerm)
+	}
+	if err == nil {
+		err = os.Rename(stagingPath, fullPath)
+	}
+	if err != nil {
+		os.Remove(stagingPath)
+		return err
+	}
+
+	info, err = os.Stat(fullPath)
+	if err != nil {
+		return err
+	}
+	entry := handler.contents[relativePath]
+	entry.FileInfo = info
+	entry.setup = true
+	entry.hash = nil
+	entry.version = handler.versionOf(relativePath).Increment(globalSettings.Name)
+	handler.contents[relativePath] = entry
+	handler.contentOrigins[relativePath] = globalSettings.Name
+	handler.clearTombstone(relativePath)
+	handler.recordChange(relativePath)
+	handler.queueHash(relativePath)
+	log.Printf("Versions: restored %s to %s from %s", relativePath, version.ID, version.ModTime)
+
+	event := Event{Name: "notify.Write", Path: relativePath, Source: globalSettings.Name, ModTime: info.ModTime(), Version: entry.version}
+	if handler.shouldPublish(event) {
+		SendEvent(event, fullPath)
+	}
+	return nil
+}
+
+// versionsHandler - list the versions of a file with GET /versions/?path=<path>, or restore one with
+// POST /versions/?path=<path>&id=<id>
+func versionsHandler(w http.ResponseWriter, r *http.Request) {
+	server, exists := serverMap[globalSettings.Name]
+	if !exists || server.storage == nil {
+		http.Error(w, "Storage is not set up", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	relativePath := query.Get("path")
+	if relativePath == "" {
+		http.Error(w, "path is required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(server.storage.versionList(relativePath))
+	case "POST":
+		err := server.storage.restoreFileVersion(relativePath, query.Get("id"))
+		switch err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case VERSION_ERROR_NOT_FOUND:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
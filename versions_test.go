@@ -0,0 +1,134 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVersionsKeepTheLastReplacedContents(t *testing.T) {
+	useTestSettings(t)
+	globalSettings.KeepVersions = 2
+
+	tracker := createTracker("versionsKeep")
+	defer cleanupTracker(tracker)
+	globalSettings.Directory = tracker.directory
+
+	receiveTestFile(t, tracker, "notes.txt", "first", "versionsPeer", VersionVector{"versionsPeer": 1})
+	receiveTestFile(t, tracker, "notes.txt", "second", "versionsPeer", VersionVector{"versionsPeer": 2})
+	receiveTestFile(t, tracker, "notes.txt", "third", "versionsPeer", VersionVector{"versionsPeer": 3})
+	receiveTestFile(t, tracker, "notes.txt", "fourth", "versionsPeer", VersionVector{"versionsPeer": 4})
+
+	versions := tracker.versionList("notes.txt")
+	if len(versions) != 2 {
+		t.Fatalf("only the last two versions should be kept: %#v", versions)
+	}
+	for i, expected := range []string{"third", "second"} {
+		kept, err := ioutil.ReadFile(fileVersionPath(versions[i]))
+		if err != nil || string(kept) != expected {
+			t.Fatalf("version %d should hold %q. kept: %q err: %v", i, expected, kept, err)
+		}
+		if versions[i].Origin != "versionsPeer" || versions[i].Size != int64(len(expected)) || versions[i].Hash == nil {
+			t.Fatalf("version %d is not described: %#v", i, versions[i])
+		}
+	}
+	if len(tracker.trashList()) != 0 {
+		t.Fatal("replaced contents kept as versions should not also go to the trash")
+	}
+}
+
+func TestKeptVersionIsNotChangedWithTheFile(t *testing.T) {
+	useTestSettings(t)
+	globalSettings.KeepVersions = 2
+
+	tracker := createTracker("versionsCopied")
+	defer cleanupTracker(tracker)
+	globalSettings.Directory = tracker.directory
+
+	receiveTestFile(t, tracker, "draft.txt", "draft", "versionsPeer", VersionVector{"versionsPeer": 1})
+
+	// The change is not applied, so the file stays where it is and is edited in place afterwards
+	failed := tracker.applyRemoteChange(EntryJSON{RelativePath: "draft.txt", Version: VersionVector{"versionsPeer": 2}, ServerName: "versionsPeer"},
+		func(relativePath string) error {
+			return os.ErrPermission
+		})
+	if failed != os.ErrPermission {
+		t.Fatalf("the apply should fail. err: %v", failed)
+	}
+	file, err := os.OpenFile(filepath.Join(tracker.directory, "draft.txt"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(" and more")
+	file.Close()
+
+	versions := tracker.versionList("draft.txt")
+	if len(versions) == 0 {
+		t.Fatal("the contents should be kept before the change is applied")
+	}
+	for _, version := range versions {
+		kept, err := ioutil.ReadFile(fileVersionPath(version))
+		if err != nil || string(kept) != "draft" {
+			t.Fatalf("a kept version should not change with the file. kept: %q err: %v", kept, err)
+		}
+	}
+}
+
+func TestRestoredVersionIsALocalChange(t *testing.T) {
+	useTestSettings(t)
+	globalSettings.KeepVersions = 5
+
+	tracker := createTracker("versionsRestore")
+	defer cleanupTracker(tracker)
+	globalSettings.Directory = tracker.directory
+
+	receiveTestFile(t, tracker, "notes.txt", "first", "versionsPeer", VersionVector{"versionsPeer": 1})
+	receiveTestFile(t, tracker, "notes.txt", "second", "versionsPeer", VersionVector{"versionsPeer": 2})
+	versions := tracker.versionList("notes.txt")
+	if len(versions) != 1 {
+		t.Fatalf("the replaced contents should be kept: %#v", versions)
+	}
+
+	if tracker.restoreFileVersion("notes.txt", "missing") != VERSION_ERROR_NOT_FOUND {
+		t.Fatal("restoring a version that is not kept should fail")
+	}
+	err := tracker.restoreFileVersion("notes.txt", versions[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := ioutil.ReadFile(filepath.Join(tracker.directory, "notes.txt"))
+	if err != nil || string(restored) != "first" {
+		t.Fatalf("the version should be back in place. restored: %q err: %v", restored, err)
+	}
+	version := tracker.currentVersion("notes.txt")
+	if version.Compare(VersionVector{"versionsPeer": 2}) != VERSION_DOMINATES {
+		t.Fatalf("the restore should be a newer change than what it replaced: %s", version)
+	}
+
+	// What the restore replaced is kept too, so it can be undone
+	versions = tracker.versionList("notes.txt")
+	if len(versions) != 2 {
+		t.Fatalf("the contents the restore replaced should be kept: %#v", versions)
+	}
+	kept, err := ioutil.ReadFile(fileVersionPath(versions[0]))
+	if err != nil || string(kept) != "second" {
+		t.Fatalf("the newest version should be what the restore replaced. kept: %q err: %v", kept, err)
+	}
+}
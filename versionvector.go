@@ -0,0 +1,138 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// VersionVector - the number of changes each node has made to a path. A node bumps its own counter when it changes
+// the path and takes the highest counter for every node when it applies a change from elsewhere. Comparing two vectors
+// tells whether one version was derived from the other or whether they were changed independently, without looking at
+// any clocks.
+type VersionVector map[string]uint64
+
+// VersionOrdering - how two versions of the same path relate to each other
+type VersionOrdering int
+
+const (
+	// VERSION_EQUAL - Both sides have seen exactly the same changes
+	VERSION_EQUAL VersionOrdering = iota
+	// VERSION_DOMINATES - This version includes every change the other one has, and more
+	VERSION_DOMINATES
+	// VERSION_DOMINATED - The other version includes every change this one has, and more
+	VERSION_DOMINATED
+	// VERSION_CONCURRENT - Each side has changes the other has not seen
+	VERSION_CONCURRENT
+)
+
+func (ordering VersionOrdering) String() string {
+	switch ordering {
+	case VERSION_EQUAL:
+		return "equal"
+	case VERSION_DOMINATES:
+		return "dominates"
+	case VERSION_DOMINATED:
+		return "dominated"
+	case VERSION_CONCURRENT:
+		return "concurrent"
+	}
+	return fmt.Sprintf("VersionOrdering(%d)", int(ordering))
+}
+
+// Copy - an independent copy of the vector
+func (version VersionVector) Copy() VersionVector {
+	result := make(VersionVector, len(version)+1)
+	for node, counter := range version {
+		result[node] = counter
+	}
+	return result
+}
+
+// Increment - a copy of the vector with a change by node added
+func (version VersionVector) Increment(node string) VersionVector {
+	result := version.Copy()
+	result[node]++
+	return result
+}
+
+// Merge - a copy of the vector that has also seen every change in other
+func (version VersionVector) Merge(other VersionVector) VersionVector {
+	result := version.Copy()
+	for node, counter := range other {
+		if counter > result[node] {
+			result[node] = counter
+		}
+	}
+	return result
+}
+
+// Compare - how this version relates to other
+func (version VersionVector) Compare(other VersionVector) VersionOrdering {
+	newer, older := false, false
+
+	for node, counter := range version {
+		if counter > other[node] {
+			newer = true
+		} else if counter < other[node] {
+			older = true
+		}
+	}
+	for node, counter := range other {
+		_, exists := version[node]
+		if !exists && counter > 0 {
+			older = true
+		}
+	}
+
+	switch {
+	case newer && older:
+		return VERSION_CONCURRENT
+	case newer:
+		return VERSION_DOMINATES
+	case older:
+		return VERSION_DOMINATED
+	}
+	return VERSION_EQUAL
+}
+
+// NodesAhead - the nodes that made changes in this version that other has not seen, in name order
+func (version VersionVector) NodesAhead(other VersionVector) []string {
+	nodes := make([]string, 0)
+	for node, counter := range version {
+		if counter > other[node] {
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+func (version VersionVector) String() string {
+	nodes := make([]string, 0, len(version))
+	for node := range version {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	parts := make([]string, len(nodes))
+	for i, node := range nodes {
+		parts[i] = fmt.Sprintf("%s:%d", node, version[node])
+	}
+	return "{" + strings.Join(parts, " ") + "}"
+}
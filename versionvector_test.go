@@ -0,0 +1,54 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import "testing"
+
+func TestVersionVectorCompare(t *testing.T) {
+	base := VersionVector{"nodeA": 1}
+	changedOnB := base.Increment("nodeB")
+	changedOnA := base.Increment("nodeA")
+
+	cases := []struct {
+		name     string
+		version  VersionVector
+		other    VersionVector
+		expected VersionOrdering
+	}{
+		{"same", base, base.Copy(), VERSION_EQUAL},
+		{"empty", VersionVector{}, nil, VERSION_EQUAL},
+		{"newer", changedOnB, base, VERSION_DOMINATES},
+		{"older", base, changedOnB, VERSION_DOMINATED},
+		{"from nothing", nil, base, VERSION_DOMINATED},
+		{"independent", changedOnA, changedOnB, VERSION_CONCURRENT},
+		{"merged", changedOnA.Merge(changedOnB), changedOnB, VERSION_DOMINATES},
+	}
+
+	for _, c := range cases {
+		ordering := c.version.Compare(c.other)
+		if ordering != c.expected {
+			t.Errorf("%s: %s compared to %s was %s, expected %s", c.name, c.version, c.other, ordering, c.expected)
+		}
+	}
+}
+
+func TestVersionVectorIncrementLeavesOriginal(t *testing.T) {
+	original := VersionVector{"nodeA": 1}
+	incremented := original.Increment("nodeA")
+	if original["nodeA"] != 1 || incremented["nodeA"] != 2 {
+		t.Fatalf("increment changed the original. original: %s incremented: %s", original, incremented)
+	}
+}
@@ -0,0 +1,111 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"os"
+)
+
+// A walker reads the directories of a tree on a few goroutines at once, so the time spent waiting on the disk for one
+// directory is spent reading others. The caller sees each directory in turn on its own goroutine and decides which of
+// the directories inside of it are walked next, so it needs no locking of its own.
+
+// SCAN_WORKERS - Number of directories read at once when the settings do not say
+const SCAN_WORKERS = 8
+
+// walkVisitor - called with what a directory holds, or with the error reading it. Returns the directories inside of it
+// to walk, relative to the root, and whether to keep walking at all.
+type walkVisitor func(relativeDirectory string, infos []os.FileInfo, err error) (subdirectories []string, keepGoing bool)
+
+// directoryWalker - walks a tree from a list of directories relative to its root
+type directoryWalker struct {
+	root        string
+	workers     int
+	followLinks bool
+	queue       []string
+	inFlight    map[string]bool
+}
+
+type walkResult struct {
+	relativeDirectory string
+	infos             []os.FileInfo
+	err               error
+}
+
+// newDirectoryWalker - a walker for the directories in pending and everything below them. With followLinks, symlinks
+// are described by what they point to, as os.Stat does. Otherwise by the link itself, as os.Lstat does.
+func newDirectoryWalker(root string, pending []string, followLinks bool) *directoryWalker {
+	workers := globalSettings.ScanWorkers
+	if workers <= 0 {
+		workers = SCAN_WORKERS
+	}
+	queue := make([]string, len(pending))
+	copy(queue, pending)
+	return &directoryWalker{root: root, workers: workers, followLinks: followLinks, queue: queue, inFlight: make(map[string]bool)}
+}
+
+// remaining - the directories not visited yet, including the one being visited. Only call from inside of visit.
+func (walker *directoryWalker) remaining() []string {
+	remaining := make([]string, 0, len(walker.inFlight)+len(walker.queue))
+	for relativeDirectory := range walker.inFlight {
+		remaining = append(remaining, relativeDirectory)
+	}
+	return append(remaining, walker.queue...)
+}
+
+// run - walk until there is nothing left or visit asks to stop. Directories being read when visit stops the walk are
+// not visited.
+func (walker *directoryWalker) run(visit walkVisitor) error {
+	root, err := openWalkRoot(walker.root)
+	if err != nil {
+		return err
+	}
+	defer root.close()
+
+	// No more than workers directories are ever in flight, so a worker never waits to hand back what it read
+	requests := make(chan string)
+	results := make(chan walkResult, walker.workers)
+	defer close(requests)
+	for i := 0; i < walker.workers; i++ {
+		go func() {
+			for relativeDirectory := range requests {
+				infos, err := root.readDirectory(relativeDirectory, walker.followLinks)
+				results <- walkResult{relativeDirectory: relativeDirectory, infos: infos, err: err}
+			}
+		}()
+	}
+
+	keepGoing := true
+	for {
+		for keepGoing && len(walker.queue) > 0 && len(walker.inFlight) < walker.workers {
+			next := walker.queue[0]
+			walker.queue = walker.queue[1:]
+			walker.inFlight[next] = true
+			requests <- next
+		}
+		if len(walker.inFlight) == 0 {
+			return nil
+		}
+
+		result := <-results
+		if keepGoing {
+			var subdirectories []string
+			subdirectories, keepGoing = visit(result.relativeDirectory, result.infos, result.err)
+			walker.queue = append(walker.queue, subdirectories...)
+		}
+		delete(walker.inFlight, result.relativeDirectory)
+	}
+}
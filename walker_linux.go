@@ -0,0 +1,150 @@
+//go:build linux
+// +build linux
+
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// On Linux the root is opened once and every directory is opened relative to it, its names are read with getdents and
+// each one is described with fstatat relative to the directory. The kernel only resolves each name once instead of
+// walking the whole path again for every entry.
+
+// WALKER_DIRENT_BUFFER_SIZE - Size of the buffer the names in a directory are read into
+const WALKER_DIRENT_BUFFER_SIZE = 32 * 1024
+
+// walkRoot - the root of a walk, opened once for every directory below it
+type walkRoot struct {
+	path string
+	fd   int
+}
+
+func openWalkRoot(path string) (*walkRoot, error) {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return &walkRoot{path: path, fd: fd}, nil
+}
+
+func (root *walkRoot) close() {
+	unix.Close(root.fd)
+}
+
+// readDirectory - the file information for everything in a directory. Entries removed while the directory is being
+// read, or that cannot be described, are left out.
+func (root *walkRoot) readDirectory(relativeDirectory string, followLinks bool) ([]os.FileInfo, error) {
+	fullPath := filepath.Join(root.path, relativeDirectory)
+	name := relativeDirectory
+	if name == "" {
+		name = "."
+	}
+	fd, err := unix.Openat(root.fd, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "openat", Path: fullPath, Err: err}
+	}
+	defer unix.Close(fd)
+
+	flags := unix.AT_SYMLINK_NOFOLLOW
+	if followLinks {
+		flags = 0
+	}
+
+	buffer := make([]byte, WALKER_DIRENT_BUFFER_SIZE)
+	infos := make([]os.FileInfo, 0)
+	var names []string
+	for {
+		n, err := unix.Getdents(fd, buffer)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "getdents", Path: fullPath, Err: err}
+		}
+		if n <= 0 {
+			return infos, nil
+		}
+
+		_, _, names = unix.ParseDirent(buffer[:n], -1, names[:0])
+		for _, name := range names {
+			info := &walkFileInfo{name: name}
+			err = fstatat(fd, name, &info.stat, flags)
+			if err == unix.ENOENT {
+				continue
+			}
+			if err != nil {
+				log.Printf("walker: unable to stat %s. Skipping it: %s", filepath.Join(fullPath, name), err)
+				continue
+			}
+			infos = append(infos, info)
+		}
+	}
+}
+
+// fstatat - describe a name inside of an open directory. unix.Stat_t and syscall.Stat_t are both the kernel's struct
+// stat, so the result is read straight into the syscall.Stat_t the rest of replicat expects from Sys.
+func fstatat(dirfd int, name string, stat *syscall.Stat_t, flags int) error {
+	return unix.Fstatat(dirfd, name, (*unix.Stat_t)(unsafe.Pointer(stat)), flags)
+}
+
+// walkFileInfo - an os.FileInfo built from fstatat. Sys returns the *syscall.Stat_t, as it does for os.Stat.
+type walkFileInfo struct {
+	name string
+	stat syscall.Stat_t
+}
+
+func (info *walkFileInfo) Name() string       { return info.name }
+func (info *walkFileInfo) Size() int64        { return info.stat.Size }
+func (info *walkFileInfo) IsDir() bool        { return info.Mode().IsDir() }
+func (info *walkFileInfo) Sys() interface{}   { return &info.stat }
+func (info *walkFileInfo) ModTime() time.Time { return time.Unix(info.stat.Mtim.Unix()) }
+
+func (info *walkFileInfo) Mode() os.FileMode {
+	mode := os.FileMode(info.stat.Mode & 0777)
+	switch info.stat.Mode & syscall.S_IFMT {
+	case syscall.S_IFBLK:
+		mode |= os.ModeDevice
+	case syscall.S_IFCHR:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case syscall.S_IFDIR:
+		mode |= os.ModeDir
+	case syscall.S_IFIFO:
+		mode |= os.ModeNamedPipe
+	case syscall.S_IFLNK:
+		mode |= os.ModeSymlink
+	case syscall.S_IFSOCK:
+		mode |= os.ModeSocket
+	}
+	if info.stat.Mode&syscall.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if info.stat.Mode&syscall.S_ISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if info.stat.Mode&syscall.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
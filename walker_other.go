@@ -0,0 +1,77 @@
+//go:build !linux
+// +build !linux
+
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+)
+
+// walkRoot - the root of a walk. Each directory is read by its full path.
+type walkRoot struct {
+	path string
+}
+
+func openWalkRoot(path string) (*walkRoot, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrInvalid}
+	}
+	return &walkRoot{path: path}, nil
+}
+
+func (root *walkRoot) close() {}
+
+// readDirectory - the file information for everything in a directory. Entries removed while the directory is being
+// read, or that cannot be described, are left out.
+func (root *walkRoot) readDirectory(relativeDirectory string, followLinks bool) ([]os.FileInfo, error) {
+	fullPath := filepath.Join(root.path, relativeDirectory)
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	stat := os.Lstat
+	if followLinks {
+		stat = os.Stat
+	}
+
+	infos := make([]os.FileInfo, 0, len(names))
+	for _, name := range names {
+		info, err := stat(filepath.Join(fullPath, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			log.Printf("walker: unable to stat %s. Skipping it: %s", filepath.Join(fullPath, name), err)
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
@@ -0,0 +1,211 @@
+// Package replicat is a server for n way synchronization of content (Replication for the cloud).
+// Copyright 2016 Jacob Taylor jacob@replic.at       More Info: http://replic.at
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// walkedInfo - what a test compares about one path
+type walkedInfo struct {
+	Size    int64
+	Mode    os.FileMode
+	ModTime int64
+	Inode   uint64
+}
+
+func describeWalked(info os.FileInfo) walkedInfo {
+	described := walkedInfo{Mode: info.Mode(), ModTime: info.ModTime().UnixNano()}
+	if !info.IsDir() {
+		described.Size = info.Size()
+	}
+	key, ok := hashCacheKeyFromInfo(info)
+	if ok {
+		described.Inode = key.Inode
+	}
+	return described
+}
+
+// walkTree - everything below root as the walker sees it
+func walkTree(t testing.TB, root string, workers int) map[string]walkedInfo {
+	original := globalSettings.ScanWorkers
+	defer func() { globalSettings.ScanWorkers = original }()
+	globalSettings.ScanWorkers = workers
+
+	found := make(map[string]walkedInfo)
+	walker := newDirectoryWalker(root, []string{""}, false)
+	err := walker.run(func(relativeDirectory string, infos []os.FileInfo, err error) ([]string, bool) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		var subdirectories []string
+		for _, info := range infos {
+			relativePath := filepath.Join(relativeDirectory, info.Name())
+			found[relativePath] = describeWalked(info)
+			if info.IsDir() {
+				subdirectories = append(subdirectories, relativePath)
+			}
+		}
+		return subdirectories, true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+// walkTreeWithLstat - everything below root as filepath.Walk sees it
+func walkTreeWithLstat(t testing.TB, root string) map[string]walkedInfo {
+	found := make(map[string]walkedInfo)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != root {
+			found[strings.TrimPrefix(path, root+string(filepath.Separator))] = describeWalked(info)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func TestWalkerMatchesFilepathWalk(t *testing.T) {
+	root, _ := filepath.Abs("testdata")
+	expected := walkTreeWithLstat(t, root)
+	if len(expected) == 0 {
+		t.Fatal("testdata is empty")
+	}
+
+	for _, workers := range []int{1, 3, SCAN_WORKERS} {
+		found := walkTree(t, root, workers)
+		if !reflect.DeepEqual(found, expected) {
+			t.Fatalf("the walker with %d workers saw a different tree.\nwalker: %v\nexpected: %v", workers, found, expected)
+		}
+	}
+}
+
+func TestWalkerFollowsLinksOnlyWhenAsked(t *testing.T) {
+	root, _ := filepath.Abs("testdata")
+	linkRoot := filepath.Join(t.TempDir(), "links")
+	os.Mkdir(linkRoot, os.ModePerm)
+	err := os.Symlink(filepath.Join(root, "README.md"), filepath.Join(linkRoot, "README.md"))
+	if err != nil {
+		t.Skip("symlinks are not available:", err)
+	}
+
+	for _, followLinks := range []bool{false, true} {
+		var seen os.FileInfo
+		walker := newDirectoryWalker(linkRoot, []string{""}, followLinks)
+		walker.run(func(relativeDirectory string, infos []os.FileInfo, err error) ([]string, bool) {
+			if len(infos) == 1 {
+				seen = infos[0]
+			}
+			return nil, true
+		})
+
+		stat := os.Lstat
+		if followLinks {
+			stat = os.Stat
+		}
+		expected, _ := stat(filepath.Join(linkRoot, "README.md"))
+		if seen == nil || describeWalked(seen) != describeWalked(expected) {
+			t.Fatalf("following links: %v. the link was seen as %#v", followLinks, seen)
+		}
+	}
+}
+
+func TestScanDirectoryContentsListsEveryDirectory(t *testing.T) {
+	useTestSettings(t)
+	root, _ := filepath.Abs("testdata")
+	globalSettings.Directory = root
+
+	contents, err := scanDirectoryContents()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make(DirTreeMap)
+	expected["/"] = []string{}
+	for relativePath, info := range walkTreeWithLstat(t, root) {
+		if info.Mode.IsDir() {
+			if expected["/"+relativePath] == nil {
+				expected["/"+relativePath] = []string{}
+			}
+			continue
+		}
+		directory := "/" + filepath.Dir(relativePath)
+		if directory == "/." {
+			directory = "/"
+		}
+		expected[directory] = append(expected[directory], filepath.Base(relativePath))
+	}
+	for _, names := range expected {
+		sort.Strings(names)
+	}
+
+	if !reflect.DeepEqual(contents, expected) {
+		t.Fatalf("scanDirectoryContents saw a different tree.\nscanned: %v\nexpected: %v", contents, expected)
+	}
+}
+
+// BenchmarkWalkTestdata - the walker over the testdata trees at a few levels of concurrency
+func BenchmarkWalkTestdata(b *testing.B) {
+	root, _ := filepath.Abs("testdata")
+	for _, workers := range []int{1, 2, SCAN_WORKERS} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				walkTree(b, root, workers)
+			}
+		})
+	}
+}
+
+// BenchmarkReaddirThenStatTestdata - the single goroutine Readdir and os.Stat walk the walker replaced, for comparison
+func BenchmarkReaddirThenStatTestdata(b *testing.B) {
+	root, _ := filepath.Abs("testdata")
+	for i := 0; i < b.N; i++ {
+		pending := []string{root}
+		for len(pending) > 0 {
+			current := pending[0]
+			pending = pending[1:]
+			f, err := os.Open(current)
+			if err != nil {
+				b.Fatal(err)
+			}
+			entries, err := f.Readdir(-1)
+			f.Close()
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, entry := range entries {
+				fullPath := filepath.Join(current, entry.Name())
+				info, err := os.Stat(fullPath)
+				if err == nil && info.IsDir() {
+					pending = append(pending, fullPath)
+				}
+			}
+		}
+	}
+}